@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	netmail "net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// parseRecipients parses each recipient as an RFC 5322 address, allowing
+// UTF-8 display names such as "Jane Doe <jane@example.com>".
+func parseRecipients(recipients []string) ([]*netmail.Address, error) {
+	addresses := make([]*netmail.Address, 0, len(recipients))
+	for _, r := range recipients {
+		address, err := netmail.ParseAddress(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", r, err)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// addressHash identifies address in Redis key names without revealing it:
+// the hex SHA-256 of it lowercased, so that its case makes no difference.
+func addressHash(address string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(address)))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatRecipients renders addresses back into a task's recipients.
+func formatRecipients(addresses []*netmail.Address) []string {
+	formatted := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		if a.Name == "" {
+			formatted = append(formatted, a.Address)
+		} else {
+			formatted = append(formatted, a.String())
+		}
+	}
+	return formatted
+}
+
+// envelopeAddresses returns the bare addresses used for the SMTP envelope.
+func envelopeAddresses(addresses []*netmail.Address) []string {
+	envelope := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		envelope = append(envelope, a.Address)
+	}
+	return envelope
+}
+
+// formatAddressList renders addresses for a To/Cc header, encoding any
+// non-ASCII display names as RFC 2047 encoded-words.
+func formatAddressList(addresses []*netmail.Address) string {
+	formatted := make([]string, 0, len(addresses))
+	for _, a := range addresses {
+		formatted = append(formatted, a.String())
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// encodeHeader encodes a header value as an RFC 2047 encoded-word if it
+// contains non-ASCII characters, and returns it unchanged otherwise.
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// asciiAddresses applies asciiAddress to every address.
+func asciiAddresses(addresses []*netmail.Address) ([]*netmail.Address, error) {
+	converted := make([]*netmail.Address, 0, len(addresses))
+	for _, a := range addresses {
+		c, err := asciiAddress(a)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, c)
+	}
+	return converted, nil
+}
+
+// asciiAddress converts an internationalized domain to its punycode form so
+// the address can be used with servers that do not support SMTPUTF8. The
+// display name is left alone as it is RFC 2047 encoded in headers anyway.
+func asciiAddress(address *netmail.Address) (*netmail.Address, error) {
+	at := strings.LastIndex(address.Address, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("invalid address %q: missing @", address.Address)
+	}
+	local, domain := address.Address[:at], address.Address[at+1:]
+	if !isASCII(local) {
+		return nil, fmt.Errorf("address %q has a non-ASCII local part and the server does not support SMTPUTF8", address.Address)
+	}
+	if isASCII(domain) {
+		return address, nil
+	}
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return nil, fmt.Errorf("error converting domain of %q to punycode: %w", address.Address, err)
+	}
+	return &netmail.Address{Name: address.Name, Address: local + "@" + domain}, nil
+}
+
+// addressDomain returns the lowercased domain of an address.
+func addressDomain(address *netmail.Address) string {
+	return strings.ToLower(address.Address[strings.LastIndex(address.Address, "@")+1:])
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
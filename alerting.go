@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	alertFailureRate = "failure-rate"
+
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+
+	defaultAlertWindow      = 5 * time.Minute
+	defaultAlertMinAttempts = 20
+	// alertEvaluateInterval is how often the leader works out the failure
+	// ratio over the window.
+	alertEvaluateInterval = 30 * time.Second
+	// alertBucket is the granularity outcomes are counted in.
+	alertBucket = time.Minute
+
+	alertNotifyTimeout = 10 * time.Second
+
+	failureRatioMetric = "post_room_delivery_failure_ratio"
+	alertFiringMetric  = "post_room_alert_firing"
+)
+
+func init() {
+	metrics.describe(failureRatioMetric, "gauge", "Share of delivery attempts that failed over the alert window, as last evaluated by the leader.")
+	metrics.describe(alertFiringMetric, "gauge", "Whether an alert is firing.")
+}
+
+// failureAlert is the payload of a failure-rate alert, as posted to
+// ALERT_WEBHOOK_URL.
+type failureAlert struct {
+	Alert     string     `json:"alert"`
+	Status    string     `json:"status"`
+	Queue     string     `json:"queue"`
+	Failures  int64      `json:"failures"`
+	Attempts  int64      `json:"attempts"`
+	Ratio     float64    `json:"ratio"`
+	Threshold float64    `json:"threshold"`
+	Window    string     `json:"window"`
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+}
+
+// summary describes the alert in a line, for chat messages and subjects.
+func (a failureAlert) summary() string {
+	if a.Status == alertResolved {
+		return fmt.Sprintf("[RESOLVED] delivery failures from queue %s are back below %s: %d of %d attempts failed in the last %s",
+			a.Queue, percent(a.Threshold), a.Failures, a.Attempts, a.Window)
+	}
+	return fmt.Sprintf("[FIRING] %s of delivery attempts from queue %s failed in the last %s: %d of %d, over the threshold of %s",
+		percent(a.Ratio), a.Queue, a.Window, a.Failures, a.Attempts, percent(a.Threshold))
+}
+
+func percent(ratio float64) string {
+	return strconv.FormatFloat(ratio*100, 'f', -1, 64) + "%"
+}
+
+// alertNotifier is an action taken when an alert fires or resolves.
+type alertNotifier interface {
+	notify(alert failureAlert) error
+}
+
+// failureAlerter fires when the share of delivery attempts that fail,
+// including those to be retried, reaches ratio over a sliding window.
+// Every replica counts its outcomes in per-minute hashes at
+// <queue>:outcomes:<minute>, and the leader evaluates them, so the rule
+// covers all replicas and fires once. A firing alert is kept at
+// <queue>:alerts:failure-rate until it resolves, so a new leader neither
+// fires it again nor loses track of it.
+type failureAlerter struct {
+	rdb         *redis.Client
+	queue       string
+	ratio       float64
+	window      time.Duration
+	minAttempts int64
+	notifiers   []alertNotifier
+}
+
+// newFailureAlerter sets up the failure-rate rule from options, returning
+// nil unless a ratio is configured.
+func newFailureAlerter(rdb *redis.Client, options AppOptions) *failureAlerter {
+	if options.AlertFailureRatio <= 0 {
+		return nil
+	}
+	a := &failureAlerter{
+		rdb:         rdb,
+		queue:       options.RedisKey,
+		ratio:       options.AlertFailureRatio,
+		window:      options.AlertWindow,
+		minAttempts: options.AlertMinAttempts,
+	}
+	client := &http.Client{Timeout: alertNotifyTimeout}
+	if options.AlertWebhookURL != "" {
+		a.notifiers = append(a.notifiers, &webhookNotifier{url: options.AlertWebhookURL, client: client})
+	}
+	if options.AlertSlackWebhookURL != "" {
+		a.notifiers = append(a.notifiers, &slackNotifier{url: options.AlertSlackWebhookURL, client: client})
+	}
+	if len(options.AlertEmailRecipients) > 0 {
+		a.notifiers = append(a.notifiers, newEmailNotifier(options))
+	}
+	return a
+}
+
+func (a *failureAlerter) bucketKey(t time.Time) string {
+	return a.queue + ":outcomes:" + strconv.FormatInt(t.Unix()/int64(alertBucket/time.Second), 10)
+}
+
+func (a *failureAlerter) stateKey() string {
+	return a.queue + ":alerts:" + alertFailureRate
+}
+
+// record counts the outcome of a delivery attempt.
+func (a *failureAlerter) record(state string) {
+	if a == nil {
+		return
+	}
+	field := "sent"
+	if state != taskSent {
+		field = "failed"
+	}
+	key := a.bucketKey(time.Now())
+	pipe := a.rdb.Pipeline()
+	pipe.HIncrBy(ctx, key, field, 1)
+	pipe.Expire(ctx, key, a.window+2*alertBucket)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Print("error counting delivery outcome: ", err)
+	}
+}
+
+// run evaluates the rule while leader leads, until the process exits.
+func (a *failureAlerter) run(leader *leaderElection) {
+	for range time.Tick(alertEvaluateInterval) {
+		if !leader.leader() {
+			continue
+		}
+		if err := a.evaluate(time.Now()); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+func (a *failureAlerter) evaluate(now time.Time) error {
+	pipe := a.rdb.Pipeline()
+	var buckets []*redis.SliceCmd
+	// The window is extended back to the start of the minute it falls in.
+	for t := now.Add(-a.window); !t.After(now); t = t.Add(alertBucket) {
+		buckets = append(buckets, pipe.HMGet(ctx, a.bucketKey(t), "sent", "failed"))
+	}
+	firing := pipe.Get(ctx, a.stateKey())
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return fmt.Errorf("error reading delivery outcomes: %w", err)
+	}
+	var sent, failed int64
+	for _, b := range buckets {
+		counts := b.Val()
+		s, _ := strconv.ParseInt(fmt.Sprint(counts[0]), 10, 64)
+		f, _ := strconv.ParseInt(fmt.Sprint(counts[1]), 10, 64)
+		sent, failed = sent+s, failed+f
+	}
+	alert := failureAlert{
+		Alert:     alertFailureRate,
+		Queue:     a.queue,
+		Failures:  failed,
+		Attempts:  sent + failed,
+		Threshold: a.ratio,
+		Window:    a.window.String(),
+	}
+	if alert.Attempts > 0 {
+		alert.Ratio = float64(failed) / float64(alert.Attempts)
+	}
+	metrics.set(failureRatioMetric, alert.Ratio)
+
+	var previous failureAlert
+	wasFiring := false
+	if data, err := firing.Bytes(); err == nil {
+		wasFiring = json.Unmarshal(data, &previous) == nil
+	}
+	failing := alert.Attempts >= a.minAttempts && alert.Ratio >= a.ratio
+	switch {
+	case failing && !wasFiring:
+		alert.Status, alert.StartsAt = alertFiring, now.UTC()
+		data, err := json.Marshal(alert)
+		if err != nil {
+			return err
+		}
+		if err := a.rdb.Set(ctx, a.stateKey(), data, 0).Err(); err != nil {
+			return fmt.Errorf("error recording alert: %w", err)
+		}
+	case !failing && wasFiring && alert.Ratio < a.ratio:
+		ended := now.UTC()
+		alert.Status, alert.StartsAt, alert.EndsAt = alertResolved, previous.StartsAt, &ended
+		if err := a.rdb.Del(ctx, a.stateKey()).Err(); err != nil {
+			return fmt.Errorf("error recording alert: %w", err)
+		}
+	default:
+		metrics.set(alertFiringMetric, boolGauge(wasFiring), "alert", alertFailureRate)
+		return nil
+	}
+	metrics.set(alertFiringMetric, boolGauge(alert.Status == alertFiring), "alert", alertFailureRate)
+	log.Print(alert.summary())
+	for _, n := range a.notifiers {
+		if err := n.notify(alert); err != nil {
+			log.Printf("error sending %s alert: %v", alert.Status, err)
+		}
+	}
+	return nil
+}
+
+// webhookNotifier posts alerts as JSON.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *webhookNotifier) notify(alert failureAlert) error {
+	return postJSON(n.client, n.url, alert)
+}
+
+// slackNotifier posts alerts to a Slack incoming webhook.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) notify(alert failureAlert) error {
+	return postJSON(n.client, n.url, map[string]string{"text": alert.summary()})
+}
+
+func postJSON(client *http.Client, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s from %s", res.Status, url)
+	}
+	return nil
+}
+
+// emailNotifier emails alerts through a secondary SMTP server, since the
+// worker's own may be what is failing. The alert is sent straight away
+// rather than queued behind the failing mail.
+type emailNotifier struct {
+	host, port string
+	auth       smtp.Auth
+	from       string
+	to         []string
+	helo       string
+	timeouts   smtpTimeouts
+}
+
+func newEmailNotifier(options AppOptions) *emailNotifier {
+	n := &emailNotifier{
+		host:     options.AlertSMTPHost,
+		port:     options.AlertSMTPPort,
+		from:     options.SenderAddress,
+		to:       options.AlertEmailRecipients,
+		helo:     options.HeloName,
+		timeouts: smtpTimeouts{dial: options.DialTimeout, command: options.CommandTimeout, send: options.SendTimeout},
+	}
+	if n.port == "" {
+		n.port = "25"
+	}
+	if options.AlertSMTPUsername != "" {
+		n.auth = smtp.PlainAuth("", options.AlertSMTPUsername, options.AlertSMTPPassword, n.host)
+	}
+	return n
+}
+
+func (n *emailNotifier) notify(alert failureAlert) error {
+	from, err := netmail.ParseAddress(n.from)
+	if err != nil {
+		return err
+	}
+	recipients, err := parseRecipients(n.to)
+	if err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(ctx, n.timeouts.send)
+	defer cancel()
+	client, conn, err := n.timeouts.connect(c, net.JoinHostPort(n.host, n.port), n.host, n.helo, nil)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := startTLS(client, conn, &tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if err := client.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if err := client.Rcpt(r.Address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	details, _ := json.MarshalIndent(alert, "", "  ")
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(formatRecipients(recipients), ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alert.summary())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Auto-Submitted: auto-generated\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n%s\r\n", alert.summary(), strings.ReplaceAll(string(details), "\n", "\r\n"))
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const alertmanagerPath = "/ingest/alertmanager"
+
+// alertmanagerPayload is the body of an Alertmanager webhook notification
+// (version 4).
+type alertmanagerPayload struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		StartsAt     time.Time         `json:"startsAt"`
+		EndsAt       time.Time         `json:"endsAt"`
+		GeneratorURL string            `json:"generatorURL"`
+		Fingerprint  string            `json:"fingerprint"`
+	} `json:"alerts"`
+}
+
+// defaultAlertTemplate renders notifications when no template is configured.
+var defaultAlertTemplate = template.Must(template.New("alerts").Parse(`<h2>{{.Status}}: {{index .CommonLabels "alertname"}}</h2>
+{{range .Alerts}}<div style="margin-bottom:1em">
+<p><strong>[{{.Status}}]</strong> {{or (index .Annotations "summary") (index .Labels "alertname")}}</p>
+{{with index .Annotations "description"}}<p>{{.}}</p>{{end}}
+<ul>{{range $k, $v := .Labels}}<li>{{$k}} = {{$v}}</li>{{end}}</ul>
+<p>Started {{.StartsAt.Format "2006-01-02 15:04:05 MST"}}{{if .GeneratorURL}} &middot; <a href="{{.GeneratorURL}}">Source</a>{{end}}</p>
+</div>{{end}}
+{{if .ExternalURL}}<p><a href="{{.ExternalURL}}">Alertmanager</a></p>{{end}}
+`))
+
+// alertmanagerReceiver turns Alertmanager webhook notifications into email
+// tasks on the queue. Recipients come from the webhook URL's "to" query
+// parameter or, failing that, the configured defaults. Those in "to" must
+// each be allowed by ALERTMANAGER_ALLOWED_TO, as an address or an @domain,
+// so that the receiver can't be used to mail anyone. With a template the
+// payload is passed to it as Data; otherwise a built-in summary is sent.
+type alertmanagerReceiver struct {
+	rdb        *redis.Client
+	queue      string
+	recipients []string
+	allowedTo  []string
+	template   string
+	token      string
+}
+
+func (a *alertmanagerReceiver) register(mux *http.ServeMux) {
+	mux.Handle(alertmanagerPath, requireToken(a.token, http.HandlerFunc(a.handle)))
+}
+
+// allowed reports whether recipient may be given in the "to" parameter.
+func (a *alertmanagerReceiver) allowed(recipient string) bool {
+	address := strings.ToLower(recipient)
+	if parsed, err := netmail.ParseAddress(recipient); err == nil {
+		address = strings.ToLower(parsed.Address)
+	} else if !strings.HasPrefix(address, groupPrefix) {
+		return false
+	}
+	for _, a := range a.allowedTo {
+		a = strings.ToLower(a)
+		if a == address || (strings.HasPrefix(a, "@") && strings.HasSuffix(address, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *alertmanagerReceiver) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var payload alertmanagerPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid Alertmanager payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	recipients := a.recipients
+	if to := r.URL.Query().Get("to"); to != "" {
+		recipients = splitList(to)
+		for _, recipient := range recipients {
+			if !a.allowed(recipient) {
+				http.Error(w, fmt.Sprintf("recipient %s is not allowed by %s", recipient, alertmanagerAllowedToKey), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	if len(recipients) == 0 {
+		http.Error(w, "no recipients configured", http.StatusBadRequest)
+		return
+	}
+
+	task := Mail{Subject: alertSubject(payload), Recipients: recipients}
+	if a.template != "" {
+		// Templates see the payload as it was sent, with its JSON field names.
+		if err := json.Unmarshal(body, &task.Data); err != nil {
+			http.Error(w, "invalid Alertmanager payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.Template = a.template
+	} else {
+		var buf bytes.Buffer
+		if err := defaultAlertTemplate.Execute(&buf, payload); err != nil {
+			log.Print("error rendering alert notification: ", err)
+			http.Error(w, "error rendering notification", http.StatusInternalServerError)
+			return
+		}
+		task.Message = buf.String()
+	}
+
+	if err := enqueue(a.rdb, a.queue, &task); err != nil {
+		log.Print(err)
+		http.Error(w, "error enqueuing notification", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("enqueued alert notification %s for group %s", task.ID, payload.GroupKey)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// alertSubject follows Alertmanager's own default email subject, e.g.
+// "[FIRING:2] HighLatency (api production)".
+func alertSubject(p alertmanagerPayload) string {
+	firing := 0
+	for _, alert := range p.Alerts {
+		if alert.Status == "firing" {
+			firing++
+		}
+	}
+	subject := "[" + strings.ToUpper(p.Status)
+	if p.Status == "firing" {
+		subject += fmt.Sprintf(":%d", firing)
+	}
+	subject += "]"
+
+	names := make([]string, 0, len(p.GroupLabels))
+	for name := range p.GroupLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var values []string
+	for _, name := range names {
+		if name != "alertname" {
+			values = append(values, p.GroupLabels[name])
+		}
+	}
+	if alertname := p.GroupLabels["alertname"]; alertname != "" {
+		subject += " " + alertname
+	}
+	if len(values) > 0 {
+		subject += " (" + strings.Join(values, " ") + ")"
+	}
+	return subject
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAlertmanagerReceiver(t *testing.T) {
+	payload := `{"version":"4","status":"firing","groupKey":"g","commonLabels":{"alertname":"DiskFull"},"alerts":[{"status":"firing","labels":{"alertname":"DiskFull"}}]}`
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+		want          int
+		recipients    string
+	}{
+		{"default recipients", "Bearer secret", "", http.StatusAccepted, "ops@example.com"},
+		{"allowed address", "Bearer secret", "?to=oncall@example.com", http.StatusAccepted, "oncall@example.com"},
+		{"allowed domain", "Bearer secret", "?to=Dev%20%3Cdev@team.example.org%3E", http.StatusAccepted, "dev@team.example.org"},
+		{"not allowed", "Bearer secret", "?to=oncall@example.com,victim@elsewhere.com", http.StatusForbidden, ""},
+		{"domain suffix only", "Bearer secret", "?to=someone@notteam.example.org.evil", http.StatusForbidden, ""},
+		{"no token", "", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdb := newTestRedis(t)
+			a := &alertmanagerReceiver{
+				rdb:        rdb,
+				queue:      "tasks",
+				recipients: []string{"ops@example.com"},
+				allowedTo:  []string{"oncall@example.com", "@team.example.org"},
+				token:      "secret",
+			}
+			mux := http.NewServeMux()
+			a.register(mux)
+			req := httptest.NewRequest(http.MethodPost, alertmanagerPath+tt.query, strings.NewReader(payload))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			queued, _ := rdb.LRange(ctx, "tasks", 0, -1).Result()
+			if tt.recipients == "" {
+				if len(queued) != 0 {
+					t.Errorf("enqueued %d tasks, want none", len(queued))
+				}
+				return
+			}
+			if len(queued) != 1 || !strings.Contains(queued[0], tt.recipients) {
+				t.Errorf("enqueued %q, want a task to %s", queued, tt.recipients)
+			}
+		})
+	}
+}
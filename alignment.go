@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	senderAlignmentOff    = "off"
+	senderAlignmentWarn   = "warn"
+	senderAlignmentStrict = "strict"
+
+	alignmentTimeout = 10 * time.Second
+	// spfLookupLimit is RFC 7208's limit on the DNS lookups an SPF check
+	// may make.
+	spfLookupLimit = 10
+)
+
+// checkSenderAlignment checks that every identity the tenants' mailers send
+// as is set up to pass SPF and DKIM: that the SPF record of its envelope
+// sender's domain authorizes the relay, or with direct delivery the HELO
+// name if set, and that it has a DKIM key for its domain if requireDKIM is
+// set. Problems are logged as warnings, or in strict mode returned to
+// refuse to start.
+func checkSenderAlignment(tenants []*tenant, mode string, requireDKIM bool) error {
+	if mode == senderAlignmentOff {
+		return nil
+	}
+	c, cancel := context.WithTimeout(ctx, alignmentTimeout)
+	defer cancel()
+	seen := map[string]bool{}
+	var problems []string
+	for _, t := range tenants {
+		for _, p := range t.mailer.alignmentProblems(c, requireDKIM) {
+			if !seen[p] {
+				seen[p] = true
+				problems = append(problems, p)
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if mode == senderAlignmentStrict {
+		return fmt.Errorf("sender alignment check failed:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	for _, p := range problems {
+		log.Printf("[WARNING] %s", p)
+	}
+	return nil
+}
+
+func (m Mailer) alignmentProblems(c context.Context, requireDKIM bool) []string {
+	identities := map[string]*identity{"default": m.sender}
+	for name, id := range m.identities {
+		identities[name] = id
+	}
+	names := make([]string, 0, len(identities))
+	for name := range identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sender := m.host
+	if m.mx != nil {
+		sender = m.helo
+	}
+	var ips []net.IP
+	var problems []string
+	if sender != "" {
+		addrs, err := net.DefaultResolver.LookupIPAddr(c, sender)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("can't check SPF: error looking up %s: %v", sender, err))
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	for _, name := range names {
+		id := identities[name]
+		domain := addressDomain(id.from)
+		if requireDKIM && id.dkim == nil {
+			problems = append(problems, fmt.Sprintf("identity %s (%s) has no DKIM key", name, id.from.Address))
+		} else if id.dkim != nil && !alignedDomain(domain, id.dkim.domain) {
+			problems = append(problems, fmt.Sprintf("identity %s (%s) signs with DKIM for %s, which doesn't align with its domain", name, id.from.Address, id.dkim.domain))
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		// SPF is checked against the envelope sender.
+		envelopeDomain := addressDomain(id.envelopeFrom())
+		spf := &spfCheck{resolver: net.DefaultResolver}
+		ok, err := spf.authorizesAny(c, envelopeDomain, ips)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("identity %s (%s): error checking SPF: %v", name, id.from.Address, err))
+		case !ok:
+			problems = append(problems, fmt.Sprintf("identity %s (%s): the SPF record of %s doesn't authorize %s", name, id.from.Address, envelopeDomain, sender))
+		}
+	}
+	return problems
+}
+
+// alignedDomain reports whether signing domain aligns with from domain
+// under DMARC's relaxed alignment: one is the other or a parent of it.
+func alignedDomain(from, signing string) bool {
+	from, signing = strings.ToLower(from), strings.ToLower(signing)
+	return from == signing || strings.HasSuffix(from, "."+signing) || strings.HasSuffix(signing, "."+from)
+}
+
+var errNoSPF = errors.New("no SPF record")
+
+// spfCheck evaluates SPF records far enough to tell whether they pass an
+// address: the ip4, ip6, a, mx, include and all mechanisms and the redirect
+// modifier. Terms using macros, exists and ptr never match.
+type spfCheck struct {
+	resolver *net.Resolver
+	lookups  int
+}
+
+func (s *spfCheck) authorizesAny(c context.Context, domain string, ips []net.IP) (bool, error) {
+	for _, ip := range ips {
+		ok, err := s.passes(c, domain, ip)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (s *spfCheck) record(c context.Context, domain string) (string, error) {
+	s.lookups++
+	if s.lookups > spfLookupLimit {
+		return "", fmt.Errorf("more than %d DNS lookups", spfLookupLimit)
+	}
+	txts, err := s.resolver.LookupTXT(c, domain)
+	if err != nil && !isNotFound(err) {
+		return "", fmt.Errorf("error looking up SPF record of %s: %w", domain, err)
+	}
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			return txt, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", domain, errNoSPF)
+}
+
+// passes reports whether the SPF record of domain passes ip: the first
+// mechanism matching it has the + qualifier.
+func (s *spfCheck) passes(c context.Context, domain string, ip net.IP) (bool, error) {
+	record, err := s.record(c, domain)
+	if err != nil {
+		return false, err
+	}
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if strings.HasPrefix(strings.ToLower(term), "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier, term = term[0], term[1:]
+		}
+		matched, err := s.matches(c, domain, term, ip)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return qualifier == '+', nil
+		}
+	}
+	if redirect != "" && !strings.Contains(redirect, "%") {
+		return s.passes(c, redirect, ip)
+	}
+	return false, nil
+}
+
+func (s *spfCheck) matches(c context.Context, domain, term string, ip net.IP) (bool, error) {
+	if strings.Contains(term, "%") {
+		return false, nil
+	}
+	name, arg := strings.ToLower(term), ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = strings.ToLower(term[:i]), term[i:]
+	}
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		cidr := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		return err == nil && network.Contains(ip), nil
+	case "include":
+		ok, err := s.passes(c, strings.TrimPrefix(arg, ":"), ip)
+		if errors.Is(err, errNoSPF) {
+			return false, fmt.Errorf("included %w", err)
+		}
+		return ok, err
+	case "a", "mx":
+		target, prefix := domain, ""
+		if strings.HasPrefix(arg, ":") {
+			target = arg[1:]
+		}
+		if i := strings.IndexByte(target, '/'); i >= 0 {
+			target, prefix = target[:i], target[i+1:]
+		} else if strings.HasPrefix(arg, "/") {
+			prefix = arg[1:]
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			s.lookups++
+			mxs, err := s.resolver.LookupMX(c, target)
+			if err != nil && !isNotFound(err) {
+				return false, fmt.Errorf("error looking up MX records of %s: %w", target, err)
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+			}
+		} else {
+			s.lookups++
+		}
+		for _, host := range hosts {
+			addrs, err := s.resolver.LookupIPAddr(c, host)
+			if err != nil && !isNotFound(err) {
+				return false, fmt.Errorf("error looking up %s: %w", host, err)
+			}
+			for _, a := range addrs {
+				if inPrefix(ip, a.IP, prefix) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// inPrefix reports whether ip is within the network of host given by an
+// SPF dual CIDR length such as "24" or "24//64", or is host without one.
+func inPrefix(ip, host net.IP, prefix string) bool {
+	bits, length := 32, ""
+	v4 := host.To4() != nil
+	if !v4 {
+		bits = 128
+	}
+	parts := strings.SplitN(prefix, "//", 2)
+	if v4 {
+		length = parts[0]
+	} else if len(parts) == 2 {
+		length = parts[1]
+	}
+	ones := bits
+	if n, err := strconv.Atoi(length); err == nil && n >= 0 && n <= bits {
+		ones = n
+	}
+	network := net.IPNet{IP: host, Mask: net.CIDRMask(ones, bits)}
+	if v4 {
+		network.IP = host.To4()
+	}
+	return network.Contains(ip)
+}
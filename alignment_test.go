@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAlignedDomain(t *testing.T) {
+	tests := []struct {
+		from, signing string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"mail.example.com", "example.com", true},
+		{"example.com", "mail.example.com", true},
+		{"example.com", "other.com", false},
+		{"badexample.com", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := alignedDomain(tt.from, tt.signing); got != tt.want {
+			t.Errorf("alignedDomain(%q, %q) = %v, want %v", tt.from, tt.signing, got, tt.want)
+		}
+	}
+}
+
+func TestInPrefix(t *testing.T) {
+	tests := []struct {
+		ip, host, prefix string
+		want             bool
+	}{
+		{"192.0.2.1", "192.0.2.1", "", true},
+		{"192.0.2.2", "192.0.2.1", "", false},
+		{"192.0.2.200", "192.0.2.1", "24", true},
+		{"192.0.3.1", "192.0.2.1", "24", false},
+		{"192.0.2.200", "192.0.2.1", "24//64", true},
+		{"2001:db8::2", "2001:db8::1", "", false},
+		{"2001:db8::2", "2001:db8::1", "24//64", true},
+		{"2001:db8:1::2", "2001:db8::1", "//64", false},
+		{"2001:db8::2", "2001:db8::1", "24", false},
+		{"192.0.2.2", "192.0.2.1", "99", false},
+	}
+	for _, tt := range tests {
+		if got := inPrefix(net.ParseIP(tt.ip), net.ParseIP(tt.host), tt.prefix); got != tt.want {
+			t.Errorf("inPrefix(%s, %s, %q) = %v, want %v", tt.ip, tt.host, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestSPFMatches(t *testing.T) {
+	tests := []struct {
+		term string
+		ip   string
+		want bool
+	}{
+		{"all", "198.51.100.1", true},
+		{"ip4:192.0.2.0/24", "192.0.2.9", true},
+		{"ip4:192.0.2.0/24", "198.51.100.1", false},
+		{"ip4:192.0.2.9", "192.0.2.9", true},
+		{"ip6:2001:db8::/32", "2001:db8::1", true},
+		{"ip6:2001:db8::1", "2001:db8::2", false},
+		{"exists:%{i}.example.com", "192.0.2.9", false},
+		{"ptr", "192.0.2.9", false},
+	}
+	for _, tt := range tests {
+		s := &spfCheck{resolver: net.DefaultResolver}
+		got, err := s.matches(context.Background(), "example.com", tt.term, net.ParseIP(tt.ip))
+		if err != nil {
+			t.Errorf("matches(%q, %s) error: %v", tt.term, tt.ip, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("matches(%q, %s) = %v, want %v", tt.term, tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// amendScript swaps the scheduled task ARGV[1] for ARGV[2], keeping its due
+// time, if it is still scheduled and, unless ARGV[3] is empty, its revision
+// in the status hash is still ARGV[3]. It returns 1 and the new revision,
+// 0 if the task is no longer scheduled or -1 and the current revision. The
+// messages rendered for the task, at KEYS[3], are dropped with it.
+var amendScript = redis.NewScript(`
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not score then
+	return {0, 0}
+end
+local revision = tonumber(redis.call("HGET", KEYS[2], "revision") or "0")
+if ARGV[3] ~= "" and tonumber(ARGV[3]) ~= revision then
+	return {-1, revision}
+end
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[1], score, ARGV[2])
+revision = redis.call("HINCRBY", KEYS[2], "revision", 1)
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+redis.call("DEL", KEYS[3])
+return {1, revision}
+`)
+
+var (
+	errTaskNotScheduled = errors.New("task is not scheduled")
+	errRevisionConflict = errors.New("task has been amended since")
+)
+
+// find returns the parked copy of the task id as stored, and decoded.
+func (s *scheduler) find(id string) (string, Mail, error) {
+	var cursor uint64
+	for {
+		members, next, err := s.rdb.ZScan(ctx, s.key(), cursor, "", 100).Result()
+		if err != nil {
+			return "", Mail{}, fmt.Errorf("error reading scheduled tasks: %w", err)
+		}
+		// ZSCAN returns members and their scores in turn.
+		for i := 0; i < len(members); i += 2 {
+			var task Mail
+			if unmarshalTask([]byte(members[i]), &task) == nil && task.ID == id {
+				return members[i], task, nil
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return "", Mail{}, errTaskNotScheduled
+		}
+	}
+}
+
+// amend replaces the scheduled task id with replacement, which is sent at
+// the same time in its place, and returns the task's new revision. Unless
+// revision is negative, it fails with errRevisionConflict if the task has
+// been amended since that revision, read from the revision field of its
+// status: 0 for a task never amended. The replacement keeps the ID and
+// attempts of the task it replaces.
+func (s *scheduler) amend(id string, replacement Mail, revision int64) (int64, error) {
+	member, task, err := s.find(id)
+	if err != nil {
+		return 0, fmt.Errorf("error amending task %s: %w", id, err)
+	}
+	replacement.ID, replacement.Attempt, replacement.EnqueuedAt = task.ID, task.Attempt, task.EnqueuedAt
+	body, err := marshalTask(replacement)
+	if err != nil {
+		return 0, fmt.Errorf("error marshalling task %s: %w", id, err)
+	}
+	expected := ""
+	if revision >= 0 {
+		expected = strconv.FormatInt(revision, 10)
+	}
+	rendered := &renderCache{queue: s.queue}
+	keys := []string{s.key(), newStatusStore(s.rdb, s.queue).key(id), rendered.key(id)}
+	result, err := amendScript.Run(ctx, s.rdb, keys, member, body, expected, int64(statusTTL.Seconds())).Int64Slice()
+	if err != nil {
+		return 0, fmt.Errorf("error amending task %s: %w", id, err)
+	}
+	switch result[0] {
+	case 0:
+		// Promoted or amended by someone else since it was found.
+		return 0, fmt.Errorf("error amending task %s: %w", id, errTaskNotScheduled)
+	case -1:
+		return 0, fmt.Errorf("error amending task %s: %w (now at revision %d)", id, errRevisionConflict, result[1])
+	}
+	return result[1], nil
+}
+
+// runAmend replaces a scheduled task with the task read from stdin as JSON.
+func runAmend(args []string) error {
+	fs := flag.NewFlagSet("amend", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue the task is on (default tasks)")
+	revision := fs.Int64("revision", -1, "revision the task must still be at, or -1 for any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: amend [flags] <task id> < task.json")
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading stdin: %w", err)
+	}
+	validator, err := newTaskValidator()
+	if err != nil {
+		return err
+	}
+	if err := validator.validate(input); err != nil {
+		return err
+	}
+	var task Mail
+	if err := json.Unmarshal(input, &task); err != nil {
+		return fmt.Errorf("invalid task: %w", err)
+	}
+	if err := protectPayloadsFromEnvironment(); err != nil {
+		return err
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	rev, err := newScheduler(rdb, *queue).amend(fs.Arg(0), task, *revision)
+	if err != nil {
+		return err
+	}
+	fmt.Println(rev)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	archivePruneInterval = time.Hour
+	archiveTimeout       = time.Minute
+)
+
+// archiveStore holds archived messages under keys like
+// 2006/01/02/<task id>-<nanoseconds>.eml. prune deletes those stored before
+// a time.
+type archiveStore interface {
+	put(key string, message []byte) error
+	prune(before time.Time) (int, error)
+}
+
+// archive keeps a copy of every message sent, exactly as it was
+// transmitted, for ARCHIVE_RETENTION if set.
+type archive struct {
+	store     archiveStore
+	retention time.Duration
+}
+
+// newArchive opens the archive at target, a directory or an
+// s3://bucket/prefix location.
+func newArchive(target string, retention time.Duration) (*archive, error) {
+	a := &archive{retention: retention}
+	if strings.HasPrefix(target, "s3://") {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 archive location %q", target)
+		}
+		s3, err := s3ClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		a.store = &s3Archive{s3: s3, client: &http.Client{Timeout: archiveTimeout}, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}
+		return a, nil
+	}
+	if err := os.MkdirAll(target, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating archive directory: %w", err)
+	}
+	a.store = dirArchive(target)
+	return a, nil
+}
+
+// add archives a message sent for mail, logging rather than returning any
+// error as the message has already gone.
+func (a *archive) add(mail Mail, message []byte) {
+	if a == nil {
+		return
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%s/%s-%d.eml", now.Format("2006/01/02"), mail.ID, now.UnixNano())
+	if err := a.store.put(key, message); err != nil {
+		log.Printf("error archiving message for task %s: %v", mail.ID, err)
+	}
+}
+
+// run deletes messages older than the retention period every
+// archivePruneInterval until the process exits.
+func (a *archive) run() {
+	if a.retention <= 0 {
+		return
+	}
+	for ; ; time.Sleep(archivePruneInterval) {
+		n, err := a.store.prune(time.Now().Add(-a.retention))
+		if err != nil {
+			log.Print("error pruning archive: ", err)
+		}
+		if n > 0 {
+			log.Printf("pruned %d archived messages", n)
+		}
+	}
+}
+
+// dirArchive stores messages as files under a directory.
+type dirArchive string
+
+func (d dirArchive) put(key string, message []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, message, 0o640)
+}
+
+func (d dirArchive) prune(before time.Time) (int, error) {
+	n := 0
+	err := filepath.Walk(string(d), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".eml") && info.ModTime().Before(before) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// s3Archive stores messages as objects under a prefix of a bucket.
+type s3Archive struct {
+	s3     *s3Client
+	client *http.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Archive) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3Archive) put(key string, message []byte) error {
+	req, err := s.s3.newRequest(http.MethodPut, s.bucket, s.key(key), message)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	return s.do(req, nil)
+}
+
+// s3Listing is the part of a ListObjectsV2 response the archive uses.
+type s3Listing struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	NextContinuationToken string
+}
+
+func (s *s3Archive) prune(before time.Time) (int, error) {
+	n := 0
+	query := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix+"/")
+	}
+	for {
+		req, err := s.s3.newBucketRequest(http.MethodGet, s.bucket, query)
+		if err != nil {
+			return n, err
+		}
+		var listing s3Listing
+		if err := s.do(req, &listing); err != nil {
+			return n, err
+		}
+		for _, object := range listing.Contents {
+			if !strings.HasSuffix(object.Key, ".eml") || !object.LastModified.Before(before) {
+				continue
+			}
+			req, err := s.s3.newRequest(http.MethodDelete, s.bucket, object.Key, nil)
+			if err != nil {
+				return n, err
+			}
+			if err := s.do(req, nil); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if listing.NextContinuationToken == "" {
+			return n, nil
+		}
+		query.Set("continuation-token", listing.NextContinuationToken)
+	}
+}
+
+// do sends req, decoding an XML response into out if given.
+func (s *s3Archive) do(req *http.Request, out interface{}) error {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, res.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.NewDecoder(res.Body).Decode(out)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const heldTasksMetric = "post_room_batch_held_tasks"
+
+func init() {
+	metrics.describe(heldTasksMetric, "gauge", "Tasks taken from a queue in a batch and not yet started, by queue.")
+}
+
+// batchPopScript pops up to ARGV[1] tasks from the lists in KEYS, in the
+// order BRPOP would, and returns each popped task after the list it came
+// from. Once a task has been popped, it stops before one that would take the
+// bytes popped over ARGV[2], unless that is 0. Popping in a script rather
+// than with RPOP's count keeps to one round trip across the priority list
+// and the queue, and works before Redis 6.2.
+var batchPopScript = redis.NewScript(`
+local popped = {}
+local wanted = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local bytes = 0
+for _, key in ipairs(KEYS) do
+	while #popped < wanted * 2 do
+		local task = redis.call("LINDEX", key, -1)
+		if not task then
+			break
+		end
+		if limit > 0 and #popped > 0 and bytes + #task > limit then
+			return popped
+		end
+		redis.call("RPOP", key)
+		bytes = bytes + #task
+		table.insert(popped, key)
+		table.insert(popped, task)
+	end
+end
+return popped
+`)
+
+// taskBatch takes a queue's tasks up to size at a time, handing them to the
+// consumer one by one. Each batch is only as large as the sends the worker
+// has room to start, so tasks aren't held from other workers, or ahead of
+// priority tasks pushed meanwhile, while the worker is busy, and the bytes
+// held are counted by the memory guard. Only when both lists are empty does
+// it block, on BRPOP, for the next task. Tasks taken but not yet started are
+// pushed back when the worker pauses or shuts down, but are lost with it if
+// it crashes, as a task taken by BRPOP would be.
+type taskBatch struct {
+	rdb    *redis.Client
+	lists  []string
+	size   int
+	memory *memoryGuard
+
+	mu sync.Mutex
+	// held are the tasks taken and not yet handed out, each after its list.
+	held []string
+	// closed stops more tasks being held, once the worker shuts down.
+	closed bool
+}
+
+func newTaskBatch(rdb *redis.Client, queue string, size int, memory *memoryGuard) *taskBatch {
+	return &taskBatch{rdb: rdb, lists: []string{priorityQueue(queue), queue}, size: size, memory: memory}
+}
+
+// pop returns the next task as BRPOP does: its list, then the task, taking
+// a batch of up to room tasks, or size if room is negative, if none are
+// held. It returns redis.Nil if no task arrived within controlPollInterval.
+func (b *taskBatch) pop(room int) ([]string, error) {
+	b.mu.Lock()
+	if len(b.held) == 0 && !b.closed {
+		if room < 0 || room > b.size {
+			room = b.size
+		}
+		if room > 1 {
+			if err := b.fill(room); err != nil {
+				b.mu.Unlock()
+				return nil, err
+			}
+		}
+	}
+	if len(b.held) > 0 {
+		defer b.mu.Unlock()
+		res := b.held[:2]
+		b.held = b.held[2:]
+		b.memory.release(int64(len(res[1])))
+		metrics.set(heldTasksMetric, float64(len(b.held)/2), "queue", b.lists[1])
+		return res, nil
+	}
+	b.mu.Unlock()
+	return b.rdb.BRPop(ctx, controlPollInterval, b.lists...).Result()
+}
+
+func (b *taskBatch) fill(n int) error {
+	popped, err := batchPopScript.Run(ctx, b.rdb, b.lists, n, b.memory.free()).StringSlice()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	var bytes int64
+	for i := 1; i < len(popped); i += 2 {
+		bytes += int64(len(popped[i]))
+	}
+	b.memory.hold(bytes)
+	b.held = popped
+	return nil
+}
+
+// giveBack pushes the tasks held back onto the lists they came from, where
+// they are taken next.
+func (b *taskBatch) giveBack() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.held) == 0 {
+		return
+	}
+	pipe := b.rdb.Pipeline()
+	var bytes int64
+	for i := len(b.held) - 2; i >= 0; i -= 2 {
+		pipe.RPush(ctx, b.held[i], b.held[i+1])
+		bytes += int64(len(b.held[i+1]))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Print("error returning tasks to list: ", err)
+		return
+	}
+	b.memory.release(bytes)
+	b.held = nil
+	metrics.set(heldTasksMetric, 0, "queue", b.lists[1])
+}
+
+// close gives back the tasks held and takes one task at a time from then
+// on, for shutting down.
+func (b *taskBatch) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.giveBack()
+}
+
+// taskBatches are the batches of every queue consumed, discovered or not,
+// for closing them all at shutdown.
+type taskBatches struct {
+	mu      sync.Mutex
+	batches []*taskBatch
+}
+
+func (s *taskBatches) add(b *taskBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, b)
+}
+
+func (s *taskBatches) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.batches {
+		b.close()
+	}
+}
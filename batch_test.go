@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTaskBatchPop(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    []string
+		priority []string
+		size     int
+		room     int
+		limit    int64
+		// want are the tasks popped in order, and held how many were held
+		// after the first pop.
+		want []string
+		held int
+	}{
+		{"one at a time", []string{"a", "b", "c"}, nil, 1, -1, 0, []string{"a", "b", "c"}, 0},
+		{"batch", []string{"a", "b", "c"}, nil, 2, -1, 0, []string{"a", "b", "c"}, 1},
+		{"priority first", []string{"a", "b"}, []string{"p", "q"}, 4, -1, 0, []string{"p", "q", "a", "b"}, 3},
+		{"room caps the batch", []string{"a", "b", "c", "d"}, nil, 4, 2, 0, []string{"a", "b", "c", "d"}, 1},
+		{"no room", []string{"a", "b"}, nil, 4, 0, 0, []string{"a", "b"}, 0},
+		{"memory caps the batch", []string{"aaaa", "bbbb", "cccc"}, nil, 3, -1, 9, []string{"aaaa", "bbbb", "cccc"}, 1},
+		{"memory always lets one through", []string{"aaaa", "bbbb"}, nil, 3, -1, 2, []string{"aaaa", "bbbb"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdb := newTestRedis(t)
+			// Tasks are pushed on the left and taken from the right.
+			for _, task := range tt.queue {
+				rdb.LPush(ctx, "tasks", task)
+			}
+			for _, task := range tt.priority {
+				rdb.LPush(ctx, priorityQueue("tasks"), task)
+			}
+			b := newTaskBatch(rdb, "tasks", tt.size, newMemoryGuard(tt.limit))
+			var got []string
+			for i := range tt.want {
+				res, err := b.pop(tt.room)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, res[1])
+				if i == 0 && len(b.held)/2 != tt.held {
+					t.Errorf("held %d tasks after the first pop, want %d", len(b.held)/2, tt.held)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("popped %v, want %v", got, tt.want)
+			}
+			if b.memory != nil && b.memory.held != 0 {
+				t.Errorf("memory guard holds %d bytes once the batch is handed out", b.memory.held)
+			}
+		})
+	}
+}
+
+func TestTaskBatchGiveBack(t *testing.T) {
+	rdb := newTestRedis(t)
+	for _, task := range []string{"a", "b", "c"} {
+		rdb.LPush(ctx, "tasks", task)
+	}
+	rdb.LPush(ctx, priorityQueue("tasks"), "p")
+	memory := newMemoryGuard(1000)
+	b := newTaskBatch(rdb, "tasks", 4, memory)
+	res, err := b.pop(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != "p" {
+		t.Fatalf("popped %s first, want p", res[1])
+	}
+	if memory.held != 3 {
+		t.Errorf("memory guard holds %d bytes for the batch, want 3", memory.held)
+	}
+	b.close()
+	if memory.held != 0 {
+		t.Errorf("memory guard holds %d bytes after giving the batch back", memory.held)
+	}
+	// The tasks are back in the order they would have been taken in.
+	for _, want := range []string{"a", "b", "c"} {
+		got, err := rdb.RPop(ctx, "tasks").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("took %s from the queue, want %s", got, want)
+		}
+	}
+	// Once closed, tasks are taken one at a time.
+	rdb.LPush(ctx, "tasks", "d", "e")
+	if _, err := b.pop(-1); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.held) != 0 {
+		t.Errorf("closed batch holds %d tasks", len(b.held)/2)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// benchPollInterval is how often bench checks the status of the tasks it is
+// waiting on, which bounds the precision of the latencies it reports.
+const benchPollInterval = 100 * time.Millisecond
+
+// runBench enqueues synthetic tasks at a steady rate and waits for the
+// workers to finish them, reporting throughput and end-to-end latency from
+// enqueue to the result recorded in the status store. Point the workers at
+// a devserver, or a relay that can take the volume, since the tasks are
+// really sent.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue to enqueue onto (default tasks)")
+	n := fs.Int("n", 1000, "number of tasks")
+	rate := fs.Float64("rate", 100, "tasks enqueued per second, or 0 for as fast as possible")
+	to := fs.String("to", "bench@example.com", "recipient of the tasks")
+	size := fs.Int("size", 1024, "size of the message body in bytes")
+	timeout := fs.Duration("timeout", 10*time.Minute, "how long to wait for the tasks to finish after enqueueing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	if *n <= 0 {
+		return errors.New("-n must be positive")
+	}
+	if err := protectPayloadsFromEnvironment(); err != nil {
+		return err
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	status := newStatusStore(rdb, *queue)
+
+	body := strings.Repeat("x", *size)
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Duration(float64(time.Second) / *rate)
+	}
+	// Tasks are checked on while they are still being enqueued, so that
+	// those finished early aren't timed as finishing when enqueueing ends.
+	var mu sync.Mutex
+	pending := map[string]time.Time{}
+	start := time.Now()
+	enqueued := make(chan error, 1)
+	go func() {
+		for i := 0; i < *n; i++ {
+			if interval > 0 {
+				if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			task := Mail{
+				Recipients: []string{*to},
+				Subject:    fmt.Sprintf("post-room bench %d/%d", i+1, *n),
+				Message:    body,
+			}
+			if err := enqueue(rdb, *queue, &task); err != nil {
+				enqueued <- err
+				return
+			}
+			mu.Lock()
+			pending[task.ID] = *task.EnqueuedAt
+			mu.Unlock()
+		}
+		took := time.Since(start)
+		fmt.Printf("enqueued %d tasks onto %s in %s (%.1f/s)\n", *n, *queue, took.Round(time.Millisecond), float64(*n)/took.Seconds())
+		enqueued <- nil
+	}()
+
+	var latencies []time.Duration
+	var sent, failed int
+	var last, deadline time.Time
+	for done := false; ; time.Sleep(benchPollInterval) {
+		if !done {
+			select {
+			case err := <-enqueued:
+				if err != nil {
+					return err
+				}
+				done, deadline = true, time.Now().Add(*timeout)
+			default:
+			}
+		}
+		mu.Lock()
+		ids := make([]string, 0, len(pending))
+		for id := range pending {
+			ids = append(ids, id)
+		}
+		mu.Unlock()
+		if done && (len(ids) == 0 || time.Now().After(deadline)) {
+			break
+		}
+		pipe := rdb.Pipeline()
+		states := make([]*redis.StringCmd, len(ids))
+		for i, id := range ids {
+			states[i] = pipe.HGet(ctx, status.key(id), "state")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return fmt.Errorf("error reading task status: %w", err)
+		}
+		now := time.Now()
+		mu.Lock()
+		for i, id := range ids {
+			switch states[i].Val() {
+			case taskSent:
+				sent++
+			case taskFailed:
+				failed++
+			default:
+				continue
+			}
+			latencies = append(latencies, now.Sub(pending[id]))
+			delete(pending, id)
+			last = now
+		}
+		mu.Unlock()
+	}
+
+	fmt.Printf("sent %d, failed %d, unfinished %d\n", sent, failed, len(pending))
+	if len(latencies) == 0 {
+		return errors.New("no tasks finished: are workers consuming the queue?")
+	}
+	elapsed := last.Sub(start)
+	fmt.Printf("throughput: %.1f tasks/s over %s\n", float64(len(latencies))/elapsed.Seconds(), elapsed.Round(time.Millisecond))
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("latency: p50 %s, p90 %s, p95 %s, p99 %s, max %s (to within %s)\n",
+		latencyPercentile(latencies, 0.5), latencyPercentile(latencies, 0.9), latencyPercentile(latencies, 0.95),
+		latencyPercentile(latencies, 0.99), latencies[len(latencies)-1].Round(time.Millisecond), benchPollInterval)
+	if len(pending) > 0 {
+		return fmt.Errorf("%d tasks didn't finish within %s", len(pending), *timeout)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+)
+
+// Event describes a meeting to be sent as an iCalendar invitation.
+type Event struct {
+	UID         string    `json:"uid,omitempty"`
+	Summary     string    `json:"summary,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Organizer   string    `json:"organizer,omitempty"`
+	Attendees   []string  `json:"attendees,omitempty"`
+}
+
+const icsTimeFormat = "20060102T150405Z"
+
+// calendarPart renders the event as a text/calendar part with METHOD:REQUEST,
+// which mail clients display as an invitation with RSVP controls. The
+// organizer defaults to the sender and the attendees to the recipients.
+func calendarPart(event Event, subject string, sender *netmail.Address, recipients []*netmail.Address) (*part, error) {
+	if event.Start.IsZero() || event.End.IsZero() {
+		return nil, fmt.Errorf("event requires a start and end time")
+	}
+	if event.End.Before(event.Start) {
+		return nil, fmt.Errorf("event ends before it starts")
+	}
+
+	organizer := sender
+	if event.Organizer != "" {
+		o, err := netmail.ParseAddress(event.Organizer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event organizer %q: %w", event.Organizer, err)
+		}
+		organizer = o
+	}
+	attendees := recipients
+	if len(event.Attendees) > 0 {
+		a, err := parseRecipients(event.Attendees)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event attendee: %w", err)
+		}
+		attendees = a
+	}
+	if event.UID == "" {
+		uid, err := randomUID()
+		if err != nil {
+			return nil, err
+		}
+		event.UID = uid
+	}
+	if event.Summary == "" {
+		event.Summary = subject
+	}
+
+	var b strings.Builder
+	line := func(s string) { b.WriteString(foldICSLine(s)) }
+	line("BEGIN:VCALENDAR")
+	line("PRODID:-//post-room//EN")
+	line("VERSION:2.0")
+	line("METHOD:REQUEST")
+	line("BEGIN:VEVENT")
+	line("UID:" + escapeICSText(event.UID))
+	line("DTSTAMP:" + time.Now().UTC().Format(icsTimeFormat))
+	line("DTSTART:" + event.Start.UTC().Format(icsTimeFormat))
+	line("DTEND:" + event.End.UTC().Format(icsTimeFormat))
+	line("SEQUENCE:0")
+	line("STATUS:CONFIRMED")
+	line("SUMMARY:" + escapeICSText(event.Summary))
+	if event.Description != "" {
+		line("DESCRIPTION:" + escapeICSText(event.Description))
+	}
+	if event.Location != "" {
+		line("LOCATION:" + escapeICSText(event.Location))
+	}
+	line("ORGANIZER" + icsCommonName(organizer) + ":mailto:" + organizer.Address)
+	for _, a := range attendees {
+		line("ATTENDEE" + icsCommonName(a) + ";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:" + a.Address)
+	}
+	line("END:VEVENT")
+	line("END:VCALENDAR")
+
+	return textPart("text/calendar; charset=\"UTF-8\"; method=REQUEST", []byte(b.String())), nil
+}
+
+func icsCommonName(a *netmail.Address) string {
+	if a.Name == "" {
+		return ""
+	}
+	return ";CN=\"" + strings.ReplaceAll(a.Name, "\"", "'") + "\""
+}
+
+// escapeICSText escapes a TEXT value per RFC 5545 section 3.3.11.
+func escapeICSText(s string) string {
+	return strings.NewReplacer(
+		"\\", "\\\\",
+		";", "\\;",
+		",", "\\,",
+		"\r\n", "\\n",
+		"\n", "\\n",
+	).Replace(s)
+}
+
+// foldICSLine terminates a content line with CRLF, folding it at 75 octets
+// without splitting UTF-8 sequences.
+func foldICSLine(s string) string {
+	const limit = 75
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		size := len(string(r))
+		if n+size > limit {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+func randomUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating event UID: %w", err)
+	}
+	return hex.EncodeToString(buf) + "@post-room", nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	campaignsPath = "/campaigns/"
+
+	campaignRunning   = "running"
+	campaignPaused    = "paused"
+	campaignCancelled = "cancelled"
+	campaignDone      = "done"
+
+	campaignLockTTL      = 30 * time.Second
+	campaignPollInterval = 10 * time.Second
+)
+
+// refreshLockScript extends a lock only if this worker still holds it.
+var refreshLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseLockScript deletes a lock only if this worker still holds it, so
+// that a worker whose lock ran out doesn't release another worker's.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// campaign turns a task into one send per address in the Redis list at
+// RecipientsKey, dispatched at up to Rate per second. With Subjects, each
+// recipient is sent one of the subject variants instead of the task's
+// subject, to see which performs best.
+type campaign struct {
+	RecipientsKey string           `json:"recipientsKey"`
+	Rate          float64          `json:"rate,omitempty"`
+	Subjects      []subjectVariant `json:"subjects,omitempty"`
+}
+
+// subjectVariant is a subject a campaign tests, sent to a share of its
+// recipients in proportion to Weight, 1 if unset. Variants are named A, B
+// and so on in order unless given a Name.
+type subjectVariant struct {
+	Name    string  `json:"name,omitempty"`
+	Subject string  `json:"subject"`
+	Weight  float64 `json:"weight,omitempty"`
+}
+
+func (c *campaign) variantName(i int) string {
+	if name := c.Subjects[i].Name; name != "" {
+		return name
+	}
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// subjectFor picks the subject variant recipient is sent by weight, from a
+// hash of the campaign and the recipient so that a campaign picked up by
+// another worker sends them the same one. It returns -1 without variants.
+func (c *campaign) subjectFor(id, recipient string) int {
+	total := 0.0
+	for _, v := range c.Subjects {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return -1
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id + "\n" + strings.ToLower(recipient)))
+	point := float64(h.Sum64()%1e9) / 1e9 * total
+	for i, v := range c.Subjects {
+		if point < v.Weight {
+			return i
+		}
+		point -= v.Weight
+	}
+	return len(c.Subjects) - 1
+}
+
+// campaignManager runs the campaigns of a queue. Each campaign's progress
+// is kept in a hash at <queue>:campaign:<task id> with its state, total,
+// sent and remaining counts, and, when it tests subjects, the number of
+// recipients sent, opening and clicking each variant in variant:<name>:sent,
+// :opens and :clicks. The active ones are kept in <queue>:campaigns. A
+// campaign is run by whichever worker holds its lock, so campaigns left by
+// a stopped worker are picked up by another.
+type campaignManager struct {
+	rdb    *redis.Client
+	queue  string
+	worker string
+	status *statusStore
+}
+
+func newCampaignManager(rdb *redis.Client, queue string) *campaignManager {
+	return &campaignManager{rdb: rdb, queue: queue, worker: newTaskID(), status: newStatusStore(rdb, queue)}
+}
+
+func (c *campaignManager) key(id string) string {
+	return c.queue + ":campaign:" + id
+}
+
+func (c *campaignManager) activeKey() string {
+	return c.queue + ":campaigns"
+}
+
+// start records a new campaign from task and begins running it.
+func (c *campaignManager) start(task Mail) error {
+	if task.Campaign.RecipientsKey == "" {
+		return fmt.Errorf("campaign %s has no recipientsKey", task.ID)
+	}
+	// Variants default to an equal share.
+	names := map[string]bool{}
+	for i := range task.Campaign.Subjects {
+		v := &task.Campaign.Subjects[i]
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		if v.Weight < 0 || v.Subject == "" {
+			return fmt.Errorf("campaign %s has a subject variant without a subject or with a negative weight", task.ID)
+		}
+		name := task.Campaign.variantName(i)
+		if names[name] {
+			return fmt.Errorf("campaign %s has two subject variants named %s", task.ID, name)
+		}
+		names[name] = true
+	}
+	total, err := c.rdb.LLen(ctx, task.Campaign.RecipientsKey).Result()
+	if err != nil {
+		return fmt.Errorf("error reading recipients of campaign %s: %w", task.ID, err)
+	}
+	body, err := marshalTask(task)
+	if err != nil {
+		return fmt.Errorf("error marshalling campaign %s: %w", task.ID, err)
+	}
+	key := c.key(task.ID)
+	created, err := c.rdb.HSetNX(ctx, key, "task", body).Result()
+	if err != nil {
+		return fmt.Errorf("error creating campaign %s: %w", task.ID, err)
+	}
+	if !created {
+		return fmt.Errorf("campaign %s already exists", task.ID)
+	}
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, key, "state", campaignRunning, "total", total, "sent", 0, "remaining", total,
+		"createdAt", time.Now().UTC().Format(time.RFC3339))
+	pipe.SAdd(ctx, c.activeKey(), task.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error creating campaign %s: %w", task.ID, err)
+	}
+	log.Printf("started campaign %s to %d recipients", task.ID, total)
+	c.claim(task.ID)
+	return nil
+}
+
+// supervise periodically claims active campaigns no worker is running,
+// until stop is closed.
+func (c *campaignManager) supervise(stop <-chan struct{}) {
+	for {
+		ids, err := c.rdb.SMembers(ctx, c.activeKey()).Result()
+		if err != nil {
+			log.Print("error listing campaigns: ", err)
+		}
+		for _, id := range ids {
+			c.claim(id)
+		}
+		select {
+		case <-time.After(campaignPollInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// claim runs the campaign in the background if no other worker is.
+func (c *campaignManager) claim(id string) {
+	ok, err := c.rdb.SetNX(ctx, c.key(id)+":lock", c.worker, campaignLockTTL).Result()
+	if err != nil {
+		log.Printf("error locking campaign %s: %v", id, err)
+		return
+	}
+	if ok {
+		go c.run(id)
+	}
+}
+
+func (c *campaignManager) run(id string) {
+	key := c.key(id)
+	lock := key + ":lock"
+	defer c.release(lock)
+
+	fields, err := c.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		log.Printf("error reading campaign %s: %v", id, err)
+		return
+	}
+	var task Mail
+	if err := unmarshalTask([]byte(fields["task"]), &task); err != nil {
+		log.Printf("error unmarshalling campaign %s: %v", id, err)
+		c.finish(id, campaignCancelled)
+		return
+	}
+	total, _ := strconv.ParseInt(fields["total"], 10, 64)
+	limiter := newRateLimiter(task.Campaign.Rate)
+
+	for {
+		if !c.hold(lock, limiter.reserve()) {
+			log.Printf("lost lock on campaign %s", id)
+			return
+		}
+		progress, err := c.rdb.HMGet(ctx, key, "state", "sent").Result()
+		if err != nil {
+			log.Printf("error reading campaign %s: %v", id, err)
+			return
+		}
+		state, _ := progress[0].(string)
+		sent, _ := strconv.ParseInt(fmt.Sprint(progress[1]), 10, 64)
+		switch {
+		case state == campaignCancelled:
+			c.finish(id, campaignCancelled)
+			return
+		case state == campaignPaused:
+			time.Sleep(time.Second)
+			continue
+		case sent >= total:
+			c.finish(id, campaignDone)
+			return
+		}
+
+		recipient, err := c.rdb.LIndex(ctx, task.Campaign.RecipientsKey, sent).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("error reading recipient %d of campaign %s: %v", sent, id, err)
+			return
+		}
+		pipe := c.rdb.TxPipeline()
+		if recipient != "" {
+			send := task
+			send.ID = fmt.Sprintf("%s-%d", id, sent)
+			send.Campaign = nil
+			send.Recipients = []string{recipient}
+			if i := task.Campaign.subjectFor(id, recipient); i >= 0 {
+				// The variant is recorded in the send's status for open and
+				// click tracking to count against, and in the campaign for
+				// its report.
+				name := task.Campaign.variantName(i)
+				send.Subject = task.Campaign.Subjects[i].Subject
+				status := c.status.key(send.ID)
+				pipe.HSet(ctx, status, "campaign", id, "subjectVariant", name)
+				pipe.Expire(ctx, status, statusTTL)
+				pipe.HIncrBy(ctx, key, "variant:"+name+":sent", 1)
+			}
+			now := time.Now().UTC()
+			send.EnqueuedAt = &now
+			body, err := marshalTask(send)
+			if err != nil {
+				log.Printf("error marshalling campaign %s: %v", id, err)
+				return
+			}
+			pipe.LPush(ctx, c.queue, body)
+		}
+		pipe.HIncrBy(ctx, key, "sent", 1)
+		pipe.HIncrBy(ctx, key, "remaining", -1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("error dispatching campaign %s: %v", id, err)
+			return
+		}
+	}
+}
+
+// hold keeps this worker's lock through delay, refreshing it every third
+// of campaignLockTTL, so that a campaign sending less often than that
+// doesn't lose its lock between sends. It returns false once the lock is
+// lost.
+func (c *campaignManager) hold(lock string, delay time.Duration) bool {
+	for {
+		held, err := refreshLockScript.Run(ctx, c.rdb, []string{lock}, c.worker, campaignLockTTL.Milliseconds()).Int()
+		if err != nil || held == 0 {
+			return false
+		}
+		if delay <= 0 {
+			return true
+		}
+		step := delay
+		if step > campaignLockTTL/3 {
+			step = campaignLockTTL / 3
+		}
+		time.Sleep(step)
+		delay -= step
+	}
+}
+
+func (c *campaignManager) release(lock string) {
+	if err := releaseLockScript.Run(ctx, c.rdb, []string{lock}, c.worker).Err(); err != nil {
+		log.Printf("error releasing %s: %v", lock, err)
+	}
+}
+
+func (c *campaignManager) finish(id, state string) {
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, c.key(id), "state", state, "finishedAt", time.Now().UTC().Format(time.RFC3339))
+	pipe.Expire(ctx, c.key(id), statusTTL)
+	pipe.SRem(ctx, c.activeKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("error finishing campaign %s: %v", id, err)
+		return
+	}
+	log.Printf("campaign %s %s", id, state)
+}
+
+// campaignAPI serves GET /campaigns/<id> with a campaign's progress and
+// POST /campaigns/<id>/pause, /resume and /cancel. The queue query parameter
+// selects a tenant's campaigns.
+type campaignAPI struct {
+	managers     map[string]*campaignManager
+	defaultQueue string
+}
+
+func (a *campaignAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	queue := r.URL.Query().Get("queue")
+	if queue == "" {
+		queue = a.defaultQueue
+	}
+	c, ok := a.managers[queue]
+	if !ok {
+		http.Error(w, "unknown queue", http.StatusNotFound)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, campaignsPath), "/")
+	id := parts[0]
+	fields, err := c.rdb.HGetAll(ctx, c.key(id)).Result()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error reading campaign", http.StatusServiceUnavailable)
+		return
+	}
+	if id == "" || len(fields) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		state := fields["state"]
+		if state == campaignDone || state == campaignCancelled {
+			http.Error(w, "campaign is "+state, http.StatusConflict)
+			return
+		}
+		switch parts[1] {
+		case "pause":
+			state = campaignPaused
+		case "resume":
+			state = campaignRunning
+		case "cancel":
+			state = campaignCancelled
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err := c.rdb.HSet(ctx, c.key(id), "state", state).Err(); err != nil {
+			log.Print(err)
+			http.Error(w, "error updating campaign", http.StatusServiceUnavailable)
+			return
+		}
+		fields["state"] = state
+	}
+
+	delete(fields, "task")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
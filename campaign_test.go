@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubjectFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		subjects []subjectVariant
+		// want is the share of recipients sent each variant, to within 3%.
+		want []float64
+	}{
+		{"no variants", nil, nil},
+		{"equal", []subjectVariant{{Subject: "A", Weight: 1}, {Subject: "B", Weight: 1}}, []float64{0.5, 0.5}},
+		{"weighted", []subjectVariant{{Subject: "A", Weight: 3}, {Subject: "B", Weight: 1}}, []float64{0.75, 0.25}},
+		{"one variant", []subjectVariant{{Subject: "A", Weight: 2}}, []float64{1}},
+	}
+	const recipients = 4000
+	for _, tt := range tests {
+		c := &campaign{Subjects: tt.subjects}
+		counts := make([]int, len(tt.subjects))
+		for i := 0; i < recipients; i++ {
+			v := c.subjectFor("c1", fmt.Sprintf("r%d@example.com", i))
+			if len(tt.subjects) == 0 {
+				if v != -1 {
+					t.Fatalf("%s: subjectFor() = %d, want -1", tt.name, v)
+				}
+				continue
+			}
+			counts[v]++
+		}
+		for i, share := range tt.want {
+			if got := float64(counts[i]) / recipients; got < share-0.03 || got > share+0.03 {
+				t.Errorf("%s: variant %d sent to %.2f of recipients, want %.2f", tt.name, i, got, share)
+			}
+		}
+	}
+
+	c := &campaign{Subjects: []subjectVariant{{Subject: "A", Weight: 1}, {Subject: "B", Weight: 1}}}
+	if c.subjectFor("c1", "ada@example.com") != c.subjectFor("c1", "Ada@Example.com") {
+		t.Error("subjectFor() picked different variants for the same recipient")
+	}
+}
+
+func TestCampaignLock(t *testing.T) {
+	rdb := newTestRedis(t)
+	holder, other := newCampaignManager(rdb, "tasks"), newCampaignManager(rdb, "tasks")
+	lock := holder.key("c1") + ":lock"
+	rdb.Set(ctx, lock, holder.worker, time.Second)
+
+	if other.hold(lock, 0) {
+		t.Error("hold() kept a lock another worker holds")
+	}
+	if !holder.hold(lock, 10*time.Millisecond) {
+		t.Error("hold() lost the worker's own lock")
+	}
+	if ttl, _ := rdb.PTTL(ctx, lock).Result(); ttl <= time.Second {
+		t.Errorf("lock expires in %s after hold(), want it refreshed to %s", ttl, campaignLockTTL)
+	}
+	other.release(lock)
+	if n, _ := rdb.Exists(ctx, lock).Result(); n != 1 {
+		t.Fatal("release() deleted another worker's lock")
+	}
+	holder.release(lock)
+	if n, _ := rdb.Exists(ctx, lock).Result(); n != 0 {
+		t.Error("release() kept the worker's own lock")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// cancelTTL is how long a cancellation is kept, which bounds how far
+	// ahead a scheduled task can be cancelled.
+	cancelTTL = 365 * 24 * time.Hour
+
+	taskCancelled = "cancelled"
+
+	cancelledMetric = "post_room_cancelled_tasks_total"
+)
+
+func init() {
+	metrics.describe(cancelledMetric, "counter", "Tasks dropped before sending because they were cancelled.")
+}
+
+// errTaskFinished is returned when cancelling a task that has already been
+// sent or has failed for good.
+var errTaskFinished = errors.New("task has already finished")
+
+// cancellations records the IDs of cancelled tasks at
+// <queue>:cancelled:<id>. Cancelled tasks stay where they are, queued,
+// scheduled or waiting to be retried, and are dropped when a worker next
+// takes them, before anything is sent.
+type cancellations struct {
+	rdb    *redis.Client
+	queue  string
+	status *statusStore
+}
+
+func newCancellations(rdb *redis.Client, queue string) *cancellations {
+	return &cancellations{rdb: rdb, queue: queue, status: newStatusStore(rdb, queue)}
+}
+
+func (c *cancellations) key(id string) string {
+	return c.queue + ":cancelled:" + id
+}
+
+// cancel cancels the task id, unless its status shows it has finished. A
+// task being sent at the time may still be sent.
+func (c *cancellations) cancel(id string) error {
+	state, err := c.rdb.HGet(ctx, c.status.key(id), "state").Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("error reading status of task %s: %w", id, err)
+	}
+	if state == taskSent || state == taskFailed || state == taskSkipped {
+		return fmt.Errorf("error cancelling task %s: %w (%s)", id, errTaskFinished, state)
+	}
+	if err := c.rdb.Set(ctx, c.key(id), time.Now().UTC().Format(time.RFC3339), cancelTTL).Err(); err != nil {
+		return fmt.Errorf("error cancelling task %s: %w", id, err)
+	}
+	return nil
+}
+
+// cancelled reports whether task has been cancelled. If that can't be told
+// it says so and reports false, since a cancelled task sent is better than
+// mail lost.
+func (c *cancellations) cancelled(task Mail) bool {
+	n, err := c.rdb.Exists(ctx, c.key(task.ID)).Result()
+	if err != nil {
+		log.Printf("error checking whether task %s is cancelled: %v", task.ID, err)
+		return false
+	}
+	return n > 0
+}
+
+// drop records that task was dropped because it was cancelled.
+func (c *cancellations) drop(task Mail, history *historyStore) {
+	log.Printf("task %s was cancelled, dropping it", task.ID)
+	metrics.add(cancelledMetric, 1)
+	history.record(task, task.Recipients, taskCancelled, "", "")
+	if err := c.status.recordResult(task.ID, taskCancelled, "", task.Attempt); err != nil {
+		log.Print(err)
+	}
+}
+
+// runCancel cancels the tasks whose IDs are given as arguments.
+func runCancel(args []string) error {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue the tasks are on (default tasks)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: cancel [flags] <task id>...")
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	c := newCancellations(rdb, *queue)
+	failed := 0
+	for _, id := range fs.Args() {
+		if err := c.cancel(id); err != nil {
+			log.Print(err)
+			failed++
+			continue
+		}
+		fmt.Println(id)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tasks couldn't be cancelled", failed, fs.NArg())
+	}
+	return nil
+}
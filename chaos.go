@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// chaosTimeout, among CHAOS_CODES, injects a network timeout rather
+	// than a reply.
+	chaosTimeout = "timeout"
+
+	chaosInjectedMetric = "post_room_chaos_faults_total"
+)
+
+func init() {
+	metrics.describe(chaosInjectedMetric, "counter", "Delivery faults injected by CHAOS_FAILURE_RATE, by the code injected.")
+}
+
+// chaosInjector fails and delays deliveries on purpose, so that retries,
+// dead-lettering and alerting can be exercised in staging against a relay
+// that behaves. Each delivery waits up to latency, then fails with
+// probability rate, with one of codes picked at random: an SMTP reply code,
+// classified like a real reply, or chaosTimeout. It must never be enabled in
+// production.
+type chaosInjector struct {
+	rate    float64
+	codes   []string
+	latency time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaosInjector(options AppOptions) *chaosInjector {
+	if options.ChaosFailureRate <= 0 && options.ChaosLatency <= 0 {
+		return nil
+	}
+	log.Printf("[WARNING] injecting faults into %s of deliveries (codes %v) and up to %s of latency: do not run this in production",
+		percent(options.ChaosFailureRate), options.ChaosCodes, options.ChaosLatency)
+	return &chaosInjector{
+		rate:    options.ChaosFailureRate,
+		codes:   options.ChaosCodes,
+		latency: options.ChaosLatency,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// validChaosCode reports whether code may be given in CHAOS_CODES.
+func validChaosCode(code string) bool {
+	if code == chaosTimeout {
+		return true
+	}
+	n, err := strconv.Atoi(code)
+	return err == nil && n >= 400 && n <= 599
+}
+
+// inject delays, then returns the fault to fail a delivery with, or nil to
+// let it go ahead.
+func (c *chaosInjector) inject(sendCtx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	delay := time.Duration(0)
+	if c.latency > 0 {
+		delay = time.Duration(c.rand.Int63n(int64(c.latency)))
+	}
+	fail := c.rand.Float64() < c.rate
+	code := c.codes[c.rand.Intn(len(c.codes))]
+	c.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-sendCtx.Done():
+			t.Stop()
+			return sendCtx.Err()
+		}
+	}
+	if !fail {
+		return nil
+	}
+	metrics.add(chaosInjectedMetric, 1, "code", code)
+	if code == chaosTimeout {
+		return &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	}
+	n, _ := strconv.Atoi(code)
+	return fmt.Errorf("chaos: %w", &textproto.Error{Code: n, Msg: "injected failure"})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamAVTimeout = 30 * time.Second
+	// clamAVChunkBytes is the size of the chunks attachments are streamed
+	// to clamd in.
+	clamAVChunkBytes = 64 << 10
+
+	attachmentScansMetric = "post_room_attachment_scans_total"
+)
+
+func init() {
+	metrics.describe(attachmentScansMetric, "counter", "Attachments scanned by ClamAV, by result: clean, infected or error.")
+}
+
+// clamAVScanner scans attachments with clamd before they are sent, over
+// TCP or, for an address starting with /, a Unix socket. Tasks with an
+// infected attachment are dead-lettered; those that can't be scanned are
+// retried. A nil scanner doesn't scan.
+type clamAVScanner struct {
+	network, address string
+	timeout          time.Duration
+}
+
+func newClamAVScanner(address string, timeout time.Duration) *clamAVScanner {
+	if address == "" {
+		return nil
+	}
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &clamAVScanner{network: network, address: address, timeout: timeout}
+}
+
+// scan scans attachments in turn, failing permanently on the first found
+// infected.
+func (s *clamAVScanner) scan(attachments []Attachment) error {
+	if s == nil {
+		return nil
+	}
+	for _, a := range attachments {
+		result, err := s.scanContent(a.Content)
+		if err != nil {
+			metrics.add(attachmentScansMetric, 1, "result", "error")
+			return fmt.Errorf("error scanning attachment %s: %w", a.Filename, err)
+		}
+		if result != "" {
+			metrics.add(attachmentScansMetric, 1, "result", "infected")
+			return permanent(fmt.Errorf("attachment %s is infected: %s", a.Filename, result))
+		}
+		metrics.add(attachmentScansMetric, 1, "result", "clean")
+	}
+	return nil
+}
+
+// scanContent streams content to clamd with INSTREAM and returns the name
+// of what it found, or "" if it is clean.
+func (s *clamAVScanner) scanContent(content []byte) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(content) > 0 {
+		n := len(content)
+		if n > clamAVChunkBytes {
+			n = clamAVChunkBytes
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(content[:n])
+		content = content[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("error reading clamd reply: %w", err)
+	}
+	// Replies are "stream: OK", "stream: <signature> FOUND" or
+	// "<reason> ERROR".
+	reply = strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(reply, "\x00"), "stream:"))
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	// gzipPrefix and zstdPrefix start a compressed task payload, followed
+	// by the compressed bytes. Compression comes before encryption, so an
+	// encrypted payload is compressed inside.
+	gzipPrefix = "gzip:"
+	zstdPrefix = "zstd:"
+
+	defaultCompressionThreshold = 16 << 10
+	// maxDecompressedBytes bounds what a compressed payload may expand to.
+	maxDecompressedBytes = 64 << 20
+)
+
+// taskCompressor is set when PAYLOAD_COMPRESSION is configured, in which
+// case tasks the worker and its subcommands write to Redis are compressed
+// once their JSON reaches the threshold, such as digests of long HTML
+// messages. Compressed payloads are read whether or not it is set. It is
+// shared like taskSealer.
+var taskCompressor *payloadCompressor
+
+type payloadCompressor struct {
+	algorithm string
+	threshold int
+}
+
+func newPayloadCompressor(algorithm string, threshold int) *payloadCompressor {
+	if algorithm == compressionNone {
+		return nil
+	}
+	return &payloadCompressor{algorithm: algorithm, threshold: threshold}
+}
+
+var zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdCodec.once.Do(func() {
+		if zstdCodec.encoder, zstdCodec.err = zstd.NewWriter(nil); zstdCodec.err != nil {
+			return
+		}
+		zstdCodec.decoder, zstdCodec.err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+	})
+	return zstdCodec.encoder, zstdCodec.decoder, zstdCodec.err
+}
+
+// compress returns payload compressed if it is at least the threshold, and
+// as it is otherwise.
+func (c *payloadCompressor) compress(payload []byte) ([]byte, error) {
+	if c == nil || len(payload) < c.threshold {
+		return payload, nil
+	}
+	switch c.algorithm {
+	case compressionGzip:
+		buf := bytes.NewBufferString(gzipPrefix)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case compressionZstd:
+		encoder, _, err := zstdCoders()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(payload, []byte(zstdPrefix)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c.algorithm)
+	}
+}
+
+// decompressPayload decompresses a compressed payload, passing others
+// through.
+func decompressPayload(payload []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(payload, []byte(gzipPrefix)):
+		r, err := gzip.NewReader(bytes.NewReader(payload[len(gzipPrefix):]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip task payload: %w", err)
+		}
+		plain, err := io.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip task payload: %w", err)
+		}
+		if len(plain) > maxDecompressedBytes {
+			return nil, errors.New("gzip task payload is too large")
+		}
+		return plain, nil
+	case bytes.HasPrefix(payload, []byte(zstdPrefix)):
+		_, decoder, err := zstdCoders()
+		if err != nil {
+			return nil, err
+		}
+		plain, err := decoder.DecodeAll(payload[len(zstdPrefix):], nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd task payload: %w", err)
+		}
+		return plain, nil
+	default:
+		return payload, nil
+	}
+}
+
+// parseCompression reads the payload compression settings, which the
+// worker and the subcommands writing tasks share.
+func parseCompression(p *envParser, options *AppOptions) {
+	options.PayloadCompression = p.choice(payloadCompressionKey, compressionNone, compressionNone, compressionGzip, compressionZstd)
+	options.PayloadCompressionThreshold = defaultCompressionThreshold
+	p.int(compressionThresholdKey, &options.PayloadCompressionThreshold)
+	if options.PayloadCompressionThreshold < 0 {
+		p.fail("%s must not be negative", compressionThresholdKey)
+	}
+}
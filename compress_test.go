@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPayloadCompression(t *testing.T) {
+	large := []byte(`{"message":"` + strings.Repeat("<p>hello</p>", 1000) + `"}`)
+	tests := []struct {
+		algorithm  string
+		payload    []byte
+		prefix     string
+		compressed bool
+	}{
+		{compressionGzip, large, gzipPrefix, true},
+		{compressionZstd, large, zstdPrefix, true},
+		{compressionGzip, []byte(`{"message":"short"}`), "", false},
+		{compressionNone, large, "", false},
+	}
+	for _, tt := range tests {
+		c := newPayloadCompressor(tt.algorithm, 1024)
+		compressed, err := c.compress(tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.compressed != !bytes.Equal(compressed, tt.payload) || !bytes.HasPrefix(compressed, []byte(tt.prefix)) {
+			t.Errorf("%s: compress() of %d bytes = %.20q, want compressed %v", tt.algorithm, len(tt.payload), compressed, tt.compressed)
+		}
+		if tt.compressed && len(compressed) >= len(tt.payload)/10 {
+			t.Errorf("%s: compressed %d bytes to %d", tt.algorithm, len(tt.payload), len(compressed))
+		}
+		plain, err := decompressPayload(compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, tt.payload) {
+			t.Errorf("%s: decompressPayload() didn't give back the payload", tt.algorithm)
+		}
+	}
+	if _, err := decompressPayload([]byte(gzipPrefix + "not gzip")); err == nil {
+		t.Error("decompressPayload() accepted an invalid gzip payload")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envParser reads typed settings from the environment. Rather than
+// stopping at the first bad setting it collects every problem, so that a
+// misconfigured deployment can be fixed in one go.
+type envParser struct {
+	problems []string
+}
+
+func (p *envParser) fail(format string, args ...interface{}) {
+	p.problems = append(p.problems, fmt.Sprintf(format, args...))
+}
+
+func (p *envParser) invalid(key string, err error) {
+	p.fail("invalid value for %s: %v", key, err)
+}
+
+// err returns the problems found, if any, as a single error.
+func (p *envParser) err() error {
+	switch len(p.problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(p.problems[0])
+	}
+	return fmt.Errorf("%d configuration problems:\n\t%s", len(p.problems), strings.Join(p.problems, "\n\t"))
+}
+
+func (p *envParser) lookup(key string) (string, bool) {
+	value, ok, err := lookupEnv(key)
+	if err != nil {
+		p.fail("%v", err)
+	}
+	return value, ok
+}
+
+// fileSuffix marks a setting read from a file, such as a Docker or
+// Kubernetes secret mounted into the container: SMTP_PASSWORD_FILE names
+// the file holding SMTP_PASSWORD.
+const fileSuffix = "_FILE"
+
+// lookupEnv returns the setting key from the environment or, if key_FILE is
+// set instead, from the file it names, less a trailing newline.
+func lookupEnv(key string) (string, bool, error) {
+	value, ok := os.LookupEnv(key)
+	path, fromFile := os.LookupEnv(key + fileSuffix)
+	if !fromFile {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("only one of %s and %s%s may be set", key, key, fileSuffix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid value for %s%s: %w", key, fileSuffix, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// getenv is os.Getenv for settings that may be read from files, taking a
+// file that can't be read as unset.
+func getenv(key string) string {
+	value, _, _ := lookupEnv(key)
+	return value
+}
+
+func (p *envParser) string(key string) string {
+	value, _ := p.lookup(key)
+	return value
+}
+
+// required returns the value of key, reporting it missing if unset or
+// empty.
+func (p *envParser) required(key string) string {
+	value, _ := p.lookup(key)
+	if value == "" {
+		p.fail("no ENV value provided for %s", key)
+	}
+	return value
+}
+
+func (p *envParser) list(key string) []string {
+	value, ok := p.lookup(key)
+	if !ok {
+		return nil
+	}
+	return splitList(value)
+}
+
+// choice returns the value of key, or def if unset, which must be one of
+// allowed.
+func (p *envParser) choice(key, def string, allowed ...string) string {
+	value, ok := p.lookup(key)
+	if !ok || value == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	p.fail("invalid value for %s: %q; must be %s or %s", key, value, strings.Join(allowed[:len(allowed)-1], ", "), allowed[len(allowed)-1])
+	return def
+}
+
+// The typed readers leave value as it is, holding its default, when key is
+// unset or invalid.
+
+func (p *envParser) bool(key string, value *bool) {
+	if s, ok := p.lookup(key); ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			p.invalid(key, err)
+			return
+		}
+		*value = b
+	}
+}
+
+func (p *envParser) int(key string, value *int) {
+	if s, ok := p.lookup(key); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			p.invalid(key, err)
+			return
+		}
+		*value = n
+	}
+}
+
+func (p *envParser) int64(key string, value *int64) {
+	if s, ok := p.lookup(key); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			p.invalid(key, err)
+			return
+		}
+		*value = n
+	}
+}
+
+func (p *envParser) float(key string, value *float64) {
+	if s, ok := p.lookup(key); ok {
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			p.invalid(key, err)
+			return
+		}
+		*value = n
+	}
+}
+
+// duration reads a Go duration, which when positive is set must be above
+// zero.
+func (p *envParser) duration(key string, value *time.Duration, positive bool) {
+	if s, ok := p.lookup(key); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			p.invalid(key, err)
+			return
+		}
+		if positive && d <= 0 {
+			p.fail("invalid value for %s: must be positive", key)
+			return
+		}
+		*value = d
+	}
+}
+
+// port returns the TCP port in key, if set.
+func (p *envParser) port(key string) string {
+	value := p.string(key)
+	if value == "" {
+		return ""
+	}
+	if err := checkPort(value); err != nil {
+		p.invalid(key, err)
+	}
+	return value
+}
+
+// address returns the host:port address in key, if set. The host may be
+// empty, as in :8080, to listen on every interface.
+func (p *envParser) address(key string) string {
+	value := p.string(key)
+	if value == "" {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err == nil {
+		err = checkPort(port)
+	}
+	if err != nil {
+		p.invalid(key, err)
+	}
+	return value
+}
+
+// email returns the email address in key, if set, which may include a
+// display name.
+func (p *envParser) email(key string) string {
+	value := p.string(key)
+	if value == "" {
+		return ""
+	}
+	if _, err := netmail.ParseAddress(value); err != nil {
+		p.invalid(key, err)
+	}
+	return value
+}
+
+// emails returns the list of email addresses in key. Entries starting with
+// other, such as group: recipients, are left for their users to check.
+func (p *envParser) emails(key, other string) []string {
+	values := p.list(key)
+	for _, v := range values {
+		if other != "" && strings.HasPrefix(v, other) {
+			continue
+		}
+		if _, err := netmail.ParseAddress(v); err != nil {
+			p.fail("invalid value for %s: %q: %v", key, v, err)
+		}
+	}
+	return values
+}
+
+// url returns the absolute http or https URL in key, if set.
+func (p *envParser) url(key string) string {
+	value := p.string(key)
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	switch {
+	case err != nil:
+		p.invalid(key, err)
+	case (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		p.fail("invalid value for %s: %q is not an absolute http or https URL", key, value)
+	}
+	return value
+}
+
+// checkPort reports whether port is a TCP port number.
+func checkPort(port string) error {
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return fmt.Errorf("%q is not a port number", port)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/go-redis/redis/v8"
+)
+
+// testRelay is an SMTP server keeping the messages it accepts, and refusing
+// recipients containing "reject" with a 550.
+type testRelay struct {
+	mu       sync.Mutex
+	messages []testMessage
+}
+
+type testMessage struct {
+	to  []string
+	raw []byte
+}
+
+func (r *testRelay) Login(state *gosmtp.ConnectionState, username, password string) (gosmtp.Session, error) {
+	return &testRelaySession{relay: r}, nil
+}
+
+func (r *testRelay) AnonymousLogin(state *gosmtp.ConnectionState) (gosmtp.Session, error) {
+	return &testRelaySession{relay: r}, nil
+}
+
+func (r *testRelay) received() []testMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]testMessage(nil), r.messages...)
+}
+
+type testRelaySession struct {
+	relay *testRelay
+	to    []string
+}
+
+func (s *testRelaySession) Reset()                                          { s.to = nil }
+func (s *testRelaySession) Logout() error                                   { return nil }
+func (s *testRelaySession) Mail(from string, opts gosmtp.MailOptions) error { return nil }
+
+func (s *testRelaySession) Rcpt(to string) error {
+	if strings.Contains(to, "reject") {
+		return &gosmtp.SMTPError{Code: 550, EnhancedCode: gosmtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *testRelaySession) Data(r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.relay.mu.Lock()
+	defer s.relay.mu.Unlock()
+	s.relay.messages = append(s.relay.messages, testMessage{to: s.to, raw: raw})
+	return nil
+}
+
+// runWorker pushes tasks onto a queue and runs a worker over it once, as
+// RUN_MODE=once does, returning the messages the relay received and the
+// worker's Redis.
+func runWorker(t *testing.T, env map[string]string, tasks ...string) ([]testMessage, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	relay := &testRelay{}
+	smtp := gosmtp.NewServer(relay)
+	smtp.Domain = "localhost"
+	smtp.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server is stopped by closing its listener and waiting for Serve
+	// to return, as Server.Close reads the listeners Serve adds to without
+	// holding its lock.
+	served := make(chan struct{})
+	go func() {
+		smtp.Serve(listener)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-served
+	})
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	for key, value := range map[string]string{
+		smtpHostKey:      host,
+		smtpPortKey:      port,
+		senderAddressKey: "Sender <sender@example.com>",
+		redisAddressKey:  server.Addr(),
+		runModeKey:       runModeOnce,
+	} {
+		t.Setenv(key, value)
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	options, err := validateEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer, err := newMailer(options, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer.run = newRunOnce(0, 0)
+
+	tn := &tenant{queue: options.RedisKey, mailer: mailer, limiter: newRateLimiter(options.RateLimit)}
+	if tn.payloads, err = newPayloadDecoder(options.PayloadFormat); err != nil {
+		t.Fatal(err)
+	}
+	tn.quotas = &quotaCounter{rdb: rdb, queue: tn.queue}
+	tn.scheduler = newScheduler(rdb, tn.queue)
+	tn.mailer.retries = tn.scheduler
+	tn.mailer.status = newStatusStore(rdb, tn.queue)
+	tn.cancelled = newCancellations(rdb, tn.queue)
+	tn.inflight = newInflightTasks()
+	tn.control = newController(rdb, tn.queue)
+	tn.tuning = newTuning(rdb, tn.queue, options)
+	tn.batch = newTaskBatch(rdb, tn.queue, options.DequeueBatchSize, nil)
+	tn.campaigns = newCampaignManager(rdb, tn.queue)
+	tn.digests = &digester{rdb: rdb, queue: tn.queue, interval: options.DigestInterval}
+
+	for _, task := range tasks {
+		if err := rdb.LPush(ctx, tn.queue, task).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	consume(rdb, tn, &wg, nil)
+	wg.Wait()
+	return relay.received(), rdb
+}
+
+// messageParts returns a message's header and the decoded content of each
+// of its parts, or of its body if it has none.
+func messageParts(t *testing.T, raw []byte) (*netmail.Message, []string) {
+	t.Helper()
+	msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := io.ReadAll(msg.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, []string{string(body)}
+	}
+	var parts []string
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return msg, parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(content))
+	}
+}
+
+func TestConsumeRenderSend(t *testing.T) {
+	tests := []struct {
+		name string
+		task map[string]interface{}
+		// want are the recipients and text of each message sent, in order.
+		want []testMessageWant
+		dead int
+	}{
+		{
+			name: "plain message",
+			task: map[string]interface{}{"id": "plain", "recipients": []string{"a@example.com"}, "subject": "Hello", "message": "<p>Hi there</p>"},
+			want: []testMessageWant{{to: "a@example.com", subject: "Hello", text: "Hi there"}},
+		},
+		{
+			name: "inline template",
+			task: map[string]interface{}{
+				"id": "inline", "recipients": []string{"a@example.com"}, "subject": "Order",
+				"message": "<p>Order {{ .order }} for {{ .name | upper }}</p>", "data": map[string]interface{}{"order": 42},
+				"recipientData": map[string]interface{}{"a@example.com": map[string]interface{}{"name": "ada"}},
+			},
+			want: []testMessageWant{{to: "a@example.com", subject: "Order", text: "Order 42 for ADA"}},
+		},
+		{
+			name: "personalized split",
+			task: map[string]interface{}{
+				"id": "split", "recipients": []string{"a@example.com", "b@example.com"}, "split": true,
+				"subject": "Hi", "message": "<p>Hi {{ .name }}</p>",
+				"recipientData": map[string]interface{}{"a@example.com": map[string]interface{}{"name": "Ada"}, "b@example.com": map[string]interface{}{"name": "Bob"}},
+			},
+			want: []testMessageWant{{to: "a@example.com", subject: "Hi", text: "Hi Ada"}, {to: "b@example.com", subject: "Hi", text: "Hi Bob"}},
+		},
+		{
+			name: "rejected recipient",
+			task: map[string]interface{}{"id": "rejected", "recipients": []string{"reject@example.com"}, "subject": "Hi", "message": "<p>Hi</p>"},
+			dead: 1,
+		},
+		{
+			name: "rendered attachment",
+			task: map[string]interface{}{
+				"id": "report", "recipients": []string{"a@example.com"}, "subject": "Report", "message": "<p>Attached</p>",
+				"attachments": []map[string]interface{}{{"filename": "report.csv", "render": "csv", "columns": []string{"name", "total"}, "rows": [][]interface{}{{"ada", 3}}}},
+			},
+			want: []testMessageWant{{to: "a@example.com", subject: "Report", text: "Attached", attachment: "name,total\r\nada,3\r\n"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task, _ := json.Marshal(tt.task)
+			messages, rdb := runWorker(t, nil, string(task))
+			if len(messages) != len(tt.want) {
+				t.Fatalf("relay received %d messages, want %d", len(messages), len(tt.want))
+			}
+			for i, want := range tt.want {
+				msg, parts := messageParts(t, messages[i].raw)
+				if strings.Join(messages[i].to, ",") != want.to {
+					t.Errorf("message %d sent to %v, want %s", i, messages[i].to, want.to)
+				}
+				if to := msg.Header.Get("To"); !strings.Contains(to, want.to) {
+					t.Errorf("message %d has To: %s, want %s", i, to, want.to)
+				}
+				if subject := msg.Header.Get("Subject"); subject != want.subject {
+					t.Errorf("message %d has Subject: %s, want %s", i, subject, want.subject)
+				}
+				if !strings.Contains(parts[0], want.text) {
+					t.Errorf("message %d text %q doesn't contain %q", i, parts[0], want.text)
+				}
+				if want.attachment != "" && (len(parts) < 2 || parts[1] != want.attachment) {
+					t.Errorf("message %d parts %q, want the attachment %q", i, parts, want.attachment)
+				}
+			}
+			if dead, _ := rdb.LLen(ctx, "tasks:dead").Result(); int(dead) != tt.dead {
+				t.Errorf("%d dead letters, want %d", dead, tt.dead)
+			}
+		})
+	}
+}
+
+type testMessageWant struct {
+	to, subject, text string
+	// attachment is the content of the second part, if any.
+	attachment string
+}
+
+func TestConsumeBatches(t *testing.T) {
+	var tasks []string
+	for _, id := range []string{"b1", "b2", "b3", "b4", "b5"} {
+		task, _ := json.Marshal(map[string]interface{}{"id": id, "recipients": []string{id + "@example.com"}, "subject": id, "message": "<p>" + id + "</p>"})
+		tasks = append(tasks, string(task))
+	}
+	messages, rdb := runWorker(t, map[string]string{dequeueBatchSizeKey: "3"}, tasks...)
+	if len(messages) != len(tasks) {
+		t.Fatalf("relay received %d messages, want %d", len(messages), len(tasks))
+	}
+	seen := map[string]bool{}
+	for _, m := range messages {
+		seen[strings.Join(m.to, ",")] = true
+	}
+	for _, id := range []string{"b1", "b2", "b3", "b4", "b5"} {
+		if !seen[id+"@example.com"] {
+			t.Errorf("no message to %s@example.com", id)
+		}
+	}
+	if n, _ := rdb.LLen(ctx, "tasks").Result(); n != 0 {
+		t.Errorf("%d tasks left on the queue", n)
+	}
+}
+
+func TestConsumeDryRun(t *testing.T) {
+	task, _ := json.Marshal(map[string]interface{}{"id": "dry", "recipients": []string{"a@example.com"}, "subject": "Hi", "message": "<p>Hi</p>"})
+	messages, rdb := runWorker(t, map[string]string{dryRunKey: "true"}, string(task))
+	if len(messages) != 0 {
+		t.Errorf("relay received %d messages in a dry run", len(messages))
+	}
+	state, err := rdb.HGet(ctx, newStatusStore(rdb, "tasks").key("dry"), "state").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != taskSkipped {
+		t.Errorf("task state is %q, want %q", state, taskSkipped)
+	}
+}
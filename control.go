@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	controlPause  = "pause"
+	controlResume = "resume"
+	controlDrain  = "drain"
+
+	// controlPollInterval bounds how long a consumer blocks on the queue,
+	// and so how long a pause can take to be noticed.
+	controlPollInterval = time.Second
+
+	pausedMetric = "post_room_paused"
+)
+
+func init() {
+	metrics.describe(pausedMetric, "gauge", "Whether consumption is paused by a control command.")
+}
+
+// controller carries out the commands published on the <queue>:control
+// channel by every replica: pause stops taking tasks from the queues,
+// resume starts again and drain finishes the tasks in progress and exits.
+// Pauses are also kept in the <queue>:control key so that replicas started
+// while paused stay paused.
+type controller struct {
+	rdb *redis.Client
+	key string
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	paused  bool
+	drained chan struct{}
+}
+
+func newController(rdb *redis.Client, queue string) *controller {
+	c := &controller{rdb: rdb, key: queue + ":control", drained: make(chan struct{})}
+	c.resumed = sync.NewCond(&c.mu)
+	return c
+}
+
+// start takes up any pause in force and follows the control channel. It
+// subscribes before reading the key so that no command is missed.
+func (c *controller) start() {
+	pubsub := c.rdb.Subscribe(ctx, c.key)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Printf("error subscribing to control channel: %v", err)
+	}
+	if state, err := c.rdb.Get(ctx, c.key).Result(); err == nil && state == controlPause {
+		c.apply(controlPause)
+	} else if err != nil && err != redis.Nil {
+		log.Printf("error reading control state: %v", err)
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			c.apply(msg.Payload)
+		}
+	}()
+}
+
+func (c *controller) apply(command string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch command {
+	case controlPause:
+		if !c.paused {
+			log.Print("pausing consumption")
+			opsEvents.notify(eventPaused, "consumption paused")
+		}
+		c.paused = true
+	case controlResume:
+		if c.paused {
+			log.Print("resuming consumption")
+			opsEvents.notify(eventResumed, "consumption resumed")
+		}
+		c.paused = false
+	case controlDrain:
+		select {
+		case <-c.drained:
+		default:
+			log.Print("draining: finishing tasks in progress before exiting")
+			opsEvents.notify(eventDraining, "draining: finishing tasks in progress before exiting")
+			close(c.drained)
+		}
+	default:
+		log.Printf("ignoring unknown control command %q", command)
+		return
+	}
+	metrics.set(pausedMetric, boolGauge(c.paused))
+	c.resumed.Broadcast()
+}
+
+// wait blocks while consumption is paused. It returns false once draining,
+// when the consumer should stop.
+func (c *controller) wait() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.paused && !c.draining() {
+		c.resumed.Wait()
+	}
+	return !c.draining()
+}
+
+// active reports whether a task just taken from a queue may be started.
+func (c *controller) active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.paused && !c.draining()
+}
+
+func (c *controller) draining() bool {
+	select {
+	case <-c.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// runControl publishes a control command to every replica.
+func runControl(args []string) error {
+	fs := flag.NewFlagSet("control", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue the workers are configured with (default tasks)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	command := fs.Arg(0)
+	if fs.NArg() != 1 || (command != controlPause && command != controlResume && command != controlDrain) {
+		return fmt.Errorf("usage: control [flags] pause|resume|drain")
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	key := *queue + ":control"
+	var err error
+	switch command {
+	case controlPause:
+		err = rdb.Set(ctx, key, controlPause, 0).Err()
+	case controlResume:
+		err = rdb.Del(ctx, key).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("error recording control state: %w", err)
+	}
+	receivers, err := rdb.Publish(ctx, key, command).Result()
+	if err != nil {
+		return fmt.Errorf("error publishing control command: %w", err)
+	}
+	log.Printf("sent %s to %d workers", command, receivers)
+	return nil
+}
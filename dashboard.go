@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	dashboardPath     = "/admin/"
+	dashboardFailures = 10
+	dashboardPageSize = 50
+)
+
+// inflightTasks tracks the tasks this worker is sending, for the dashboard.
+type inflightTasks struct {
+	mu    sync.Mutex
+	next  uint64
+	tasks map[uint64]inflightTask
+}
+
+type inflightTask struct {
+	Task    Mail
+	Started time.Time
+}
+
+func newInflightTasks() *inflightTasks {
+	return &inflightTasks{tasks: map[uint64]inflightTask{}}
+}
+
+// start records task as being sent and returns the token to pass to done.
+func (f *inflightTasks) start(task Mail) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	f.tasks[f.next] = inflightTask{Task: task, Started: time.Now()}
+	return f.next
+}
+
+func (f *inflightTasks) done(token uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tasks, token)
+}
+
+func (f *inflightTasks) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.tasks)
+}
+
+// list returns the tasks being sent, longest running first.
+func (f *inflightTasks) list() []inflightTask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tasks := make([]inflightTask, 0, len(f.tasks))
+	for _, t := range f.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Started.Before(tasks[j].Started) })
+	return tasks
+}
+
+// dashboard is the admin web UI at dashboardPath. Queue depths, dead
+// letters and send volumes are read from Redis and so cover every worker;
+// in-flight tasks are this worker's own.
+type dashboard struct {
+	rdb     *redis.Client
+	tenants []*tenant
+	// csrf is embedded in the page's forms and required on every POST.
+	csrf string
+
+	username, password string
+	oidc               *oidcLogin
+}
+
+func newDashboard(rdb *redis.Client, tenants []*tenant, options AppOptions) (*dashboard, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	d := &dashboard{rdb: rdb, tenants: tenants, csrf: hex.EncodeToString(buf)}
+	if options.DashboardUsername != "" && options.DashboardPassword != "" {
+		d.username, d.password = options.DashboardUsername, options.DashboardPassword
+	} else {
+		var err error
+		if d.oidc, err = newOIDCLogin(options); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *dashboard) register(mux *http.ServeMux) {
+	mux.Handle(dashboardPath, d.authorize(http.HandlerFunc(d.index)))
+	mux.Handle(dashboardPath+"dead", d.authorize(http.HandlerFunc(d.dead)))
+	mux.Handle(dashboardPath+"requeue", d.authorize(http.HandlerFunc(d.requeue)))
+	if d.oidc != nil {
+		mux.Handle(d.oidc.callbackPath, http.HandlerFunc(d.oidc.callback))
+	}
+}
+
+// authorize requires basic auth with the dashboard credentials, or if there
+// are none an OIDC login.
+func (d *dashboard) authorize(next http.Handler) http.Handler {
+	if d.oidc != nil {
+		return d.oidc.require(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(d.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="Post Room"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *dashboard) tenant(queue string) *tenant {
+	for _, t := range d.tenants {
+		if t.queue == queue {
+			return t
+		}
+	}
+	return nil
+}
+
+type dashboardQueue struct {
+	Queue                              string
+	Pending, Priority, Scheduled, Dead int64
+	Inflight                           []inflightTask
+	Failures                           []dashboardLetter
+	Volumes                            []templateVolume
+}
+
+type dashboardLetter struct {
+	deadLetter
+	Raw string
+}
+
+type templateVolume struct {
+	Template string
+	Sent     int64
+}
+
+func (d *dashboard) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != dashboardPath {
+		http.NotFound(w, r)
+		return
+	}
+	var queues []dashboardQueue
+	for _, t := range d.tenants {
+		q, err := d.summarise(t)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "error reading queues", http.StatusServiceUnavailable)
+			return
+		}
+		queues = append(queues, q)
+	}
+	d.render(w, "index", map[string]interface{}{"Queues": queues, "CSRF": d.csrf})
+}
+
+// summarise reads the depths of t's lists, its most recent failures and its
+// send volumes.
+func (d *dashboard) summarise(t *tenant) (dashboardQueue, error) {
+	q := dashboardQueue{Queue: t.queue, Inflight: t.inflight.list()}
+	pipe := d.rdb.Pipeline()
+	pending := pipe.LLen(ctx, t.queue)
+	priority := pipe.LLen(ctx, priorityQueue(t.queue))
+	scheduled := pipe.ZCard(ctx, t.scheduler.key())
+	dead := pipe.LLen(ctx, t.mailer.dead.key())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return q, err
+	}
+	q.Pending, q.Priority, q.Scheduled, q.Dead = pending.Val(), priority.Val(), scheduled.Val(), dead.Val()
+
+	entries, err := t.mailer.dead.list(0, dashboardFailures)
+	if err != nil {
+		return q, err
+	}
+	q.Failures = dashboardLetters(entries)
+
+	volumes, err := t.mailer.status.sendVolumes()
+	if err != nil {
+		return q, err
+	}
+	for template, sent := range volumes {
+		q.Volumes = append(q.Volumes, templateVolume{Template: template, Sent: sent})
+	}
+	sort.Slice(q.Volumes, func(i, j int) bool { return q.Volumes[i].Sent > q.Volumes[j].Sent })
+	return q, nil
+}
+
+func dashboardLetters(entries []deadLetterEntry) []dashboardLetter {
+	letters := make([]dashboardLetter, 0, len(entries))
+	for _, e := range entries {
+		letters = append(letters, dashboardLetter{deadLetter: e.letter, Raw: e.raw})
+	}
+	return letters
+}
+
+// dead pages through a queue's dead letters.
+func (d *dashboard) dead(w http.ResponseWriter, r *http.Request) {
+	t := d.tenant(r.URL.Query().Get("queue"))
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if offset < 0 {
+		offset = 0
+	}
+	total, err := t.mailer.dead.length()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error reading dead letters", http.StatusServiceUnavailable)
+		return
+	}
+	entries, err := t.mailer.dead.list(offset, dashboardPageSize)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error reading dead letters", http.StatusServiceUnavailable)
+		return
+	}
+	page := map[string]interface{}{
+		"Queue":   t.queue,
+		"Total":   total,
+		"Offset":  offset,
+		"Letters": dashboardLetters(entries),
+		"CSRF":    d.csrf,
+	}
+	if offset > 0 {
+		page["Previous"] = strconv.FormatInt(maxInt64(offset-dashboardPageSize, 0), 10)
+	}
+	if offset+dashboardPageSize < total {
+		page["Next"] = strconv.FormatInt(offset+dashboardPageSize, 10)
+	}
+	d.render(w, "dead", page)
+}
+
+// requeue puts a dead letter back on its queue.
+func (d *dashboard) requeue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(d.csrf)) != 1 {
+		http.Error(w, "invalid form token", http.StatusForbidden)
+		return
+	}
+	t := d.tenant(r.PostFormValue("queue"))
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := t.mailer.dead.requeue(r.PostFormValue("letter"), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	back := r.PostFormValue("back")
+	if back == "" || back[0] != '/' || (len(back) > 1 && back[1] == '/') {
+		back = dashboardPath
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+func (d *dashboard) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, name, data); err != nil {
+		log.Print("error rendering dashboard: ", err)
+	}
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05") },
+	"since": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	// dict passes several values to a nested template.
+	"dict": func(pairs ...interface{}) map[string]interface{} {
+		m := map[string]interface{}{}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			m[pairs[i].(string)] = pairs[i+1]
+		}
+		return m
+	},
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Post Room</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+.reason { font-family: monospace; white-space: pre-wrap; max-width: 40em; }
+</style></head><body>
+<h1><a href="/admin/">Post Room</a></h1>{{end}}
+
+{{define "letters"}}<table>
+<tr><th>Failed</th><th>Task</th><th>Recipients</th><th>Subject</th><th>Reason</th><th></th></tr>
+{{range .Letters}}<tr>
+<td>{{time .FailedAt}}</td><td>{{.Task.ID}}</td><td>{{range .Task.Recipients}}{{.}}<br>{{end}}</td>
+<td>{{.Task.Subject}}</td><td class="reason">{{.Reason}}</td>
+<td><form method="post" action="/admin/requeue">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="queue" value="{{$.Queue}}">
+<input type="hidden" name="letter" value="{{.Raw}}">
+<input type="hidden" name="back" value="{{$.Back}}">
+<button>Requeue</button></form></td>
+</tr>{{else}}<tr><td colspan="6">No dead letters.</td></tr>{{end}}
+</table>{{end}}
+
+{{define "index"}}{{template "header"}}
+{{range .Queues}}<h2>{{.Queue}}</h2>
+<table>
+<tr><th>Pending</th><th>Priority</th><th>Scheduled</th><th>Dead</th><th>In flight</th></tr>
+<tr><td>{{.Pending}}</td><td>{{.Priority}}</td><td>{{.Scheduled}}</td><td>{{.Dead}}</td><td>{{len .Inflight}}</td></tr>
+</table>
+{{if .Inflight}}<h3>In flight on this worker</h3>
+<table>
+<tr><th>Task</th><th>Recipients</th><th>Subject</th><th>Running for</th></tr>
+{{range .Inflight}}<tr><td>{{.Task.ID}}</td><td>{{len .Task.Recipients}}</td><td>{{.Task.Subject}}</td><td>{{since .Started}}</td></tr>{{end}}
+</table>{{end}}
+<h3>Recent failures</h3>
+{{template "letters" (dict "Letters" .Failures "Queue" .Queue "CSRF" $.CSRF "Back" "/admin/")}}
+<p><a href="/admin/dead?queue={{.Queue}}">Browse all {{.Dead}} dead letters</a></p>
+<h3>Sends by template</h3>
+<table>
+<tr><th>Template</th><th>Sent</th></tr>
+{{range .Volumes}}<tr><td>{{.Template}}</td><td>{{.Sent}}</td></tr>{{else}}<tr><td colspan="2">Nothing sent yet.</td></tr>{{end}}
+</table>
+{{end}}</body></html>{{end}}
+
+{{define "dead"}}{{template "header"}}
+<h2>Dead letters in {{.Queue}}</h2>
+<p>{{.Total}} dead letters, newest first.
+{{with .Previous}}<a href="/admin/dead?queue={{$.Queue}}&offset={{.}}">Newer</a>{{end}}
+{{with .Next}}<a href="/admin/dead?queue={{$.Queue}}&offset={{.}}">Older</a>{{end}}</p>
+{{template "letters" (dict "Letters" .Letters "Queue" .Queue "CSRF" .CSRF "Back" (printf "/admin/dead?queue=%s&offset=%d" (urlquery .Queue) .Offset))}}
+</body></html>{{end}}
+`
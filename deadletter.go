@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// deadLetter is an entry in the dead letter list: a task that won't be
+// retried, with why it failed. Payloads rejected before being decoded are
+// kept as they were received in Payload, base64 encoded if they aren't
+// JSON.
+type deadLetter struct {
+	Task     Mail            `json:"task"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Reason   string          `json:"reason"`
+	FailedAt time.Time       `json:"failedAt"`
+}
+
+// deadLetters is the list at <queue>:dead holding failed tasks for
+// inspection and replay. Like tasks, entries are encrypted when
+// PAYLOAD_KEYS is set.
+type deadLetters struct {
+	rdb   *redis.Client
+	queue string
+}
+
+func (d *deadLetters) key() string {
+	return d.queue + ":dead"
+}
+
+// add records task as failed for reason, logging rather than returning any
+// error as callers have nothing better to do with the task.
+func (d *deadLetters) add(task Mail, reason string) {
+	if d == nil {
+		return
+	}
+	log.Printf("moving task %s to dead letters: %s", task.ID, reason)
+	d.push(deadLetter{Task: task, Reason: reason, FailedAt: time.Now().UTC()})
+}
+
+// addPayload records a payload that couldn't be accepted as a task.
+func (d *deadLetters) addPayload(task Mail, payload []byte, reason string) {
+	if d == nil {
+		return
+	}
+	log.Printf("moving task %s to dead letters: %s", task.ID, reason)
+	letter := deadLetter{Task: task, Reason: reason, FailedAt: time.Now().UTC()}
+	if json.Valid(payload) {
+		letter.Payload = payload
+	} else {
+		letter.Payload, _ = json.Marshal(payload)
+	}
+	d.push(letter)
+}
+
+func (d *deadLetters) push(letter deadLetter) {
+	body, err := json.Marshal(letter)
+	if err == nil && taskSealer != nil {
+		body, err = taskSealer.seal(body)
+	}
+	if err == nil {
+		err = d.rdb.LPush(ctx, d.key(), body).Err()
+	}
+	if err != nil {
+		log.Print(fmt.Errorf("error recording dead letter for task %s: %w", letter.Task.ID, err))
+	}
+}
+
+// deadLetterEntry is a dead letter read back from the list with the entry
+// as Redis holds it, which identifies it for removal.
+type deadLetterEntry struct {
+	raw    string
+	letter deadLetter
+}
+
+// length returns the number of dead letters.
+func (d *deadLetters) length() (int64, error) {
+	n, err := d.rdb.LLen(ctx, d.key()).Result()
+	if err != nil {
+		return 0, fmt.Errorf("error reading dead letters of %s: %w", d.queue, err)
+	}
+	return n, nil
+}
+
+// list returns up to count dead letters from offset, newest first.
+// Entries that can't be decrypted or decoded are returned with only their
+// reason set to why not.
+func (d *deadLetters) list(offset, count int64) ([]deadLetterEntry, error) {
+	raw, err := d.rdb.LRange(ctx, d.key(), offset, offset+count-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead letters of %s: %w", d.queue, err)
+	}
+	entries := make([]deadLetterEntry, 0, len(raw))
+	for _, r := range raw {
+		entry := deadLetterEntry{raw: r}
+		body, err := taskSealer.open([]byte(r))
+		if err == nil {
+			err = json.Unmarshal(body, &entry.letter)
+		}
+		if err != nil {
+			entry.letter.Reason = fmt.Sprintf("unreadable dead letter: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// requeue removes the dead letter raw from the list and enqueues its task
+// again from the first attempt, after applying rewrite if it isn't nil.
+// Letters holding only a rejected payload are requeued from the payload, if
+// it is JSON.
+func (d *deadLetters) requeue(raw string, rewrite func(*Mail) error) (Mail, error) {
+	var letter deadLetter
+	body, err := taskSealer.open([]byte(raw))
+	if err == nil {
+		err = json.Unmarshal(body, &letter)
+	}
+	if err != nil {
+		return Mail{}, fmt.Errorf("error reading dead letter: %w", err)
+	}
+	task := letter.Task
+	if len(letter.Payload) > 0 {
+		task = Mail{}
+		if err := json.Unmarshal(letter.Payload, &task); err != nil {
+			return Mail{}, fmt.Errorf("dead letter for task %s has no task to requeue: %w", letter.Task.ID, err)
+		}
+		if task.ID == "" {
+			task.ID = letter.Task.ID
+		}
+	}
+	task.Attempt = 0
+	if rewrite != nil {
+		if err := rewrite(&task); err != nil {
+			return Mail{}, fmt.Errorf("error rewriting task %s: %w", task.ID, err)
+		}
+	}
+
+	removed, err := d.rdb.LRem(ctx, d.key(), 1, raw).Result()
+	if err != nil {
+		return Mail{}, fmt.Errorf("error removing dead letter for task %s: %w", task.ID, err)
+	}
+	if removed == 0 {
+		return Mail{}, fmt.Errorf("dead letter for task %s is no longer in %s", task.ID, d.key())
+	}
+	if err := enqueue(d.rdb, d.queue, &task); err != nil {
+		d.rdb.LPush(ctx, d.key(), raw)
+		return Mail{}, err
+	}
+	log.Printf("requeued dead letter for task %s", task.ID)
+	return task, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	debugPprofPath = "/debug/pprof/"
+	debugVarsPath  = "/debug/vars"
+)
+
+// diagnostics serves the Go profiler and a snapshot of the worker's
+// runtime state, for working out where memory and goroutines go when the
+// queue backs up. Both are behind DEBUG_TOKEN, since profiles and the
+// command line can give away more than metrics do.
+type diagnostics struct {
+	rdb     *redis.Client
+	tenants []*tenant
+	mx      *mxTransport
+	started time.Time
+}
+
+func (d *diagnostics) register(mux *http.ServeMux, token string) {
+	mux.Handle(debugPprofPath, requireToken(token, http.HandlerFunc(pprof.Index)))
+	mux.Handle(debugPprofPath+"cmdline", requireToken(token, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle(debugPprofPath+"profile", requireToken(token, http.HandlerFunc(pprof.Profile)))
+	mux.Handle(debugPprofPath+"symbol", requireToken(token, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle(debugPprofPath+"trace", requireToken(token, http.HandlerFunc(pprof.Trace)))
+	mux.Handle(debugVarsPath, requireToken(token, http.HandlerFunc(d.vars)))
+}
+
+type debugVars struct {
+	Version    string           `json:"version"`
+	Uptime     string           `json:"uptime"`
+	Goroutines int              `json:"goroutines"`
+	Memory     debugMemory      `json:"memory"`
+	InFlight   map[string]int   `json:"inFlight"`
+	Redis      *redis.PoolStats `json:"redisPool"`
+	// SMTPIdle counts the connections held open for reuse per mail
+	// server, when delivering directly.
+	SMTPIdle map[string]int `json:"smtpIdle,omitempty"`
+}
+
+type debugMemory struct {
+	HeapAlloc    uint64 `json:"heapAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	HeapReleased uint64 `json:"heapReleased"`
+	Sys          uint64 `json:"sys"`
+	NumGC        uint32 `json:"numGC"`
+	LastGC       string `json:"lastGC,omitempty"`
+	PauseTotal   string `json:"pauseTotal"`
+}
+
+func (d *diagnostics) vars(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	vars := debugVars{
+		Version:    workerVersion(),
+		Uptime:     time.Since(d.started).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Memory: debugMemory{
+			HeapAlloc:    mem.HeapAlloc,
+			HeapInuse:    mem.HeapInuse,
+			HeapObjects:  mem.HeapObjects,
+			HeapReleased: mem.HeapReleased,
+			Sys:          mem.Sys,
+			NumGC:        mem.NumGC,
+			PauseTotal:   time.Duration(mem.PauseTotalNs).String(),
+		},
+		InFlight: map[string]int{},
+		Redis:    d.rdb.PoolStats(),
+		SMTPIdle: d.mx.idleCounts(),
+	}
+	if mem.LastGC > 0 {
+		vars.Memory.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+	for _, t := range d.tenants {
+		vars.InFlight[t.queue] = t.inflight.count()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(vars)
+}
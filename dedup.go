@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dedupScript records an occurrence of the task with ID ARGV[1] in the hash
+// at KEYS[1], which expires after ARGV[2] milliseconds. It returns 1 for the
+// first occurrence, 2 for the same task coming back, as it does when deferred
+// or retried, and 0 for a duplicate, which it counts.
+var dedupScript = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], "id", ARGV[1]) == 1 then
+	redis.call("HSET", KEYS[1], "count", 1)
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if redis.call("HGET", KEYS[1], "id") == ARGV[1] then
+	return 2
+end
+redis.call("HINCRBY", KEYS[1], "count", 1)
+return 0
+`)
+
+// deduplicator collapses identical tasks, by subject, body and recipients,
+// arriving within window of each other into a single send. Occurrences are
+// counted at <queue>:dedup:<content hash>, along with the ID of the first,
+// which is let through again when it comes back from a deferral, a retry or
+// a replay. When annotating, the first occurrence is held in the scheduled
+// set until the window closes and then sent with the number of occurrences
+// added to its subject.
+type deduplicator struct {
+	rdb       *redis.Client
+	queue     string
+	window    time.Duration
+	annotate  bool
+	scheduler *scheduler
+}
+
+func (d *deduplicator) key(hash string) string {
+	return d.queue + ":dedup:" + hash
+}
+
+// admit reports whether task should be sent now. Duplicates are counted and
+// dropped, and held tasks parked; in both cases admit returns false.
+func (d *deduplicator) admit(task *Mail) (bool, error) {
+	if d == nil || d.window <= 0 {
+		return true, nil
+	}
+	if task.CollapseKey != "" {
+		return true, d.release(task)
+	}
+	if task.Attempt > 0 {
+		// A retry was admitted when first taken.
+		return true, nil
+	}
+
+	hash, err := contentHash(*task)
+	if err != nil {
+		return true, err
+	}
+	key := d.key(hash)
+	ttl := d.window
+	if d.annotate {
+		// Outlive the window until the held task has collected the count.
+		ttl += time.Minute
+	}
+	seen, err := dedupScript.Run(ctx, d.rdb, []string{key}, task.ID, ttl.Milliseconds()).Int()
+	if err != nil {
+		return true, fmt.Errorf("error checking for duplicate of task %s: %w", task.ID, err)
+	}
+	switch seen {
+	case 0:
+		log.Printf("collapsed task %s into an identical task sent within %s", task.ID, d.window)
+		return false, nil
+	case 2:
+		return true, nil
+	}
+	if !d.annotate {
+		return true, nil
+	}
+	task.CollapseKey = hash
+	if err := d.scheduler.schedule(*task, time.Now().Add(d.window)); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// release annotates a held task with the number of times it occurred.
+func (d *deduplicator) release(task *Mail) error {
+	key := d.key(task.CollapseKey)
+	task.CollapseKey = ""
+	pipe := d.rdb.TxPipeline()
+	get := pipe.HGet(ctx, key, "count")
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return fmt.Errorf("error reading duplicate count of task %s: %w", task.ID, err)
+	}
+	if n, _ := get.Int(); n > 1 {
+		task.Subject = fmt.Sprintf("%s (occurred %d times)", task.Subject, n)
+	}
+	return nil
+}
+
+// contentHash identifies a task by what its recipients would receive.
+func contentHash(task Mail) (string, error) {
+	recipients := append([]string(nil), task.Recipients...)
+	for i, r := range recipients {
+		recipients[i] = strings.ToLower(strings.TrimSpace(r))
+	}
+	sort.Strings(recipients)
+	// Map keys are marshalled in sorted order, so equal data hashes equally.
+	data, err := json.Marshal(task.Data)
+	if err != nil {
+		return "", fmt.Errorf("error hashing task %s: %w", task.ID, err)
+	}
+	h := sha256.New()
+	for _, field := range []string{task.Subject, task.Message, task.Template, string(data), strings.Join(recipients, "\n")} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicatorAdmit(t *testing.T) {
+	task := func(id string, attempt int) *Mail {
+		return &Mail{ID: id, Attempt: attempt, Subject: "Alert", Message: "Disk full", Recipients: []string{"ops@example.com"}}
+	}
+	tests := []struct {
+		name  string
+		tasks []*Mail
+		want  []bool
+	}{
+		{"first", []*Mail{task("a", 0)}, []bool{true}},
+		{"duplicate", []*Mail{task("a", 0), task("b", 0)}, []bool{true, false}},
+		{"same task deferred", []*Mail{task("a", 0), task("a", 0)}, []bool{true, true}},
+		{"retry", []*Mail{task("a", 0), task("a", 1)}, []bool{true, true}},
+		{"duplicate after retry", []*Mail{task("a", 0), task("a", 1), task("c", 0)}, []bool{true, true, false}},
+		{"other content", []*Mail{task("a", 0), {ID: "d", Subject: "Other", Recipients: []string{"ops@example.com"}}}, []bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &deduplicator{rdb: newTestRedis(t), queue: "tasks", window: time.Minute}
+			for i, task := range tt.tasks {
+				send, err := d.admit(task)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if send != tt.want[i] {
+					t.Errorf("admit(task %d, %s) = %v, want %v", i, task.ID, send, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	base := Mail{ID: "a", Subject: "s", Message: "m", Recipients: []string{"A@example.com", "b@example.com"}, Data: map[string]interface{}{"x": 1.0, "y": "z"}}
+	tests := []struct {
+		name  string
+		other Mail
+		equal bool
+	}{
+		{"other ID", Mail{ID: "b", Subject: "s", Message: "m", Recipients: []string{"A@example.com", "b@example.com"}, Data: map[string]interface{}{"y": "z", "x": 1.0}}, true},
+		{"recipient order and case", Mail{Subject: "s", Message: "m", Recipients: []string{" b@example.com", "a@example.com"}, Data: map[string]interface{}{"x": 1.0, "y": "z"}}, true},
+		{"subject", Mail{Subject: "t", Message: "m", Recipients: []string{"a@example.com", "b@example.com"}, Data: map[string]interface{}{"x": 1.0, "y": "z"}}, false},
+		{"data", Mail{Subject: "s", Message: "m", Recipients: []string{"a@example.com", "b@example.com"}, Data: map[string]interface{}{"x": 2.0, "y": "z"}}, false},
+		{"fields run together", Mail{Subject: "sm", Recipients: []string{"a@example.com", "b@example.com"}, Data: map[string]interface{}{"x": 1.0, "y": "z"}}, false},
+	}
+	want, err := contentHash(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := contentHash(tt.other)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.equal {
+				t.Errorf("contentHash equal = %v, want %v", got == want, tt.equal)
+			}
+		})
+	}
+}
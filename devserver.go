@@ -0,0 +1,248 @@
+//go:build devserver
+// +build devserver
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+const (
+	devMessagesPath    = "/messages"
+	defaultDevKeep     = 100
+	devMaxMessageBytes = 50 << 20
+)
+
+// devMessage is a message the development server accepted.
+type devMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Subject  string    `json:"subject"`
+	Size     int       `json:"size"`
+	Received time.Time `json:"received"`
+	raw      []byte
+}
+
+// devMailbox keeps the last messages the development server accepted.
+type devMailbox struct {
+	mu       sync.Mutex
+	keep     int
+	messages []devMessage
+}
+
+func (b *devMailbox) add(m devMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = append(b.messages, m)
+	if len(b.messages) > b.keep {
+		b.messages = b.messages[len(b.messages)-b.keep:]
+	}
+}
+
+func (b *devMailbox) list() []devMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]devMessage{}, b.messages...)
+}
+
+func (b *devMailbox) get(id string) (devMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.messages {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return devMessage{}, false
+}
+
+func (b *devMailbox) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = nil
+}
+
+// ServeHTTP lists the messages at /messages, newest last, serves one with
+// its headers and body at /messages/<id>, and clears them on DELETE.
+func (b *devMailbox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, devMessagesPath), "/")
+	switch {
+	case r.Method == http.MethodDelete && id == "":
+		b.clear()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.list())
+	default:
+		m, ok := b.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Write(m.raw)
+	}
+}
+
+// devBackend accepts mail from anyone, with or without credentials, except
+// to recipients containing one of the reject or deferred strings, who are
+// refused with a 550 or 451 so that producers can see failures through.
+type devBackend struct {
+	box            *devMailbox
+	reject, deferr []string
+	print          bool
+}
+
+func (be *devBackend) Login(state *gosmtp.ConnectionState, username, password string) (gosmtp.Session, error) {
+	return &devSession{backend: be}, nil
+}
+
+func (be *devBackend) AnonymousLogin(state *gosmtp.ConnectionState) (gosmtp.Session, error) {
+	return &devSession{backend: be}, nil
+}
+
+type devSession struct {
+	backend *devBackend
+	from    string
+	to      []string
+}
+
+func (s *devSession) Reset() {
+	s.from, s.to = "", nil
+}
+
+func (s *devSession) Logout() error {
+	return nil
+}
+
+func (s *devSession) Mail(from string, opts gosmtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *devSession) Rcpt(to string) error {
+	for _, r := range s.backend.reject {
+		if strings.Contains(to, r) {
+			return &gosmtp.SMTPError{Code: 550, EnhancedCode: gosmtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+		}
+	}
+	for _, d := range s.backend.deferr {
+		if strings.Contains(to, d) {
+			return &gosmtp.SMTPError{Code: 451, EnhancedCode: gosmtp.EnhancedCode{4, 3, 0}, Message: "try again later"}
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *devSession) Data(r io.Reader) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m := devMessage{ID: newTaskID(), From: s.from, To: s.to, Size: len(raw), Received: time.Now().UTC(), raw: raw}
+	if parsed, err := netmail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		subject := parsed.Header.Get("Subject")
+		if m.Subject, err = new(mime.WordDecoder).DecodeHeader(subject); err != nil {
+			m.Subject = subject
+		}
+	}
+	s.backend.box.add(m)
+	log.Printf("received message %s from %s to %s: %q", m.ID, m.From, strings.Join(m.To, ", "), m.Subject)
+	if s.backend.print {
+		os.Stdout.Write(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")))
+		fmt.Println()
+	}
+	return nil
+}
+
+// runDevserver runs a fake SMTP server, and optionally an in-memory Redis,
+// for developing producers against a local worker without a real relay.
+// Accepted messages are logged and kept for inspection over HTTP. It is
+// only built with the devserver tag, keeping its servers out of the worker.
+func runDevserver(args []string) error {
+	fs := flag.NewFlagSet("devserver", flag.ExitOnError)
+	smtpAddr := fs.String("smtp", "127.0.0.1:2525", "address to accept SMTP on")
+	httpAddr := fs.String("http", "127.0.0.1:8025", "address to serve received messages on, or empty for none")
+	redisAddr := fs.String("redis", "", "address to run an in-memory Redis on, or empty for none")
+	reject := fs.String("reject", "", "comma-separated strings; recipients containing one are rejected with 550")
+	deferred := fs.String("defer", "", "comma-separated strings; recipients containing one are deferred with 451")
+	keep := fs.Int("keep", defaultDevKeep, "number of messages to keep")
+	printMessages := fs.Bool("print", false, "print each message received")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keep <= 0 {
+		return fmt.Errorf("invalid -keep %d: must be positive", *keep)
+	}
+
+	box := &devMailbox{keep: *keep}
+	backend := &devBackend{box: box, reject: splitList(*reject), deferr: splitList(*deferred), print: *printMessages}
+	srv := gosmtp.NewServer(backend)
+	srv.Addr = *smtpAddr
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	srv.EnableSMTPUTF8 = true
+	srv.MaxMessageBytes = devMaxMessageBytes
+	errs := make(chan error, 2)
+	go func() { errs <- srv.ListenAndServe() }()
+	defer srv.Close()
+	log.Printf("accepting SMTP on %s", *smtpAddr)
+
+	if *redisAddr != "" {
+		rdb := miniredis.NewMiniRedis()
+		if err := rdb.StartAddr(*redisAddr); err != nil {
+			return fmt.Errorf("error starting Redis: %w", err)
+		}
+		defer rdb.Close()
+		log.Printf("running an in-memory Redis on %s", rdb.Addr())
+	}
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle(devMessagesPath, box)
+		mux.Handle(devMessagesPath+"/", box)
+		web := &http.Server{Addr: *httpAddr, Handler: mux}
+		go func() { errs <- web.ListenAndServe() }()
+		defer web.Close()
+		log.Printf("serving received messages at http://%s%s", *httpAddr, devMessagesPath)
+	}
+
+	host, port, err := net.SplitHostPort(*smtpAddr)
+	if err != nil {
+		return fmt.Errorf("invalid -smtp address: %w", err)
+	}
+	fmt.Printf("point a worker here with:\n  %s=%s %s=%s", smtpHostKey, host, smtpPortKey, port)
+	if *redisAddr != "" {
+		fmt.Printf(" %s=%s", redisAddressKey, *redisAddr)
+	}
+	fmt.Println()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt)
+	select {
+	case <-sigchan:
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
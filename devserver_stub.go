@@ -0,0 +1,11 @@
+//go:build !devserver
+// +build !devserver
+
+package main
+
+import "errors"
+
+// runDevserver is built with the devserver tag; see devserver.go.
+func runDevserver(args []string) error {
+	return errors.New("devserver is not built into this binary: build with -tags devserver")
+}
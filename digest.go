@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const defaultDigestInterval = 15 * time.Minute
+
+// takeDigestScript moves everything buffered for a recipient from KEYS[1]
+// to the end of KEYS[2], where it stays until their digest is enqueued, and
+// returns KEYS[2], which starts with anything a failed flush left there.
+var takeDigestScript = redis.NewScript(`
+while true do
+	local item = redis.call("LPOP", KEYS[1])
+	if not item then
+		break
+	end
+	redis.call("RPUSH", KEYS[2], item)
+end
+return redis.call("LRANGE", KEYS[2], 0, -1)
+`)
+
+// finishDigestScript drops the tasks taken for a recipient's digest from
+// KEYS[2] once it is enqueued, and the recipient ARGV[1] from the set at
+// KEYS[3] unless more has been buffered for them at KEYS[1] meanwhile.
+var finishDigestScript = redis.NewScript(`
+redis.call("DEL", KEYS[2])
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[3], ARGV[1])
+end
+return 0
+`)
+
+// defaultDigestTemplate renders digests when no template is configured.
+var defaultDigestTemplate = template.Must(template.New("digest").Parse(`<p>{{len .items}} notification{{if ne (len .items) 1}}s{{end}} since the last digest:</p>
+{{range .items}}<div style="border-top:1px solid #ddd;padding:0.5em 0">
+<p><strong>{{.subject}}</strong></p>
+{{.body}}
+</div>{{end}}
+`))
+
+// digester buffers digest tasks per recipient at <queue>:digest:<hash>,
+// keyed by the addressHash of each recipient, and periodically enqueues a
+// single email to each recipient aggregating them. The digest template
+// receives the buffered tasks as .items, each with its subject, message,
+// template, data and id.
+type digester struct {
+	rdb      *redis.Client
+	queue    string
+	interval time.Duration
+	template string
+}
+
+func (d *digester) recipientsKey() string {
+	return d.queue + ":digest:recipients"
+}
+
+func (d *digester) key(hash string) string {
+	return d.queue + ":digest:" + hash
+}
+
+// add buffers task for each of its recipients.
+func (d *digester) add(task Mail) error {
+	recipients, err := parseRecipients(task.Recipients)
+	if err != nil {
+		return err
+	}
+	pipe := d.rdb.TxPipeline()
+	for _, r := range recipients {
+		item := task
+		item.Recipients = []string{r.String()}
+		body, err := marshalTask(item)
+		if err != nil {
+			return fmt.Errorf("error marshalling task %s: %w", task.ID, err)
+		}
+		hash := addressHash(r.Address)
+		pipe.RPush(ctx, d.key(hash), body)
+		pipe.SAdd(ctx, d.recipientsKey(), hash)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error buffering digest task %s: %w", task.ID, err)
+	}
+	return nil
+}
+
+// run flushes the digests every interval until the process exits or stop
+// is closed, while leader leads, so that replicas don't each flush on their
+// own schedule.
+func (d *digester) run(leader *leaderElection, stop <-chan struct{}) {
+	tick := time.NewTicker(d.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			return
+		}
+		if !leader.leader() {
+			continue
+		}
+		if err := d.flush(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// flush enqueues a digest for every recipient with buffered tasks.
+func (d *digester) flush() error {
+	recipients, err := d.rdb.SMembers(ctx, d.recipientsKey()).Result()
+	if err != nil {
+		return fmt.Errorf("error listing digest recipients: %w", err)
+	}
+	for _, r := range recipients {
+		keys := []string{d.key(r), d.key(r) + ":flushing", d.recipientsKey()}
+		raw, err := takeDigestScript.Run(ctx, d.rdb, keys[:2]).StringSlice()
+		if err != nil {
+			return fmt.Errorf("error reading digest for %s: %w", r, err)
+		}
+		// The tasks taken are only dropped once their digest is enqueued,
+		// so that a failed enqueue leaves them for the next flush. Tasks
+		// that can't be built into a digest are dropped, as they would
+		// fail again.
+		if len(raw) > 0 {
+			task, err := d.build(raw)
+			if err != nil {
+				log.Printf("error building digest for %s: %v", r, err)
+			} else if err := enqueue(d.rdb, d.queue, &task); err != nil {
+				return err
+			} else {
+				log.Printf("enqueued digest %s of %d tasks", task.ID, len(raw))
+			}
+		}
+		if err := finishDigestScript.Run(ctx, d.rdb, keys, r).Err(); err != nil {
+			return fmt.Errorf("error finishing digest for %s: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// build aggregates buffered tasks into a single digest email.
+func (d *digester) build(raw []string) (Mail, error) {
+	items := make([]interface{}, 0, len(raw))
+	var first Mail
+	for i, body := range raw {
+		var item Mail
+		if err := unmarshalTask([]byte(body), &item); err != nil {
+			return Mail{}, fmt.Errorf("error unmarshalling digest task: %w", err)
+		}
+		if i == 0 {
+			first = item
+		}
+		items = append(items, map[string]interface{}{
+			"id":       item.ID,
+			"subject":  item.Subject,
+			"message":  item.Message,
+			"template": item.Template,
+			"data":     item.Data,
+		})
+	}
+
+	task := Mail{
+		Subject:    fmt.Sprintf("%d notifications", len(raw)),
+		Recipients: first.Recipients,
+		From:       first.From,
+		Identity:   first.Identity,
+		Locale:     first.Locale,
+	}
+	if len(raw) == 1 {
+		task.Subject = first.Subject
+	}
+	if d.template != "" {
+		task.Template = d.template
+		task.Data = map[string]interface{}{"items": items}
+		return task, nil
+	}
+
+	// The built-in digest embeds each task's message as it was sent.
+	for _, item := range items {
+		fields := item.(map[string]interface{})
+		fields["body"] = template.HTML(fields["message"].(string))
+	}
+	var buf bytes.Buffer
+	if err := defaultDigestTemplate.Execute(&buf, map[string]interface{}{"items": items}); err != nil {
+		return Mail{}, err
+	}
+	task.Message = buf.String()
+	return task, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb
+}
+
+func TestDigesterFlush(t *testing.T) {
+	rdb := newTestRedis(t)
+	d := &digester{rdb: rdb, queue: "tasks"}
+	for _, task := range []Mail{
+		{ID: "n1", Subject: "First", Message: "<p>one</p>", Recipients: []string{"Ada <Ada@example.com>"}},
+		{ID: "n2", Subject: "Second", Message: "<p>two</p>", Recipients: []string{"ada@example.com", "bob@example.com"}},
+	} {
+		if err := d.add(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, _ := rdb.Keys(ctx, "*").Result()
+	for _, key := range keys {
+		if strings.Contains(strings.ToLower(key), "example.com") {
+			t.Errorf("key %s names a recipient", key)
+		}
+	}
+	if err := d.flush(); err != nil {
+		t.Fatal(err)
+	}
+	digests := map[string]Mail{}
+	for {
+		body, err := rdb.RPop(ctx, "tasks").Result()
+		if err != nil {
+			break
+		}
+		var task Mail
+		if err := json.Unmarshal([]byte(body), &task); err != nil {
+			t.Fatal(err)
+		}
+		address, err := netmail.ParseAddress(task.Recipients[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[strings.ToLower(address.Address)] = task
+	}
+	// Addresses differing only in case share a digest.
+	tests := []struct {
+		recipient, subject string
+	}{
+		{"ada@example.com", "2 notifications"},
+		{"bob@example.com", "Second"},
+	}
+	if len(digests) != len(tests) {
+		t.Errorf("flushed %d digests, want %d", len(digests), len(tests))
+	}
+	for _, tt := range tests {
+		if got := digests[tt.recipient]; got.Subject != tt.subject {
+			t.Errorf("digest to %s has subject %q, want %q", tt.recipient, got.Subject, tt.subject)
+		}
+	}
+}
+
+func TestDigesterFlushFailure(t *testing.T) {
+	rdb := newTestRedis(t)
+	d := &digester{rdb: rdb, queue: "tasks"}
+	add := func(id string) {
+		if err := d.add(Mail{ID: id, Subject: id, Message: "<p>" + id + "</p>", Recipients: []string{"ada@example.com"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("n1")
+	// A queue that isn't a list makes enqueuing fail.
+	rdb.Set(ctx, "tasks", "not a list", 0)
+	if err := d.flush(); err == nil {
+		t.Fatal("flush() enqueued onto a queue that isn't a list")
+	}
+	add("n2")
+	rdb.Del(ctx, "tasks")
+	if err := d.flush(); err != nil {
+		t.Fatal(err)
+	}
+	bodies, _ := rdb.LRange(ctx, "tasks", 0, -1).Result()
+	if len(bodies) != 1 {
+		t.Fatalf("flushed %d digests, want 1", len(bodies))
+	}
+	var task Mail
+	if err := json.Unmarshal([]byte(bodies[0]), &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Subject != "2 notifications" || !strings.Contains(task.Message, "n1") || strings.Index(task.Message, "n1") > strings.Index(task.Message, "n2") {
+		t.Errorf("digest %q: %s, want n1 then n2", task.Subject, task.Message)
+	}
+	if keys, _ := rdb.Keys(ctx, "tasks:digest:*").Result(); len(keys) != 0 {
+		t.Errorf("keys %v left after the digest was enqueued", keys)
+	}
+}
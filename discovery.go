@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultQueueDiscoveryInterval = 30 * time.Second
+	// queueDiscoveryMisses is how many scans in a row a discovered queue
+	// must be missing from before its consumer stops. Redis deletes lists
+	// once emptied, so a queue caught between tasks looks gone.
+	queueDiscoveryMisses = 3
+
+	discoveredQueuesMetric = "post_room_discovered_queues"
+)
+
+func init() {
+	metrics.describe(discoveredQueuesMetric, "gauge", "Queues matching QUEUE_PATTERN being consumed.")
+}
+
+// queueDiscovery consumes the lists matching QUEUE_PATTERN, such as
+// tasks:*, besides the worker's configured queues, so that a tenant's
+// queue is served as soon as it is first pushed to. Since other lists can
+// match the pattern too, such as a campaign's recipients, a list is only
+// taken for a queue once marked as one with the key <queue>:queue, set by
+// whoever creates the tenant. It scans for them every interval, starting a
+// consumer and the queue's background loops for each new queue and
+// stopping them once the queue has gone. Discovered queues are sent from
+// with the worker's own configuration. Their campaigns and dead letters
+// are run as for any queue, but aren't served by the HTTP APIs, which only
+// know the configured queues.
+type queueDiscovery struct {
+	rdb      *redis.Client
+	pattern  string
+	interval time.Duration
+	// configured are the queues consumed anyway.
+	configured map[string]bool
+	newTenant  func(queue string) (*tenant, error)
+	// start consumes a tenant's queue until stop is closed.
+	start  func(t *tenant, stop <-chan struct{})
+	queues map[string]*discoveredQueue
+}
+
+// discoveredQueue is a discovered queue's tenant, kept once set up so that
+// a queue coming back is consumed again with the same one.
+type discoveredQueue struct {
+	tenant *tenant
+	// stop is closed to stop the consumer and the queue's loops, and is nil
+	// while stopped.
+	stop   chan struct{}
+	misses int
+}
+
+func newQueueDiscovery(rdb *redis.Client, options AppOptions, tenants []*tenant, newTenant func(string) (*tenant, error), start func(*tenant, <-chan struct{})) *queueDiscovery {
+	configured := map[string]bool{}
+	for _, t := range tenants {
+		configured[t.queue] = true
+	}
+	return &queueDiscovery{
+		rdb:        rdb,
+		pattern:    options.QueuePattern,
+		interval:   options.QueueDiscoveryInterval,
+		configured: configured,
+		newTenant:  newTenant,
+		start:      start,
+		queues:     map[string]*discoveredQueue{},
+	}
+}
+
+func (d *queueDiscovery) run() {
+	for {
+		if found, err := d.scan(); err != nil {
+			log.Printf("error discovering queues: %v", err)
+		} else {
+			d.update(found)
+		}
+		time.Sleep(d.interval)
+	}
+}
+
+// queueMarker is the key marking queue as one to discover.
+func queueMarker(queue string) string {
+	return queue + ":queue"
+}
+
+// scan returns the marked queues with lists matching the pattern, counting
+// a priority list as its queue and leaving out the dead letter and digest
+// lists the worker keeps beside queues. A queue being consumed whose list
+// has gone is still found while it has tasks scheduled, digests buffered
+// or campaigns running, which its loops are yet to push to it.
+func (d *queueDiscovery) scan() (map[string]bool, error) {
+	lists := map[string]bool{}
+	var cursor uint64
+	for {
+		keys, next, err := d.rdb.ScanType(ctx, cursor, d.pattern, 100, "list").Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			key = strings.TrimSuffix(key, priorityQueue(""))
+			if strings.HasSuffix(key, ":dead") || strings.Contains(key, ":digest:") || d.configured[key] {
+				continue
+			}
+			lists[key] = true
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	pipe := d.rdb.Pipeline()
+	marked := map[string]*redis.IntCmd{}
+	for queue := range lists {
+		marked[queue] = pipe.Exists(ctx, queueMarker(queue))
+	}
+	pending := map[string]*redis.IntCmd{}
+	for queue, q := range d.queues {
+		if q.stop != nil && !lists[queue] {
+			t := q.tenant
+			pending[queue] = pipe.Exists(ctx, t.scheduler.key(), t.digests.recipientsKey(), t.campaigns.activeKey())
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for queue, n := range marked {
+		if n.Val() > 0 {
+			found[queue] = true
+		}
+	}
+	for queue, n := range pending {
+		if n.Val() > 0 {
+			found[queue] = true
+		}
+	}
+	return found, nil
+}
+
+func (d *queueDiscovery) update(found map[string]bool) {
+	for queue := range found {
+		q, ok := d.queues[queue]
+		if !ok {
+			t, err := d.newTenant(queue)
+			if err != nil {
+				log.Printf("error setting up discovered queue %s: %v", queue, err)
+				continue
+			}
+			q = &discoveredQueue{tenant: t}
+			d.queues[queue] = q
+		}
+		q.misses = 0
+		if q.stop == nil {
+			log.Printf("consuming discovered queue %s", queue)
+			q.stop = make(chan struct{})
+			d.start(q.tenant, q.stop)
+		}
+	}
+	running := 0
+	for queue, q := range d.queues {
+		if q.stop != nil && !found[queue] {
+			if q.misses++; q.misses >= queueDiscoveryMisses {
+				log.Printf("discovered queue %s is gone, no longer consuming it", queue)
+				close(q.stop)
+				q.stop = nil
+			}
+		}
+		if q.stop != nil {
+			running++
+		}
+	}
+	metrics.set(discoveredQueuesMetric, float64(running))
+}
+
+// closed reports whether ch is closed. A nil channel never is.
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueDiscoveryScan(t *testing.T) {
+	rdb := newTestRedis(t)
+	for _, list := range []string{"tasks", "tasks:acme", "tasks:acme:dead", (&digester{queue: "tasks:acme"}).key(addressHash("a@example.com")), "tasks:beta:priority", "tasks:spring-recipients"} {
+		rdb.LPush(ctx, list, "x")
+	}
+	for _, queue := range []string{"tasks:acme", "tasks:beta"} {
+		rdb.Set(ctx, queueMarker(queue), "1", 0)
+	}
+	d := newQueueDiscovery(rdb, AppOptions{QueuePattern: "tasks:*"}, []*tenant{{queue: "tasks"}}, nil, nil)
+	// A queue being consumed, whose list is gone but which has tasks
+	// scheduled, and one that has nothing left.
+	for _, queue := range []string{"tasks:gamma", "tasks:delta"} {
+		d.queues[queue] = &discoveredQueue{
+			tenant: &tenant{queue: queue, scheduler: newScheduler(rdb, queue), digests: &digester{queue: queue}, campaigns: newCampaignManager(rdb, queue)},
+			stop:   make(chan struct{}),
+		}
+	}
+	if err := newScheduler(rdb, "tasks:gamma").schedule(Mail{ID: "later"}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := d.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for queue := range found {
+		got = append(got, queue)
+	}
+	sort.Strings(got)
+	if want := "tasks:acme,tasks:beta,tasks:gamma"; strings.Join(got, ",") != want {
+		t.Errorf("scan() = %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// dkimHeaderKeys are the header fields covered by DKIM signatures.
+var dkimHeaderKeys = []string{"From", "To", "Subject", "Date", "Message-ID", "Reply-To", "MIME-Version", "Content-Type"}
+
+// dkimSigner adds a DKIM-Signature header to outgoing messages for a domain.
+type dkimSigner struct {
+	domain, selector string
+	key              crypto.Signer
+}
+
+// loadDKIMSigner reads a PEM-encoded RSA or Ed25519 private key from path.
+func loadDKIMSigner(domain, selector, path string) (*dkimSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading DKIM key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("error parsing DKIM key %s: no PEM data", path)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("error parsing DKIM key %s: %w", path, err)
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return &dkimSigner{domain: domain, selector: selector, key: signer}, nil
+}
+
+// sign returns message with a DKIM-Signature header prepended, using relaxed
+// canonicalization so relays rewrapping headers don't break the signature.
+func (s *dkimSigner) sign(message []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, bytes.NewReader(message), &dkim.SignOptions{
+		Domain:                 s.domain,
+		Selector:               s.selector,
+		Signer:                 s.key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaderKeys,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error signing message with DKIM: %w", err)
+	}
+	return signed.Bytes(), nil
+}
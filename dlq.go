@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const dlqReplayPath = "/dlq/replay"
+
+// Dead letters fall into an error class: invalid for payloads rejected
+// before being sent, transient for sends that ran out of retries and
+// permanent for those refused outright. They also match the SMTP reply
+// codes in their reason, such as 550 or 5.1.1.
+const (
+	errorClassInvalid   = "invalid"
+	errorClassTransient = "transient"
+	errorClassPermanent = "permanent"
+)
+
+var replyCodePattern = regexp.MustCompile(`\b([245]\d\d|[245]\.\d{1,3}\.\d{1,3})\b`)
+
+// errorClasses returns the class of a dead letter followed by the reply
+// codes in its reason.
+func errorClasses(letter deadLetter) []string {
+	class := errorClassPermanent
+	switch {
+	case len(letter.Payload) > 0 || strings.HasPrefix(letter.Reason, "invalid task"):
+		class = errorClassInvalid
+	case strings.HasPrefix(letter.Reason, "giving up after"):
+		class = errorClassTransient
+	}
+	return append([]string{class}, replyCodePattern.FindAllString(letter.Reason, -1)...)
+}
+
+// replayFilter selects dead letters to replay; empty fields match
+// everything. ErrorClasses match a letter's class or a prefix of one of its
+// reply codes, and Domains the domain of any of its recipients.
+type replayFilter struct {
+	Since        time.Time `json:"since"`
+	Until        time.Time `json:"until"`
+	ErrorClasses []string  `json:"errorClasses"`
+	Domains      []string  `json:"domains"`
+}
+
+func (f replayFilter) match(letter deadLetter) bool {
+	if !f.Since.IsZero() && letter.FailedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !letter.FailedAt.Before(f.Until) {
+		return false
+	}
+	if len(f.ErrorClasses) > 0 && !matchErrorClass(f.ErrorClasses, errorClasses(letter)) {
+		return false
+	}
+	if len(f.Domains) > 0 && !matchDomain(f.Domains, letter.Task.Recipients) {
+		return false
+	}
+	return true
+}
+
+func matchErrorClass(wanted, classes []string) bool {
+	for _, w := range wanted {
+		w = strings.ToLower(w)
+		for i, c := range classes {
+			if c == w || (i > 0 && strings.HasPrefix(c, w)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDomain(domains, recipients []string) bool {
+	for _, r := range recipients {
+		address, err := netmail.ParseAddress(r)
+		if err != nil {
+			continue
+		}
+		for _, d := range domains {
+			if strings.EqualFold(addressDomain(address), strings.TrimPrefix(d, "@")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// taskRewrite sets top-level task fields, by their JSON names, before a
+// dead letter is requeued.
+type taskRewrite map[string]json.RawMessage
+
+// parseRewrite reads field=value settings. Values that aren't JSON are
+// taken as strings, so from=noreply@example.com needs no quoting.
+func parseRewrite(settings []string) (taskRewrite, error) {
+	rewrite := taskRewrite{}
+	for _, s := range settings {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid rewrite %q: use field=value", s)
+		}
+		field, value := s[:eq], s[eq+1:]
+		if json.Valid([]byte(value)) {
+			rewrite[field] = json.RawMessage(value)
+		} else {
+			rewrite[field], _ = json.Marshal(value)
+		}
+	}
+	return rewrite, nil
+}
+
+// apply rewrites task, rejecting the result if it isn't a valid task.
+func (r taskRewrite) apply(task *Mail, validator *taskValidator) error {
+	if len(r) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+	for field, value := range r {
+		if string(value) == "null" {
+			delete(fields, field)
+		} else {
+			fields[field] = value
+		}
+	}
+	if body, err = json.Marshal(fields); err != nil {
+		return err
+	}
+	if err := validator.validate(body); err != nil {
+		return err
+	}
+	rewritten := Mail{}
+	if err := json.Unmarshal(body, &rewritten); err != nil {
+		return err
+	}
+	*task = rewritten
+	return nil
+}
+
+// replayResult reports the dead letters a replay matched and the tasks it
+// requeued, which is none of them on a dry run.
+type replayResult struct {
+	Matched  int      `json:"matched"`
+	Requeued []string `json:"requeued"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// replay requeues the dead letters matching filter, oldest first. Letters
+// that fail again while the replay runs aren't replayed twice.
+func (d *deadLetters) replay(filter replayFilter, rewrite taskRewrite, validator *taskValidator, dryRun bool) (replayResult, error) {
+	result := replayResult{Requeued: []string{}}
+	total, err := d.length()
+	if err != nil {
+		return result, err
+	}
+	entries, err := d.list(0, total)
+	if err != nil {
+		return result, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !filter.match(e.letter) {
+			continue
+		}
+		result.Matched++
+		if dryRun {
+			continue
+		}
+		task, err := d.requeue(e.raw, func(task *Mail) error { return rewrite.apply(task, validator) })
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.Requeued = append(result.Requeued, task.ID)
+	}
+	return result, nil
+}
+
+// dlqAPI serves POST /dlq/replay, replaying the dead letters of a queue
+// matching a replayRequest.
+type dlqAPI struct {
+	rdb          *redis.Client
+	queues       map[string]bool
+	defaultQueue string
+	validator    *taskValidator
+}
+
+type replayRequest struct {
+	Queue string `json:"queue"`
+	replayFilter
+	Set    taskRewrite `json:"set"`
+	DryRun bool        `json:"dryRun"`
+}
+
+func (a *dlqAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := replayRequest{Queue: a.defaultQueue}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !a.queues[req.Queue] {
+		http.Error(w, fmt.Sprintf("unknown queue %q", req.Queue), http.StatusNotFound)
+		return
+	}
+	dead := &deadLetters{rdb: a.rdb, queue: req.Queue}
+	result, err := dead.replay(req.replayFilter, req.Set, a.validator, req.DryRun)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error replaying dead letters", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("replayed %d of %d matching dead letters in %s", len(result.Requeued), result.Matched, req.Queue)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// listFlag collects a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runDLQ runs the dlq subcommands; replay is the only one.
+func runDLQ(args []string) error {
+	if len(args) == 0 || args[0] != "replay" {
+		return fmt.Errorf("usage: dlq replay [flags]")
+	}
+	fs := flag.NewFlagSet("dlq replay", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue whose dead letters to replay (default tasks)")
+	since := fs.String("since", "", "earliest failure time, as a date or RFC 3339 time")
+	until := fs.String("until", "", "latest failure time (exclusive), as a date or RFC 3339 time")
+	classes := fs.String("error-class", "", "comma-separated error classes (invalid, transient, permanent) or SMTP codes such as 550 or 5.1")
+	domains := fs.String("domain", "", "comma-separated recipient domains")
+	dryRun := fs.Bool("dry-run", false, "count the matching dead letters without requeueing them")
+	var set listFlag
+	fs.Var(&set, "set", "field=value to set on each task before requeueing; repeatable")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	filter := replayFilter{ErrorClasses: splitList(*classes), Domains: splitList(*domains)}
+	var err error
+	if filter.Since, err = parseHistoryTime(*since); err != nil {
+		return fmt.Errorf("invalid since: %w", err)
+	}
+	if filter.Until, err = parseHistoryTime(*until); err != nil {
+		return fmt.Errorf("invalid until: %w", err)
+	}
+	rewrite, err := parseRewrite(set)
+	if err != nil {
+		return err
+	}
+	validator, err := newTaskValidator()
+	if err != nil {
+		return err
+	}
+
+	// Requeued tasks are sealed and signed as the worker expects.
+	if err := protectPayloadsFromEnvironment(); err != nil {
+		return err
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	dead := &deadLetters{rdb: rdb, queue: *queue}
+	result, err := dead.replay(filter, rewrite, validator, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, id := range result.Requeued {
+		fmt.Println(id)
+	}
+	for _, e := range result.Errors {
+		log.Print(e)
+	}
+	if *dryRun {
+		log.Printf("%d dead letters match", result.Matched)
+	} else {
+		log.Printf("requeued %d of %d matching dead letters", len(result.Requeued), result.Matched)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	renderPDF  = "pdf"
+	renderCSV  = "csv"
+	renderXLSX = "xlsx"
+
+	pdfRenderTimeout = time.Minute
+)
+
+// pdfRenderer converts HTML to PDF for attachments rendered from templates,
+// such as receipts and invoices. It is pluggable through PDF_RENDERER: an
+// http(s) URL is sent the HTML in a POST and answers with the PDF, and
+// anything else is a command, such as "wkhtmltopdf --quiet - -", reading
+// the HTML on stdin and writing the PDF to stdout. Renderers load the
+// images, stylesheets and other URLs the HTML refers to, which come from the
+// task, so they should run where they can't reach anything private and
+// without access to local files, as with wkhtmltopdf's
+// --disable-local-file-access.
+type pdfRenderer struct {
+	url     string
+	command []string
+	client  *http.Client
+}
+
+func newPDFRenderer(renderer string) *pdfRenderer {
+	if renderer == "" {
+		return nil
+	}
+	if strings.HasPrefix(renderer, "http://") || strings.HasPrefix(renderer, "https://") {
+		return &pdfRenderer{url: renderer, client: &http.Client{Timeout: pdfRenderTimeout}}
+	}
+	return &pdfRenderer{command: strings.Fields(renderer)}
+}
+
+func (r *pdfRenderer) render(html string) ([]byte, error) {
+	c, cancel := context.WithTimeout(ctx, pdfRenderTimeout)
+	defer cancel()
+	if r.url != "" {
+		req, err := http.NewRequestWithContext(c, http.MethodPost, r.url, strings.NewReader(html))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/html; charset=utf-8")
+		res, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("PDF renderer answered %s", res.Status)
+		}
+		return io.ReadAll(res.Body)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(c, r.command[0], r.command[1:]...)
+	cmd.Stdin = strings.NewReader(html)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// renderAttachments returns the task's attachments with the content of
+// those it describes rather than carries produced: those rendered from a
+// template, as HTML or converted to PDF, and CSV and XLSX files written from
+// the task's rows or a list in its data. The task's own attachments, which
+// the copies personalized for other recipients share, are left as they are.
+// Errors in the task are permanent, and the renderer's transient.
+func (m Mailer) renderAttachments(mail Mail) ([]Attachment, error) {
+	var attachments []Attachment
+	for i, a := range mail.Attachments {
+		if a.Template == "" && a.Render == "" {
+			continue
+		}
+		if attachments == nil {
+			attachments = append([]Attachment(nil), mail.Attachments...)
+		}
+		if err := m.renderAttachment(mail, &a); err != nil {
+			return nil, fmt.Errorf("error rendering attachment %s: %w", a.Filename, err)
+		}
+		a.Template, a.Render, a.Data, a.Columns, a.Rows = "", "", "", nil, nil
+		attachments[i] = a
+	}
+	if attachments == nil {
+		return mail.Attachments, nil
+	}
+	return attachments, nil
+}
+
+func (m Mailer) renderAttachment(mail Mail, a *Attachment) error {
+	html := string(a.Content)
+	if a.Template != "" {
+		page := mail
+		page.Template, page.TemplateVersion = a.Template, ""
+		var err error
+		if html, err = m.renderTemplate(page); err != nil {
+			return permanent(err)
+		}
+	}
+	switch a.Render {
+	case "":
+		a.Content = []byte(html)
+		if a.ContentType == "" {
+			a.ContentType = "text/html; charset=utf-8"
+		}
+	case renderPDF:
+		if m.pdf == nil {
+			return permanent(fmt.Errorf("no PDF renderer is configured with %s", pdfRendererKey))
+		}
+		content, err := m.pdf.render(html)
+		if err != nil {
+			return fmt.Errorf("error converting to PDF: %w", err)
+		}
+		a.Content, a.ContentType = content, "application/pdf"
+	case renderCSV, renderXLSX:
+		columns, rows := a.Columns, a.Rows
+		if a.Data != "" {
+			var err error
+			if columns, rows, err = dataTable(mail.Data, a.Data); err != nil {
+				return permanent(err)
+			}
+		}
+		write, contentType := tableCSV, "text/csv; charset=utf-8"
+		if a.Render == renderXLSX {
+			write, contentType = tableXLSX, xlsxContentType
+		}
+		content, err := write(columns, rows)
+		if err != nil {
+			return permanent(err)
+		}
+		a.Content, a.ContentType = content, contentType
+	default:
+		return permanent(fmt.Errorf("unknown render %q", a.Render))
+	}
+	return nil
+}
+
+// dataTable reads the list of objects at key in data as a table, with a
+// column for each of their fields in alphabetical order.
+func dataTable(data map[string]interface{}, key string) ([]string, [][]interface{}, error) {
+	items, ok := data[key].([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("task data has no list at %q", key)
+	}
+	seen := map[string]bool{}
+	var columns []string
+	for _, item := range items {
+		row, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("%q is not a list of objects", key)
+		}
+		for column := range row {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	rows := make([][]interface{}, 0, len(items))
+	for _, item := range items {
+		object := item.(map[string]interface{})
+		row := make([]interface{}, len(columns))
+		for i, column := range columns {
+			row[i] = object[column]
+		}
+		rows = append(rows, row)
+	}
+	return columns, rows, nil
+}
+
+// tableCSV writes a table as CSV, with a header row if it has columns.
+func tableCSV(columns []string, rows [][]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if len(columns) > 0 {
+		w.Write(columns)
+	}
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = cellText(v)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// cellText formats a JSON value for a cell, writing numbers without
+// exponents and nested values as JSON.
+func cellText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestRenderAttachments(t *testing.T) {
+	tests := []struct {
+		name        string
+		attachment  Attachment
+		data        map[string]interface{}
+		content     string
+		contentType string
+		permanent   bool
+	}{
+		{
+			name:        "csv from rows",
+			attachment:  Attachment{Filename: "a.csv", Render: renderCSV, Columns: []string{"item", "price"}, Rows: [][]interface{}{{"tea", 2.5}, {"cake, large", 1e7}}},
+			content:     "item,price\ntea,2.5\n\"cake, large\",10000000\n",
+			contentType: "text/csv; charset=utf-8",
+		},
+		{
+			name:        "csv from data",
+			attachment:  Attachment{Filename: "a.csv", Render: renderCSV, Data: "lines"},
+			data:        map[string]interface{}{"lines": []interface{}{map[string]interface{}{"b": true, "a": nil}}},
+			content:     "a,b\n,true\n",
+			contentType: "text/csv; charset=utf-8",
+		},
+		{
+			name:       "data not a list",
+			attachment: Attachment{Filename: "a.csv", Render: renderCSV, Data: "lines"},
+			data:       map[string]interface{}{"lines": "no"},
+			permanent:  true,
+		},
+		{
+			name:       "unknown render",
+			attachment: Attachment{Filename: "a.doc", Render: "doc"},
+			permanent:  true,
+		},
+		{
+			name:       "pdf without a renderer",
+			attachment: Attachment{Filename: "a.pdf", Render: renderPDF, Content: []byte("<p>hi</p>")},
+			permanent:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := Attachment{Filename: "plain.txt", Content: []byte("as is")}
+			mail := Mail{Data: tt.data, Attachments: []Attachment{plain, tt.attachment}}
+			got, err := Mailer{}.renderAttachments(mail)
+			if tt.permanent {
+				if err == nil || !isPermanent(err) {
+					t.Fatalf("renderAttachments() error = %v, want a permanent error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got[1].Content) != tt.content || got[1].ContentType != tt.contentType {
+				t.Errorf("rendered %q as %q, want %q as %q", got[1].Content, got[1].ContentType, tt.content, tt.contentType)
+			}
+			if got[1].Render != "" || got[1].Rows != nil {
+				t.Errorf("rendered attachment still describes its content: %+v", got[1])
+			}
+			if string(got[0].Content) != "as is" {
+				t.Errorf("attachment without a render changed: %q", got[0].Content)
+			}
+			// The task's attachments are shared by the copies for each
+			// recipient, and must be rendered afresh for each.
+			if mail.Attachments[1].Render != tt.attachment.Render || mail.Attachments[1].Content != nil {
+				t.Errorf("task's attachment was changed: %+v", mail.Attachments[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDomainBackoff = time.Minute
+	// domainBusyDelay is how long a task to a domain with all its
+	// connections in use waits before being tried again.
+	domainBusyDelay = 5 * time.Second
+
+	domainDeferredMetric = "post_room_domain_deferred_total"
+	domainActiveMetric   = "post_room_domain_active"
+)
+
+func init() {
+	metrics.describe(domainDeferredMetric, "counter", "Tasks deferred to the scheduled set by a recipient domain's limits, by the limit reached.")
+	metrics.describe(domainActiveMetric, "gauge", "Sends in progress to a recipient domain with limits.")
+}
+
+// parseDomainValues parses a comma-separated list of domain=value settings.
+func parseDomainValues(value string) (map[string]float64, error) {
+	values := map[string]float64{}
+	for _, item := range splitList(value) {
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid entry %q: expected domain=value", item)
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(item[i+1:]), 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid entry %q: value must be a positive number", item)
+		}
+		values[strings.ToLower(strings.TrimSpace(item[:i]))] = n
+	}
+	return values, nil
+}
+
+// domainLimit caps the sends to one recipient domain in progress at once
+// and per second. Zero means no cap.
+type domainLimit struct {
+	concurrency int
+	interval    time.Duration
+}
+
+type domainState struct {
+	active int
+	next   time.Time
+	// deferred is when the last task deferred for the rate was told to
+	// come back, so that tasks deferred together come back spread out.
+	deferred time.Time
+	// throttles counts the domain's transient failures since it last
+	// accepted a message, and the domain isn't sent to until backoffUntil.
+	throttles    int
+	backoffUntil time.Time
+}
+
+// domainLimiter keeps sends to the recipient domains given limits, such as
+// those that throttle aggressively, within them, and backs off from a
+// domain on its own when it defers messages, doubling the wait from backoff
+// with each deferral in a row. Tasks to a domain at its limit are deferred
+// rather than waited for, so that a slow domain doesn't hold up the worker.
+// Limits are per worker. A nil limiter doesn't limit.
+type domainLimiter struct {
+	limits  map[string]domainLimit
+	backoff time.Duration
+
+	mu    sync.Mutex
+	state map[string]*domainState
+}
+
+func newDomainLimiter(options AppOptions) *domainLimiter {
+	limits := map[string]domainLimit{}
+	for domain, n := range options.DomainConcurrency {
+		l := limits[domain]
+		l.concurrency = int(n)
+		limits[domain] = l
+	}
+	for domain, perSecond := range options.DomainRateLimits {
+		l := limits[domain]
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+		limits[domain] = l
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return &domainLimiter{limits: limits, backoff: options.DomainBackoff, state: map[string]*domainState{}}
+}
+
+// limited returns the domains of recipients that have limits, in order.
+func (d *domainLimiter) limited(recipients []string) []string {
+	seen := map[string]bool{}
+	var domains []string
+	for _, r := range recipients {
+		addr, err := netmail.ParseAddress(r)
+		if err != nil {
+			continue
+		}
+		domain := addressDomain(addr)
+		if _, ok := d.limits[domain]; ok && !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func (d *domainLimiter) stateOf(domain string) *domainState {
+	s, ok := d.state[domain]
+	if !ok {
+		s = &domainState{}
+		d.state[domain] = s
+	}
+	return s
+}
+
+// domainSends are the sends to limited domains a task was admitted with,
+// and the time its turn comes under their rates.
+type domainSends struct {
+	domains []string
+	at      time.Time
+}
+
+// wait blocks until the task's turn.
+func (s domainSends) wait() {
+	time.Sleep(time.Until(s.at))
+}
+
+// admit takes a send to each of the task's limited recipient domains,
+// to be given back to done once the task has been sent. If any of them is
+// at its limit, or backing off, nothing is taken and retryAt is when to try
+// the task again. A task whose turn under a rate is sooner than the
+// scheduler could bring it back is admitted, to wait for it.
+func (d *domainLimiter) admit(task Mail, now time.Time) (sends domainSends, retryAt time.Time, ok bool) {
+	if d == nil {
+		return domainSends{}, time.Time{}, true
+	}
+	domains := d.limited(task.Recipients)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, domain := range domains {
+		l, s := d.limits[domain], d.stateOf(domain)
+		reason := ""
+		switch {
+		case s.backoffUntil.After(now):
+			reason, retryAt = "backoff", s.backoffUntil
+		case l.concurrency > 0 && s.active >= l.concurrency:
+			reason, retryAt = "concurrency", now.Add(domainBusyDelay)
+		case l.interval > 0 && s.next.After(now.Add(schedulerInterval)):
+			reason, retryAt = "rate", s.next
+			if s.deferred.After(retryAt) {
+				retryAt = s.deferred
+			}
+			s.deferred = retryAt.Add(l.interval)
+		}
+		if reason != "" {
+			metrics.add(domainDeferredMetric, 1, "domain", domain, "limit", reason)
+			// The scheduler counts in whole seconds; don't bring the task
+			// back early.
+			if rounded := retryAt.Truncate(time.Second); rounded.Before(retryAt) {
+				retryAt = rounded.Add(time.Second)
+			}
+			return domainSends{}, retryAt, false
+		}
+	}
+	sends = domainSends{domains: domains, at: now}
+	for _, domain := range domains {
+		if s := d.stateOf(domain); s.next.After(sends.at) {
+			sends.at = s.next
+		}
+	}
+	for _, domain := range domains {
+		l, s := d.limits[domain], d.stateOf(domain)
+		s.active++
+		s.next = sends.at.Add(l.interval)
+		metrics.set(domainActiveMetric, float64(s.active), "domain", domain)
+	}
+	return sends, time.Time{}, true
+}
+
+// done gives back the sends admit took.
+func (d *domainLimiter) done(sends domainSends) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, domain := range sends.domains {
+		s := d.stateOf(domain)
+		s.active--
+		metrics.set(domainActiveMetric, float64(s.active), "domain", domain)
+	}
+}
+
+// record updates the backoff state of the limited domains of a send's
+// recipients from its failures: a message accepted ends a domain's backoff,
+// and a 4xx reply other than greylisting, which only holds up the one
+// sender and recipient, backs off from the domains it came from.
+func (d *domainLimiter) record(recipients []*netmail.Address, failures []deliveryFailure) {
+	if d == nil {
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, domain := range d.limited(formatRecipients(deliveredTo(recipients, failures))) {
+		s := d.stateOf(domain)
+		if s.throttles > 0 {
+			opsEvents.notify(eventCircuitClosed, "%s accepted a message: no longer backing off from it", domain)
+		}
+		s.throttles, s.backoffUntil = 0, time.Time{}
+	}
+	for _, f := range failures {
+		var reply *textproto.Error
+		if !errors.As(f.err, &reply) || reply.Code >= 500 || isGreylisted(f.err) {
+			continue
+		}
+		for _, domain := range d.limited(formatRecipients(f.recipients)) {
+			s := d.stateOf(domain)
+			s.throttles++
+			wait := retryBackoff(d.backoff, s.throttles)
+			s.backoffUntil = now.Add(wait)
+			log.Printf("%s deferred a message (%03d): backing off from it for %s", domain, reply.Code, wait)
+			if s.throttles == 1 {
+				opsEvents.notify(eventCircuitOpened, "%s deferred a message (%03d): backing off from it for %s", domain, reply.Code, wait)
+			}
+		}
+	}
+}
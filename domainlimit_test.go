@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDomainValues(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{"", map[string]float64{}, false},
+		{"Example.com=2, other.org = 0.5", map[string]float64{"example.com": 2, "other.org": 0.5}, false},
+		{"example.com", nil, true},
+		{"example.com=0", nil, true},
+		{"=3", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDomainValues(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDomainValues(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseDomainValues(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+		for domain, n := range tt.want {
+			if got[domain] != n {
+				t.Errorf("parseDomainValues(%q)[%s] = %v, want %v", tt.value, domain, got[domain], n)
+			}
+		}
+	}
+}
+
+func TestDomainLimiterAdmit(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		recipients [][]string
+		want       []bool
+	}{
+		{"unlimited domain", [][]string{{"a@free.org"}, {"b@free.org"}, {"c@free.org"}}, []bool{true, true, true}},
+		{"concurrency", [][]string{{"a@slow.com"}, {"b@slow.com"}, {"c@slow.com"}}, []bool{true, true, false}},
+		{"any recipient at its limit", [][]string{{"a@slow.com", "b@slow.com"}, {"c@free.org"}, {"d@free.org", "e@slow.com"}}, []bool{true, true, true}},
+		{"named recipients", [][]string{{"A <a@Slow.com>"}, {"b@slow.com"}, {"C <c@slow.com>"}}, []bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDomainLimiter(AppOptions{DomainConcurrency: map[string]float64{"slow.com": 2}, DomainBackoff: time.Minute})
+			for i, recipients := range tt.recipients {
+				_, retryAt, ok := d.admit(Mail{Recipients: recipients}, now)
+				if ok != tt.want[i] {
+					t.Errorf("admit(%q) = %v, want %v", recipients, ok, tt.want[i])
+				}
+				if !ok && !retryAt.After(now) {
+					t.Errorf("admit(%q) retryAt = %v, want after now", recipients, retryAt)
+				}
+			}
+		})
+	}
+}
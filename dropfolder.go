@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	dropFolderInterval = 5 * time.Second
+	// dropFolderSettle is how long a file must go unmodified before it is
+	// read, so that files still being written are left alone. Writers that
+	// can should write elsewhere and rename into the folder instead.
+	dropFolderSettle = 2 * time.Second
+
+	dropFolderDone   = "done"
+	dropFolderFailed = "failed"
+)
+
+// dropFolder enqueues the tasks written to a directory as .json files, or
+// as .eml messages, moving each file to done/ as it is enqueued or to
+// failed/, beside a .error file giving the reason, if it can't be.
+type dropFolder struct {
+	rdb       *redis.Client
+	queue     string
+	dir       string
+	validator *taskValidator
+}
+
+func newDropFolder(rdb *redis.Client, queue, dir string, validator *taskValidator) (*dropFolder, error) {
+	for _, sub := range []string{dropFolderDone, dropFolderFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating drop folder: %w", err)
+		}
+	}
+	return &dropFolder{rdb: rdb, queue: queue, dir: dir, validator: validator}, nil
+}
+
+func (d *dropFolder) run() {
+	for range time.Tick(dropFolderInterval) {
+		if err := d.scan(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// scan ingests the settled files in the folder in name order.
+func (d *dropFolder) scan() error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return fmt.Errorf("error reading drop folder: %w", err)
+	}
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || (ext != ".json" && ext != ".eml") {
+			continue
+		}
+		if info, err := e.Info(); err != nil || time.Since(info.ModTime()) < dropFolderSettle {
+			continue
+		}
+		d.ingest(e.Name(), ext)
+	}
+	return nil
+}
+
+func (d *dropFolder) ingest(name, ext string) {
+	path := filepath.Join(d.dir, name)
+	task, err := d.read(path, ext)
+	if err != nil {
+		d.fail(path, name, err)
+		return
+	}
+	// The file is moved out of the way before its task is enqueued, so
+	// that one that can't be moved isn't enqueued again on every scan.
+	done := filepath.Join(d.dir, dropFolderDone, name)
+	if err := os.Rename(path, done); err != nil {
+		log.Printf("error moving %s to %s, leaving it for the next scan: %v", name, dropFolderDone, err)
+		return
+	}
+	if err := enqueue(d.rdb, d.queue, &task); err != nil {
+		d.fail(done, name, err)
+		return
+	}
+	log.Printf("enqueued task %s from %s", task.ID, name)
+}
+
+// fail moves the file name, now at path, to failed/, replacing any earlier
+// file of the same name, beside a .error file giving err.
+func (d *dropFolder) fail(path, name string, err error) {
+	log.Printf("error ingesting %s from drop folder: %v", name, err)
+	if err := os.Rename(path, filepath.Join(d.dir, dropFolderFailed, name)); err != nil {
+		log.Printf("error moving %s to %s: %v", name, dropFolderFailed, err)
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, dropFolderFailed, name+".error"), []byte(err.Error()+"\n"), 0o644); err != nil {
+		log.Print("error recording drop folder failure: ", err)
+	}
+}
+
+// read returns the task in the file at path, validated against the task
+// schema whether it was written as JSON or as a message.
+func (d *dropFolder) read(path, ext string) (Mail, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Mail{}, err
+	}
+	if ext == ".eml" {
+		task, err := parseEML(data)
+		if err != nil {
+			return Mail{}, err
+		}
+		if data, err = json.Marshal(task); err != nil {
+			return Mail{}, err
+		}
+	}
+	if err := d.validator.validate(data); err != nil {
+		return Mail{}, err
+	}
+	var task Mail
+	if err := json.Unmarshal(data, &task); err != nil {
+		return Mail{}, fmt.Errorf("invalid task: %w", err)
+	}
+	return task, nil
+}
+
+// parseEML makes a task of an RFC 5322 message, sent to the addresses in
+// its To and Cc headers, from the address in From. The HTML body is used if
+// there is one and the plain text body otherwise; parts with a filename are
+// attached.
+func parseEML(data []byte) (Mail, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return Mail{}, fmt.Errorf("invalid message: %w", err)
+	}
+	var task Mail
+	dec := new(mime.WordDecoder)
+	if task.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		task.Subject = msg.Header.Get("Subject")
+	}
+	if from := msg.Header.Get("From"); from != "" {
+		address, err := netmail.ParseAddress(from)
+		if err != nil {
+			return Mail{}, fmt.Errorf("invalid From: %w", err)
+		}
+		task.From = address.Address
+	}
+	for _, field := range []string{"To", "Cc"} {
+		if msg.Header.Get(field) == "" {
+			continue
+		}
+		addresses, err := msg.Header.AddressList(field)
+		if err != nil {
+			return Mail{}, fmt.Errorf("invalid %s: %w", field, err)
+		}
+		task.Recipients = append(task.Recipients, formatRecipients(addresses)...)
+	}
+	if len(task.Recipients) == 0 {
+		return Mail{}, fmt.Errorf("message has no To or Cc recipients")
+	}
+
+	var htmlBody, textBody string
+	err = walkParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body,
+		func(mediaType, filename string, body []byte) {
+			switch {
+			case filename != "":
+				task.Attachments = append(task.Attachments, Attachment{Filename: filename, ContentType: mediaType, Content: body})
+			case mediaType == "text/html" && htmlBody == "":
+				htmlBody = string(body)
+			case mediaType == "text/plain" && textBody == "":
+				textBody = string(body)
+			}
+		})
+	if err != nil {
+		return Mail{}, fmt.Errorf("invalid message body: %w", err)
+	}
+	task.Message = htmlBody
+	if task.Message == "" {
+		task.Message = strings.ReplaceAll(html.EscapeString(textBody), "\n", "<br>\n")
+	}
+	return task, nil
+}
+
+// walkParts calls fn with every leaf part of a MIME body, decoded.
+func walkParts(contentType, encoding string, body io.Reader, fn func(mediaType, filename string, body []byte)) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkParts(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, func(mediaType, filename string, body []byte) {
+				if name := part.FileName(); name != "" {
+					filename = name
+				}
+				fn(mediaType, filename, body)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	fn(mediaType, params["name"], data)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+func TestDropFolderIngest(t *testing.T) {
+	// Subjects are limited to show that messages are validated as tasks
+	// written as JSON are.
+	schema, err := jsonschema.CompileString("task.schema.json", `{"properties": {"subject": {"maxLength": 10}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, content string
+		// want is the folder the file ends up in, and queued whether its
+		// task was enqueued.
+		want   string
+		queued bool
+	}{
+		{"task.json", `{"recipients": ["a@example.com"], "subject": "Hi", "message": "<p>Hi</p>"}`, dropFolderDone, true},
+		{"invalid.json", `{"recipients": ["a@example.com"], "subject": "Far too long a subject"}`, dropFolderFailed, false},
+		{"message.eml", "From: b@example.com\r\nTo: a@example.com\r\nSubject: Hi\r\n\r\nHello\r\n", dropFolderDone, true},
+		{"invalid.eml", "From: b@example.com\r\nTo: a@example.com\r\nSubject: Far too long a subject\r\n\r\nHello\r\n", dropFolderFailed, false},
+		{"norecipients.eml", "From: b@example.com\r\nSubject: Hi\r\n\r\nHello\r\n", dropFolderFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdb := newTestRedis(t)
+			d, err := newDropFolder(rdb, "tasks", t.TempDir(), &taskValidator{schema: schema})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(d.dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			d.ingest(tt.name, strings.ToLower(filepath.Ext(tt.name)))
+			if _, err := os.Stat(filepath.Join(d.dir, tt.want, tt.name)); err != nil {
+				t.Errorf("%s not moved to %s: %v", tt.name, tt.want, err)
+			}
+			if n, _ := rdb.LLen(ctx, "tasks").Result(); (n == 1) != tt.queued {
+				t.Errorf("%d tasks queued, want queued %v", n, tt.queued)
+			}
+		})
+	}
+}
+
+func TestDropFolderUnmovable(t *testing.T) {
+	rdb := newTestRedis(t)
+	d, err := newDropFolder(rdb, "tasks", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "task.json"
+	if err := os.WriteFile(filepath.Join(d.dir, name), []byte(`{"recipients": ["a@example.com"], "subject": "Hi"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A directory in the way of the move to done/ leaves the file where it
+	// is, however many times it is scanned, without enqueuing it.
+	if err := os.MkdirAll(filepath.Join(d.dir, dropFolderDone, name, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	os.Chtimes(filepath.Join(d.dir, name), past, past)
+	for i := 0; i < 2; i++ {
+		if err := d.scan(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := rdb.LLen(ctx, "tasks").Result(); n != 0 {
+		t.Errorf("%d tasks queued from a file that couldn't be moved", n)
+	}
+	if _, err := os.Stat(filepath.Join(d.dir, name)); err != nil {
+		t.Errorf("file not left in the folder: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// dsnConditions are the NOTIFY values of RFC 3461.
+var dsnConditions = map[string]bool{"SUCCESS": true, "FAILURE": true, "DELAY": true, "NEVER": true}
+
+// envelope holds the extra parameters for MAIL FROM and RCPT TO.
+type envelope struct {
+	mail, rcpt string
+}
+
+// envelopeFor returns the DSN parameters requested by mail, if the server
+// supports the extension. The task ID is sent as the envelope ID so
+// notifications can be correlated back to the task.
+func envelopeFor(c *smtp.Client, mail Mail) (envelope, error) {
+	if len(mail.DSN) == 0 {
+		return envelope{}, nil
+	}
+	notify := make([]string, 0, len(mail.DSN))
+	for _, condition := range mail.DSN {
+		condition = strings.ToUpper(condition)
+		if !dsnConditions[condition] {
+			return envelope{}, permanent(fmt.Errorf("invalid DSN condition %q", condition))
+		}
+		notify = append(notify, condition)
+	}
+	if len(notify) > 1 && dsnNever(notify) {
+		return envelope{}, permanent(errors.New("DSN condition NEVER cannot be combined with others"))
+	}
+	if ok, _ := c.Extension("DSN"); !ok {
+		return envelope{}, nil
+	}
+	e := envelope{rcpt: " NOTIFY=" + strings.Join(notify, ",")}
+	if mail.ID != "" {
+		e.mail = " RET=HDRS ENVID=" + xtext(mail.ID)
+	}
+	return e, nil
+}
+
+func dsnNever(conditions []string) bool {
+	for _, c := range conditions {
+		if c == "NEVER" {
+			return true
+		}
+	}
+	return false
+}
+
+// mailFrom issues MAIL FROM with the envelope's parameters. net/smtp's own
+// Client.Mail doesn't accept extra parameters, so this replicates it.
+func mailFrom(c *smtp.Client, from string, e envelope) error {
+	if e.mail == "" {
+		return c.Mail(from)
+	}
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	return command(c, 250, cmd+"%s", from, e.mail)
+}
+
+// rcptTo issues RCPT TO with the envelope's parameters.
+func rcptTo(c *smtp.Client, to string, e envelope) error {
+	if e.rcpt == "" {
+		return c.Rcpt(to)
+	}
+	return command(c, 25, "RCPT TO:<%s>%s", to, e.rcpt)
+}
+
+// command issues a command and reads its reply, which must have
+// expectCode. Addresses and other data go in args rather than format, so
+// that a % in them can't change the command.
+func command(c *smtp.Client, expectCode int, format string, args ...interface{}) error {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return permanent(fmt.Errorf("invalid address %q: contains CR or LF", s))
+		}
+	}
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+// xtext encodes s as an RFC 3461 xtext.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+)
+
+// dsnServer answers a client on conn as a server supporting DSN, sending
+// each command it receives after EHLO on commands.
+func dsnServer(conn net.Conn, commands chan<- string) {
+	defer close(commands)
+	text := textproto.NewConn(conn)
+	defer text.Close()
+	text.PrintfLine("220 localhost ready")
+	if _, err := text.ReadLine(); err != nil {
+		return
+	}
+	text.PrintfLine("250-localhost")
+	text.PrintfLine("250 DSN")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		commands <- line
+		text.PrintfLine("250 ok")
+	}
+}
+
+func TestEnvelopeCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		mail    Mail
+		command func(c *smtp.Client, e envelope) error
+		want    string
+	}{
+		{
+			name:    "mail with envelope ID",
+			mail:    Mail{ID: "t1", DSN: []string{"failure"}},
+			command: func(c *smtp.Client, e envelope) error { return mailFrom(c, "sender@example.com", e) },
+			want:    "MAIL FROM:<sender@example.com> RET=HDRS ENVID=t1",
+		},
+		{
+			name:    "percent in task ID",
+			mail:    Mail{ID: "100%s%d done", DSN: []string{"failure"}},
+			command: func(c *smtp.Client, e envelope) error { return mailFrom(c, "sender@example.com", e) },
+			want:    "MAIL FROM:<sender@example.com> RET=HDRS ENVID=100%s%d+20done",
+		},
+		{
+			name:    "rcpt with notify",
+			mail:    Mail{ID: "t1", DSN: []string{"success", "failure"}},
+			command: func(c *smtp.Client, e envelope) error { return rcptTo(c, "a%s@example.com", e) },
+			want:    "RCPT TO:<a%s@example.com> NOTIFY=SUCCESS,FAILURE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			commands := make(chan string, 1)
+			go dsnServer(server, commands)
+			c, err := smtp.NewClient(client, "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			e, err := envelopeFor(c, tt.mail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.command(c, e); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-commands; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
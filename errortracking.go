@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// errorBacklog is how many reports may wait to be sent before new ones
+	// are dropped, so that a flood of errors can't hold up the worker.
+	errorBacklog = 64
+	errorTimeout = 10 * time.Second
+)
+
+// errorTracker reports unexpected errors to Sentry, or a service accepting
+// its protocol such as GlitchTip, at SENTRY_DSN. It is nil unless one is
+// set.
+var errorTracker *sentryClient
+
+// sentryClient sends events to the envelope endpoint of a Sentry project,
+// in the background. Each event carries the worker's ID, version and
+// environment, and tags such as the task_id and queue it concerns.
+type sentryClient struct {
+	dsn, endpoint, auth  string
+	release, environment string
+	serverName           string
+	client               *http.Client
+
+	mu sync.Mutex
+	// flushed stops reports being queued once queue is closed, at shutdown.
+	flushed   bool
+	flushOnce sync.Once
+	queue     chan []byte
+	done      chan struct{}
+}
+
+// newSentryClient reports to the project at dsn.
+func newSentryClient(dsn string, options AppOptions) (*sentryClient, error) {
+	endpoint, key, err := parseSentryDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sentryClient{
+		dsn:         dsn,
+		endpoint:    endpoint,
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=post-room/%s", key, workerVersion()),
+		release:     workerVersion(),
+		environment: options.SentryEnvironment,
+		serverName:  options.WorkerID,
+		client:      &http.Client{Timeout: errorTimeout},
+		queue:       make(chan []byte, errorBacklog),
+		done:        make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// parseSentryDSN returns the envelope endpoint and public key of dsn, of
+// the form https://<key>@<host>[/<path>]/<project>.
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if u.User == nil || u.User.Username() == "" || u.Host == "" || slash < 0 || u.Path[slash+1:] == "" {
+		return "", "", fmt.Errorf("%q is not a DSN of the form https://<key>@<host>/<project>", dsn)
+	}
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path[:slash] + "/api/" + u.Path[slash+1:] + "/envelope/"}
+	return endpoint.String(), u.User.Username(), nil
+}
+
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     *sentryMessage    `json:"message,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+type sentryMessage struct {
+	Formatted string `json:"formatted"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// captureError reports err, which happened doing what message says, with
+// the stack of the caller.
+func (s *sentryClient) captureError(message string, err error, tags ...string) {
+	if s == nil {
+		return
+	}
+	s.capture("error", message, fmt.Sprintf("%T", rootCause(err)), err.Error(), tags)
+}
+
+// capturePanic reports the panic r, from within the deferred function that
+// recovered it, with the stack of the panic.
+func (s *sentryClient) capturePanic(message string, r interface{}, tags ...string) {
+	if s == nil {
+		return
+	}
+	s.capture("fatal", message, fmt.Sprintf("%T", r), fmt.Sprint(r), tags)
+}
+
+// capture queues an event. tags are name/value pairs, like metric labels.
+func (s *sentryClient) capture(level, message, kind, value string, tags []string) {
+	event := sentryEvent{
+		EventID:     newTaskID(),
+		Timestamp:   time.Now().UTC(),
+		Level:       level,
+		Platform:    "go",
+		Release:     s.release,
+		Environment: s.environment,
+		ServerName:  s.serverName,
+		Message:     &sentryMessage{Formatted: message},
+		Exception: &sentryExceptions{Values: []sentryException{{
+			Type:       kind,
+			Value:      value,
+			Stacktrace: stacktrace(),
+		}}},
+		Tags: map[string]string{},
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			event.Tags[tags[i]] = tags[i+1]
+		}
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Print("error encoding error report: ", err)
+		return
+	}
+	header, _ := json.Marshal(map[string]interface{}{"event_id": event.EventID, "sent_at": event.Timestamp, "dsn": s.dsn})
+	item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+	envelope := bytes.Join([][]byte{header, item, payload}, []byte("\n"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushed {
+		log.Print("dropping error report: reports have been flushed")
+		return
+	}
+	select {
+	case s.queue <- envelope:
+	default:
+		log.Print("dropping error report: too many waiting to be sent")
+	}
+}
+
+func (s *sentryClient) run() {
+	defer close(s.done)
+	for envelope := range s.queue {
+		req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(envelope))
+		if err != nil {
+			log.Print("error reporting error: ", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/x-sentry-envelope")
+		req.Header.Set("X-Sentry-Auth", s.auth)
+		res, err := s.client.Do(req)
+		if err != nil {
+			log.Print("error reporting error: ", err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			log.Printf("error reporting error: unexpected status %s", res.Status)
+		}
+	}
+}
+
+// flush sends the reports still waiting, giving up after timeout. Errors
+// captured after it are dropped.
+func (s *sentryClient) flush(timeout time.Duration) {
+	if s == nil {
+		return
+	}
+	s.flushOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.flushed = true
+		close(s.queue)
+	})
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		log.Print("gave up sending error reports")
+	}
+}
+
+// stacktrace returns the stack of the goroutine calling into the client,
+// from the panic if it is panicking, oldest frame first as Sentry expects.
+func stacktrace() *sentryStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "runtime.gopanic":
+			// Everything so far is the recovery; the panic starts here.
+			stack = nil
+		case strings.HasPrefix(frame.Function, "main.(*sentryClient)") || frame.Function == "main.stacktrace":
+		default:
+			module := frame.Function
+			if i := strings.LastIndex(module, "/"); i >= 0 {
+				module = module[:i] + strings.SplitN(module[i:], ".", 2)[0]
+			} else {
+				module = strings.SplitN(module, ".", 2)[0]
+			}
+			stack = append(stack, sentryFrame{
+				Function: frame.Function,
+				Module:   module,
+				Filename: fileName(frame.File),
+				AbsPath:  frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, "main."),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return &sentryStacktrace{Frames: stack}
+}
+
+func fileName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func rootCause(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
+
+// isTransportBug reports whether a failed send's err is neither a reply
+// from the server nor a network failure, and so is likely a fault in the
+// worker or its configuration rather than the mail server's doing.
+func isTransportBug(err error) bool {
+	var reply *textproto.Error
+	var netErr net.Error
+	var permanent permanentError
+	return !errors.As(err, &reply) && !errors.As(err, &netErr) && !errors.As(err, &permanent) &&
+		!errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	tests := []struct {
+		dsn, endpoint, key string
+		wantErr            bool
+	}{
+		{"https://abc@o1.ingest.sentry.io/42", "https://o1.ingest.sentry.io/api/42/envelope/", "abc", false},
+		{"https://abc@glitchtip.example.com/prefix/7", "https://glitchtip.example.com/prefix/api/7/envelope/", "abc", false},
+		{"https://o1.ingest.sentry.io/42", "", "", true},
+		{"https://abc@o1.ingest.sentry.io/", "", "", true},
+	}
+	for _, tt := range tests {
+		endpoint, key, err := parseSentryDSN(tt.dsn)
+		if (err != nil) != tt.wantErr || endpoint != tt.endpoint || key != tt.key {
+			t.Errorf("parseSentryDSN(%q) = %q, %q, %v, want %q, %q, error %v", tt.dsn, endpoint, key, err, tt.endpoint, tt.key, tt.wantErr)
+		}
+	}
+}
+
+func TestSentryClientFlush(t *testing.T) {
+	var mu sync.Mutex
+	var envelopes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		envelopes = append(envelopes, string(body))
+		mu.Unlock()
+	}))
+	defer server.Close()
+	s, err := newSentryClient(strings.Replace(server.URL, "://", "://key@", 1)+"/1", AppOptions{WorkerID: "w1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.captureError("sending", errors.New("boom"), "task_id", "t1")
+	s.flush(time.Second)
+	// Reports after flushing, as from sends still finishing, are dropped,
+	// and flushing again is harmless.
+	s.captureError("sending", errors.New("late"))
+	s.flush(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(envelopes) != 1 || !strings.Contains(envelopes[0], `"boom"`) || !strings.Contains(envelopes[0], `"task_id":"t1"`) {
+		t.Errorf("sent %q, want the one report before flushing", envelopes)
+	}
+}
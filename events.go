@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operational events notified to NOTIFY_WEBHOOK_URL.
+const (
+	eventWorkerStarted = "worker-started"
+	eventWorkerStopped = "worker-stopped"
+	eventPaused        = "paused"
+	eventResumed       = "resumed"
+	eventDraining      = "draining"
+	eventDeadLetters   = "dead-letters"
+	eventSendPanic     = "send-panic"
+	// eventCircuitOpened and eventCircuitClosed are sent when a limited
+	// domain's deferrals start the worker backing off from it, and when it
+	// accepts a message again.
+	eventCircuitOpened = "circuit-opened"
+	eventCircuitClosed = "circuit-closed"
+)
+
+var allEvents = []string{eventWorkerStarted, eventWorkerStopped, eventPaused, eventResumed, eventDraining, eventDeadLetters, eventSendPanic, eventCircuitOpened, eventCircuitClosed}
+
+const (
+	notifyFormatAuto  = "auto"
+	notifyFormatSlack = "slack"
+	notifyFormatTeams = "teams"
+
+	// notifyBacklog is how many events may wait to be posted before new
+	// ones are dropped, so a slow chat service never holds up sending.
+	notifyBacklog = 32
+	// notifyFlushTimeout bounds how long the worker waits to post its last
+	// events when stopping.
+	notifyFlushTimeout = 5 * time.Second
+	// deadLetterCheckInterval is how often the leader compares the dead
+	// letter lists to DLQ_ALERT_THRESHOLD.
+	deadLetterCheckInterval = 30 * time.Second
+)
+
+// opsEvents posts operational events to a Slack or Microsoft Teams incoming
+// webhook, in the background and outside the mail pipeline, so that
+// operators hear about them even when mail isn't getting through. It is
+// nil unless NOTIFY_WEBHOOK_URL is set.
+var opsEvents *eventNotifier
+
+type eventNotifier struct {
+	url, format string
+	// events are the events to post, or nil for all of them.
+	events map[string]bool
+	worker string
+	client *http.Client
+
+	mu sync.Mutex
+	// closed stops events being queued once the worker is stopping and
+	// queue is closed.
+	closed bool
+	queue  chan string
+	done   chan struct{}
+}
+
+func newEventNotifier(options AppOptions) *eventNotifier {
+	n := &eventNotifier{
+		url:    options.NotifyWebhookURL,
+		format: options.NotifyFormat,
+		worker: options.WorkerID,
+		client: &http.Client{Timeout: alertNotifyTimeout},
+		queue:  make(chan string, notifyBacklog),
+		done:   make(chan struct{}),
+	}
+	if n.format == notifyFormatAuto {
+		n.format = notifyFormatSlack
+		if u, err := url.Parse(n.url); err == nil && (strings.HasSuffix(u.Hostname(), ".office.com") || strings.HasSuffix(u.Hostname(), ".logic.azure.com")) {
+			n.format = notifyFormatTeams
+		}
+	}
+	if len(options.NotifyEvents) > 0 {
+		n.events = map[string]bool{}
+		for _, e := range options.NotifyEvents {
+			n.events[e] = true
+		}
+	}
+	go n.run()
+	return n
+}
+
+// notify posts event, described by format and args, unless it is filtered
+// out, the backlog is full or the notifier has been closed.
+func (n *eventNotifier) notify(event, format string, args ...interface{}) {
+	if n == nil || (n.events != nil && !n.events[event]) {
+		return
+	}
+	text := fmt.Sprintf("[post-room %s] %s", n.worker, fmt.Sprintf(format, args...))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		log.Printf("dropping %s notification: the worker is stopping", event)
+		return
+	}
+	select {
+	case n.queue <- text:
+	default:
+		log.Printf("dropping %s notification: too many waiting to be posted", event)
+	}
+}
+
+func (n *eventNotifier) run() {
+	defer close(n.done)
+	for text := range n.queue {
+		var body interface{} = map[string]string{"text": text}
+		if n.format == notifyFormatTeams {
+			body = map[string]string{
+				"@type":    "MessageCard",
+				"@context": "https://schema.org/extensions",
+				"summary":  text,
+				"text":     text,
+			}
+		}
+		if err := postJSON(n.client, n.url, body); err != nil {
+			log.Print("error posting notification: ", err)
+		}
+	}
+}
+
+// close posts the events still waiting, giving up after
+// notifyFlushTimeout. Events notified after it are dropped.
+func (n *eventNotifier) close() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+	case <-time.After(notifyFlushTimeout):
+		log.Print("gave up posting notifications")
+	}
+}
+
+// watchDeadLetters notifies, while leader leads, when a tenant's dead letter
+// list grows past threshold, and again once it has been brought back under
+// it and grows past it again.
+func watchDeadLetters(tenants []*tenant, threshold int64, leader *leaderElection) {
+	over := map[string]bool{}
+	for range time.Tick(deadLetterCheckInterval) {
+		if !leader.leader() {
+			continue
+		}
+		for _, t := range tenants {
+			mailer, _ := t.current()
+			if mailer.dead == nil {
+				continue
+			}
+			n, err := mailer.dead.length()
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			key := mailer.dead.key()
+			if n > threshold && !over[key] {
+				opsEvents.notify(eventDeadLetters, "%d dead letters in %s, over the threshold of %d", n, key, threshold)
+			}
+			over[key] = n > threshold
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEvents replaces opsEvents with a notifier posting to a test server,
+// returning the texts it posts.
+func testEvents(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		texts = append(texts, body["text"])
+		mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	opsEvents = newEventNotifier(AppOptions{NotifyWebhookURL: server.URL, NotifyFormat: notifyFormatSlack, WorkerID: "w1"})
+	t.Cleanup(func() { opsEvents = nil })
+	return func() []string {
+		opsEvents.close()
+		mu.Lock()
+		defer mu.Unlock()
+		return texts
+	}
+}
+
+func TestEventNotifierClose(t *testing.T) {
+	posted := testEvents(t)
+	opsEvents.notify(eventWorkerStarted, "started")
+	if texts := posted(); len(texts) != 1 || texts[0] != "[post-room w1] started" {
+		t.Errorf("posted %q, want the started event", texts)
+	}
+	// Events after closing, as from sends still finishing, are dropped.
+	opsEvents.notify(eventWorkerStopped, "stopped")
+	opsEvents.close()
+}
+
+func TestDomainCircuitEvents(t *testing.T) {
+	posted := testEvents(t)
+	d := newDomainLimiter(AppOptions{DomainConcurrency: map[string]float64{"slow.com": 1}, DomainBackoff: time.Minute})
+	recipients := []*netmail.Address{{Address: "a@slow.com"}}
+	deferred := []deliveryFailure{{recipients: recipients, err: &textproto.Error{Code: 421, Msg: "try later"}}}
+	d.record(recipients, deferred)
+	d.record(recipients, deferred)
+	d.record(recipients, nil)
+	d.record(recipients, nil)
+
+	texts := posted()
+	if len(texts) != 2 || !strings.Contains(texts[0], "backing off") || !strings.Contains(texts[1], "no longer backing off") {
+		t.Errorf("posted %q, want the circuit opening once and closing once", texts)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+)
+
+// implicitTLSPort is the submission port spoken over TLS from the start,
+// rather than upgraded with STARTTLS.
+const implicitTLSPort = "465"
+
+// tlsMode describes how a session with the relay on port is secured.
+func (m Mailer) tlsMode(port string) string {
+	switch {
+	case port == implicitTLSPort:
+		return "implicit TLS"
+	case m.auth != nil:
+		return "STARTTLS"
+	default:
+		return "plain text"
+	}
+}
+
+// implicitTLS returns the TLS configuration to connect to the relay on port
+// with, or nil if the port takes plain text first.
+func (m Mailer) implicitTLS(port string) *tls.Config {
+	if port != implicitTLSPort {
+		return nil
+	}
+	return &tls.Config{ServerName: m.host}
+}
+
+// portFallback tries further relay ports, in order, when connecting on the
+// configured one fails, such as where a network blocks 587, and keeps to
+// the port that last worked for the sends after. A nil fallback only tries
+// the configured port.
+type portFallback struct {
+	ports []string
+
+	mu      sync.Mutex
+	current string
+}
+
+func newPortFallback(port string, fallbacks []string) *portFallback {
+	if len(fallbacks) == 0 {
+		return nil
+	}
+	ports := []string{port}
+	for _, p := range fallbacks {
+		if p != port {
+			ports = append(ports, p)
+		}
+	}
+	return &portFallback{ports: ports, current: port}
+}
+
+// order returns the ports to try: the one that last worked, then the rest
+// in the configured order.
+func (f *portFallback) order(port string) []string {
+	if f == nil {
+		return []string{port}
+	}
+	f.mu.Lock()
+	current := f.current
+	f.mu.Unlock()
+	ports := []string{current}
+	for _, p := range f.ports {
+		if p != current {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// worked records that connecting to host on port, secured with mode,
+// worked, logging when that changes the port used.
+func (f *portFallback) worked(host, port, mode string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current == port {
+		return
+	}
+	log.Printf("connected to %s with %s after %s failed; using it for future sends", net.JoinHostPort(host, port), mode, f.current)
+	f.current = port
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultAttachmentMaxBytes     = 25 << 20
+	defaultAttachmentFetchTimeout = 30 * time.Second
+)
+
+// privateNetworks are the loopback, private, link-local and other
+// non-public addresses attachments aren't fetched from, so that a task
+// can't have the worker read its own network, such as a cloud metadata
+// service, and mail the response.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// attachmentFetcher downloads attachments given by URL or s3:// reference
+// rather than carried inline in the task payload. It only connects to
+// public addresses, checked as it dials so that neither redirects nor DNS
+// answers changing between lookups can lead it elsewhere, except for the
+// hosts in ATTACHMENT_PRIVATE_HOSTS and the S3 endpoint.
+type attachmentFetcher struct {
+	client   *http.Client
+	maxBytes int64
+	s3       *s3Client
+	// privateHosts are the hosts that may be fetched from at any address.
+	privateHosts map[string]bool
+}
+
+func newAttachmentFetcher(maxBytes int64, timeout time.Duration, privateHosts []string) *attachmentFetcher {
+	if maxBytes <= 0 {
+		maxBytes = defaultAttachmentMaxBytes
+	}
+	if timeout <= 0 {
+		timeout = defaultAttachmentFetchTimeout
+	}
+	f := &attachmentFetcher{maxBytes: maxBytes, privateHosts: map[string]bool{}}
+	for _, host := range privateHosts {
+		f.privateHosts[strings.ToLower(host)] = true
+	}
+	// S3 credentials are optional; s3:// references fail clearly without them.
+	f.s3, _ = s3ClientFromEnv()
+	if f.s3 != nil && f.s3.endpoint != "" {
+		if u, err := url.Parse(f.s3.endpoint); err == nil {
+			f.privateHosts[strings.ToLower(u.Hostname())] = true
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = f.dial
+	f.client = &http.Client{Timeout: timeout, Transport: transport}
+	return f
+}
+
+// dial connects to address, refusing private addresses unless its host is
+// one of privateHosts.
+func (f *attachmentFetcher) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnly}
+	if host, _, err := net.SplitHostPort(address); err == nil && f.privateHosts[strings.ToLower(host)] {
+		dialer.Control = nil
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// publicOnly refuses connections to privateNetworks.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("can't connect to %s: not an IP address", host)
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return permanent(fmt.Errorf("%s is a private address: add its host to %s to fetch attachments from it", ip, attachmentPrivateHostsKey))
+		}
+	}
+	return nil
+}
+
+// resolve fetches the content of every attachment that has a URL.
+func (f *attachmentFetcher) resolve(attachments []Attachment) error {
+	for i := range attachments {
+		if attachments[i].URL == "" {
+			continue
+		}
+		if err := f.fetch(&attachments[i]); err != nil {
+			return fmt.Errorf("error fetching attachment %s: %w", attachments[i].URL, err)
+		}
+	}
+	return nil
+}
+
+func (f *attachmentFetcher) fetch(a *Attachment) error {
+	req, err := f.request(a.URL)
+	if err != nil {
+		return err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if res.ContentLength > f.maxBytes {
+		return fmt.Errorf("attachment is %d bytes, limit is %d", res.ContentLength, f.maxBytes)
+	}
+	content, err := io.ReadAll(io.LimitReader(res.Body, f.maxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(content)) > f.maxBytes {
+		return fmt.Errorf("attachment exceeds limit of %d bytes", f.maxBytes)
+	}
+
+	if a.SHA256 != "" {
+		sum := sha256.Sum256(content)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), a.SHA256) {
+			return fmt.Errorf("checksum mismatch")
+		}
+	}
+
+	a.Content = content
+	if a.ContentType == "" {
+		a.ContentType = servedContentType(res.Header.Get("Content-Type"))
+	}
+	if a.Filename == "" {
+		a.Filename = path.Base(req.URL.Path)
+	}
+	return nil
+}
+
+func (f *attachmentFetcher) request(ref string) (*http.Request, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return http.NewRequest(http.MethodGet, ref, nil)
+	case "s3":
+		if f.s3 == nil {
+			return nil, fmt.Errorf("S3 credentials are not configured")
+		}
+		bucket, key, err := parseS3URL(ref)
+		if err != nil {
+			return nil, err
+		}
+		return f.s3.newRequest(http.MethodGet, bucket, key, nil)
+	default:
+		return nil, fmt.Errorf("unsupported attachment URL scheme %q", u.Scheme)
+	}
+}
+
+// servedContentType returns the server's content type unless it is a generic
+// binary type, in which case the content is sniffed later instead.
+func servedContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" || mediaType == "binary/octet-stream" {
+		return ""
+	}
+	return contentType
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::]:443", true},
+		{"127.0.0.1:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"0.0.0.0:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+	}
+	for _, tt := range tests {
+		err := publicOnly("tcp", tt.address, nil)
+		if (err == nil) != tt.allowed {
+			t.Errorf("publicOnly(%s) = %v, want allowed %v", tt.address, err, tt.allowed)
+		}
+		if err != nil && !isPermanent(err) {
+			t.Errorf("publicOnly(%s) = %v, want a permanent error", tt.address, err)
+		}
+	}
+}
+
+func TestAttachmentFetcherPrivateHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("report"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name         string
+		privateHosts []string
+		wantErr      bool
+	}{
+		{"private address refused", nil, true},
+		{"private host allowed", []string{u.Hostname()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newAttachmentFetcher(0, 0, tt.privateHosts)
+			a := Attachment{URL: server.URL + "/report.txt"}
+			err := f.fetch(&a)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetch() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !isPermanent(err) {
+					t.Errorf("fetch() = %v, want a permanent error", err)
+				}
+				return
+			}
+			if string(a.Content) != "report" || a.Filename != "report.txt" || a.ContentType != "text/plain" {
+				t.Errorf("fetched %+v", a)
+			}
+		})
+	}
+}
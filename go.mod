@@ -2,4 +2,23 @@ module github.com/djaustin/post-room
 
 go 1.16
 
-require github.com/go-redis/redis/v8 v8.11.4
+require (
+	github.com/Masterminds/sprig/v3 v3.2.2
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/emersion/go-msgauth v0.6.5
+	github.com/emersion/go-smtp v0.15.0
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/klauspost/compress v1.15.9
+	github.com/lib/pq v1.10.9
+	github.com/santhosh-tekuri/jsonschema/v5 v5.2.0
+	github.com/vanng822/go-premailer v1.20.2
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/yuin/goldmark v1.4.11
+	go.mozilla.org/pkcs7 v0.0.0-20200128120323-432b2356ecb1
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/text v0.3.6
+	google.golang.org/protobuf v1.26.0
+	modernc.org/sqlite v1.17.3
+	software.sslmate.com/src/go-pkcs12 v0.2.0
+)
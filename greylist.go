@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"regexp"
+	"time"
+)
+
+const (
+	// defaultGreylistDelay outlasts the five minutes most greylisting
+	// servers make first-time senders wait.
+	defaultGreylistDelay = 6 * time.Minute
+
+	greylistedMetric = "post_room_greylisted_total"
+)
+
+func init() {
+	metrics.describe(greylistedMetric, "counter", "Retries put off for GREYLIST_DELAY because the server appeared to be greylisting.")
+}
+
+// greylistReply matches the text of the replies greylisting servers give,
+// such as postgrey's "Greylisted, see ..." or "try again later".
+var greylistReply = regexp.MustCompile(`(?i)gr[ae]y[- ]?list|try again later|please retry later|temporarily rejected|4\.7\.1`)
+
+// isGreylisted reports whether err is a 450 or 451 reply that looks like
+// greylisting: a first delivery from an unknown sender refused until it is
+// retried after a few minutes, which the generic backoff would likely try
+// again too soon and too often.
+func isGreylisted(err error) bool {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) || (reply.Code != 450 && reply.Code != 451) {
+		return false
+	}
+	return greylistReply.MatchString(reply.Msg)
+}
+
+// retryDelay returns how long to wait before retrying mail after err: the
+// greylist delay for greylisting, if it is longer than the backoff, and the
+// backoff otherwise.
+func (m Mailer) retryDelay(err error, attempt int) time.Duration {
+	backoff := retryBackoff(m.retryBackoff, attempt)
+	if m.greylistDelay > backoff && isGreylisted(err) {
+		metrics.add(greylistedMetric, 1)
+		return m.greylistDelay
+	}
+	return backoff
+}
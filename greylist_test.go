@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestIsGreylisted(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&textproto.Error{Code: 450, Msg: "4.2.0 Greylisted, see http://postgrey.schweikert.ch/"}, true},
+		{&textproto.Error{Code: 451, Msg: "4.7.1 Please try again later"}, true},
+		{fmt.Errorf("sending: %w", &textproto.Error{Code: 451, Msg: "grey-listed"}), true},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 local error in processing"}, false},
+		{&textproto.Error{Code: 550, Msg: "greylisted"}, false},
+		{errors.New("try again later"), false},
+	}
+	for _, tt := range tests {
+		if got := isGreylisted(tt.err); got != tt.want {
+			t.Errorf("isGreylisted(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	greylisted := &textproto.Error{Code: 450, Msg: "Greylisted"}
+	deferred := &textproto.Error{Code: 421, Msg: "too many connections"}
+	tests := []struct {
+		name          string
+		greylistDelay time.Duration
+		err           error
+		attempt       int
+		want          time.Duration
+	}{
+		{"greylisted", 6 * time.Minute, greylisted, 1, 6 * time.Minute},
+		{"backoff past the greylist delay", 6 * time.Minute, greylisted, 5, 16 * time.Minute},
+		{"not greylisted", 6 * time.Minute, deferred, 1, time.Minute},
+		{"greylist delay off", 0, greylisted, 1, time.Minute},
+	}
+	for _, tt := range tests {
+		m := Mailer{retryBackoff: time.Minute, greylistDelay: tt.greylistDelay}
+		if got := m.retryDelay(tt.err, tt.attempt); got != tt.want {
+			t.Errorf("%s: retryDelay() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
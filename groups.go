@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const groupPrefix = "group:"
+
+// groupResolver expands "group:<name>" recipients into the group's current
+// members, read from the Redis set group:<name> or, when a directory URL is
+// configured, from a JSON array of addresses served at that URL with
+// {group} replaced by the name.
+type groupResolver struct {
+	rdb          *redis.Client
+	directoryURL string
+	token        string
+	client       *http.Client
+}
+
+func newGroupResolver(rdb *redis.Client, directoryURL, token string) *groupResolver {
+	return &groupResolver{rdb: rdb, directoryURL: directoryURL, token: token, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// expand replaces group aliases in recipients with their members, dropping
+// addresses that appear more than once.
+func (g *groupResolver) expand(recipients []string) ([]string, error) {
+	var expanded []string
+	seen := map[string]bool{}
+	add := func(r string) {
+		key := strings.ToLower(r)
+		if address, err := netmail.ParseAddress(r); err == nil {
+			key = strings.ToLower(address.Address)
+		}
+		if !seen[key] {
+			seen[key] = true
+			expanded = append(expanded, r)
+		}
+	}
+	for _, r := range recipients {
+		if !strings.HasPrefix(r, groupPrefix) {
+			add(r)
+			continue
+		}
+		if g == nil {
+			return nil, fmt.Errorf("cannot expand %s: groups are not configured", r)
+		}
+		members, err := g.members(strings.TrimPrefix(r, groupPrefix))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			add(m)
+		}
+	}
+	return expanded, nil
+}
+
+func (g *groupResolver) members(name string) ([]string, error) {
+	if g.directoryURL == "" {
+		members, err := g.rdb.SMembers(ctx, groupPrefix+name).Result()
+		if err != nil {
+			return nil, fmt.Errorf("error reading members of group %s: %w", name, err)
+		}
+		return members, nil
+	}
+
+	target := strings.ReplaceAll(g.directoryURL, "{group}", url.PathEscape(name))
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up group %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error looking up group %s: unexpected status %s", name, res.Status)
+	}
+	var members []string
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&members); err != nil {
+		return nil, fmt.Errorf("error parsing members of group %s: %w", name, err)
+	}
+	return members, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// protectedHeaders are set by the worker and can't be overridden by a
+// task's Headers, along with any Content-* header.
+var protectedHeaders = map[string]bool{
+	"From":           true,
+	"Sender":         true,
+	"Reply-To":       true,
+	"To":             true,
+	"Cc":             true,
+	"Bcc":            true,
+	"Subject":        true,
+	"Date":           true,
+	"Message-Id":     true,
+	"Return-Path":    true,
+	"Mime-Version":   true,
+	"Dkim-Signature": true,
+	"X-Priority":     true,
+	"Importance":     true,
+	"Received":       true,
+}
+
+// writeCustomHeaders writes a task's own headers in a stable order,
+// rejecting protected and malformed ones.
+func writeCustomHeaders(w io.Writer, headers map[string]string) error {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !validHeaderName(k) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		if name := textproto.CanonicalMIMEHeaderKey(k); protectedHeaders[name] || strings.HasPrefix(name, "Content-") {
+			return fmt.Errorf("header %q can't be set by a task", k)
+		}
+		value := headers[k]
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %q: contains a line break", k)
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, encodeHeader(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasHeader reports whether headers sets name, in any case.
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validHeaderName reports whether name is a valid RFC 5322 field name:
+// printable ASCII except the colon.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < '!' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	historyPath        = "/history"
+	historyTimeFormat  = "2006-01-02T15:04:05.000Z"
+	defaultHistoryRows = 100
+)
+
+// historySchema creates the history table. Times are stored as fixed-width
+// UTC text so they compare the same way in SQLite and Postgres.
+var historySchema = []string{
+	`CREATE TABLE IF NOT EXISTS history (
+		task_id TEXT NOT NULL,
+		queue TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		state TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		headers TEXT NOT NULL,
+		response TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		at TEXT NOT NULL,
+		enqueued_at TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS history_recipient ON history (recipient, at)`,
+	`CREATE INDEX IF NOT EXISTS history_task ON history (task_id, at)`,
+}
+
+// historyDB is the database HISTORY_DSN, or LEDGER_DSN, names: postgres://
+// URLs open Postgres and sqlite:<path> an SQLite file.
+type historyDB struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func openHistory(dsn string) (*historyDB, error) {
+	h, err := openSQL(dsn, "history", historySchema)
+	if err != nil {
+		return nil, err
+	}
+	// Tables created before enqueued_at was recorded gain the column, empty
+	// in existing rows.
+	if _, err := h.db.Exec("SELECT enqueued_at FROM history LIMIT 0"); err != nil {
+		if _, err := h.db.Exec("ALTER TABLE history ADD COLUMN enqueued_at TEXT NOT NULL DEFAULT ''"); err != nil {
+			h.db.Close()
+			return nil, fmt.Errorf("error adding enqueued_at to history table: %w", err)
+		}
+	}
+	return h, nil
+}
+
+// openSQL opens the database dsn names, for what it is to hold, and runs
+// schema on it.
+func openSQL(dsn, what string, schema []string) (*historyDB, error) {
+	h := &historyDB{}
+	var err error
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		h.postgres = true
+		h.db, err = sql.Open("postgres", dsn)
+	case strings.HasPrefix(dsn, "sqlite:"):
+		h.db, err = sql.Open("sqlite", strings.TrimPrefix(dsn, "sqlite:"))
+	default:
+		return nil, fmt.Errorf("unsupported %s database %q: use postgres:// or sqlite:<path>", what, dsn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s database: %w", what, err)
+	}
+	for _, stmt := range schema {
+		if _, err := h.db.Exec(stmt); err != nil {
+			h.db.Close()
+			return nil, fmt.Errorf("error creating %s table: %w", what, err)
+		}
+	}
+	return h, nil
+}
+
+// placeholder returns the nth (from 1) bind parameter in the database's
+// syntax.
+func (h *historyDB) placeholder(n int) string {
+	if h.postgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// historyEvent is one recipient's transition to a state.
+type historyEvent struct {
+	TaskID    string    `json:"taskId"`
+	Queue     string    `json:"queue"`
+	Recipient string    `json:"recipient"`
+	State     string    `json:"state"`
+	Subject   string    `json:"subject"`
+	Headers   string    `json:"headers,omitempty"`
+	Response  string    `json:"response,omitempty"`
+	Attempt   int       `json:"attempt"`
+	At        time.Time `json:"at"`
+}
+
+// historyStore records what happened to a queue's tasks, for audits.
+type historyStore struct {
+	db    *historyDB
+	queue string
+}
+
+// record adds a row per recipient of mail, logging rather than returning any
+// error so that history never holds up sending.
+func (s *historyStore) record(mail Mail, recipients []string, state, response, headers string) {
+	if s == nil {
+		return
+	}
+	at := time.Now().UTC().Format(historyTimeFormat)
+	var enqueued string
+	if mail.EnqueuedAt != nil {
+		enqueued = mail.EnqueuedAt.UTC().Format(historyTimeFormat)
+	}
+	p := s.db.placeholder
+	stmt := fmt.Sprintf("INSERT INTO history (task_id, queue, recipient, state, subject, headers, response, attempt, at, enqueued_at) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s)",
+		p(1), p(2), p(3), p(4), p(5), p(6), p(7), p(8), p(9), p(10))
+	for _, r := range recipients {
+		if address, err := netmail.ParseAddress(r); err == nil {
+			r = address.Address
+		}
+		r = strings.ToLower(r)
+		if _, err := s.db.db.Exec(stmt, mail.ID, s.queue, r, state, mail.Subject, headers, response, mail.Attempt, at, enqueued); err != nil {
+			log.Printf("error recording history of task %s: %v", mail.ID, err)
+			return
+		}
+	}
+}
+
+// messageHeaders returns the header section of a message.
+func messageHeaders(message []byte) string {
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		return string(message[:i])
+	}
+	return string(message)
+}
+
+// historyFilter selects history rows; empty fields match everything.
+type historyFilter struct {
+	TaskID, Recipient, Queue string
+	Since, Until             time.Time
+	Limit                    int
+}
+
+// query returns the matching rows, oldest first.
+func (h *historyDB) query(f historyFilter) ([]historyEvent, error) {
+	var where []string
+	var args []interface{}
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, clause+" "+h.placeholder(len(args)))
+	}
+	if f.TaskID != "" {
+		add("task_id =", f.TaskID)
+	}
+	if f.Recipient != "" {
+		add("recipient =", strings.ToLower(f.Recipient))
+	}
+	if f.Queue != "" {
+		add("queue =", f.Queue)
+	}
+	if !f.Since.IsZero() {
+		add("at >=", f.Since.UTC().Format(historyTimeFormat))
+	}
+	if !f.Until.IsZero() {
+		add("at <", f.Until.UTC().Format(historyTimeFormat))
+	}
+	if f.Limit <= 0 {
+		f.Limit = defaultHistoryRows
+	}
+	q := "SELECT task_id, queue, recipient, state, subject, headers, response, attempt, at FROM history"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY at LIMIT " + strconv.Itoa(f.Limit)
+
+	rows, err := h.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %w", err)
+	}
+	defer rows.Close()
+	var events []historyEvent
+	for rows.Next() {
+		var e historyEvent
+		var at string
+		if err := rows.Scan(&e.TaskID, &e.Queue, &e.Recipient, &e.State, &e.Subject, &e.Headers, &e.Response, &e.Attempt, &at); err != nil {
+			return nil, fmt.Errorf("error reading history: %w", err)
+		}
+		e.At, _ = time.Parse(historyTimeFormat, at)
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history: %w", err)
+	}
+	return events, nil
+}
+
+// parseHistoryFilter reads a filter from query parameters or flags: id,
+// recipient, queue, since and until (RFC 3339 times or dates) and limit.
+func parseHistoryFilter(get func(string) string) (historyFilter, error) {
+	f := historyFilter{TaskID: get("id"), Recipient: get("recipient"), Queue: get("queue")}
+	var err error
+	if f.Since, err = parseHistoryTime(get("since")); err != nil {
+		return f, fmt.Errorf("invalid since: %w", err)
+	}
+	if f.Until, err = parseHistoryTime(get("until")); err != nil {
+		return f, fmt.Errorf("invalid until: %w", err)
+	}
+	if limit := get("limit"); limit != "" {
+		if f.Limit, err = strconv.Atoi(limit); err != nil {
+			return f, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// historyAPI serves GET /history with the rows matching the query
+// parameters.
+type historyAPI struct {
+	db *historyDB
+}
+
+func (a *historyAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := parseHistoryFilter(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events, err := a.db.query(f)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error reading history", http.StatusServiceUnavailable)
+		return
+	}
+	if events == nil {
+		events = []historyEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// runHistory prints the history rows matching its flags as JSON lines.
+func runHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	dsn := fs.String("dsn", getenv(historyDSNKey), "history database")
+	values := map[string]*string{
+		"id":        fs.String("id", "", "task ID"),
+		"recipient": fs.String("recipient", "", "recipient address"),
+		"queue":     fs.String("queue", "", "queue"),
+		"since":     fs.String("since", "", "earliest time, as a date or RFC 3339 time"),
+		"until":     fs.String("until", "", "latest time (exclusive), as a date or RFC 3339 time"),
+		"limit":     fs.String("limit", "", fmt.Sprintf("maximum rows (default %d)", defaultHistoryRows)),
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dsn == "" {
+		return fmt.Errorf("no history database given; use -dsn or %s", historyDSNKey)
+	}
+	f, err := parseHistoryFilter(func(name string) string { return *values[name] })
+	if err != nil {
+		return err
+	}
+	db, err := openHistory(*dsn)
+	if err != nil {
+		return err
+	}
+	defer db.db.Close()
+	events, err := db.query(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
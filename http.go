@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxIngestBytes bounds the webhook payloads the ingest endpoints accept.
+const maxIngestBytes = 1 << 20
+
+// startHTTPServer serves mux on addr in the background.
+func startHTTPServer(addr string, mux *http.ServeMux) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln("HTTP server failed:", err)
+		}
+	}()
+	log.Printf("HTTP server listening on %s", addr)
+	return srv
+}
+
+// stopHTTPServer gives in-flight requests a few seconds to complete.
+func stopHTTPServer(srv *http.Server) {
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(c); err != nil {
+		log.Print("error shutting down HTTP server: ", err)
+	}
+}
+
+// handleWithToken serves next at path behind the bearer token set with
+// tokenKey. Without a token the path isn't served at all, as what is
+// served there mustn't be open to anyone who can reach the port.
+func handleWithToken(mux *http.ServeMux, path, token, tokenKey string, next http.Handler) {
+	if token == "" {
+		log.Printf("not serving %s: %s is not set", path, tokenKey)
+		return
+	}
+	mux.Handle(path, requireToken(token, next))
+}
+
+// readIngestBody reads a request body up to maxIngestBytes.
+func readIngestBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, maxIngestBytes)); err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// requireToken rejects requests without the bearer token, and every
+// request if the token isn't set.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// normalizeLocale lowercases a locale and uses "-" as the separator, so
+// "de_AT" and "de-at" select the same template variant.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// localeChain lists the locales to try for a task, most specific first:
+// "de-at" falls back to "de", then to the default locale's own chain, and
+// finally to "" for the unlocalized template.
+func localeChain(locale, defaultLocale string) []string {
+	var chain []string
+	seen := map[string]bool{}
+	add := func(l string) {
+		for l != "" {
+			if !seen[l] {
+				seen[l] = true
+				chain = append(chain, l)
+			}
+			i := strings.LastIndex(l, "-")
+			if i < 0 {
+				break
+			}
+			l = l[:i]
+		}
+	}
+	add(normalizeLocale(locale))
+	add(normalizeLocale(defaultLocale))
+	return append(chain, "")
+}
+
+// dateLayouts holds the short and long date layouts and month names for the
+// locales with built-in formatting. Other locales use English.
+var dateLayouts = map[string]struct {
+	short, long string
+	months      [12]string
+}{
+	"en":    {"01/02/2006", "January 2, 2006", [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}},
+	"en-gb": {"02/01/2006", "2 January 2006", [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}},
+	"de":    {"02.01.2006", "2. January 2006", [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"}},
+	"fr":    {"02/01/2006", "2 January 2006", [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"}},
+	"es":    {"02/01/2006", "2 de January de 2006", [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}},
+	"it":    {"02/01/2006", "2 January 2006", [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"}},
+	"nl":    {"02-01-2006", "2 January 2006", [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"}},
+	"pt":    {"02/01/2006", "2 de January de 2006", [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"}},
+}
+
+// localeFuncs returns the template helpers bound to locale:
+//
+//	formatDate       short numeric date, e.g. 24.12.2021
+//	formatDateLong   date with the month name, e.g. 24. Dezember 2021
+//	formatNumber     number with locale separators and the given decimals
+//
+// Dates may be time.Time values or RFC 3339 strings, as they arrive from
+// JSON task data.
+func localeFuncs(locale string) template.FuncMap {
+	layouts := dateLayouts["en"]
+	for _, l := range localeChain(locale, "") {
+		if d, ok := dateLayouts[l]; ok {
+			layouts = d
+			break
+		}
+	}
+	tag := language.Make(locale)
+	printer := message.NewPrinter(tag)
+
+	return template.FuncMap{
+		"formatDate": func(v interface{}) (string, error) {
+			t, err := toTime(v)
+			if err != nil {
+				return "", err
+			}
+			return t.Format(layouts.short), nil
+		},
+		"formatDateLong": func(v interface{}) (string, error) {
+			t, err := toTime(v)
+			if err != nil {
+				return "", err
+			}
+			// Go layouts only know English month names, so substitute the
+			// localized name after formatting.
+			return strings.Replace(t.Format(layouts.long), t.Month().String(), layouts.months[t.Month()-1], 1), nil
+		},
+		"formatNumber": func(v interface{}, decimals int) string {
+			return printer.Sprint(number.Decimal(v, number.Scale(decimals)))
+		},
+	}
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q: %w", t, err)
+		}
+		return parsed, nil
+	default:
+		return time.Time{}, fmt.Errorf("cannot format %T as a date", v)
+	}
+}
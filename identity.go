@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	netmail "net/mail"
+	"os"
+)
+
+// identity is an address mail can be sent as, with the Reply-To and DKIM
+// key that go with it. returnPath, if set, is the envelope sender, where
+// bounces go, in place of from, such as an address at a bounce domain.
+type identity struct {
+	from       *netmail.Address
+	returnPath *netmail.Address
+	replyTo    []*netmail.Address
+	dkim       *dkimSigner
+	quota      sendQuota
+}
+
+// envelopeFrom returns the address to give in MAIL FROM.
+func (id *identity) envelopeFrom() *netmail.Address {
+	if id.returnPath != nil {
+		return id.returnPath
+	}
+	return id.from
+}
+
+// identityConfig is an entry in the identities file.
+type identityConfig struct {
+	From       string   `json:"from"`
+	ReturnPath string   `json:"returnPath,omitempty"`
+	ReplyTo    []string `json:"replyTo,omitempty"`
+	DKIM       *struct {
+		Domain   string `json:"domain"`
+		Selector string `json:"selector"`
+		KeyPath  string `json:"keyPath"`
+	} `json:"dkim,omitempty"`
+	Quota sendQuota `json:"quota"`
+}
+
+// loadIdentities reads the named sender identities from a JSON file mapping
+// each name to an identityConfig.
+func loadIdentities(path string) (map[string]*identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identities file: %w", err)
+	}
+	var configs map[string]identityConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing identities file: %w", err)
+	}
+	identities := make(map[string]*identity, len(configs))
+	for name, c := range configs {
+		id, err := newIdentity(c)
+		if err != nil {
+			return nil, fmt.Errorf("error loading identity %q: %w", name, err)
+		}
+		identities[name] = id
+	}
+	return identities, nil
+}
+
+func newIdentity(c identityConfig) (*identity, error) {
+	from, err := netmail.ParseAddress(c.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", c.From, err)
+	}
+	replyTo, err := parseRecipients(c.ReplyTo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply-to address: %w", err)
+	}
+	id := &identity{from: from, replyTo: replyTo, quota: c.Quota}
+	if c.ReturnPath != "" {
+		if id.returnPath, err = netmail.ParseAddress(c.ReturnPath); err != nil {
+			return nil, fmt.Errorf("invalid return path %q: %w", c.ReturnPath, err)
+		}
+	}
+	if c.DKIM != nil {
+		if id.dkim, err = loadDKIMSigner(c.DKIM.Domain, c.DKIM.Selector, c.DKIM.KeyPath); err != nil {
+			return nil, err
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/vanng822/go-premailer/premailer"
+)
+
+// inlineCSS moves the rules from <style> blocks into style attributes on the
+// matching elements, since many mail clients strip style blocks entirely.
+func inlineCSS(html string) (string, error) {
+	p, err := premailer.NewPremailerFromString(html, premailer.NewOptions())
+	if err != nil {
+		return "", fmt.Errorf("error parsing HTML for CSS inlining: %w", err)
+	}
+	inlined, err := p.Transform()
+	if err != nil {
+		return "", fmt.Errorf("error inlining CSS: %w", err)
+	}
+	return inlined, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath evaluates a JSONPath expression against a document decoded from
+// JSON. It supports the subset webhook routes need: member access by dot or
+// bracket notation, array indexes and the [*] wildcard, as in
+// $.alerts[*].labels['alertname']. A wildcard yields a list of the matches.
+func jsonPath(doc interface{}, path string) (interface{}, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	values, wildcard := []interface{}{doc}, false
+	for _, step := range steps {
+		var next []interface{}
+		for _, v := range values {
+			switch {
+			case step == "*":
+				wildcard = true
+				switch c := v.(type) {
+				case []interface{}:
+					next = append(next, c...)
+				case map[string]interface{}:
+					for _, item := range c {
+						next = append(next, item)
+					}
+				}
+			default:
+				if item, ok := jsonPathStep(v, step); ok {
+					next = append(next, item)
+				}
+			}
+		}
+		values = next
+	}
+	if wildcard {
+		return values, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values[0], nil
+}
+
+func jsonPathStep(v interface{}, step string) (interface{}, bool) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		item, ok := c[step]
+		return item, ok
+	case []interface{}:
+		i, err := strconv.Atoi(step)
+		if err != nil {
+			return nil, false
+		}
+		if i < 0 {
+			i += len(c)
+		}
+		if i < 0 || i >= len(c) {
+			return nil, false
+		}
+		return c[i], true
+	}
+	return nil, false
+}
+
+// parseJSONPath splits a path into its member names and indexes.
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSONPath %q: must start with $", path)
+	}
+	var steps []string
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q: empty member name", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q: unterminated [", path)
+			}
+			step := strings.TrimSpace(rest[1:end])
+			if len(step) >= 2 && (step[0] == '\'' || step[0] == '"') && step[len(step)-1] == step[0] {
+				step = step[1 : len(step)-1]
+			}
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q: unexpected %q", path, rest[0])
+		}
+	}
+	return steps, nil
+}
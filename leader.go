@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// leaderTTL is how long leadership outlasts a leader that stops
+	// renewing it, and so how long the loops it runs can go unattended.
+	leaderTTL           = 15 * time.Second
+	leaderRenewInterval = leaderTTL / 3
+
+	leaderMetric = "post_room_leader"
+)
+
+func init() {
+	metrics.describe(leaderMetric, "gauge", "Whether this worker is the leader running the scheduled-send and digest loops.")
+}
+
+// resignScript gives up a lock only if this worker still holds it.
+var resignScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// leaderElection elects one of the replicas consuming a queue to run the
+// loops that must only run once across them: promoting scheduled tasks and
+// flushing digests. The leader holds the <queue>:leader key, which expires
+// unless renewed, so another replica takes over within leaderTTL of the
+// leader stopping. A nil election always leads.
+type leaderElection struct {
+	rdb *redis.Client
+	key string
+	// id is the instance of the worker's heartbeat, so the workers command
+	// can tell which is leading.
+	id string
+
+	mu       sync.Mutex
+	leading  bool
+	resigned bool
+}
+
+func newLeaderElection(rdb *redis.Client, queue, id string) *leaderElection {
+	return &leaderElection{rdb: rdb, key: leaderKey(queue), id: id}
+}
+
+func leaderKey(queue string) string {
+	return queue + ":leader"
+}
+
+// run stands for election until the process exits.
+func (e *leaderElection) run() {
+	metrics.set(leaderMetric, 0)
+	for {
+		e.campaign()
+		time.Sleep(leaderRenewInterval)
+	}
+}
+
+// campaign renews the leadership if held, or takes it if vacant. A leader
+// that can't reach Redis steps down, as its leadership may have lapsed.
+func (e *leaderElection) campaign() {
+	e.mu.Lock()
+	leading, resigned := e.leading, e.resigned
+	e.mu.Unlock()
+	if resigned {
+		return
+	}
+	var err error
+	if leading {
+		var held int
+		held, err = refreshLockScript.Run(ctx, e.rdb, []string{e.key}, e.id, leaderTTL.Milliseconds()).Int()
+		leading = err == nil && held == 1
+	} else {
+		leading, err = e.rdb.SetNX(ctx, e.key, e.id, leaderTTL).Result()
+	}
+	if err != nil {
+		log.Print("error standing for leader: ", err)
+	}
+	e.set(leading)
+}
+
+func (e *leaderElection) set(leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if leading == e.leading {
+		return
+	}
+	e.leading = leading
+	if leading {
+		log.Print("elected leader: running the scheduled-send and digest loops")
+	} else {
+		log.Print("no longer the leader")
+	}
+	metrics.set(leaderMetric, boolGauge(leading))
+}
+
+// leader reports whether this worker is the leader.
+func (e *leaderElection) leader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading
+}
+
+// resign hands over leadership, if held, so another replica can take over
+// without waiting for it to expire, and stops standing for it.
+func (e *leaderElection) resign() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.resigned = true
+	e.mu.Unlock()
+	if !e.leader() {
+		return
+	}
+	e.set(false)
+	if err := resignScript.Run(ctx, e.rdb, []string{e.key}, e.id).Err(); err != nil {
+		log.Print("error resigning leadership: ", err)
+	}
+}
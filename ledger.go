@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultLedgerTTL = 7 * 24 * time.Hour
+
+	ledgerSkippedMetric = "post_room_ledger_skipped_total"
+)
+
+func init() {
+	metrics.describe(ledgerSkippedMetric, "counter", "Recipients not sent to because the processed-task ledger shows them already sent.")
+}
+
+var ledgerSchema = []string{
+	`CREATE TABLE IF NOT EXISTS ledger (
+		idempotency_key TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		task_id TEXT NOT NULL,
+		queue TEXT NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (idempotency_key, recipient)
+	)`,
+}
+
+// processedLedger records which recipients each send has been delivered to,
+// keyed by the task's idempotency key, so that copies of a task enqueued
+// twice, requeued or recovered after a crash don't reach anyone again. It
+// is checked before sending and written after, in a Redis hash at
+// <queue>:ledger:<key> kept for ttl and, if LEDGER_DSN is set, in SQL for
+// good. A worker crashing between the server accepting a message and the
+// ledger being written can still cause a duplicate.
+//
+// While a worker sends a task it holds <queue>:ledger:<key>:claim, so that
+// a copy taken by another worker at the same time waits for it.
+type processedLedger struct {
+	rdb      *redis.Client
+	queue    string
+	ttl      time.Duration
+	claimTTL time.Duration
+	db       *historyDB
+}
+
+func idempotencyKey(mail Mail) string {
+	if mail.IdempotencyKey != "" {
+		return mail.IdempotencyKey
+	}
+	return mail.ID
+}
+
+func (l *processedLedger) key(mail Mail) string {
+	return l.queue + ":ledger:" + idempotencyKey(mail)
+}
+
+// claim takes the task's claim, returning the token to release it with, or
+// "" if another worker holds it.
+func (l *processedLedger) claim(mail Mail) (string, error) {
+	token := newTaskID()
+	ok, err := l.rdb.SetNX(ctx, l.key(mail)+":claim", token, l.claimTTL).Result()
+	if err != nil {
+		return "", fmt.Errorf("error claiming task %s: %w", mail.ID, err)
+	}
+	if !ok {
+		return "", nil
+	}
+	return token, nil
+}
+
+func (l *processedLedger) release(mail Mail, token string) {
+	if err := resignScript.Run(ctx, l.rdb, []string{l.key(mail) + ":claim"}, token).Err(); err != nil {
+		log.Printf("error releasing claim on task %s: %v", mail.ID, err)
+	}
+}
+
+// unsent returns the recipients the ledger doesn't show as sent to. If the
+// ledger can't be read it says so and returns them all, since a possible
+// duplicate is better than mail not sent.
+func (l *processedLedger) unsent(mail Mail, recipients []*netmail.Address) []*netmail.Address {
+	if l == nil || len(recipients) == 0 {
+		return recipients
+	}
+	fields := make([]string, len(recipients))
+	for i, r := range recipients {
+		fields[i] = strings.ToLower(r.Address)
+	}
+	sent, err := l.rdb.HMGet(ctx, l.key(mail), fields...).Result()
+	if err != nil {
+		log.Printf("error reading ledger of task %s: %v", mail.ID, err)
+		return recipients
+	}
+	done := map[string]bool{}
+	var unknown []string
+	for i, v := range sent {
+		if v != nil {
+			done[fields[i]] = true
+		} else {
+			unknown = append(unknown, fields[i])
+		}
+	}
+	if l.db != nil && len(unknown) > 0 {
+		found, err := l.sentInSQL(idempotencyKey(mail), unknown)
+		if err != nil {
+			log.Printf("error reading ledger of task %s: %v", mail.ID, err)
+		}
+		for _, r := range found {
+			done[r] = true
+		}
+	}
+	if len(done) == 0 {
+		return recipients
+	}
+	var remaining []*netmail.Address
+	for i, r := range recipients {
+		if !done[fields[i]] {
+			remaining = append(remaining, r)
+		}
+	}
+	skipped := len(recipients) - len(remaining)
+	log.Printf("task %s was already sent to %d of its %d recipients; skipping them", mail.ID, skipped, len(recipients))
+	metrics.add(ledgerSkippedMetric, float64(skipped))
+	return remaining
+}
+
+func (l *processedLedger) sentInSQL(key string, recipients []string) ([]string, error) {
+	args := []interface{}{key}
+	var in []string
+	for _, r := range recipients {
+		args = append(args, r)
+		in = append(in, l.db.placeholder(len(args)))
+	}
+	rows, err := l.db.db.Query("SELECT recipient FROM ledger WHERE idempotency_key = "+l.db.placeholder(1)+" AND recipient IN ("+strings.Join(in, ", ")+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		found = append(found, r)
+	}
+	return found, rows.Err()
+}
+
+// deliveredTo returns the recipients not among failures.
+func deliveredTo(recipients []*netmail.Address, failures []deliveryFailure) []*netmail.Address {
+	failed := map[string]bool{}
+	for _, f := range failures {
+		for _, r := range f.recipients {
+			failed[strings.ToLower(r.Address)] = true
+		}
+	}
+	var delivered []*netmail.Address
+	for _, r := range recipients {
+		if !failed[strings.ToLower(r.Address)] {
+			delivered = append(delivered, r)
+		}
+	}
+	return delivered
+}
+
+// markSent records that mail was delivered to recipients.
+func (l *processedLedger) markSent(mail Mail, recipients []*netmail.Address) {
+	if l == nil || len(recipients) == 0 {
+		return
+	}
+	at := time.Now().UTC().Format(historyTimeFormat)
+	values := make([]interface{}, 0, 2*len(recipients))
+	for _, r := range recipients {
+		values = append(values, strings.ToLower(r.Address), at)
+	}
+	pipe := l.rdb.TxPipeline()
+	pipe.HSet(ctx, l.key(mail), values...)
+	pipe.Expire(ctx, l.key(mail), l.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("error recording task %s in the ledger: %v", mail.ID, err)
+	}
+	if l.db == nil {
+		return
+	}
+	p := l.db.placeholder
+	stmt := fmt.Sprintf("INSERT INTO ledger (idempotency_key, recipient, task_id, queue, sent_at) VALUES (%s, %s, %s, %s, %s) ON CONFLICT DO NOTHING",
+		p(1), p(2), p(3), p(4), p(5))
+	for _, r := range recipients {
+		if _, err := l.db.db.Exec(stmt, idempotencyKey(mail), strings.ToLower(r.Address), mail.ID, l.queue, at); err != nil {
+			log.Printf("error recording task %s in the ledger: %v", mail.ID, err)
+			return
+		}
+	}
+}
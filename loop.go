@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const defaultLoopWindow = time.Hour
+
+// countSendScript increments a recipient's send count, starting its window
+// on the first send.
+var countSendScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// loopGuard stops sending to a recipient that has been sent more than limit
+// messages within window, which is what an auto-responder answering our own
+// automated mail looks like. Counts are kept at <queue>:loop:<hash>, keyed
+// by the addressHash of each recipient.
+type loopGuard struct {
+	rdb    *redis.Client
+	queue  string
+	limit  int64
+	window time.Duration
+}
+
+func (g *loopGuard) key(address string) string {
+	return g.queue + ":loop:" + addressHash(address)
+}
+
+// check counts a send to each recipient and splits off those over the limit,
+// with the reason for each.
+func (g *loopGuard) check(recipients []*netmail.Address) (allowed, blocked []*netmail.Address, reasons []string, err error) {
+	if g == nil {
+		return recipients, nil, nil, nil
+	}
+	for _, r := range recipients {
+		n, err := countSendScript.Run(ctx, g.rdb, []string{g.key(r.Address)}, g.window.Milliseconds()).Int64()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error counting sends to %s: %w", r.Address, err)
+		}
+		if n > g.limit {
+			blocked = append(blocked, r)
+			reasons = append(reasons, fmt.Sprintf("%s was sent %d messages within %s", r.Address, n, g.window))
+			continue
+		}
+		allowed = append(allowed, r)
+	}
+	return allowed, blocked, reasons, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	netmail "net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopGuardCheck(t *testing.T) {
+	rdb := newTestRedis(t)
+	g := &loopGuard{rdb: rdb, queue: "tasks", limit: 2, window: time.Hour}
+	ada, bob := &netmail.Address{Address: "ada@example.com"}, &netmail.Address{Address: "bob@example.com"}
+	tests := []struct {
+		recipients []*netmail.Address
+		blocked    int
+	}{
+		{[]*netmail.Address{ada}, 0},
+		{[]*netmail.Address{{Address: "Ada@Example.com"}, bob}, 0},
+		{[]*netmail.Address{ada, bob}, 1},
+	}
+	for i, tt := range tests {
+		_, blocked, _, err := g.check(tt.recipients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blocked) != tt.blocked {
+			t.Errorf("send %d blocked %d recipients, want %d", i, len(blocked), tt.blocked)
+		}
+	}
+	keys, _ := rdb.Keys(ctx, "*").Result()
+	for _, key := range keys {
+		if strings.Contains(strings.ToLower(key), "example.com") {
+			t.Errorf("key %s names a recipient", key)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+type Mailer struct {
+	host, port string
+	// helo is the name the worker gives in EHLO.
+	helo       string
+	sender     *identity
+	identities map[string]*identity
+	auth       smtp.Auth
+	signer     *smimeSigner
+	keyring    *pgpKeyring
+	fetcher    *attachmentFetcher
+	scanner    *clamAVScanner
+	templates  *templateStore
+	redisTpl   *redisTemplateStore
+	inlineCSS  bool
+	tracker    *tracker
+	groups     *groupResolver
+	// pdf converts attachments rendered from templates to PDF.
+	pdf *pdfRenderer
+	// mx, when set, delivers directly to recipient domains instead of
+	// through the relay at host:port.
+	mx *mxTransport
+	// fallback tries other relay ports when port can't be connected to.
+	fallback *portFallback
+	// retries schedules tasks that failed transiently for another attempt.
+	retries       *scheduler
+	retryAttempts int
+	retryBackoff  time.Duration
+	// greylistDelay is how long to wait before retrying after greylisting,
+	// or zero to treat it like any other deferral.
+	greylistDelay time.Duration
+	status        *statusStore
+	timeouts      smtpTimeouts
+	// maxMessageBytes caps message size below what the server advertises.
+	maxMessageBytes int64
+	preflight       *preflight
+	// recipientPolicy restricts the domains sent to.
+	recipientPolicy *recipientPolicy
+	loops           *loopGuard
+	history         *historyStore
+	archive         *archive
+	// archiveBCC is blind copied on every message, in the same transaction
+	// or, with archiveSeparate and for direct delivery, in one of its own.
+	archiveBCC      *netmail.Address
+	archiveSeparate bool
+	dead            *deadLetters
+	// run counts outcomes when the worker runs once.
+	run *runOnce
+	// alerts counts outcomes for the failure-rate alert.
+	alerts *failureAlerter
+	// autoSubmitted and precedence mark mail as automated, so that
+	// auto-responders don't answer it.
+	autoSubmitted bool
+	precedence    string
+	// receiptAddress is where read receipts are asked to be sent, instead
+	// of the sender's address.
+	receiptAddress *netmail.Address
+	// senderDomains lists the domains tasks may send from with Mail.From.
+	senderDomains []string
+	// debug logs the SMTP dialogue of failed sends.
+	debug bool
+	// chaos injects faults into deliveries, for testing.
+	chaos *chaosInjector
+	// ledger skips recipients a copy of the task was already sent to.
+	ledger *processedLedger
+	// domains limits sends to recipient domains and backs off from those
+	// deferring mail. It is shared by every tenant.
+	domains *domainLimiter
+	// rendered keeps the messages rendered for tasks, to resend unchanged.
+	rendered *renderCache
+}
+
+// delivery is one SMTP transaction within a send. Recipients with PGP keys
+// get a separately encrypted copy of the message.
+type delivery struct {
+	to   []string
+	keys openpgp.EntityList
+}
+
+func (m Mailer) sendMail(mail Mail) {
+	if m.ledger != nil {
+		token, err := m.ledger.claim(mail)
+		switch {
+		case err != nil:
+			log.Print(err)
+		case token == "":
+			// Another worker is sending a copy; whatever it doesn't get
+			// to is sent once its claim has run out. The task comes back
+			// with its ID, so dedup doesn't take it for a duplicate.
+			at := time.Now().Add(m.ledger.claimTTL)
+			log.Printf("task %s is being sent by another worker; looking again at %s", mail.ID, at.Format(time.RFC3339))
+			if m.retries != nil {
+				if err := m.retries.schedule(mail, at); err != nil {
+					log.Print(err)
+				}
+			}
+			return
+		default:
+			defer m.ledger.release(mail, token)
+		}
+	}
+	recipients, err := m.groups.expand(mail.Recipients)
+	if err != nil {
+		log.Print("error expanding recipient groups: ", err)
+		return
+	}
+	mail.Recipients = recipients
+	if !mail.Split && len(mail.RecipientData) == 0 {
+		m.deliverMail(mail)
+		return
+	}
+	for _, r := range mail.Recipients {
+		m.deliverMail(personalize(mail, r))
+	}
+}
+
+// personalize returns the copy of mail sent to a single recipient, with
+// that recipient's data merged over the shared data.
+func personalize(mail Mail, recipient string) Mail {
+	mail.Recipients = []string{recipient}
+	mail.Split = false
+	if len(mail.RecipientData) == 0 {
+		return mail
+	}
+	fields, ok := mail.RecipientData[recipient]
+	if !ok {
+		if address, err := netmail.ParseAddress(recipient); err == nil {
+			fields = mail.RecipientData[address.Address]
+		}
+	}
+	data := make(map[string]interface{}, len(mail.Data)+len(fields))
+	for k, v := range mail.Data {
+		data[k] = v
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+	mail.Data = data
+	return mail
+}
+
+func (m Mailer) deliverMail(mail Mail) {
+	recipients, err := parseRecipients(mail.Recipients)
+	if err != nil {
+		log.Print("error parsing recipients: ", err)
+		return
+	}
+	if m.recipientPolicy != nil {
+		var blocked []*netmail.Address
+		var reasons []string
+		recipients, blocked, reasons = m.recipientPolicy.check(recipients)
+		if len(blocked) > 0 {
+			denied := mail
+			denied.Recipients = formatRecipients(blocked)
+			m.dead.add(denied, "recipient domain not allowed: "+strings.Join(reasons, "; "))
+			m.history.record(denied, denied.Recipients, taskFailed, strings.Join(reasons, "; "), "")
+		}
+		mail.Recipients = formatRecipients(recipients)
+	}
+	if m.preflight != nil {
+		var rejected []*netmail.Address
+		var reasons []string
+		recipients, rejected, reasons = m.preflight.check(recipients)
+		if len(rejected) > 0 {
+			undeliverable := mail
+			undeliverable.Recipients = formatRecipients(rejected)
+			m.dead.add(undeliverable, "undeliverable: "+strings.Join(reasons, "; "))
+			m.history.record(undeliverable, undeliverable.Recipients, taskFailed, strings.Join(reasons, "; "), "")
+		}
+		mail.Recipients = formatRecipients(recipients)
+	}
+	if m.loops != nil {
+		var blocked []*netmail.Address
+		var reasons []string
+		recipients, blocked, reasons, err = m.loops.check(recipients)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if len(blocked) > 0 {
+			looping := mail
+			looping.Recipients = formatRecipients(blocked)
+			m.dead.add(looping, "possible mail loop: "+strings.Join(reasons, "; "))
+			m.history.record(looping, looping.Recipients, taskFailed, strings.Join(reasons, "; "), "")
+		}
+		mail.Recipients = formatRecipients(recipients)
+	}
+	if m.ledger != nil && len(recipients) > 0 {
+		unsent := m.ledger.unsent(mail, recipients)
+		if len(unsent) == 0 {
+			return
+		}
+		recipients, mail.Recipients = unsent, formatRecipients(unsent)
+	}
+	if len(recipients) == 0 {
+		log.Print("error sending email: no recipients")
+		return
+	}
+	sender, err := m.senderFor(mail)
+	if err != nil {
+		log.Print("error setting sender: ", err)
+		return
+	}
+	// Attachments that can't be fetched are retried, but those at private
+	// addresses fail for good.
+	if err := m.fetcher.resolve(mail.Inline); err != nil {
+		m.fail(mail, deliveryFailure{recipients: recipients, err: err})
+		return
+	}
+	if err := m.fetcher.resolve(mail.Attachments); err != nil {
+		m.fail(mail, deliveryFailure{recipients: recipients, err: err})
+		return
+	}
+	if mail.Attachments, err = m.renderAttachments(mail); err != nil {
+		m.fail(mail, deliveryFailure{recipients: recipients, err: err})
+		return
+	}
+	if err := m.scanner.scan(append(mail.Inline, mail.Attachments...)); err != nil {
+		m.fail(mail, deliveryFailure{recipients: recipients, err: err})
+		return
+	}
+	if mail.Template != "" {
+		mail.Message, err = m.renderTemplate(mail)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		mail.MessageFormat = messageFormatHTML
+	} else if len(mail.RecipientData) > 0 {
+		mail.Message, err = renderInline(mail.Message, mail.Locale, mail.Data)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	if mail.Sanitize && mail.Template == "" && mail.MessageFormat != messageFormatMarkdown {
+		mail.Message = contentSanitizer.sanitize(mail.Message)
+	}
+	if m.shouldInlineCSS(mail) {
+		if mail.Message, err = inlineCSS(mail.Message); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	log.Printf("sending email to SMTP server...\n")
+	sendCtx, cancel := context.WithTimeout(ctx, m.timeouts.send)
+	defer cancel()
+	var dialogue *transcript
+	if m.debug {
+		dialogue = &transcript{}
+		sendCtx = withTranscript(sendCtx, dialogue)
+	}
+	replies := newServerReplies()
+	failures := m.deliver(sendCtx, recipients, func(c *smtp.Client, to []*netmail.Address) error {
+		return m.sendSession(c, sender, recipients, to, mail, replies)
+	})
+	if len(failures) > 0 && dialogue != nil {
+		log.Printf("SMTP dialogue of task %s:\n%s", mail.ID, dialogue)
+	}
+	for _, f := range failures {
+		replies.set(envelopeAddresses(f.recipients), smtpReply(f.err))
+	}
+	if m.status != nil {
+		if err := m.status.recordReplies(mail.ID, recipients, replies); err != nil {
+			log.Print(err)
+		}
+	}
+	m.ledger.markSent(mail, deliveredTo(recipients, failures))
+	m.domains.record(recipients, failures)
+	for _, f := range failures {
+		m.fail(mail, f)
+	}
+	failed := 0
+	for _, f := range failures {
+		failed += len(f.recipients)
+	}
+	if m.archiveBCC != nil && (m.archiveSeparate || m.mx != nil) && failed < len(recipients) {
+		// The archive copy isn't retried on its own; it is only worth
+		// having alongside a message that went out.
+		archived := m.deliver(sendCtx, []*netmail.Address{m.archiveBCC}, func(c *smtp.Client, to []*netmail.Address) error {
+			return m.sendSession(c, sender, recipients, to, mail, nil)
+		})
+		for _, f := range archived {
+			log.Printf("error sending archive copy of task %s: %v", mail.ID, f.err)
+		}
+	}
+	if len(failures) == 0 {
+		m.rendered.drop(mail)
+		m.recordResult(mail, taskSent, "")
+		log.Print("email sent successfully")
+	}
+}
+
+// deliver connects to the relay, or with direct delivery to each recipient
+// domain's mail servers, and calls send to transmit to the recipients
+// reached through each connection, all within the deadline of sendCtx.
+func (m Mailer) deliver(sendCtx context.Context, recipients []*netmail.Address, send func(*smtp.Client, []*netmail.Address) error) []deliveryFailure {
+	if err := m.chaos.inject(sendCtx); err != nil {
+		return []deliveryFailure{{recipients: recipients, err: err}}
+	}
+	if m.mx != nil {
+		return m.mx.deliver(sendCtx, recipients, send)
+	}
+	c, err := m.dial(sendCtx)
+	if err != nil {
+		return []deliveryFailure{{recipients: recipients, err: err}}
+	}
+	defer c.Close()
+	err = send(c, recipients)
+	var partial *partialDelivery
+	if err != nil && !errors.As(err, &partial) {
+		return []deliveryFailure{{recipients: recipients, err: err}}
+	}
+	if err := c.Quit(); err != nil {
+		log.Print("error closing SMTP session: ", err)
+	}
+	return failuresOf(recipients, err)
+}
+
+// sendSession transmits mail to the recipients in to over an established
+// connection, collecting the server's replies to them in replies. all holds
+// every recipient of the message for its headers. Errors other than the
+// server's replies are permanent. If the server refuses some recipients,
+// the message still goes to the rest and a partialDelivery is returned.
+func (m Mailer) sendSession(c *smtp.Client, sender *identity, all, to []*netmail.Address, mail Mail, replies *serverReplies) error {
+	// Without SMTPUTF8 the envelope and headers must be ASCII, so IDN domains
+	// are converted to punycode. Non-ASCII local parts cannot be represented
+	// and are rejected rather than being mangled by the relay.
+	requested := to
+	bcc := m.archiveBCC
+	utf8, _ := c.Extension("SMTPUTF8")
+	if !utf8 {
+		var err error
+		if bcc != nil {
+			if bcc, err = asciiAddress(bcc); err != nil {
+				return permanent(fmt.Errorf("error encoding archive address: %w", err))
+			}
+		}
+		converted := *sender
+		if converted.from, err = asciiAddress(sender.from); err != nil {
+			return permanent(fmt.Errorf("error encoding sender address: %w", err))
+		}
+		if sender.returnPath != nil {
+			if converted.returnPath, err = asciiAddress(sender.returnPath); err != nil {
+				return permanent(fmt.Errorf("error encoding return path: %w", err))
+			}
+		}
+		if converted.replyTo, err = asciiAddresses(sender.replyTo); err != nil {
+			return permanent(fmt.Errorf("error encoding reply-to address: %w", err))
+		}
+		sender = &converted
+		if all, err = asciiAddresses(all); err != nil {
+			return permanent(fmt.Errorf("error encoding recipient address: %w", err))
+		}
+		if to, err = asciiAddresses(to); err != nil {
+			return permanent(fmt.Errorf("error encoding recipient address: %w", err))
+		}
+	}
+
+	// Refusals are reported against the recipients as the task gave them.
+	recipientOf := map[string]*netmail.Address{}
+	for i, r := range to {
+		recipientOf[strings.ToLower(r.Address)] = requested[i]
+	}
+
+	deliveries := []delivery{{to: envelopeAddresses(to)}}
+	if m.keyring != nil {
+		keys, encrypted, plain, err := m.keyring.partition(envelopeAddresses(to))
+		if err != nil {
+			return fmt.Errorf("error looking up PGP keys: %w", err)
+		}
+		deliveries = nil
+		if len(encrypted) > 0 {
+			deliveries = append(deliveries, delivery{to: encrypted, keys: keys})
+		}
+		if len(plain) > 0 {
+			deliveries = append(deliveries, delivery{to: plain})
+		}
+	}
+
+	if bcc != nil && !m.archiveSeparate && m.mx == nil {
+		// Journaling mailboxes want a readable copy, so the archive rides
+		// along with the last, unencrypted where possible, transaction.
+		last := &deliveries[len(deliveries)-1]
+		last.to = append(last.to, bcc.Address)
+	}
+
+	env, err := envelopeFor(c, mail)
+	if err != nil {
+		return err
+	}
+	var rejected refusals
+	for _, d := range deliveries {
+		build := func() ([]byte, error) { return m.buildMessage(sender, all, mail, d.keys) }
+		message, err := m.rendered.render(mail, renderVariant(utf8, d.keys), build)
+		if err != nil {
+			return permanent(fmt.Errorf("error building message: %w", err))
+		}
+		if err := m.checkSize(c, message); err != nil {
+			return err
+		}
+		reply, refused, err := m.transmit(c, sender.envelopeFrom().Address, d.to, env, message)
+		if err != nil {
+			return err
+		}
+		var accepted []string
+		for _, address := range d.to {
+			err, ok := refused[address]
+			if !ok {
+				accepted = append(accepted, address)
+			} else if r, ok := recipientOf[strings.ToLower(address)]; ok {
+				rejected.add(r, err)
+			} else {
+				log.Printf("error sending archive copy of task %s: %v", mail.ID, err)
+			}
+		}
+		if len(accepted) == 0 {
+			continue
+		}
+		replies.set(accepted, reply)
+		m.history.record(mail, accepted, taskSent, reply, messageHeaders(message))
+		m.archive.add(mail, message)
+		if mail.ReadReceipt && m.status != nil {
+			if err := m.status.expectReceipt(mail.ID, sentMessageID(message)); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	return rejected.err()
+}
+
+// senderFor returns the identity mail is sent as: the named identity or the
+// worker's default, with its address replaced by the task's own From if that
+// names an allowed domain.
+func (m Mailer) senderFor(mail Mail) (*identity, error) {
+	sender := m.sender
+	if mail.Identity != "" {
+		var ok bool
+		if sender, ok = m.identities[mail.Identity]; !ok {
+			return nil, fmt.Errorf("unknown sender identity %q", mail.Identity)
+		}
+	}
+	if mail.From == "" {
+		return sender, nil
+	}
+	from, err := netmail.ParseAddress(mail.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", mail.From, err)
+	}
+	domain := addressDomain(from)
+	for _, allowed := range m.senderDomains {
+		if domain == allowed {
+			override := *sender
+			override.from = from
+			return &override, nil
+		}
+	}
+	return nil, fmt.Errorf("sender domain %q is not allowed by %s", domain, senderDomainsKey)
+}
+
+// renderTemplate renders the task's template, preferring a version stored in
+// Redis over the template directory.
+func (m Mailer) renderTemplate(mail Mail) (string, error) {
+	if m.redisTpl != nil {
+		html, found, err := m.redisTpl.render(mail.Template, mail.TemplateVersion, mail.Locale, mail.Data)
+		if found || err != nil {
+			return html, err
+		}
+	}
+	if mail.TemplateVersion != "" {
+		return "", fmt.Errorf("unknown version %q of template %q", mail.TemplateVersion, mail.Template)
+	}
+	if m.templates == nil {
+		return "", fmt.Errorf("error rendering template %q: no %s configured", mail.Template, templateDirKey)
+	}
+	return m.templates.render(mail.Template, mail.Locale, mail.Data)
+}
+
+// shouldInlineCSS reports whether the HTML body should have its styles
+// inlined, preferring the template's own setting over the worker default.
+func (m Mailer) shouldInlineCSS(mail Mail) bool {
+	if mail.MessageFormat != "" && mail.MessageFormat != messageFormatHTML {
+		return false
+	}
+	if mail.Template != "" {
+		if inline := m.templates.config(mail.Template).InlineCSS; inline != nil {
+			return *inline
+		}
+	}
+	return m.inlineCSS
+}
+
+// dial connects to the SMTP server and, when credentials are configured,
+// upgrades to TLS where offered and authenticates.
+func (m Mailer) dial(sendCtx context.Context) (*smtp.Client, error) {
+	var c *smtp.Client
+	var err error
+	ports := m.fallback.order(m.port)
+	for i, port := range ports {
+		if c, err = m.connect(sendCtx, port); err == nil {
+			m.fallback.worked(m.host, port, m.tlsMode(port))
+			break
+		}
+		if i < len(ports)-1 {
+			log.Printf("error connecting to %s with %s, trying port %s: %v", net.JoinHostPort(m.host, port), m.tlsMode(port), ports[i+1], err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.auth == nil {
+		return c, nil
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		c.Close()
+		return nil, errors.New("server doesn't support AUTH")
+	}
+	if err := c.Auth(m.auth); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error authenticating: %w", err)
+	}
+	return c, nil
+}
+
+// connect starts a session with the relay on port, secured as the port
+// calls for: over TLS from the start on 465 and otherwise, if there are
+// credentials to protect, with STARTTLS when the server offers it.
+func (m Mailer) connect(sendCtx context.Context, port string) (*smtp.Client, error) {
+	implicit := m.implicitTLS(port)
+	c, conn, err := m.timeouts.connect(sendCtx, net.JoinHostPort(m.host, port), m.host, m.helo, implicit)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to remote SMTP host: %w", err)
+	}
+	if implicit != nil || m.auth == nil {
+		return c, nil
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := startTLS(c, conn, &tls.Config{ServerName: m.host}); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("error starting TLS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// transmit sends a single message over an established connection, and
+// returns the server's reply accepting it. Recipients the server refuses
+// are returned with its replies, and the message goes to the others; if it
+// refuses them all, nothing is sent. The SMTPUTF8 parameter is added to
+// MAIL FROM when the server advertises it, along with any DSN parameters
+// in e.
+func (m Mailer) transmit(c *smtp.Client, from string, to []string, e envelope, message []byte) (string, map[string]error, error) {
+	// Set the sender and recipients first
+	if err := mailFrom(c, from, e); err != nil {
+		return "", nil, fmt.Errorf("error setting sender address: %w", err)
+	}
+	refused := map[string]error{}
+	for _, recipient := range to {
+		err := rcptTo(c, recipient, e)
+		var reply *textproto.Error
+		if errors.As(err, &reply) {
+			refused[recipient] = fmt.Errorf("error setting recipient address %s: %w", recipient, err)
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("error setting recipient address %s: %w", recipient, err)
+		}
+	}
+	if len(refused) == len(to) {
+		if err := c.Reset(); err != nil {
+			return "", nil, fmt.Errorf("error resetting SMTP session: %w", err)
+		}
+		return "", refused, nil
+	}
+
+	// Send the email body. net/smtp's Data discards the final reply, which
+	// often carries the relay's ID for the message, so DATA is issued here.
+	if err := command(c, 354, "DATA"); err != nil {
+		return "", nil, fmt.Errorf("error issuing DATA command to remote SMTP host: %w", err)
+	}
+	wc := c.Text.DotWriter()
+	if _, err := wc.Write(message); err != nil {
+		return "", nil, fmt.Errorf("error writing message body: %w", err)
+	}
+	if err := wc.Close(); err != nil {
+		return "", nil, fmt.Errorf("error closing message body writer: %w", err)
+	}
+	code, msg, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", nil, fmt.Errorf("error closing message body writer: %w", err)
+	}
+	return fmt.Sprintf("%03d %s", code, msg), refused, nil
+}
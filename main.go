@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	netmail "net/mail"
 	"net/smtp"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -17,192 +21,1427 @@ import (
 var ctx = context.Background()
 
 type Mail struct {
+	// ID identifies the task in the status store. Tasks enqueued without one
+	// are assigned an ID when dequeued.
+	ID string `json:"id,omitempty"`
+	// From overrides the worker's sender address. Its domain must be
+	// allowed by SENDER_DOMAINS.
+	From string `json:"from,omitempty"`
+	// Identity names one of the sender identities from IDENTITIES_FILE to
+	// send as instead of SENDER_ADDRESS.
+	Identity string `json:"identity,omitempty"`
+	// Priority is "high", "normal" or "low", set as the X-Priority and
+	// Importance headers. High priority tasks enqueued by the worker itself
+	// go to the priority list, which is consumed ahead of the queue.
+	Priority   string   `json:"priority,omitempty"`
 	Subject    string   `json:"subject"`
 	Message    string   `json:"message"`
 	Recipients []string `json:"recipients"`
+	// MessageFormat is "html" (the default) or "markdown".
+	MessageFormat string `json:"messageFormat,omitempty"`
+	// Template names a template from TEMPLATE_DIR rendered with Data to
+	// produce the message body, in place of Message.
+	Template string                 `json:"template,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	// TemplateVersion pins a version of a template stored in Redis.
+	TemplateVersion string `json:"templateVersion,omitempty"`
+	// Locale selects a localized variant of Template, e.g. "de-AT".
+	Locale string `json:"locale,omitempty"`
+	// Split sends each recipient an individual message instead of one
+	// message addressed to all of them.
+	Split bool `json:"split,omitempty"`
+	// RecipientData holds per-recipient fields merged over Data, keyed by
+	// recipient address. It implies Split; without a Template the Message
+	// itself is rendered as a template.
+	RecipientData map[string]map[string]interface{} `json:"recipientData,omitempty"`
+	// TrackOpens overrides whether an open-tracking pixel is injected.
+	TrackOpens *bool `json:"trackOpens,omitempty"`
+	// TrackClicks overrides whether links are rewritten for click tracking.
+	TrackClicks *bool `json:"trackClicks,omitempty"`
+	// UTM holds campaign parameters (source, medium, campaign, term,
+	// content) appended to every link, over the template's own.
+	UTM map[string]string `json:"utm,omitempty"`
+	// Inline holds assets referenced from the HTML body as cid: URLs.
+	Inline      []Attachment `json:"inline,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Event, when set, is sent as a calendar invitation alongside the body.
+	Event *Event `json:"event,omitempty"`
+	// Digest buffers the task to be sent to each recipient as part of a
+	// periodic digest rather than on its own.
+	Digest bool `json:"digest,omitempty"`
+	// Campaign expands the task into one send per address in a Redis list.
+	Campaign *campaign `json:"campaign,omitempty"`
+	// DeliveryWindow restricts when the task may be sent, in the
+	// recipient's Timezone (an IANA name such as "Europe/Berlin"). Tasks
+	// without one use DELIVERY_WINDOW unless they are Urgent.
+	DeliveryWindow *deliveryWindow `json:"deliveryWindow,omitempty"`
+	Timezone       string          `json:"timezone,omitempty"`
+	Urgent         bool            `json:"urgent,omitempty"`
+	// DSN requests delivery status notifications under the given NOTIFY
+	// conditions ("success", "failure", "delay" or "never") from servers
+	// supporting the extension, with the task ID as the envelope ID.
+	DSN []string `json:"dsn,omitempty"`
+	// Attempt counts the failed delivery attempts the task has been
+	// retried after.
+	Attempt int `json:"attempt,omitempty"`
+	// CollapseKey is set by the worker on a task held back to collect
+	// duplicates of it.
+	CollapseKey string `json:"collapseKey,omitempty"`
+	// Headers are added to the message as they are, such as List-ID or
+	// X-Campaign-ID. Headers the worker sets itself, like From and
+	// Return-Path, are rejected.
+	Headers map[string]string `json:"headers,omitempty"`
+	// SkipSigning opts this task out of S/MIME signing.
+	SkipSigning bool `json:"skipSigning,omitempty"`
+	// Sanitize runs an HTML Message that isn't a Template through the HTML
+	// sanitizer once rendered, for bodies built from content users supplied.
+	// Templates sanitize such content themselves with their sanitize
+	// function.
+	Sanitize bool `json:"sanitize,omitempty"`
+	// ReadReceipt asks recipients' mail clients for a read receipt with a
+	// Disposition-Notification-To header. Receipts posted back to the
+	// receipt processor are recorded in the task's status.
+	ReadReceipt bool `json:"readReceipt,omitempty"`
+	// Preheader is the preview text clients show after the subject, added
+	// hidden at the top of the HTML body. Without it they show the first
+	// text of the message.
+	Preheader string `json:"preheader,omitempty"`
+	// EnqueuedAt is when the task was pushed onto the queue, set by the
+	// worker's own producers, from which its time in the queue is measured.
+	EnqueuedAt *time.Time `json:"enqueuedAt,omitempty"`
+	// IdempotencyKey identifies the send to the processed-task ledger, so
+	// that copies of a task enqueued more than once aren't sent again. It
+	// defaults to the task's ID.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+}
+
+// Attachment is a file carried in the task payload. Content is base64 in JSON;
+// alternatively URL names an http(s):// or s3:// location the worker fetches
+// it from, optionally verified against a hex SHA-256 checksum, or Template
+// and Render have it rendered for the task.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+	ContentID   string `json:"contentId,omitempty"`
+	Content     []byte `json:"content,omitempty"`
+	URL         string `json:"url,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	// Template names a template rendered with the task's data and locale
+	// for the content, which is HTML unless Render converts it.
+	Template string `json:"template,omitempty"`
+	// Render is "pdf" to convert the HTML of Template or Content to PDF
+	// with PDF_RENDERER, or "csv" or "xlsx" to write a spreadsheet of Rows
+	// under a header row of Columns, or of the list of objects at the Data
+	// key of the task's data.
+	Render  string          `json:"render,omitempty"`
+	Data    string          `json:"data,omitempty"`
+	Columns []string        `json:"columns,omitempty"`
+	Rows    [][]interface{} `json:"rows,omitempty"`
 }
 
 type AppOptions struct {
 	SMTPUsername, SMTPPassword, SMTPHost, SMTPPort, SenderAddress, RedisAddress, RedisKey string
+	ReturnPathAddress, ReceiptAddress                                                     string
+	SMTPFallbackPorts                                                                     []string
+	SMIMECertPath, SMIMECertPassword                                                      string
+	PGPKeyringDir, PGPMissingKeyPolicy                                                    string
+	PGPWKD                                                                                bool
+	AttachmentMaxBytes                                                                    int64
+	AttachmentFetchTimeout                                                                time.Duration
+	AttachmentPrivateHosts                                                                []string
+	ClamAVAddress                                                                         string
+	ClamAVTimeout                                                                         time.Duration
+	TemplateDir, MJMLBinary, DefaultLocale                                                string
+	PDFRenderer                                                                           string
+	InlineCSS, RedisTemplates                                                             bool
+	HTTPAddress, TrackingBaseURL, TrackingSecret                                          string
+	OpenTracking, ClickTracking                                                           bool
+	ClickTrackingDomains, SenderDomains                                                   []string
+	SanitizeTags, SanitizeAttributes                                                      []string
+	RecipientDomainAllowlist, RecipientDomainDenylist                                     []string
+	IdentitiesFile, TenantsFile                                                           string
+	QueuePattern, PubSubChannel                                                           string
+	QueueDiscoveryInterval                                                                time.Duration
+	SchedulerNotifications                                                                bool
+	RateLimit                                                                             float64
+	Concurrency, DequeueBatchSize                                                         int
+	DomainConcurrency, DomainRateLimits                                                   map[string]float64
+	DomainBackoff                                                                         time.Duration
+	DryRun                                                                                bool
+	QuotaHourly, QuotaDaily                                                               int64
+	AlertmanagerWebhook                                                                   bool
+	AlertmanagerRecipients, AlertmanagerAllowedTo                                         []string
+	AlertmanagerTemplate, IngestToken, WebhooksFile                                       string
+	DigestTemplate                                                                        string
+	DigestInterval, DedupWindow                                                           time.Duration
+	DedupAnnotate                                                                         bool
+	DeliveryWindow                                                                        *deliveryWindow
+	DefaultTimezone                                                                       *time.Location
+	APIToken, GroupDirectoryURL, GroupDirectoryToken                                      string
+	Preflight                                                                             bool
+	SenderAlignment                                                                       string
+	RequireDKIM                                                                           bool
+	AutoSubmitted, ValidateTasks                                                          bool
+	Precedence, PayloadFormat                                                             string
+	PayloadKeys                                                                           []string
+	PayloadCompression                                                                    string
+	PayloadCompressionThreshold                                                           int
+	PayloadEncryptionRequired                                                             bool
+	TaskSigningSecret, HistoryDSN, ArchiveTarget, ArchiveBCC                              string
+	ArchiveBCCSeparate                                                                    bool
+	ArchiveRetention                                                                      time.Duration
+	LoopLimit                                                                             int64
+	LoopWindow                                                                            time.Duration
+	DeliveryMode, MXPort                                                                  string
+	MXVerifyTLS                                                                           bool
+	HeloName                                                                              string
+	MaxMessageBytes                                                                       int64
+	MaxInflightBytes                                                                      int64
+	RetryAttempts                                                                         int
+	RetryBackoff                                                                          time.Duration
+	GreylistDelay                                                                         time.Duration
+	DialTimeout, CommandTimeout, SendTimeout                                              time.Duration
+	Dashboard                                                                             bool
+	DashboardUsername, DashboardPassword                                                  string
+	OIDCIssuer, OIDCClientID, OIDCClientSecret, OIDCRedirectURL                           string
+	OIDCAllowedEmails                                                                     []string
+	RunMode                                                                               string
+	RunMaxTasks                                                                           int64
+	RunMaxDuration                                                                        time.Duration
+	DropFolder                                                                            string
+	SMTPDebug                                                                             bool
+	VaultAddress, VaultToken, VaultRoleID, VaultSecretID                                  string
+	VaultSMTPPath, VaultRedisPath                                                         string
+	ConfigWatchInterval                                                                   time.Duration
+	WorkerID                                                                              string
+	AlertFailureRatio                                                                     float64
+	AlertWindow                                                                           time.Duration
+	AlertMinAttempts                                                                      int64
+	AlertWebhookURL, AlertSlackWebhookURL                                                 string
+	AlertEmailRecipients                                                                  []string
+	AlertSMTPHost, AlertSMTPPort, AlertSMTPUsername, AlertSMTPPassword                    string
+	NotifyWebhookURL, NotifyFormat                                                        string
+	NotifyEvents                                                                          []string
+	DLQAlertThreshold                                                                     int64
+	SentryDSN, SentryEnvironment                                                          string
+	DebugEndpoints                                                                        bool
+	DebugToken                                                                            string
+	ChaosFailureRate                                                                      float64
+	ChaosCodes                                                                            []string
+	ChaosLatency                                                                          time.Duration
+	OutboxDSN, OutboxTable                                                                string
+	OutboxInterval                                                                        time.Duration
+	OutboxBatchSize                                                                       int
+	Ledger                                                                                bool
+	LedgerTTL                                                                             time.Duration
+	RenderCache                                                                           bool
+	RenderCacheTTL                                                                        time.Duration
+	LedgerDSN                                                                             string
 }
 
 const (
-	smtpUsernameKey  = "SMTP_USERNAME"
-	smtpPasswordKey  = "SMTP_PASSWORD"
-	smtpHostKey      = "SMTP_HOST"
-	smtpPortKey      = "SMTP_PORT"
-	senderAddressKey = "SENDER_ADDRESS"
-	redisAddressKey  = "REDIS_ADDRESS"
-	redisKeyKey      = "REDIS_KEY"
+	smtpUsernameKey              = "SMTP_USERNAME"
+	smtpPasswordKey              = "SMTP_PASSWORD"
+	smtpHostKey                  = "SMTP_HOST"
+	smtpPortKey                  = "SMTP_PORT"
+	smtpFallbackPortsKey         = "SMTP_FALLBACK_PORTS"
+	senderAddressKey             = "SENDER_ADDRESS"
+	returnPathAddressKey         = "RETURN_PATH_ADDRESS"
+	receiptAddressKey            = "RECEIPT_ADDRESS"
+	redisAddressKey              = "REDIS_ADDRESS"
+	redisKeyKey                  = "REDIS_KEY"
+	smimeCertPathKey             = "SMIME_CERT_PATH"
+	smimeCertPasswordKey         = "SMIME_CERT_PASSWORD"
+	pgpKeyringDirKey             = "PGP_KEYRING_DIR"
+	pgpWKDKey                    = "PGP_WKD"
+	pgpMissingKeyPolicyKey       = "PGP_MISSING_KEY_POLICY"
+	attachmentMaxBytesKey        = "ATTACHMENT_MAX_BYTES"
+	attachmentFetchTimeoutKey    = "ATTACHMENT_FETCH_TIMEOUT"
+	attachmentPrivateHostsKey    = "ATTACHMENT_PRIVATE_HOSTS"
+	clamAVAddressKey             = "CLAMAV_ADDRESS"
+	clamAVTimeoutKey             = "CLAMAV_TIMEOUT"
+	templateDirKey               = "TEMPLATE_DIR"
+	mjmlBinaryKey                = "MJML_BINARY"
+	pdfRendererKey               = "PDF_RENDERER"
+	inlineCSSKey                 = "INLINE_CSS"
+	defaultLocaleKey             = "DEFAULT_LOCALE"
+	redisTemplatesKey            = "REDIS_TEMPLATES"
+	httpAddressKey               = "HTTP_ADDRESS"
+	trackingBaseURLKey           = "TRACKING_BASE_URL"
+	openTrackingKey              = "OPEN_TRACKING"
+	clickTrackingKey             = "CLICK_TRACKING"
+	clickTrackingDomainsKey      = "CLICK_TRACKING_DOMAINS"
+	trackingSecretKey            = "TRACKING_SECRET"
+	senderDomainsKey             = "SENDER_DOMAINS"
+	sanitizeTagsKey              = "SANITIZE_TAGS"
+	sanitizeAttributesKey        = "SANITIZE_ATTRIBUTES"
+	identitiesFileKey            = "IDENTITIES_FILE"
+	tenantsFileKey               = "TENANTS_FILE"
+	queuePatternKey              = "QUEUE_PATTERN"
+	queueDiscoveryIntervalKey    = "QUEUE_DISCOVERY_INTERVAL"
+	pubsubChannelKey             = "PUBSUB_CHANNEL"
+	schedulerNotificationsKey    = "SCHEDULER_NOTIFICATIONS"
+	rateLimitKey                 = "RATE_LIMIT"
+	concurrencyKey               = "CONCURRENCY"
+	dequeueBatchSizeKey          = "DEQUEUE_BATCH_SIZE"
+	domainConcurrencyKey         = "DOMAIN_CONCURRENCY"
+	domainRateLimitsKey          = "DOMAIN_RATE_LIMITS"
+	domainBackoffKey             = "DOMAIN_BACKOFF"
+	dryRunKey                    = "DRY_RUN"
+	quotaHourlyKey               = "QUOTA_HOURLY"
+	quotaDailyKey                = "QUOTA_DAILY"
+	alertmanagerWebhookKey       = "ALERTMANAGER_WEBHOOK"
+	alertmanagerRecipientsKey    = "ALERTMANAGER_RECIPIENTS"
+	alertmanagerAllowedToKey     = "ALERTMANAGER_ALLOWED_TO"
+	alertmanagerTemplateKey      = "ALERTMANAGER_TEMPLATE"
+	ingestTokenKey               = "INGEST_TOKEN"
+	webhooksFileKey              = "WEBHOOKS_FILE"
+	digestTemplateKey            = "DIGEST_TEMPLATE"
+	digestIntervalKey            = "DIGEST_INTERVAL"
+	dedupWindowKey               = "DEDUP_WINDOW"
+	dedupAnnotateKey             = "DEDUP_ANNOTATE"
+	deliveryWindowKey            = "DELIVERY_WINDOW"
+	defaultTimezoneKey           = "DEFAULT_TIMEZONE"
+	apiTokenKey                  = "API_TOKEN"
+	groupDirectoryURLKey         = "GROUP_DIRECTORY_URL"
+	groupDirectoryTokenKey       = "GROUP_DIRECTORY_TOKEN"
+	preflightKey                 = "PREFLIGHT"
+	recipientDomainAllowlistKey  = "RECIPIENT_DOMAIN_ALLOWLIST"
+	recipientDomainDenylistKey   = "RECIPIENT_DOMAIN_DENYLIST"
+	senderAlignmentKey           = "SENDER_ALIGNMENT"
+	requireDKIMKey               = "REQUIRE_DKIM"
+	autoSubmittedKey             = "AUTO_SUBMITTED"
+	validateTasksKey             = "VALIDATE_TASKS"
+	payloadFormatKey             = "PAYLOAD_FORMAT"
+	payloadKeysKey               = "PAYLOAD_KEYS"
+	payloadCompressionKey        = "PAYLOAD_COMPRESSION"
+	compressionThresholdKey      = "PAYLOAD_COMPRESSION_THRESHOLD"
+	taskSigningSecretKey         = "TASK_SIGNING_SECRET"
+	historyDSNKey                = "HISTORY_DSN"
+	archiveTargetKey             = "ARCHIVE_TARGET"
+	archiveRetentionKey          = "ARCHIVE_RETENTION"
+	archiveBCCKey                = "ARCHIVE_BCC"
+	archiveBCCSeparateKey        = "ARCHIVE_BCC_SEPARATE"
+	payloadEncryptionRequiredKey = "PAYLOAD_ENCRYPTION_REQUIRED"
+	precedenceKey                = "PRECEDENCE"
+	loopLimitKey                 = "LOOP_LIMIT"
+	loopWindowKey                = "LOOP_WINDOW"
+	deliveryModeKey              = "DELIVERY_MODE"
+	mxPortKey                    = "MX_PORT"
+	mxVerifyTLSKey               = "MX_VERIFY_TLS"
+	heloNameKey                  = "SMTP_HELO_NAME"
+	maxMessageBytesKey           = "MAX_MESSAGE_BYTES"
+	maxInflightBytesKey          = "MAX_INFLIGHT_BYTES"
+	retryAttemptsKey             = "RETRY_ATTEMPTS"
+	retryBackoffKey              = "RETRY_BACKOFF"
+	greylistDelayKey             = "GREYLIST_DELAY"
+	dialTimeoutKey               = "SMTP_DIAL_TIMEOUT"
+	commandTimeoutKey            = "SMTP_COMMAND_TIMEOUT"
+	sendTimeoutKey               = "SMTP_SEND_TIMEOUT"
+	dashboardKey                 = "DASHBOARD"
+	dashboardUsernameKey         = "DASHBOARD_USERNAME"
+	dashboardPasswordKey         = "DASHBOARD_PASSWORD"
+	oidcIssuerKey                = "OIDC_ISSUER"
+	oidcClientIDKey              = "OIDC_CLIENT_ID"
+	oidcClientSecretKey          = "OIDC_CLIENT_SECRET"
+	oidcRedirectURLKey           = "OIDC_REDIRECT_URL"
+	oidcAllowedEmailsKey         = "OIDC_ALLOWED_EMAILS"
+	runModeKey                   = "RUN_MODE"
+	runMaxTasksKey               = "RUN_MAX_TASKS"
+	runMaxDurationKey            = "RUN_MAX_DURATION"
+	dropFolderKey                = "DROP_FOLDER"
+	smtpDebugKey                 = "SMTP_DEBUG"
+	vaultAddressKey              = "VAULT_ADDR"
+	vaultTokenKey                = "VAULT_TOKEN"
+	vaultRoleIDKey               = "VAULT_ROLE_ID"
+	vaultSecretIDKey             = "VAULT_SECRET_ID"
+	vaultSMTPPathKey             = "VAULT_SMTP_PATH"
+	vaultRedisPathKey            = "VAULT_REDIS_PATH"
+	configWatchIntervalKey       = "CONFIG_WATCH_INTERVAL"
+	workerIDKey                  = "WORKER_ID"
+	alertFailureRatioKey         = "ALERT_FAILURE_RATIO"
+	alertWindowKey               = "ALERT_WINDOW"
+	alertMinAttemptsKey          = "ALERT_MIN_ATTEMPTS"
+	alertWebhookURLKey           = "ALERT_WEBHOOK_URL"
+	alertSlackWebhookURLKey      = "ALERT_SLACK_WEBHOOK_URL"
+	alertEmailRecipientsKey      = "ALERT_EMAIL_RECIPIENTS"
+	alertSMTPHostKey             = "ALERT_SMTP_HOST"
+	alertSMTPPortKey             = "ALERT_SMTP_PORT"
+	alertSMTPUsernameKey         = "ALERT_SMTP_USERNAME"
+	alertSMTPPasswordKey         = "ALERT_SMTP_PASSWORD"
+	notifyWebhookURLKey          = "NOTIFY_WEBHOOK_URL"
+	notifyFormatKey              = "NOTIFY_FORMAT"
+	notifyEventsKey              = "NOTIFY_EVENTS"
+	dlqAlertThresholdKey         = "DLQ_ALERT_THRESHOLD"
+	sentryDSNKey                 = "SENTRY_DSN"
+	sentryEnvironmentKey         = "SENTRY_ENVIRONMENT"
+	debugEndpointsKey            = "DEBUG_ENDPOINTS"
+	debugTokenKey                = "DEBUG_TOKEN"
+	chaosFailureRateKey          = "CHAOS_FAILURE_RATE"
+	chaosCodesKey                = "CHAOS_CODES"
+	chaosLatencyKey              = "CHAOS_LATENCY"
+	outboxDSNKey                 = "OUTBOX_DSN"
+	outboxTableKey               = "OUTBOX_TABLE"
+	outboxIntervalKey            = "OUTBOX_POLL_INTERVAL"
+	outboxBatchSizeKey           = "OUTBOX_BATCH_SIZE"
+	ledgerKey                    = "LEDGER"
+	ledgerTTLKey                 = "LEDGER_TTL"
+	ledgerDSNKey                 = "LEDGER_DSN"
+	renderCacheKey               = "RENDER_CACHE"
+	renderCacheTTLKey            = "RENDER_CACHE_TTL"
 )
 
-type Mailer struct {
-	template, senderAddress, host, port string
-	auth                                smtp.Auth
-}
+const (
+	deliveryModeRelay = "relay"
+	deliveryModeMX    = "mx"
+)
 
-func (m Mailer) sendMail(mail Mail) {
-	mail.Message = fmt.Sprintf(m.template, strings.Join(mail.Recipients, ", "), m.senderAddress, mail.Subject, mail.Message)
-	if m.auth == nil {
-		err := m.sendMailUnauthenticated(mail)
-		if err != nil {
-			log.Printf("error sending without authentication: %v", err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] != drainFlag {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalln(err)
 		}
 		return
 	}
-	log.Printf("sending email to SMTP server...\n")
-	err := smtp.SendMail(fmt.Sprintf("%s:%s", m.host, m.port),
-		m.auth,
-		m.senderAddress,
-		mail.Recipients,
-		[]byte(mail.Message),
-	)
 
+	options, err := validateEnvironment()
 	if err != nil {
-		log.Print("error sending email to server: ", err)
+		log.Fatalln(err)
+	}
+	if len(os.Args) > 1 {
+		options.RunMode = runModeOnce
+	}
+	printDetails(options)
+	if options.NotifyWebhookURL != "" {
+		opsEvents = newEventNotifier(options)
+	}
+	if options.SentryDSN != "" {
+		if errorTracker, err = newSentryClient(options.SentryDSN, options); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	if err := protectPayloads(options); err != nil {
+		log.Println(err)
 		return
 	}
-	log.Print("email sent successfully")
-}
+	contentSanitizer = newHTMLSanitizer(options.SanitizeTags, options.SanitizeAttributes)
 
-func (m Mailer) sendMailUnauthenticated(mail Mail) error {
-	// Connect to the remote SMTP server.
-	c, err := smtp.Dial(fmt.Sprintf("%s:%s", m.host, m.port))
+	rdb, vault, err := connectRedis(&options)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	mailer, err := newMailer(options, rdb)
 	if err != nil {
-		return fmt.Errorf("error connecting to remote SMTP host: %w", err)
+		log.Println(err)
+		return
+	}
+	if options.RunMode == runModeOnce {
+		mailer.run = newRunOnce(options.RunMaxTasks, options.RunMaxDuration)
+	}
+	if mailer.archive != nil {
+		go mailer.archive.run()
+	}
+	vault.watchSMTP(mailer)
+	var history *historyDB
+	if mailer.history != nil {
+		history = mailer.history.db
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, metrics)
+	if len(options.TrackingBaseURL) > 0 {
+		mailer.tracker = &tracker{
+			baseURL:      strings.TrimSuffix(options.TrackingBaseURL, "/"),
+			opens:        options.OpenTracking,
+			clicks:       options.ClickTracking,
+			clickDomains: options.ClickTrackingDomains,
+			secret:       []byte(options.TrackingSecret),
+			rdb:          rdb,
+		}
+		if (options.OpenTracking || options.ClickTracking) && len(options.TrackingSecret) == 0 {
+			log.Printf("[WARNING] %s is not set, open and click tracking are disabled", trackingSecretKey)
+		}
+		mailer.tracker.register(mux)
+	}
+	if options.AlertmanagerWebhook {
+		receiver := &alertmanagerReceiver{
+			rdb:        rdb,
+			queue:      options.RedisKey,
+			recipients: options.AlertmanagerRecipients,
+			allowedTo:  options.AlertmanagerAllowedTo,
+			template:   options.AlertmanagerTemplate,
+			token:      options.IngestToken,
+		}
+		receiver.register(mux)
+		log.Printf("accepting Alertmanager notifications at %s", alertmanagerPath)
+	}
+	var webhooks *webhookGateway
+	if len(options.WebhooksFile) > 0 {
+		routes, err := loadWebhookRoutes(options.WebhooksFile, options)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		webhooks = &webhookGateway{rdb: rdb, queue: options.RedisKey, token: options.IngestToken}
+		webhooks.register(mux, routes)
+		log.Printf("accepting webhooks on %d routes from %s", len(routes), options.WebhooksFile)
+	}
+	var srv *http.Server
+	if len(options.HTTPAddress) > 0 {
+		srv = startHTTPServer(options.HTTPAddress, mux)
 	}
-	defer c.Quit()
 
-	// Set the sender and recipient first
-	if err := c.Mail(m.senderAddress); err != nil {
-		return fmt.Errorf("error setting sender address: %w", err)
+	tenants := []*tenant{{
+		queue:   options.RedisKey,
+		mailer:  mailer,
+		limiter: newRateLimiter(options.RateLimit),
+		quota:   sendQuota{Hourly: options.QuotaHourly, Daily: options.QuotaDaily},
+	}}
+	if len(options.TenantsFile) > 0 {
+		configured, err := loadTenants(options.TenantsFile, mailer, options)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		tenants = append(tenants, configured...)
+		log.Printf("loaded %d tenants from %s", len(configured), options.TenantsFile)
 	}
-	if err := c.Rcpt(mail.Recipients[0]); err != nil {
-		return fmt.Errorf("error setting recipient address: %w", err)
+	if err := checkSenderAlignment(tenants, options.SenderAlignment, options.RequireDKIM); err != nil {
+		log.Println(err)
+		return
 	}
 
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		return fmt.Errorf("error issuing DATA command to remote SMTP host: %w", err)
+	campaigns := &campaignAPI{managers: map[string]*campaignManager{}, defaultQueue: options.RedisKey}
+	handleWithToken(mux, campaignsPath, options.APIToken, apiTokenKey, campaigns)
+	if history != nil {
+		handleWithToken(mux, historyPath, options.APIToken, apiTokenKey, &historyAPI{db: history})
+	}
+	var admin *dashboard
+	if options.Dashboard {
+		if admin, err = newDashboard(rdb, tenants, options); err != nil {
+			log.Println(err)
+			return
+		}
 	}
 
-	_, err = fmt.Fprintf(wc, mail.Message)
+	wg := sync.WaitGroup{}
+	payloads, err := newPayloadDecoder(options.PayloadFormat)
 	if err != nil {
-		return fmt.Errorf("error writing message body: %w", err)
+		log.Println(err)
+		return
 	}
-	err = wc.Close()
-	if err != nil {
-		return fmt.Errorf("error closing message body writer: %w", err)
+	var validator *taskValidator
+	if options.ValidateTasks {
+		if validator, err = newTaskValidator(); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	replays := &dlqAPI{rdb: rdb, queues: map[string]bool{}, defaultQueue: options.RedisKey, validator: validator}
+	for _, t := range tenants {
+		replays.queues[t.queue] = true
+	}
+	handleWithToken(mux, dlqReplayPath, options.APIToken, apiTokenKey, replays)
+	receipts := &receiptProcessor{token: options.IngestToken}
+	for _, t := range tenants {
+		receipts.stores = append(receipts.stores, newStatusStore(rdb, t.queue))
+	}
+	receipts.register(mux)
+	handleWithToken(mux, tasksPath, options.APIToken, apiTokenKey, &tasksAPI{rdb: rdb, queues: replays.queues, defaultQueue: options.RedisKey, validator: validator})
+	if len(options.DropFolder) > 0 {
+		drop, err := newDropFolder(rdb, options.RedisKey, options.DropFolder, validator)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go drop.run()
+		log.Printf("enqueuing tasks dropped in %s", options.DropFolder)
+	}
+	beats := newHeartbeat(rdb, options, tenants)
+	leader := newLeaderElection(rdb, options.RedisKey, beats.info.Instance)
+	go leader.run()
+	if options.PubSubChannel != "" {
+		ingest := &pubsubIngest{rdb: rdb, channel: options.PubSubChannel, queue: options.RedisKey, leader: leader}
+		go ingest.run()
+		log.Printf("taking tasks published on %s, which are lost if published while no worker is subscribed", options.PubSubChannel)
+	}
+	if options.OutboxDSN != "" {
+		outbox, err := newOutbox(rdb, options, validator)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		go outbox.run(leader)
+		log.Printf("enqueuing tasks from the %s table", options.OutboxTable)
+	}
+	alerts := newFailureAlerter(rdb, options)
+	if alerts != nil {
+		go alerts.run(leader)
+		log.Printf("alerting when %s of delivery attempts fail over %s", percent(options.AlertFailureRatio), options.AlertWindow)
+	}
+	var ledgerDB *historyDB
+	if options.LedgerDSN != "" {
+		if ledgerDB, err = openSQL(options.LedgerDSN, "ledger", ledgerSchema); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	control := newController(rdb, options.RedisKey)
+	var consumers sync.WaitGroup
+	control.start()
+	tune := newTuning(rdb, options.RedisKey, options)
+	tune.start()
+	memory := newMemoryGuard(options.MaxInflightBytes)
+	batches := &taskBatches{}
+	var due *dueNotifier
+	if options.SchedulerNotifications {
+		if due = newDueNotifier(rdb); due != nil {
+			go due.run()
+		}
+	}
+	// setup gives a tenant what it needs to consume its queue.
+	setup := func(t *tenant) {
+		t.payloads, t.validator = payloads, validator
+		t.quotas = &quotaCounter{rdb: rdb, queue: t.queue}
+		t.window, t.timezone = options.DeliveryWindow, options.DefaultTimezone
+		t.batch = newTaskBatch(rdb, t.queue, options.DequeueBatchSize, memory)
+		batches.add(t.batch)
+		t.scheduler = newScheduler(rdb, t.queue)
+		t.scheduler.notify = due
+		t.mailer.retries = t.scheduler
+		t.mailer.alerts = alerts
+		t.mailer.status = newStatusStore(rdb, t.queue)
+		t.cancelled = newCancellations(rdb, t.queue)
+		if options.Ledger {
+			// The claim outlasts the send, so that it only runs out if the
+			// worker holding it has died.
+			t.mailer.ledger = &processedLedger{rdb: rdb, queue: t.queue, ttl: options.LedgerTTL, claimTTL: 2 * options.SendTimeout, db: ledgerDB}
+		}
+		if options.RenderCache {
+			t.mailer.rendered = &renderCache{rdb: rdb, queue: t.queue, ttl: options.RenderCacheTTL}
+		}
+		t.inflight = newInflightTasks()
+		t.control = control
+		t.tuning = tune
+		t.memory = memory
+		t.digests = &digester{rdb: rdb, queue: t.queue, interval: options.DigestInterval, template: options.DigestTemplate}
+		t.campaigns = newCampaignManager(rdb, t.queue)
+		if options.DedupWindow > 0 {
+			t.dedup = &deduplicator{rdb: rdb, queue: t.queue, window: options.DedupWindow, annotate: options.DedupAnnotate, scheduler: t.scheduler}
+		}
+	}
+	// background starts a tenant's loops beside its consumer, until stop is
+	// closed.
+	background := func(t *tenant, stop <-chan struct{}) {
+		go t.scheduler.run(leader, stop)
+		go t.digests.run(leader, stop)
+		go t.campaigns.supervise(stop)
+	}
+	for _, t := range tenants {
+		setup(t)
+		background(t, nil)
+		campaigns.managers[t.queue] = t.campaigns
+		consumers.Add(1)
+		go func(t *tenant) {
+			consume(rdb, t, &wg, nil)
+			consumers.Done()
+		}(t)
+	}
+	if options.QueuePattern != "" {
+		if options.RunMode == runModeOnce {
+			log.Printf("[WARNING] %s is ignored when running once", queuePatternKey)
+		} else {
+			discovery := newQueueDiscovery(rdb, options, tenants, func(queue string) (*tenant, error) {
+				t, err := newTenant(queue, tenantConfig{Queue: queue}, mailer, options)
+				if err != nil {
+					return nil, err
+				}
+				t.limiter, t.quota = newRateLimiter(options.RateLimit), sendQuota{Hourly: options.QuotaHourly, Daily: options.QuotaDaily}
+				setup(t)
+				return t, nil
+			}, func(t *tenant, stop <-chan struct{}) {
+				background(t, stop)
+				go consume(rdb, t, &wg, stop)
+			})
+			go discovery.run()
+			log.Printf("consuming the lists matching %s", options.QueuePattern)
+		}
+	}
+	if admin != nil {
+		admin.register(mux)
+		log.Printf("serving the admin dashboard at %s", dashboardPath)
+	}
+	if options.DebugEndpoints {
+		diag := &diagnostics{rdb: rdb, tenants: tenants, mx: mailer.mx, started: time.Now()}
+		diag.register(mux, options.DebugToken)
+		log.Printf("serving profiles at %s and runtime state at %s", debugPprofPath, debugVarsPath)
+	}
+	beats.start()
+	go sampleQueues(rdb, tenants)
+	reload := &reloader{options: options, tenants: tenants, webhooks: webhooks, credentials: options.VaultSMTPPath == ""}
+	go reload.run(options.ConfigWatchInterval)
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt)
+	for _, t := range tenants {
+		log.Printf("worker registered for tasks on list '%s' at %s\n", t.queue, options.RedisAddress)
+	}
+	if options.DLQAlertThreshold > 0 {
+		go watchDeadLetters(tenants, options.DLQAlertThreshold, leader)
+	}
+	opsEvents.notify(eventWorkerStarted, "worker started: version %s consuming %s", workerVersion(), strings.Join(beats.info.Queues, ", "))
+	// Consumers only stop by themselves when running once.
+	emptied := make(chan struct{})
+	go func() {
+		consumers.Wait()
+		close(emptied)
+	}()
+	select {
+	case <-sigchan:
+	case <-control.drained:
+	case <-emptied:
+	}
+	if srv != nil {
+		stopHTTPServer(srv)
+	}
+	batches.close()
+	log.Print("waiting for in-progress tasks to finish...")
+	wg.Wait()
+	log.Println("tasks finished")
+	leader.resign()
+	beats.stop()
+	opsEvents.notify(eventWorkerStopped, "worker stopped")
+	opsEvents.close()
+	errorTracker.flush(errorTimeout)
+	if mailer.run != nil {
+		var remaining int64
+		for _, t := range tenants {
+			for _, queue := range []string{t.queue, priorityQueue(t.queue)} {
+				n, err := rdb.LLen(ctx, queue).Result()
+				if err != nil {
+					log.Print("error counting remaining tasks: ", err)
+				}
+				remaining += n
+			}
+		}
+		code := mailer.run.exitCode(remaining)
+		log.Println("exiting...")
+		os.Exit(code)
+	}
+	log.Println("exiting...")
+}
+
+// protectPayloads sets up the signing, encryption and compression of task
+// payloads.
+func protectPayloads(options AppOptions) error {
+	taskSigningSecret = []byte(options.TaskSigningSecret)
+	taskCompressor = newPayloadCompressor(options.PayloadCompression, options.PayloadCompressionThreshold)
+	if len(options.PayloadKeys) > 0 {
+		var err error
+		if taskSealer, err = newPayloadSealer(options.PayloadKeys, options.PayloadEncryptionRequired); err != nil {
+			return fmt.Errorf("invalid %s: %w", payloadKeysKey, err)
+		}
 	}
 	return nil
 }
 
-func main() {
-	options, err := validateEnvironment()
+// protectPayloadsFromEnvironment is protectPayloads for the subcommands,
+// which don't need the rest of the worker's configuration.
+func protectPayloadsFromEnvironment() error {
+	p := &envParser{}
+	options := AppOptions{
+		TaskSigningSecret: p.string(taskSigningSecretKey),
+		PayloadKeys:       p.list(payloadKeysKey),
+	}
+	parseCompression(p, &options)
+	if err := p.err(); err != nil {
+		return err
+	}
+	return protectPayloads(options)
+}
+
+// connectRedis makes the worker's Redis client, first reading any
+// credentials kept in Vault: those for Redis, which the client's
+// connections authenticate with, and those for SMTP, into options.
+func connectRedis(options *AppOptions) (*redis.Client, *vaultClient, error) {
+	redisOptions := &redis.Options{Addr: options.RedisAddress}
+	vault, err := newVault(options, redisOptions)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, nil, err
+	}
+	return redis.NewClient(redisOptions), vault, nil
+}
+
+// newMailer builds the worker's mailer from its options.
+func newMailer(options AppOptions, rdb *redis.Client) (Mailer, error) {
+	sender, err := netmail.ParseAddress(options.SenderAddress)
+	if err != nil {
+		return Mailer{}, fmt.Errorf("invalid %s: %w", senderAddressKey, err)
+	}
+	var returnPath *netmail.Address
+	if options.ReturnPathAddress != "" {
+		if returnPath, err = netmail.ParseAddress(options.ReturnPathAddress); err != nil {
+			return Mailer{}, fmt.Errorf("invalid %s: %w", returnPathAddressKey, err)
+		}
+	}
+	var receiptAddress *netmail.Address
+	if options.ReceiptAddress != "" {
+		if receiptAddress, err = netmail.ParseAddress(options.ReceiptAddress); err != nil {
+			return Mailer{}, fmt.Errorf("invalid %s: %w", receiptAddressKey, err)
+		}
 	}
-	printDetails(options)
 
 	mailer := Mailer{
-		template: "Content-Type: text/html; charset=\"UTF-8\";\r\n" +
-			"To: %s\r\n" +
-			"From: %s\r\n" +
-			"Subject: %s\r\n\r\n%s",
-		senderAddress: options.SenderAddress,
-		host:          options.SMTPHost,
-		port:          options.SMTPPort,
+		sender:          &identity{from: sender, returnPath: returnPath},
+		host:            options.SMTPHost,
+		port:            options.SMTPPort,
+		fetcher:         newAttachmentFetcher(options.AttachmentMaxBytes, options.AttachmentFetchTimeout, options.AttachmentPrivateHosts),
+		scanner:         newClamAVScanner(options.ClamAVAddress, options.ClamAVTimeout),
+		pdf:             newPDFRenderer(options.PDFRenderer),
+		inlineCSS:       options.InlineCSS,
+		retryAttempts:   options.RetryAttempts,
+		retryBackoff:    options.RetryBackoff,
+		greylistDelay:   options.GreylistDelay,
+		helo:            options.HeloName,
+		maxMessageBytes: options.MaxMessageBytes,
+		autoSubmitted:   options.AutoSubmitted,
+		precedence:      options.Precedence,
+		receiptAddress:  receiptAddress,
+		timeouts:        smtpTimeouts{dial: options.DialTimeout, command: options.CommandTimeout, send: options.SendTimeout},
+		debug:           options.SMTPDebug,
+		chaos:           newChaosInjector(options),
+		domains:         newDomainLimiter(options),
+		// The worker's own domain may always be used for overrides.
+		senderDomains: append([]string{addressDomain(sender)}, options.SenderDomains...),
+	}
+
+	if len(options.IdentitiesFile) > 0 {
+		mailer.identities, err = loadIdentities(options.IdentitiesFile)
+		if err != nil {
+			return Mailer{}, err
+		}
+		log.Printf("loaded %d sender identities from %s", len(mailer.identities), options.IdentitiesFile)
 	}
 
-	if len(options.SMTPUsername) > 0 && len(options.SMTPPassword) > 0 {
-		mailer.auth = smtp.PlainAuth("", options.SMTPUsername, options.SMTPPassword, options.SMTPHost)
+	mailer.fallback = newPortFallback(options.SMTPPort, options.SMTPFallbackPorts)
+	if options.DeliveryMode == deliveryModeMX {
+		mailer.mx = newMXTransport(options.MXPort, options.MXVerifyTLS, options.HeloName, mailer.timeouts)
+		log.Println("delivering directly to recipient mail servers")
+	} else if len(options.SMTPUsername) > 0 && len(options.SMTPPassword) > 0 {
+		mailer.auth = newReloadableAuth(smtp.PlainAuth("", options.SMTPUsername, options.SMTPPassword, options.SMTPHost))
 	} else {
 		log.Println("[WARNING] No auth details provided, using unauthenticated SMTP")
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr: options.RedisAddress,
-	})
+	if len(options.SMIMECertPath) > 0 {
+		mailer.signer, err = loadSMIMESigner(options.SMIMECertPath, options.SMIMECertPassword)
+		if err != nil {
+			return Mailer{}, err
+		}
+		log.Println("signing outgoing mail with S/MIME certificate", options.SMIMECertPath)
+	}
 
-	wg := sync.WaitGroup{}
+	mailer.groups = newGroupResolver(rdb, options.GroupDirectoryURL, options.GroupDirectoryToken)
+	mailer.dead = &deadLetters{rdb: rdb, queue: options.RedisKey}
+	if options.Preflight {
+		mailer.preflight = newPreflight()
+	}
+	mailer.recipientPolicy = newRecipientPolicy(options.RecipientDomainAllowlist, options.RecipientDomainDenylist)
+	if options.HistoryDSN != "" {
+		history, err := openHistory(options.HistoryDSN)
+		if err != nil {
+			return Mailer{}, err
+		}
+		mailer.history = &historyStore{db: history, queue: options.RedisKey}
+	}
+	if options.ArchiveBCC != "" {
+		if mailer.archiveBCC, err = netmail.ParseAddress(options.ArchiveBCC); err != nil {
+			return Mailer{}, fmt.Errorf("invalid %s: %w", archiveBCCKey, err)
+		}
+		mailer.archiveSeparate = options.ArchiveBCCSeparate
+	}
+	if options.ArchiveTarget != "" {
+		if mailer.archive, err = newArchive(options.ArchiveTarget, options.ArchiveRetention); err != nil {
+			return Mailer{}, err
+		}
+	}
+	if options.LoopLimit > 0 {
+		mailer.loops = &loopGuard{rdb: rdb, queue: options.RedisKey, limit: options.LoopLimit, window: options.LoopWindow}
+	}
 
-	go func() {
-		for {
-			res, err := rdb.BRPop(ctx, 0, "tasks").Result()
-			if err != nil {
-				log.Fatalln("cannot pop from list:", err)
+	if len(options.TemplateDir) > 0 {
+		mailer.templates, err = loadTemplates(options.TemplateDir, options.MJMLBinary, options.DefaultLocale)
+		if err != nil {
+			return Mailer{}, err
+		}
+		log.Printf("loaded %d templates from %s", len(mailer.templates.templates), options.TemplateDir)
+	}
+	if options.RedisTemplates {
+		mailer.redisTpl = newRedisTemplateStore(rdb, mailer.templates)
+		log.Println("loading templates from Redis")
+	}
+
+	if len(options.PGPKeyringDir) > 0 || options.PGPWKD {
+		mailer.keyring, err = loadPGPKeyring(options.PGPKeyringDir, options.PGPWKD, options.PGPMissingKeyPolicy)
+		if err != nil {
+			return Mailer{}, err
+		}
+		log.Printf("encrypting mail with PGP where recipient keys are available (missing keys: %s)", mailer.keyring.missingPolicy)
+	}
+	return mailer, nil
+}
+
+// consume sends the tasks popped from the tenant's queue until the process
+// exits or drains, stop is closed, or when running once until the queue is
+// empty or a limit is reached, adding each in-progress send to wg. Tasks on
+// the priority list are taken first.
+func consume(rdb *redis.Client, t *tenant, wg *sync.WaitGroup, stop <-chan struct{}) {
+	defer t.batch.giveBack()
+	for {
+		if !t.control.active() {
+			// Don't keep the rest of a batch from other workers while paused.
+			t.batch.giveBack()
+		}
+		if !t.control.wait() || !t.mailer.run.take() || closed(stop) {
+			return
+		}
+		// Waiting for a free slot before taking a task keeps it in the
+		// queue, rather than held here, while the worker is at capacity.
+		t.tuning.wait()
+		t.slots.wait()
+		t.memory.wait()
+		res, err := t.batch.pop(t.room())
+		if err == redis.Nil {
+			if t.mailer.run != nil {
+				// Running once, the queue has been emptied.
+				return
 			}
-			log.Print("processing task from list...")
-			taskBody := res[1]
-			task := Mail{}
-			err = json.Unmarshal([]byte(taskBody), &task)
-			if err != nil {
-				log.Print("error unmarshalling task data to JSON: ", err)
-				continue
+			continue
+		}
+		if err != nil {
+			errorTracker.captureError("cannot pop from list", err, "queue", t.queue)
+			errorTracker.flush(errorTimeout)
+			log.Fatalln("cannot pop from list:", err)
+		}
+		if !t.control.active() {
+			// Paused while waiting: put the task back where it came from.
+			if err := rdb.RPush(ctx, res[0], res[1]).Err(); err != nil {
+				log.Print("error returning task to list: ", err)
 			}
-			wg.Add(1)
-			go func() {
-				mailer.sendMail(task)
-				wg.Done()
-			}()
+			continue
 		}
-	}()
+		log.Printf("processing task from list %s...", res[0])
+		task := Mail{}
+		taskBody, err := openPayload([]byte(res[1]))
+		if err == nil {
+			taskBody, err = t.payloads.decode(taskBody)
+		}
+		if err != nil {
+			id := newTaskID()
+			errorTracker.captureError("error decoding task payload", err, "queue", res[0], "task_id", id)
+			t.mailer.dead.addPayload(Mail{ID: id}, []byte(res[1]), err.Error())
+			continue
+		}
+		if err := t.validator.validate(taskBody); err != nil {
+			// Decode what we can so the dead letter can still be
+			// identified and replayed once fixed.
+			json.Unmarshal(taskBody, &task)
+			if task.ID == "" {
+				task.ID = newTaskID()
+			}
+			t.mailer.dead.addPayload(task, taskBody, err.Error())
+			continue
+		}
+		err = json.Unmarshal(taskBody, &task)
+		if err != nil {
+			log.Print("error unmarshalling task data to JSON: ", err)
+			errorTracker.captureError("error unmarshalling task data to JSON", err, "queue", res[0])
+			continue
+		}
+		if task.ID == "" {
+			task.ID = newTaskID()
+		}
+		t.applyDefaults(&task)
+		if t.cancelled.cancelled(task) {
+			t.cancelled.drop(task, t.mailer.history)
+			continue
+		}
+		observeQueueWait(res[0], task, time.Now())
+		// A dry run takes tasks before anything is counted or held for them,
+		// so that turning it off leaves no quota used or duplicates dropped.
+		if t.tuning.dryRun() {
+			t.tuning.skip(task, t.mailer.status, t.mailer.history)
+			continue
+		}
+		if send, err := t.dedup.admit(&task); err != nil {
+			log.Print(err)
+		} else if !send {
+			continue
+		}
+		if task.Campaign != nil {
+			if err := t.campaigns.start(task); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if task.Digest {
+			if err := t.digests.add(task); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if at, err := deliveryTime(task, t.window, t.timezone, time.Now()); err != nil {
+			log.Print(err)
+		} else if time.Until(at) > 0 {
+			log.Printf("task %s is outside its delivery window, deferring until %s", task.ID, at.Format(time.RFC3339))
+			if err := t.scheduler.schedule(task, at); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if t.mailer.domains != nil {
+			// Limit by the domains of groups' members rather than of the
+			// groups. A group that can't be expanded is reported by the send.
+			if recipients, err := t.mailer.groups.expand(task.Recipients); err == nil {
+				task.Recipients = recipients
+			}
+		}
+		sends, retryAt, ok := t.mailer.domains.admit(task, time.Now())
+		if !ok {
+			log.Printf("task %s is to a domain at its limit, deferring until %s", task.ID, retryAt.Format(time.RFC3339))
+			if err := t.scheduler.schedule(task, retryAt); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if retryAt, ok, err := t.admit(task); err != nil {
+			log.Print(err)
+		} else if !ok {
+			log.Printf("task %s exceeds a sending quota, deferring until %s", task.ID, retryAt.Format(time.RFC3339))
+			t.mailer.domains.done(sends)
+			if err := t.scheduler.schedule(task, retryAt); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		mailer, limiter := t.current()
+		t.tuning.rateLimiter(limiter).wait()
+		t.tuning.acquire()
+		t.slots.acquire()
+		wg.Add(1)
+		token := t.inflight.start(task)
+		// The send holds the task decoded, which a compressed payload can be
+		// many times the size of.
+		size := int64(len(taskBody))
+		t.memory.hold(size)
+		go func() {
+			sends.wait()
+			mailer.sendMailSafely(task)
+			mailer.domains.done(sends)
+			t.inflight.done(token)
+			t.memory.release(size)
+			t.slots.release()
+			t.tuning.release()
+			wg.Done()
+		}()
+	}
+}
 
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
-	log.Printf("worker registered for tasks on list '%s' at %s\n", options.RedisKey, options.RedisAddress)
-	<-sigchan
-	log.Print("waiting for in-progress tasks to finish...")
-	wg.Wait()
-	log.Println("tasks finished")
-	log.Println("exiting...")
+// runCommand runs a subcommand instead of the worker.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "preview":
+		return runPreview(args)
+	case "schema":
+		return runSchema(args)
+	case "history":
+		return runHistory(args)
+	case "report":
+		return runReport(args)
+	case "dlq":
+		return runDLQ(args)
+	case "control":
+		return runControl(args)
+	case "send":
+		return runSend(args)
+	case "selftest":
+		return runSelftest(args)
+	case "tune":
+		return runTune(args)
+	case "workers":
+		return runWorkers(args)
+	case "devserver":
+		return runDevserver(args)
+	case "bench":
+		return runBench(args)
+	case "cancel":
+		return runCancel(args)
+	case "amend":
+		return runAmend(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func printDetails(options AppOptions) {
-	fmt.Printf("\n=========\n"+"Post Room\n"+"=========\n"+"Redis Server:\t%s\n"+"Redis List:\t%s\n"+"Mail Server:\t%s:%s\n\n", options.RedisAddress, options.RedisKey, options.SMTPHost, options.SMTPPort)
+	server := net.JoinHostPort(options.SMTPHost, options.SMTPPort)
+	if options.DeliveryMode == deliveryModeMX {
+		server = "direct to MX"
+	}
+	fmt.Printf("\n=========\n"+"Post Room\n"+"=========\n"+"Redis Server:\t%s\n"+"Redis List:\t%s\n"+"Mail Server:\t%s\n"+"Worker ID:\t%s (%s)\n\n", options.RedisAddress, options.RedisKey, server, options.WorkerID, workerVersion())
 }
 
+// validateEnvironment reads the worker's configuration, reporting every
+// missing or malformed setting at once.
 func validateEnvironment() (AppOptions, error) {
-	const errorTemplate = "no ENV value provided for %s"
+	p := &envParser{}
 	options := AppOptions{}
-	username, _ := os.LookupEnv(smtpUsernameKey)
-	options.SMTPUsername = username
+	options.SMTPUsername = p.string(smtpUsernameKey)
+	options.SMTPPassword = p.string(smtpPasswordKey)
 
-	password, _ := os.LookupEnv(smtpPasswordKey)
-	options.SMTPPassword = password
+	options.DeliveryMode = p.choice(deliveryModeKey, deliveryModeRelay, deliveryModeRelay, deliveryModeMX)
+	options.RunMode = p.choice(runModeKey, runModeDaemon, runModeDaemon, runModeOnce)
+	p.int64(runMaxTasksKey, &options.RunMaxTasks)
+	p.duration(runMaxDurationKey, &options.RunMaxDuration, true)
+	options.MXPort = p.port(mxPortKey)
+	p.bool(mxVerifyTLSKey, &options.MXVerifyTLS)
 
-	host, ok := os.LookupEnv(smtpHostKey)
-	if !ok {
-		return options, fmt.Errorf(errorTemplate, smtpHostKey)
+	// A relay is only needed when not delivering directly.
+	if options.DeliveryMode == deliveryModeRelay {
+		options.SMTPHost = p.required(smtpHostKey)
+		if p.required(smtpPortKey) != "" {
+			options.SMTPPort = p.port(smtpPortKey)
+		}
+	} else {
+		options.SMTPHost = p.string(smtpHostKey)
+		options.SMTPPort = p.port(smtpPortKey)
+	}
+	options.SMTPFallbackPorts = p.list(smtpFallbackPortsKey)
+	for _, port := range options.SMTPFallbackPorts {
+		if err := checkPort(port); err != nil {
+			p.invalid(smtpFallbackPortsKey, err)
+		}
 	}
-	options.SMTPHost = host
+	options.HeloName = p.string(heloNameKey)
+	p.int64(maxMessageBytesKey, &options.MaxMessageBytes)
+	p.int64(maxInflightBytesKey, &options.MaxInflightBytes)
 
-	port, ok := os.LookupEnv(smtpPortKey)
-	if !ok {
-		return options, fmt.Errorf(errorTemplate, smtpPortKey)
+	options.RetryAttempts = defaultRetryAttempts
+	p.int(retryAttemptsKey, &options.RetryAttempts)
+	options.RetryBackoff = defaultRetryBackoff
+	p.duration(retryBackoffKey, &options.RetryBackoff, false)
+	options.GreylistDelay = defaultGreylistDelay
+	p.duration(greylistDelayKey, &options.GreylistDelay, false)
+
+	options.DialTimeout = defaultDialTimeout
+	p.duration(dialTimeoutKey, &options.DialTimeout, true)
+	options.CommandTimeout = defaultCommandTimeout
+	p.duration(commandTimeoutKey, &options.CommandTimeout, true)
+	options.SendTimeout = defaultSendTimeout
+	p.duration(sendTimeoutKey, &options.SendTimeout, true)
+	p.bool(smtpDebugKey, &options.SMTPDebug)
+
+	p.float(chaosFailureRateKey, &options.ChaosFailureRate)
+	if options.ChaosFailureRate < 0 || options.ChaosFailureRate > 1 {
+		p.fail("invalid value for %s: must be between 0 and 1", chaosFailureRateKey)
+	}
+	if options.ChaosCodes = p.list(chaosCodesKey); len(options.ChaosCodes) == 0 {
+		options.ChaosCodes = []string{"451"}
+	}
+	for _, code := range options.ChaosCodes {
+		if !validChaosCode(code) {
+			p.fail("invalid value for %s: %q is neither a 4xx or 5xx reply code nor %s", chaosCodesKey, code, chaosTimeout)
+		}
+	}
+	p.duration(chaosLatencyKey, &options.ChaosLatency, false)
+
+	if p.required(senderAddressKey) != "" {
+		options.SenderAddress = p.email(senderAddressKey)
+	}
+	options.ReturnPathAddress = p.email(returnPathAddressKey)
+	options.ReceiptAddress = p.email(receiptAddressKey)
+	options.SenderDomains = splitList(strings.ToLower(p.string(senderDomainsKey)))
+	if options.SanitizeTags = p.list(sanitizeTagsKey); options.SanitizeTags == nil {
+		options.SanitizeTags = defaultSanitizeTags
+	}
+	if options.SanitizeAttributes = p.list(sanitizeAttributesKey); options.SanitizeAttributes == nil {
+		options.SanitizeAttributes = defaultSanitizeAttributes
+	}
+	options.IdentitiesFile = p.string(identitiesFileKey)
+	options.TenantsFile = p.string(tenantsFileKey)
+	options.QueuePattern = p.string(queuePatternKey)
+	options.QueueDiscoveryInterval = defaultQueueDiscoveryInterval
+	p.duration(queueDiscoveryIntervalKey, &options.QueueDiscoveryInterval, true)
+	options.PubSubChannel = p.string(pubsubChannelKey)
+	p.bool(schedulerNotificationsKey, &options.SchedulerNotifications)
+	p.float(rateLimitKey, &options.RateLimit)
+	p.int(concurrencyKey, &options.Concurrency)
+	if options.Concurrency < 0 {
+		p.fail("invalid value for %s: must not be negative", concurrencyKey)
+	}
+	options.DequeueBatchSize = 1
+	p.int(dequeueBatchSizeKey, &options.DequeueBatchSize)
+	if options.DequeueBatchSize <= 0 {
+		p.fail("invalid value for %s: must be positive", dequeueBatchSizeKey)
 	}
-	options.SMTPPort = port
+	var err error
+	if options.DomainConcurrency, err = parseDomainValues(p.string(domainConcurrencyKey)); err != nil {
+		p.invalid(domainConcurrencyKey, err)
+	}
+	for domain, n := range options.DomainConcurrency {
+		if n != float64(int(n)) {
+			p.fail("invalid value for %s: %s must have a whole number of connections", domainConcurrencyKey, domain)
+		}
+	}
+	if options.DomainRateLimits, err = parseDomainValues(p.string(domainRateLimitsKey)); err != nil {
+		p.invalid(domainRateLimitsKey, err)
+	}
+	options.DomainBackoff = defaultDomainBackoff
+	p.duration(domainBackoffKey, &options.DomainBackoff, true)
+	p.bool(dryRunKey, &options.DryRun)
+	p.int64(quotaHourlyKey, &options.QuotaHourly)
+	p.int64(quotaDailyKey, &options.QuotaDaily)
 
-	address, ok := os.LookupEnv(senderAddressKey)
-	if !ok {
-		return options, fmt.Errorf(errorTemplate, senderAddressKey)
+	if p.required(redisAddressKey) != "" {
+		options.RedisAddress = p.address(redisAddressKey)
 	}
-	options.SenderAddress = address
+	options.RedisKey = "tasks"
+	if key, ok := p.lookup(redisKeyKey); ok {
+		options.RedisKey = key
+	}
+
+	options.SMIMECertPath = p.string(smimeCertPathKey)
+	options.SMIMECertPassword = p.string(smimeCertPasswordKey)
+	options.PGPKeyringDir = p.string(pgpKeyringDirKey)
+	options.PGPMissingKeyPolicy = p.string(pgpMissingKeyPolicyKey)
+	p.bool(pgpWKDKey, &options.PGPWKD)
 
-	redisAddress, ok := os.LookupEnv(redisAddressKey)
-	if !ok {
-		return options, fmt.Errorf(errorTemplate, redisAddressKey)
+	options.TemplateDir = p.string(templateDirKey)
+	options.MJMLBinary = p.string(mjmlBinaryKey)
+	options.PDFRenderer = p.string(pdfRendererKey)
+	options.DefaultLocale = p.string(defaultLocaleKey)
+	p.bool(redisTemplatesKey, &options.RedisTemplates)
+	options.HTTPAddress = p.address(httpAddressKey)
+	options.TrackingBaseURL = p.url(trackingBaseURLKey)
+	p.bool(openTrackingKey, &options.OpenTracking)
+	p.bool(clickTrackingKey, &options.ClickTracking)
+	options.ClickTrackingDomains = splitList(strings.ToLower(p.string(clickTrackingDomainsKey)))
+	options.TrackingSecret = p.string(trackingSecretKey)
+	p.bool(alertmanagerWebhookKey, &options.AlertmanagerWebhook)
+	options.AlertmanagerRecipients = p.emails(alertmanagerRecipientsKey, groupPrefix)
+	options.AlertmanagerAllowedTo = p.list(alertmanagerAllowedToKey)
+	options.AlertmanagerTemplate = p.string(alertmanagerTemplateKey)
+	options.IngestToken = p.string(ingestTokenKey)
+	if options.AlertmanagerWebhook && options.IngestToken == "" {
+		p.fail("%s requires %s", alertmanagerWebhookKey, ingestTokenKey)
+	}
+	options.WebhooksFile = p.string(webhooksFileKey)
+	if options.WebhooksFile != "" && options.IngestToken == "" {
+		p.fail("%s requires %s", webhooksFileKey, ingestTokenKey)
+	}
+	options.APIToken = p.string(apiTokenKey)
+	p.bool(preflightKey, &options.Preflight)
+	options.RecipientDomainAllowlist = p.list(recipientDomainAllowlistKey)
+	options.RecipientDomainDenylist = p.list(recipientDomainDenylistKey)
+	options.SenderAlignment = p.choice(senderAlignmentKey, senderAlignmentOff, senderAlignmentOff, senderAlignmentWarn, senderAlignmentStrict)
+	p.bool(requireDKIMKey, &options.RequireDKIM)
+	if options.RequireDKIM && options.SenderAlignment == senderAlignmentOff {
+		p.fail("%s requires %s", requireDKIMKey, senderAlignmentKey)
 	}
-	options.RedisAddress = redisAddress
+	p.bool(autoSubmittedKey, &options.AutoSubmitted)
+	options.Precedence = p.string(precedenceKey)
+	options.PayloadFormat = p.choice(payloadFormatKey, payloadFormatAuto, payloadFormatAuto, payloadFormatJSON, payloadFormatMsgpack, payloadFormatProtobuf)
+	options.PayloadKeys = p.list(payloadKeysKey)
+	p.bool(payloadEncryptionRequiredKey, &options.PayloadEncryptionRequired)
+	if options.PayloadEncryptionRequired && len(options.PayloadKeys) == 0 {
+		p.fail("%s requires %s", payloadEncryptionRequiredKey, payloadKeysKey)
+	}
+	parseCompression(p, &options)
+	options.TaskSigningSecret = p.string(taskSigningSecretKey)
+	options.HistoryDSN = p.string(historyDSNKey)
+	options.ArchiveTarget = p.string(archiveTargetKey)
+	options.DropFolder = p.string(dropFolderKey)
+	p.bool(ledgerKey, &options.Ledger)
+	options.LedgerTTL = defaultLedgerTTL
+	p.duration(ledgerTTLKey, &options.LedgerTTL, true)
+	if options.LedgerDSN = p.string(ledgerDSNKey); options.LedgerDSN != "" && !options.Ledger {
+		p.fail("%s requires %s", ledgerDSNKey, ledgerKey)
+	}
+	p.bool(renderCacheKey, &options.RenderCache)
+	options.RenderCacheTTL = defaultRenderCacheTTL
+	p.duration(renderCacheTTLKey, &options.RenderCacheTTL, true)
 
-	redisKey, ok := os.LookupEnv(redisKeyKey)
-	if !ok {
-		options.RedisKey = "tasks"
-	} else {
+	options.OutboxDSN = p.string(outboxDSNKey)
+	if options.OutboxDSN != "" && !strings.HasPrefix(options.OutboxDSN, "postgres://") && !strings.HasPrefix(options.OutboxDSN, "postgresql://") {
+		p.fail("invalid value for %s: must be a postgres:// URL", outboxDSNKey)
+	}
+	if options.OutboxTable = p.string(outboxTableKey); options.OutboxTable == "" {
+		options.OutboxTable = defaultOutboxTable
+	} else if !outboxTableName.MatchString(options.OutboxTable) {
+		p.fail("invalid value for %s: %q is not a table name", outboxTableKey, options.OutboxTable)
+	}
+	options.OutboxInterval = defaultOutboxInterval
+	p.duration(outboxIntervalKey, &options.OutboxInterval, true)
+	options.OutboxBatchSize = defaultOutboxBatchSize
+	p.int(outboxBatchSizeKey, &options.OutboxBatchSize)
+	if options.OutboxBatchSize <= 0 {
+		p.fail("invalid value for %s: must be positive", outboxBatchSizeKey)
+	}
+	options.ArchiveBCC = p.email(archiveBCCKey)
+	p.bool(archiveBCCSeparateKey, &options.ArchiveBCCSeparate)
+	p.duration(archiveRetentionKey, &options.ArchiveRetention, false)
+	p.bool(dashboardKey, &options.Dashboard)
+	options.DashboardUsername = p.string(dashboardUsernameKey)
+	options.DashboardPassword = p.string(dashboardPasswordKey)
+	options.OIDCIssuer = p.url(oidcIssuerKey)
+	options.OIDCClientID = p.string(oidcClientIDKey)
+	options.OIDCClientSecret = p.string(oidcClientSecretKey)
+	options.OIDCRedirectURL = p.url(oidcRedirectURLKey)
+	options.OIDCAllowedEmails = p.emails(oidcAllowedEmailsKey, "@")
+	if options.Dashboard {
+		basic := options.DashboardUsername != "" && options.DashboardPassword != ""
+		oidc := options.OIDCIssuer != "" && options.OIDCClientID != "" && options.OIDCClientSecret != "" && options.OIDCRedirectURL != ""
+		if len(options.HTTPAddress) == 0 {
+			p.fail("%s requires %s", dashboardKey, httpAddressKey)
+		}
+		if !basic && !oidc {
+			p.fail("%s requires %s and %s, or %s, %s, %s and %s", dashboardKey,
+				dashboardUsernameKey, dashboardPasswordKey, oidcIssuerKey, oidcClientIDKey, oidcClientSecretKey, oidcRedirectURLKey)
+		}
+	}
+	options.ValidateTasks = true
+	p.bool(validateTasksKey, &options.ValidateTasks)
+	p.int64(loopLimitKey, &options.LoopLimit)
+	options.LoopWindow = defaultLoopWindow
+	p.duration(loopWindowKey, &options.LoopWindow, true)
+	options.GroupDirectoryURL = p.url(groupDirectoryURLKey)
+	if options.GroupDirectoryURL != "" && !strings.Contains(options.GroupDirectoryURL, "{group}") {
+		p.fail("invalid value for %s: must contain {group}", groupDirectoryURLKey)
+	}
+	options.GroupDirectoryToken = p.string(groupDirectoryTokenKey)
+	options.DigestTemplate = p.string(digestTemplateKey)
+	options.DigestInterval = defaultDigestInterval
+	p.duration(digestIntervalKey, &options.DigestInterval, true)
+	p.duration(dedupWindowKey, &options.DedupWindow, false)
+	p.bool(dedupAnnotateKey, &options.DedupAnnotate)
+	if window, ok := p.lookup(deliveryWindowKey); ok {
+		w, err := parseDeliveryWindow(window)
+		if err != nil {
+			p.invalid(deliveryWindowKey, err)
+		}
+		options.DeliveryWindow = w
+	}
+	options.DefaultTimezone = time.UTC
+	if timezone, ok := p.lookup(defaultTimezoneKey); ok {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			p.invalid(defaultTimezoneKey, err)
+		} else {
+			options.DefaultTimezone = loc
+		}
+	}
+	p.bool(inlineCSSKey, &options.InlineCSS)
+
+	p.int64(attachmentMaxBytesKey, &options.AttachmentMaxBytes)
+	p.duration(attachmentFetchTimeoutKey, &options.AttachmentFetchTimeout, false)
+	options.AttachmentPrivateHosts = p.list(attachmentPrivateHostsKey)
+	options.ClamAVAddress = p.string(clamAVAddressKey)
+	options.ClamAVTimeout = defaultClamAVTimeout
+	p.duration(clamAVTimeoutKey, &options.ClamAVTimeout, true)
+	p.duration(configWatchIntervalKey, &options.ConfigWatchInterval, true)
+	// The hostname is stable across restarts of a Kubernetes pod or a
+	// container with a fixed name; replicas sharing a host need WORKER_ID.
+	if options.WorkerID = p.string(workerIDKey); options.WorkerID == "" {
+		if options.WorkerID, _ = os.Hostname(); options.WorkerID == "" {
+			options.WorkerID = newTaskID()
+		}
+	}
+
+	p.float(alertFailureRatioKey, &options.AlertFailureRatio)
+	options.AlertWindow = defaultAlertWindow
+	p.duration(alertWindowKey, &options.AlertWindow, true)
+	options.AlertMinAttempts = defaultAlertMinAttempts
+	p.int64(alertMinAttemptsKey, &options.AlertMinAttempts)
+	options.AlertWebhookURL = p.url(alertWebhookURLKey)
+	options.AlertSlackWebhookURL = p.url(alertSlackWebhookURLKey)
+	options.AlertEmailRecipients = p.emails(alertEmailRecipientsKey, "")
+	options.AlertSMTPHost = p.string(alertSMTPHostKey)
+	options.AlertSMTPPort = p.port(alertSMTPPortKey)
+	options.AlertSMTPUsername = p.string(alertSMTPUsernameKey)
+	options.AlertSMTPPassword = p.string(alertSMTPPasswordKey)
+	if options.AlertFailureRatio < 0 || options.AlertFailureRatio > 1 {
+		p.fail("invalid value for %s: must be between 0 and 1", alertFailureRatioKey)
+	}
+	if options.AlertFailureRatio > 0 && options.AlertWebhookURL == "" && options.AlertSlackWebhookURL == "" && len(options.AlertEmailRecipients) == 0 {
+		p.fail("%s requires %s, %s or %s", alertFailureRatioKey, alertWebhookURLKey, alertSlackWebhookURLKey, alertEmailRecipientsKey)
+	}
+	if len(options.AlertEmailRecipients) > 0 && options.AlertSMTPHost == "" {
+		p.fail("%s requires %s", alertEmailRecipientsKey, alertSMTPHostKey)
+	}
+
+	options.NotifyWebhookURL = p.url(notifyWebhookURLKey)
+	options.NotifyFormat = p.choice(notifyFormatKey, notifyFormatAuto, notifyFormatAuto, notifyFormatSlack, notifyFormatTeams)
+	options.NotifyEvents = p.list(notifyEventsKey)
+	for _, e := range options.NotifyEvents {
+		known := false
+		for _, k := range allEvents {
+			known = known || e == k
+		}
+		if !known {
+			p.fail("invalid value for %s: unknown event %q; must be one of %s", notifyEventsKey, e, strings.Join(allEvents, ", "))
+		}
+	}
+	p.int64(dlqAlertThresholdKey, &options.DLQAlertThreshold)
+	if options.DLQAlertThreshold > 0 && options.NotifyWebhookURL == "" {
+		p.fail("%s requires %s", dlqAlertThresholdKey, notifyWebhookURLKey)
+	}
 
-		options.RedisKey = redisKey
+	if options.SentryDSN = p.string(sentryDSNKey); options.SentryDSN != "" {
+		if _, _, err := parseSentryDSN(options.SentryDSN); err != nil {
+			p.invalid(sentryDSNKey, err)
+		}
+	}
+	options.SentryEnvironment = p.string(sentryEnvironmentKey)
+
+	p.bool(debugEndpointsKey, &options.DebugEndpoints)
+	options.DebugToken = p.string(debugTokenKey)
+	if options.DebugEndpoints {
+		if len(options.HTTPAddress) == 0 {
+			p.fail("%s requires %s", debugEndpointsKey, httpAddressKey)
+		}
+		if options.DebugToken == "" {
+			p.fail("%s requires %s", debugEndpointsKey, debugTokenKey)
+		}
+	}
+
+	options.VaultAddress = p.url(vaultAddressKey)
+	options.VaultToken = p.string(vaultTokenKey)
+	options.VaultRoleID = p.string(vaultRoleIDKey)
+	options.VaultSecretID = p.string(vaultSecretIDKey)
+	options.VaultSMTPPath = p.string(vaultSMTPPathKey)
+	options.VaultRedisPath = p.string(vaultRedisPathKey)
+	if (options.VaultSMTPPath != "" || options.VaultRedisPath != "") && options.VaultAddress == "" {
+		p.fail("%s and %s require %s", vaultSMTPPathKey, vaultRedisPathKey, vaultAddressKey)
+	}
+	if options.VaultAddress != "" && options.VaultToken == "" && (options.VaultRoleID == "" || options.VaultSecretID == "") {
+		p.fail("%s requires %s, or %s and %s", vaultAddressKey, vaultTokenKey, vaultRoleIDKey, vaultSecretIDKey)
+	}
+	if options.VaultSMTPPath != "" && (options.SMTPUsername != "" || options.SMTPPassword != "") {
+		p.fail("%s can't be used with %s or %s", vaultSMTPPathKey, smtpUsernameKey, smtpPasswordKey)
 	}
-	return options, nil
+	return options, p.err()
 }
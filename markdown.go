@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	messageFormatHTML     = "html"
+	messageFormatMarkdown = "markdown"
+)
+
+// markdown renders CommonMark with GitHub extensions. Raw HTML in the source
+// is omitted and unsafe link schemes are dropped, so producers can't inject
+// markup through the Markdown body.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+func renderMarkdown(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", fmt.Errorf("error rendering markdown: %w", err)
+	}
+	return buf.String(), nil
+}
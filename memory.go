@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+const inflightBytesMetric = "post_room_inflight_bytes"
+
+func init() {
+	metrics.describe(inflightBytesMetric, "gauge", "Bytes of task payloads held by sends in progress.")
+}
+
+// memoryGuard counts the bytes of the task payloads the worker's sends in
+// progress hold, across every tenant, and stops tasks being taken from the
+// queue while they reach limit, so that a deep queue of tasks with large
+// attachments can't run the worker out of memory. A send's payload is
+// counted decoded, however it was compressed on the queue, and tasks held
+// in a batch as they were taken. Attachments fetched by URL aren't
+// counted. A nil guard doesn't limit.
+type memoryGuard struct {
+	limit int64
+
+	mu       sync.Mutex
+	released *sync.Cond
+	held     int64
+	paused   bool
+}
+
+func newMemoryGuard(limit int64) *memoryGuard {
+	if limit <= 0 {
+		return nil
+	}
+	g := &memoryGuard{limit: limit}
+	g.released = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait blocks while the sends in progress hold limit bytes or more.
+func (g *memoryGuard) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.held >= g.limit {
+		if !g.paused {
+			log.Printf("sends in progress hold %d bytes of tasks, over %s: waiting for them before taking more", g.held, maxInflightBytesKey)
+			g.paused = true
+		}
+		g.released.Wait()
+	}
+}
+
+// hold counts a send holding a payload of n bytes, to be given back to
+// release when it is done.
+func (g *memoryGuard) hold(n int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.held += n
+	metrics.set(inflightBytesMetric, float64(g.held))
+}
+
+// free returns how many more bytes may be held before the limit, at least
+// 1, or 0 for a nil guard.
+func (g *memoryGuard) free() int64 {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.held >= g.limit {
+		return 1
+	}
+	return g.limit - g.held
+}
+
+func (g *memoryGuard) release(n int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.held -= n
+	if g.held == 0 {
+		// Log the next wait again only once the sends have caught up.
+		g.paused = false
+	}
+	metrics.set(inflightBytesMetric, float64(g.held))
+	g.released.Broadcast()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// part is a single MIME entity. Leaf parts carry an already decoded body that
+// is transfer-encoded on write; multipart parts carry children instead.
+type part struct {
+	header   textproto.MIMEHeader
+	body     []byte
+	boundary string
+	children []*part
+}
+
+// textPart builds a leaf part for textual content, encoded as
+// quoted-printable so long lines stay within the SMTP line length limit.
+func textPart(contentType string, body []byte) *part {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &part{header: h, body: body}
+}
+
+// binaryPart builds a leaf part for arbitrary binary content, encoded as
+// base64.
+func binaryPart(contentType string, body []byte) *part {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "base64")
+	return &part{header: h, body: body}
+}
+
+// rawPart builds a leaf part whose body is already 7-bit safe and is written
+// without a transfer encoding.
+func rawPart(contentType string, body []byte) *part {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType)
+	return &part{header: h, body: body}
+}
+
+// contentPart picks textPart or binaryPart based on the media type.
+func contentPart(contentType string, body []byte) *part {
+	if strings.HasPrefix(strings.ToLower(contentType), "text/") {
+		return textPart(contentType, body)
+	}
+	return binaryPart(contentType, body)
+}
+
+// multipartOf builds a multipart/<subtype> container around children.
+func multipartOf(subtype string, children ...*part) *part {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary}))
+	return &part{header: h, boundary: boundary, children: children}
+}
+
+// relatedPart wraps an HTML part in multipart/related together with the
+// inline assets it references by Content-ID.
+func relatedPart(html *part, inline []Attachment) (*part, error) {
+	children := []*part{html}
+	for _, a := range inline {
+		if a.ContentID == "" {
+			return nil, fmt.Errorf("inline attachment %q has no contentId", a.Filename)
+		}
+		p := binaryPart(attachmentContentType(a), a.Content)
+		p.header.Set("Content-ID", "<"+strings.Trim(a.ContentID, "<>")+">")
+		p.header.Set("Content-Disposition", dispositionHeader("inline", a.Filename))
+		children = append(children, p)
+	}
+	related := multipartOf("related", children...)
+	related.header.Set("Content-Type", mime.FormatMediaType("multipart/related", map[string]string{
+		"boundary": related.boundary,
+		"type":     "text/html",
+	}))
+	return related, nil
+}
+
+// attachmentContentType returns the declared content type, sniffing it from
+// the content when the producer didn't provide one.
+func attachmentContentType(a Attachment) string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	return http.DetectContentType(a.Content)
+}
+
+func dispositionHeader(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// writeHeader writes the part's headers in a stable order followed by the
+// blank line separating them from the body.
+func (p *part) writeHeader(w io.Writer) error {
+	return writeHeaderFields(w, p.header)
+}
+
+// writeBody writes the transfer-encoded body, recursing into children for
+// multipart parts.
+func (p *part) writeBody(w io.Writer) error {
+	if p.children != nil {
+		mw := multipart.NewWriter(w)
+		if err := mw.SetBoundary(p.boundary); err != nil {
+			return err
+		}
+		for _, child := range p.children {
+			cw, err := mw.CreatePart(child.header)
+			if err != nil {
+				return err
+			}
+			if err := child.writeBody(cw); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}
+
+	switch p.header.Get("Content-Transfer-Encoding") {
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(p.body); err != nil {
+			return err
+		}
+		return qw.Close()
+	case "base64":
+		return writeBase64(w, p.body)
+	default:
+		_, err := w.Write(p.body)
+		return err
+	}
+}
+
+// writeBase64 writes data as base64 wrapped at 76 characters per line.
+func writeBase64(w io.Writer, data []byte) error {
+	const lineLength = 76
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 0 {
+		n := lineLength
+		if len(encoded) < n {
+			n = len(encoded)
+		}
+		if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
+
+func writeHeaderFields(w io.Writer, h textproto.MIMEHeader) error {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// buildMessage renders the full RFC 5322 message for mail, signing it when
+// the mailer has an S/MIME certificate and the task hasn't opted out, and
+// encrypting it when encryptTo holds recipient keys. Identities with a DKIM
+// key sign the finished message. Each call gives the message a new
+// Message-ID and the current Date.
+func (m Mailer) buildMessage(sender *identity, recipients []*netmail.Address, mail Mail, encryptTo openpgp.EntityList) ([]byte, error) {
+	root, err := m.buildBody(sender.from, recipients, mail)
+	if err != nil {
+		return nil, err
+	}
+	if m.signer != nil && !mail.SkipSigning {
+		if root, err = m.signer.sign(root); err != nil {
+			return nil, err
+		}
+	}
+	if len(encryptTo) > 0 {
+		if root, err = pgpEncrypt(root, encryptTo); err != nil {
+			return nil, err
+		}
+	}
+
+	xPriority, importance, err := priorityFields(mail.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", newTaskID(), addressDomain(sender.from))
+	fmt.Fprintf(&buf, "To: %s\r\n", formatAddressList(recipients))
+	fmt.Fprintf(&buf, "From: %s\r\n", sender.from.String())
+	if len(sender.replyTo) > 0 {
+		fmt.Fprintf(&buf, "Reply-To: %s\r\n", formatAddressList(sender.replyTo))
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\n", encodeHeader(mail.Subject))
+	if xPriority != "" {
+		fmt.Fprintf(&buf, "X-Priority: %s\r\n", xPriority)
+		fmt.Fprintf(&buf, "Importance: %s\r\n", importance)
+	}
+	if m.autoSubmitted && !hasHeader(mail.Headers, "Auto-Submitted") {
+		fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	}
+	if m.precedence != "" && !hasHeader(mail.Headers, "Precedence") {
+		fmt.Fprintf(&buf, "Precedence: %s\r\n", m.precedence)
+	}
+	if mail.ReadReceipt && !hasHeader(mail.Headers, "Disposition-Notification-To") {
+		receipts := sender.from
+		if m.receiptAddress != nil {
+			receipts = m.receiptAddress
+		}
+		fmt.Fprintf(&buf, "Disposition-Notification-To: %s\r\n", receipts.String())
+	}
+	if err := writeCustomHeaders(&buf, mail.Headers); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	if err := root.writeHeader(&buf); err != nil {
+		return nil, err
+	}
+	if err := root.writeBody(&buf); err != nil {
+		return nil, err
+	}
+	if sender.dkim != nil {
+		return sender.dkim.sign(buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// buildBody assembles the MIME tree for the message content.
+func (m Mailer) buildBody(sender *netmail.Address, recipients []*netmail.Address, mail Mail) (*part, error) {
+	html := mail.Message
+	var plain string
+	switch mail.MessageFormat {
+	case "", messageFormatHTML:
+	case messageFormatMarkdown:
+		rendered, err := renderMarkdown(mail.Message)
+		if err != nil {
+			return nil, err
+		}
+		// Markdown reads well as it is, so the source doubles as the
+		// plaintext alternative.
+		html, plain = rendered, mail.Message
+	default:
+		return nil, fmt.Errorf("unknown message format %q", mail.MessageFormat)
+	}
+	html = injectPreheader(html, mail.Preheader)
+	html = appendUTM(html, utmParams(m.templates.config(mail.Template).UTM, mail.UTM))
+	// Opens and clicks are recorded in the task's status, so there is
+	// nothing to track without a status store.
+	if m.status != nil && m.tracker.tracksClicks(mail) {
+		html = m.tracker.rewriteLinks(html, m.status.queue, mail.ID)
+	}
+	if m.status != nil && m.tracker.tracksOpens(mail) {
+		html = m.tracker.injectOpenPixel(html, m.status.queue, mail.ID)
+	}
+
+	root := textPart("text/html; charset=\"UTF-8\"", []byte(html))
+	if len(mail.Inline) > 0 {
+		related, err := relatedPart(root, mail.Inline)
+		if err != nil {
+			return nil, err
+		}
+		root = related
+	}
+
+	// Alternatives are ordered from least to most preferred.
+	var alternatives []*part
+	if plain != "" {
+		alternatives = append(alternatives, textPart("text/plain; charset=\"UTF-8\"", []byte(plain)))
+	}
+	alternatives = append(alternatives, root)
+	if mail.Event != nil {
+		invite, err := calendarPart(*mail.Event, mail.Subject, sender, recipients)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, invite)
+	}
+	if len(alternatives) > 1 {
+		root = multipartOf("alternative", alternatives...)
+	}
+	if len(mail.Attachments) > 0 {
+		children := []*part{root}
+		for _, a := range mail.Attachments {
+			p := contentPart(attachmentContentType(a), a.Content)
+			p.header.Set("Content-Disposition", dispositionHeader("attachment", a.Filename))
+			children = append(children, p)
+		}
+		root = multipartOf("mixed", children...)
+	}
+	return root, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsPath = "/metrics"
+
+// metrics is the registry served at metricsPath.
+var metrics = newMetricsRegistry()
+
+// metricsRegistry holds counters, gauges and histograms and renders them in
+// the Prometheus text exposition format.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	kind, help string
+	// values is keyed by the rendered label set, e.g. {queue="tasks"}.
+	values map[string]float64
+	// buckets are a histogram's upper bounds, and histograms its
+	// observations by label set.
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+// histogram holds cumulative counts per bucket, as they are exposed.
+type histogram struct {
+	counts     []float64
+	sum, count float64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: map[string]*metricFamily{}}
+}
+
+// describe registers a metric family. kind is "counter" or "gauge".
+func (r *metricsRegistry) describe(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = &metricFamily{kind: kind, help: help, values: map[string]float64{}}
+	}
+}
+
+// describeHistogram registers a histogram family with the given bucket upper
+// bounds, in increasing order.
+func (r *metricsRegistry) describeHistogram(name, help string, buckets []float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = &metricFamily{kind: "histogram", help: help, buckets: buckets, histograms: map[string]*histogram{}}
+	}
+}
+
+// observe records value in the named histogram for the given label
+// name/value pairs.
+func (r *metricsRegistry) observe(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok || f.kind != "histogram" {
+		return
+	}
+	h, ok := f.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(f.buckets))}
+		f.histograms[key] = h
+	}
+	for i, bound := range f.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// add increments the named metric for the given label name/value pairs.
+func (r *metricsRegistry) add(name string, delta float64, labels ...string) {
+	r.update(name, labels, func(v float64) float64 { return v + delta })
+}
+
+// set sets the named gauge for the given label name/value pairs.
+func (r *metricsRegistry) set(name string, value float64, labels ...string) {
+	r.update(name, labels, func(float64) float64 { return value })
+}
+
+func (r *metricsRegistry) update(name string, labels []string, fn func(float64) float64) {
+	key := formatLabels(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &metricFamily{kind: "untyped", values: map[string]float64{}}
+		r.families[name] = f
+	}
+	f.values[key] = fn(f.values[key])
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		f := r.families[name]
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		if f.kind == "histogram" {
+			f.writeHistograms(w, name)
+			continue
+		}
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", name, k, f.values[k])
+		}
+	}
+}
+
+func (f *metricFamily) writeHistograms(w io.Writer, name string) {
+	keys := make([]string, 0, len(f.histograms))
+	for k := range f.histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := f.histograms[k]
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %g\n", name, withLabel(k, "le", fmt.Sprintf("%g", bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %g\n", name, withLabel(k, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, k, h.sum)
+		fmt.Fprintf(w, "%s_count%s %g\n", name, k, h.count)
+	}
+}
+
+// withLabel adds a label to a rendered label set.
+func withLabel(labels, name, value string) string {
+	label := fmt.Sprintf(`%s="%s"`, name, value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + label + "}"
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	defaultMXPort    = "25"
+	mxIdleTimeout    = 30 * time.Second
+	mxMaxIdlePerHost = 2
+)
+
+// mxTransport delivers directly to each recipient domain's mail servers
+// instead of through a relay. Servers are tried in MX preference order
+// until one accepts the message or rejects it permanently. STARTTLS is used
+// whenever offered; as is usual between MTAs, certificates are only verified
+// if verifyTLS is set. Connections are kept open for reuse for a short while
+// after each delivery.
+type mxTransport struct {
+	port      string
+	verifyTLS bool
+	helo      string
+	resolver  *net.Resolver
+	timeouts  smtpTimeouts
+
+	mu   sync.Mutex
+	idle map[string][]idleClient
+}
+
+type idleClient struct {
+	client *smtp.Client
+	conn   *timeoutConn
+	since  time.Time
+}
+
+func newMXTransport(port string, verifyTLS bool, helo string, timeouts smtpTimeouts) *mxTransport {
+	if port == "" {
+		port = defaultMXPort
+	}
+	t := &mxTransport{port: port, verifyTLS: verifyTLS, helo: helo, resolver: net.DefaultResolver, timeouts: timeouts, idle: map[string][]idleClient{}}
+	go t.expireIdle()
+	return t
+}
+
+// deliver calls send once per recipient domain with a client connected to
+// one of the domain's mail servers, and returns the recipients that failed.
+func (t *mxTransport) deliver(sendCtx context.Context, recipients []*netmail.Address, send func(*smtp.Client, []*netmail.Address) error) []deliveryFailure {
+	var domains []string
+	groups := map[string][]*netmail.Address{}
+	for _, r := range recipients {
+		d := addressDomain(r)
+		if _, ok := groups[d]; !ok {
+			domains = append(domains, d)
+		}
+		groups[d] = append(groups[d], r)
+	}
+
+	var failures []deliveryFailure
+	for _, d := range domains {
+		err := t.deliverDomain(sendCtx, d, groups[d], send)
+		failures = append(failures, failuresOf(groups[d], err)...)
+	}
+	return failures
+}
+
+func (t *mxTransport) deliverDomain(sendCtx context.Context, domain string, recipients []*netmail.Address, send func(*smtp.Client, []*netmail.Address) error) error {
+	hosts, err := t.hosts(sendCtx, domain)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, host := range hosts {
+		idle, err := t.get(sendCtx, host)
+		if err == nil {
+			err = send(idle.client, recipients)
+			t.release(host, idle)
+		}
+		// Once a server has answered for the recipients, don't ask the next
+		// one about those it refused.
+		var partial *partialDelivery
+		if err == nil || isPermanent(err) || errors.As(err, &partial) {
+			return err
+		}
+		log.Printf("error delivering to %s via %s: %v", domain, host, err)
+		lastErr = err
+	}
+	return fmt.Errorf("no mail server for %s accepted the message: %w", domain, lastErr)
+}
+
+// hosts returns the mail servers for domain in order of preference.
+func (t *mxTransport) hosts(c context.Context, domain string) ([]string, error) {
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("invalid domain %q: %w", domain, err))
+	}
+
+	mxs, err := t.resolver.LookupMX(c, ascii)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("error looking up MX records for %s: %w", domain, err)
+	}
+	if len(mxs) == 0 {
+		// Without MX records the domain itself is the mail server.
+		if _, err := t.resolver.LookupHost(c, ascii); err != nil {
+			if isNotFound(err) {
+				return nil, permanent(fmt.Errorf("domain %s does not exist", domain))
+			}
+			return nil, fmt.Errorf("error looking up %s: %w", domain, err)
+		}
+		return []string{ascii}, nil
+	}
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			return nil, permanent(fmt.Errorf("domain %s does not accept mail (null MX)", domain))
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// get returns an idle connection to host, or a new one, bound to the
+// deadline of sendCtx.
+func (t *mxTransport) get(sendCtx context.Context, host string) (idleClient, error) {
+	t.mu.Lock()
+	for len(t.idle[host]) > 0 {
+		n := len(t.idle[host])
+		idle := t.idle[host][n-1]
+		t.idle[host] = t.idle[host][:n-1]
+		t.mu.Unlock()
+		idle.conn.bind(sendCtx)
+		if time.Since(idle.since) < mxIdleTimeout && idle.client.Noop() == nil {
+			return idle, nil
+		}
+		idle.client.Close()
+		t.mu.Lock()
+	}
+	t.mu.Unlock()
+	return t.dial(sendCtx, host)
+}
+
+func (t *mxTransport) dial(sendCtx context.Context, host string) (idleClient, error) {
+	c, conn, err := t.timeouts.connect(sendCtx, net.JoinHostPort(host, t.port), host, t.helo, nil)
+	if err != nil {
+		return idleClient{}, fmt.Errorf("error connecting to %s: %w", host, err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := startTLS(c, conn, &tls.Config{ServerName: host, InsecureSkipVerify: !t.verifyTLS}); err != nil {
+			c.Close()
+			return idleClient{}, fmt.Errorf("error starting TLS with %s: %w", host, err)
+		}
+	}
+	return idleClient{client: c, conn: conn}, nil
+}
+
+// release resets the session and keeps the connection for reuse, closing it
+// if the session is unusable or enough connections to host are idle.
+func (t *mxTransport) release(host string, idle idleClient) {
+	idle.conn.bind(context.Background())
+	if idle.client.Reset() != nil {
+		idle.client.Close()
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle[host]) >= mxMaxIdlePerHost {
+		go idle.client.Quit()
+		return
+	}
+	idle.since = time.Now()
+	t.idle[host] = append(t.idle[host], idle)
+}
+
+// expireIdle closes connections that have been idle too long.
+func (t *mxTransport) expireIdle() {
+	for range time.Tick(mxIdleTimeout / 2) {
+		var expired []*smtp.Client
+		t.mu.Lock()
+		for host, clients := range t.idle {
+			kept := clients[:0]
+			for _, idle := range clients {
+				if time.Since(idle.since) >= mxIdleTimeout {
+					expired = append(expired, idle.client)
+				} else {
+					kept = append(kept, idle)
+				}
+			}
+			t.idle[host] = kept
+		}
+		t.mu.Unlock()
+		for _, c := range expired {
+			c.Quit()
+		}
+	}
+}
+
+// idleCounts returns how many connections are held open to each host.
+func (t *mxTransport) idleCounts() map[string]int {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[string]int{}
+	for host, clients := range t.idle {
+		if len(clients) > 0 {
+			counts[host] = len(clients)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcSessionCookie = "post_room_session"
+	oidcStateCookie   = "post_room_login"
+	oidcSessionTTL    = 12 * time.Hour
+	oidcLoginTTL      = 10 * time.Minute
+)
+
+// oidcLogin signs dashboard users in with an OpenID Connect provider using
+// the authorization code flow, keeping them signed in with an HMAC-signed
+// session cookie. The cookie key is generated at startup, so restarting the
+// worker signs everyone out.
+type oidcLogin struct {
+	issuer, clientID, clientSecret string
+	redirectURL, callbackPath      string
+	// allowed holds the email addresses, or @domains, that may sign in.
+	// Empty allows anyone the provider authenticates.
+	allowed []string
+	secure  bool
+	key     []byte
+	client  *http.Client
+
+	authURL, tokenURL, jwksURL string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+// newOIDCLogin reads the provider's discovery document.
+func newOIDCLogin(options AppOptions) (*oidcLogin, error) {
+	redirect, err := url.Parse(options.OIDCRedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", oidcRedirectURLKey, err)
+	}
+	o := &oidcLogin{
+		issuer:       strings.TrimSuffix(options.OIDCIssuer, "/"),
+		clientID:     options.OIDCClientID,
+		clientSecret: options.OIDCClientSecret,
+		redirectURL:  options.OIDCRedirectURL,
+		callbackPath: redirect.Path,
+		allowed:      options.OIDCAllowedEmails,
+		secure:       redirect.Scheme == "https",
+		key:          make([]byte, 32),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if _, err := rand.Read(o.key); err != nil {
+		return nil, err
+	}
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(o.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("error discovering OIDC provider: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("OIDC provider reports issuer %q, expected %q", discovery.Issuer, o.issuer)
+	}
+	o.authURL, o.tokenURL, o.jwksURL = discovery.AuthorizationEndpoint, discovery.TokenEndpoint, discovery.JWKSURI
+	return o, nil
+}
+
+func (o *oidcLogin) getJSON(target string, v interface{}) error {
+	resp, err := o.client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// require passes signed in users to next. Others are sent to the provider
+// to sign in, except for requests other than GET, which are refused.
+func (o *oidcLogin) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(oidcSessionCookie); err == nil {
+			if _, ok := o.verify(oidcSessionCookie, cookie.Value); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		state, nonce := randomToken(), randomToken()
+		o.setCookie(w, oidcStateCookie, o.sign(oidcStateCookie, oidcLoginTTL, state, nonce, r.URL.RequestURI()), oidcLoginTTL)
+		query := url.Values{
+			"response_type": {"code"},
+			"client_id":     {o.clientID},
+			"redirect_uri":  {o.redirectURL},
+			"scope":         {"openid email"},
+			"state":         {state},
+			"nonce":         {nonce},
+		}
+		sep := "?"
+		if strings.Contains(o.authURL, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, o.authURL+sep+query.Encode(), http.StatusFound)
+	})
+}
+
+// callback completes a sign in, exchanging the code for an ID token.
+func (o *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		http.Error(w, "sign in failed: "+msg, http.StatusForbidden)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "sign in expired, try again", http.StatusBadRequest)
+		return
+	}
+	login, ok := o.verify(oidcStateCookie, cookie.Value)
+	if !ok || len(login) < 3 || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(login[0])) != 1 {
+		http.Error(w, "sign in expired, try again", http.StatusBadRequest)
+		return
+	}
+	email, err := o.exchange(r.URL.Query().Get("code"), login[1])
+	if err != nil {
+		log.Print("error signing in to dashboard: ", err)
+		http.Error(w, "sign in failed", http.StatusForbidden)
+		return
+	}
+	if !o.permitted(email) {
+		log.Printf("refused dashboard sign in by %s", email)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	log.Printf("%s signed in to the dashboard", email)
+	o.setCookie(w, oidcStateCookie, "", -time.Second)
+	o.setCookie(w, oidcSessionCookie, o.sign(oidcSessionCookie, oidcSessionTTL, email), oidcSessionTTL)
+	back := strings.Join(login[2:], "|")
+	if !strings.HasPrefix(back, dashboardPath) {
+		back = dashboardPath
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+func (o *oidcLogin) permitted(email string) bool {
+	if len(o.allowed) == 0 {
+		return true
+	}
+	email = strings.ToLower(email)
+	for _, a := range o.allowed {
+		a = strings.ToLower(a)
+		if a == email || (strings.HasPrefix(a, "@") && strings.HasSuffix(email, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange redeems code at the token endpoint and returns the verified
+// email address from the ID token.
+func (o *oidcLogin) exchange(code, nonce string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.redirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error redeeming code: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error redeeming code: %s", resp.Status)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error reading token response: %w", err)
+	}
+	return o.verifyIDToken(token.IDToken, nonce)
+}
+
+// verifyIDToken checks an RS256 ID token's signature and claims.
+func (o *oidcLogin) verifyIDToken(token, nonce string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := o.publicKey(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return "", errors.New("ID token signature does not match")
+	}
+
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Audience      json.RawMessage `json:"aud"`
+		Expiry        int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified *bool           `json:"email_verified"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	var audience []string
+	if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+		audience = []string{""}
+		json.Unmarshal(claims.Audience, &audience[0])
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != o.issuer:
+		return "", fmt.Errorf("ID token issued by %q", claims.Issuer)
+	case !containsString(audience, o.clientID):
+		return "", errors.New("ID token is for another client")
+	case time.Now().Unix() >= claims.Expiry:
+		return "", errors.New("ID token has expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("ID token nonce does not match")
+	case claims.Email == "":
+		return "", errors.New("ID token has no email claim")
+	case claims.EmailVerified != nil && !*claims.EmailVerified:
+		return "", fmt.Errorf("email %s is not verified", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// publicKey returns the provider's signing key kid, fetching the key set
+// again if it isn't known, as happens when keys are rotated.
+func (o *oidcLogin) publicKey(kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(o.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC signing keys: %w", err)
+	}
+	o.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown OIDC signing key %q", kid)
+}
+
+// sign encodes fields in a value for the cookie named purpose, which verify
+// accepts for that cookie alone until ttl has passed. The purpose is signed
+// with the fields, so that a login state can't be passed off as a session.
+func (o *oidcLogin) sign(purpose string, ttl time.Duration, fields ...string) string {
+	value := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + "|" + purpose + "|" + strings.Join(fields, "|")
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (o *oidcLogin) verify(purpose, cookie string) ([]string, bool) {
+	dot := strings.IndexByte(cookie, '.')
+	if dot < 0 {
+		return nil, false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(cookie[:dot])
+	if err != nil {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(cookie[dot+1:])
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write(value)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, false
+	}
+	fields := strings.Split(string(value), "|")
+	if len(fields) < 2 || fields[1] != purpose {
+		return nil, false
+	}
+	expiry, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return nil, false
+	}
+	return fields[2:], true
+}
+
+func (o *oidcLogin) setCookie(w http.ResponseWriter, name, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   o.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("error generating token: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
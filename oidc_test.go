@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOIDCCookiePurpose(t *testing.T) {
+	o := &oidcLogin{key: []byte("0123456789abcdef0123456789abcdef")}
+	state := o.sign(oidcStateCookie, oidcLoginTTL, "state", "nonce", "/dashboard")
+	session := o.sign(oidcSessionCookie, oidcSessionTTL, "someone@example.com")
+	expired := o.sign(oidcSessionCookie, -time.Second, "someone@example.com")
+
+	tests := []struct {
+		name    string
+		purpose string
+		cookie  string
+		want    []string
+	}{
+		{"session", oidcSessionCookie, session, []string{"someone@example.com"}},
+		{"login state", oidcStateCookie, state, []string{"state", "nonce", "/dashboard"}},
+		{"state as session", oidcSessionCookie, state, nil},
+		{"session as state", oidcStateCookie, session, nil},
+		{"expired", oidcSessionCookie, expired, nil},
+		{"tampered", oidcSessionCookie, session[:len(session)-2] + "xx", nil},
+		{"malformed", oidcSessionCookie, "nodot", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, ok := o.verify(tt.purpose, tt.cookie)
+			if ok != (tt.want != nil) {
+				t.Fatalf("verify() ok = %v, want %v", ok, tt.want != nil)
+			}
+			if !equalStrings(fields, tt.want) {
+				t.Errorf("verify() = %q, want %q", fields, tt.want)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
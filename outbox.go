@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	defaultOutboxTable     = "post_room_outbox"
+	defaultOutboxInterval  = time.Second
+	defaultOutboxBatchSize = 100
+
+	outboxPending = "pending"
+	outboxQueued  = "queued"
+)
+
+// outboxTableName is an optionally schema-qualified table name, which is
+// interpolated into SQL and so must be checked.
+var outboxTableName = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// outbox enqueues the tasks producers insert into a Postgres table, in the
+// same transaction as their own writes, so that a task is sent if and only
+// if the producer's transaction commits. Rows go from pending to queued
+// once enqueued, then to sent, failed or cancelled once the worker has a
+// result, with invalid tasks failed at once. Replicas claim rows with FOR
+// UPDATE SKIP LOCKED so they never pick the same one. A row is enqueued
+// again only if marking it queued fails; the copy is identical, with the ID
+// <table>-<row id> unless the task has one, so LEDGER drops it. Dedup lets
+// it through, as it does any task sent again under its own ID.
+type outbox struct {
+	db        *sql.DB
+	table     string
+	rdb       *redis.Client
+	queue     string
+	status    *statusStore
+	validator *taskValidator
+	interval  time.Duration
+	batch     int
+	// cursor is the last queued row sync looked at, so that rows waiting a
+	// long time, such as those scheduled, don't hold up the rest.
+	cursor int64
+}
+
+func newOutbox(rdb *redis.Client, options AppOptions, validator *taskValidator) (*outbox, error) {
+	db, err := sql.Open("postgres", options.OutboxDSN)
+	if err != nil {
+		return nil, fmt.Errorf("error opening outbox database: %w", err)
+	}
+	o := &outbox{
+		db:        db,
+		table:     options.OutboxTable,
+		rdb:       rdb,
+		queue:     options.RedisKey,
+		status:    newStatusStore(rdb, options.RedisKey),
+		validator: validator,
+		interval:  options.OutboxInterval,
+		batch:     options.OutboxBatchSize,
+	}
+	index := o.table[strings.LastIndex(o.table, ".")+1:] + "_state"
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS ` + o.table + ` (
+			id BIGSERIAL PRIMARY KEY,
+			task JSONB NOT NULL,
+			state TEXT NOT NULL DEFAULT 'pending',
+			task_id TEXT,
+			error TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + index + ` ON ` + o.table + ` (state, id)`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error creating outbox table: %w", err)
+		}
+	}
+	return o, nil
+}
+
+// run polls for pending rows, straight away again while there are more
+// than a batch, and while leader leads records the results of queued ones.
+func (o *outbox) run(leader *leaderElection) {
+	for {
+		n, err := o.poll()
+		if err != nil {
+			log.Print(err)
+		}
+		if leader.leader() {
+			if err := o.sync(); err != nil {
+				log.Print(err)
+			}
+		}
+		if n < o.batch {
+			time.Sleep(o.interval)
+		}
+	}
+}
+
+type outboxRow struct {
+	id   int64
+	task []byte
+}
+
+// poll claims and enqueues a batch of pending rows, returning how many it
+// claimed. If Redis fails part way, the rows enqueued so far are still
+// marked queued in the same transaction.
+func (o *outbox) poll() (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error reading outbox: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT id, task::text FROM `+o.table+` WHERE state = $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED`, outboxPending, o.batch)
+	if err != nil {
+		return 0, fmt.Errorf("error reading outbox: %w", err)
+	}
+	var claimed []outboxRow
+	for rows.Next() {
+		var r outboxRow
+		if err := rows.Scan(&r.id, &r.task); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error reading outbox: %w", err)
+		}
+		claimed = append(claimed, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading outbox: %w", err)
+	}
+
+	var enqueueErr error
+	for _, r := range claimed {
+		task, err := o.read(r)
+		if err != nil {
+			log.Printf("error ingesting row %d of %s: %v", r.id, o.table, err)
+			if _, err := tx.Exec(`UPDATE `+o.table+` SET state = $1, error = $2, updated_at = now() WHERE id = $3`, taskFailed, err.Error(), r.id); err != nil {
+				return 0, fmt.Errorf("error updating outbox: %w", err)
+			}
+			continue
+		}
+		if enqueueErr = enqueue(o.rdb, o.queue, &task); enqueueErr != nil {
+			break
+		}
+		if _, err := tx.Exec(`UPDATE `+o.table+` SET state = $1, task_id = $2, updated_at = now() WHERE id = $3`, outboxQueued, task.ID, r.id); err != nil {
+			return 0, fmt.Errorf("error updating outbox: %w", err)
+		}
+		log.Printf("enqueued task %s from row %d of %s", task.ID, r.id, o.table)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error updating outbox: %w", err)
+	}
+	if enqueueErr != nil {
+		return 0, enqueueErr
+	}
+	return len(claimed), nil
+}
+
+func (o *outbox) read(r outboxRow) (Mail, error) {
+	if err := o.validator.validate(r.task); err != nil {
+		return Mail{}, err
+	}
+	var task Mail
+	if err := json.Unmarshal(r.task, &task); err != nil {
+		return Mail{}, fmt.Errorf("invalid task: %w", err)
+	}
+	if task.ID == "" {
+		task.ID = fmt.Sprintf("%s-%d", o.table, r.id)
+	}
+	return task, nil
+}
+
+// sync marks queued rows sent, failed or cancelled once the status store
+// has their final result. Rows still being retried are left queued.
+func (o *outbox) sync() error {
+	rows, err := o.db.QueryContext(ctx, `SELECT id, task_id FROM `+o.table+` WHERE state = $1 AND id > $2 ORDER BY id LIMIT $3`, outboxQueued, o.cursor, o.batch)
+	if err != nil {
+		return fmt.Errorf("error reading outbox: %w", err)
+	}
+	ids := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var taskID string
+		if err := rows.Scan(&id, &taskID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading outbox: %w", err)
+		}
+		ids[id] = taskID
+		o.cursor = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading outbox: %w", err)
+	}
+	if len(ids) < o.batch {
+		o.cursor = 0
+	}
+	for id, taskID := range ids {
+		result, err := o.rdb.HMGet(ctx, o.status.key(taskID), "state", "response").Result()
+		if err != nil {
+			return fmt.Errorf("error reading status of task %s: %w", taskID, err)
+		}
+		state, _ := result[0].(string)
+		response, _ := result[1].(string)
+		if state != taskSent && state != taskFailed && state != taskCancelled {
+			continue
+		}
+		if _, err := o.db.ExecContext(ctx, `UPDATE `+o.table+` SET state = $1, error = NULLIF($2, ''), updated_at = now() WHERE id = $3`, state, response, id); err != nil {
+			return fmt.Errorf("error updating outbox: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+const sendPanicsMetric = "post_room_send_panics_total"
+
+func init() {
+	metrics.describe(sendPanicsMetric, "counter", "Sends that panicked and were dead-lettered.")
+}
+
+// sendMailSafely sends mail like sendMail, but recovers from a panic while
+// doing so, dead-lettering the task rather than letting one bad task take
+// the worker down with the rest of the queue. With split tasks, recipients
+// reached before the panic may be sent to again if the task is replayed.
+func (m Mailer) sendMailSafely(mail Mail) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic sending task %s: %v\n%s", mail.ID, r, debug.Stack())
+			metrics.add(sendPanicsMetric, 1)
+			errorTracker.capturePanic("panic sending task", r, "task_id", mail.ID)
+			opsEvents.notify(eventSendPanic, "panic sending task %s: %v", mail.ID, r)
+			m.recordResult(mail, taskFailed, fmt.Sprint(r))
+			m.dead.add(mail, fmt.Sprintf("panic: %v", r))
+		}
+	}()
+	m.sendMail(mail)
+}
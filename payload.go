@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	payloadFormatAuto     = "auto"
+	payloadFormatJSON     = "json"
+	payloadFormatMsgpack  = "msgpack"
+	payloadFormatProtobuf = "protobuf"
+)
+
+// payloadDecoder turns task payloads in the configured format into the JSON
+// the rest of the worker handles, so every format is validated and decoded
+// the same way. JSON objects, which start with '{', are always accepted as
+// the worker re-enqueues tasks as JSON itself. In auto mode other formats
+// are sniffed from the first byte: MessagePack maps start with 0x80-0x8f,
+// 0xde or 0xdf, and anything else is taken to be protobuf.
+type payloadDecoder struct {
+	format string
+	task   protoreflect.MessageDescriptor
+}
+
+func newPayloadDecoder(format string) (*payloadDecoder, error) {
+	d := &payloadDecoder{format: format}
+	if format == payloadFormatJSON {
+		return d, nil
+	}
+	task, err := taskDescriptor()
+	if err != nil {
+		return nil, fmt.Errorf("error building protobuf task descriptor: %w", err)
+	}
+	d.task = task
+	return d, nil
+}
+
+// decode returns body as JSON.
+func (d *payloadDecoder) decode(body []byte) ([]byte, error) {
+	format := sniffPayloadFormat(body)
+	if format != payloadFormatJSON && d.format != payloadFormatAuto {
+		format = d.format
+	}
+	switch format {
+	case payloadFormatJSON:
+		return body, nil
+	case payloadFormatMsgpack:
+		var doc interface{}
+		if err := msgpack.Unmarshal(body, &doc); err != nil {
+			return nil, fmt.Errorf("invalid MessagePack payload: %w", err)
+		}
+		decoded, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MessagePack payload: %w", err)
+		}
+		return decoded, nil
+	case payloadFormatProtobuf:
+		task := dynamicpb.NewMessage(d.task)
+		if err := proto.Unmarshal(body, task); err != nil {
+			return nil, fmt.Errorf("invalid protobuf payload: %w", err)
+		}
+		return protojson.Marshal(task)
+	default:
+		return nil, fmt.Errorf("unknown payload format %q", format)
+	}
+}
+
+func sniffPayloadFormat(body []byte) string {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] == '{' {
+		return payloadFormatJSON
+	}
+	if b := trimmed[0]; b&0xf0 == 0x80 || b == 0xde || b == 0xdf {
+		return payloadFormatMsgpack
+	}
+	return payloadFormatProtobuf
+}
+
+// taskDescriptor builds the descriptor of the postroom.Task message
+// published in task.proto. Its JSON mapping matches Mail's.
+func taskDescriptor() (protoreflect.MessageDescriptor, error) {
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("postroom/task.proto"),
+		Package: proto.String("postroom"),
+		Syntax:  proto.String("proto3"),
+		Dependency: []string{
+			"google/protobuf/struct.proto",
+			"google/protobuf/timestamp.proto",
+			"google/protobuf/wrappers.proto",
+		},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Task"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("from", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("identity", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("priority", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("subject", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("message", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					repeated(scalarField("recipients", 7, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+					scalarField("message_format", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("template", 9, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					messageField("data", 10, ".google.protobuf.Struct"),
+					scalarField("template_version", 11, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("locale", 12, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("split", 13, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					repeated(messageField("recipient_data", 14, ".postroom.Task.RecipientDataEntry")),
+					messageField("track_opens", 15, ".google.protobuf.BoolValue"),
+					messageField("track_clicks", 16, ".google.protobuf.BoolValue"),
+					repeated(messageField("utm", 17, ".postroom.Task.UtmEntry")),
+					repeated(messageField("inline", 18, ".postroom.Attachment")),
+					repeated(messageField("attachments", 19, ".postroom.Attachment")),
+					messageField("event", 20, ".postroom.Event"),
+					scalarField("digest", 21, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					messageField("campaign", 22, ".postroom.Campaign"),
+					messageField("delivery_window", 23, ".postroom.DeliveryWindow"),
+					scalarField("timezone", 24, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("urgent", 25, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					repeated(scalarField("dsn", 26, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+					scalarField("attempt", 27, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+					scalarField("collapse_key", 28, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					repeated(messageField("headers", 29, ".postroom.Task.HeadersEntry")),
+					scalarField("skip_signing", 30, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					messageField("enqueued_at", 31, ".google.protobuf.Timestamp"),
+					scalarField("idempotency_key", 32, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("sanitize", 33, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					scalarField("read_receipt", 34, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					scalarField("preheader", 35, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					mapEntry("RecipientDataEntry", messageField("value", 2, ".google.protobuf.Struct")),
+					mapEntry("UtmEntry", scalarField("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+					mapEntry("HeadersEntry", scalarField("value", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+				},
+			},
+			{
+				Name: proto.String("Attachment"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("filename", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("content_type", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("content_id", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("content", 4, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+					scalarField("url", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("sha256", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("template", 7, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("render", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("data", 9, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					repeated(scalarField("columns", 10, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+					repeated(messageField("rows", 11, ".google.protobuf.ListValue")),
+				},
+			},
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("uid", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("summary", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("description", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("location", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					messageField("start", 5, ".google.protobuf.Timestamp"),
+					messageField("end", 6, ".google.protobuf.Timestamp"),
+					scalarField("organizer", 7, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					repeated(scalarField("attendees", 8, descriptorpb.FieldDescriptorProto_TYPE_STRING)),
+				},
+			},
+			{
+				Name: proto.String("Campaign"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("recipients_key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("rate", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+					repeated(messageField("subjects", 3, ".postroom.SubjectVariant")),
+				},
+			},
+			{
+				Name: proto.String("SubjectVariant"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("subject", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("weight", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				},
+			},
+			{
+				Name: proto.String("DeliveryWindow"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					scalarField("start", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					scalarField("end", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			},
+		},
+	}
+	fd, err := protodesc.NewFile(file, protoregistry.GlobalFiles)
+	if err != nil {
+		return nil, err
+	}
+	return fd.Messages().ByName("Task"), nil
+}
+
+func scalarField(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:   typ.Enum(),
+	}
+}
+
+func messageField(name string, number int32, typeName string) *descriptorpb.FieldDescriptorProto {
+	f := scalarField(name, number, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	f.TypeName = proto.String(typeName)
+	return f
+}
+
+func repeated(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+	f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	return f
+}
+
+// mapEntry builds the nested entry message protoc generates for a
+// map<string, V> field.
+func mapEntry(name string, value *descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	return &descriptorpb.DescriptorProto{
+		Name: proto.String(name),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			scalarField("key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			value,
+		},
+		Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+	}
+}
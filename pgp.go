@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+const (
+	pgpPolicyPlaintext = "plaintext"
+	pgpPolicyFail      = "fail"
+
+	wkdCacheTTL = time.Hour
+)
+
+// pgpKeyring finds OpenPGP public keys for recipients, first in a local
+// keyring directory and then, if enabled, via Web Key Directory lookups.
+type pgpKeyring struct {
+	local         openpgp.EntityList
+	wkd           bool
+	missingPolicy string
+	client        *http.Client
+
+	mu    sync.Mutex
+	cache map[string]wkdResult
+}
+
+type wkdResult struct {
+	entity  *openpgp.Entity
+	expires time.Time
+}
+
+// loadPGPKeyring reads every public key file in dir. dir may be empty when
+// only WKD lookups are wanted.
+func loadPGPKeyring(dir string, wkd bool, missingPolicy string) (*pgpKeyring, error) {
+	switch missingPolicy {
+	case "":
+		missingPolicy = pgpPolicyPlaintext
+	case pgpPolicyPlaintext, pgpPolicyFail:
+	default:
+		return nil, fmt.Errorf("unknown PGP missing key policy %q", missingPolicy)
+	}
+
+	k := &pgpKeyring{
+		wkd:           wkd,
+		missingPolicy: missingPolicy,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		cache:         map[string]wkdResult{},
+	}
+	if dir == "" {
+		return k, nil
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PGP keyring directory: %w", err)
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		entities, err := readKeyFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		k.local = append(k.local, entities...)
+	}
+	return k, nil
+}
+
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PGP key %s: %w", path, err)
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing PGP key %s: %w", path, err)
+	}
+	return entities, nil
+}
+
+// lookup returns the key for address, or nil if none could be found.
+func (k *pgpKeyring) lookup(address string) (*openpgp.Entity, error) {
+	address = strings.ToLower(address)
+	if e := findEntity(k.local, address); e != nil {
+		return e, nil
+	}
+	if !k.wkd {
+		return nil, nil
+	}
+
+	k.mu.Lock()
+	cached, ok := k.cache[address]
+	k.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.entity, nil
+	}
+	entity, err := k.fetchWKD(address)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.cache[address] = wkdResult{entity: entity, expires: time.Now().Add(wkdCacheTTL)}
+	k.mu.Unlock()
+	return entity, nil
+}
+
+func findEntity(entities openpgp.EntityList, address string) *openpgp.Entity {
+	for _, e := range entities {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.ToLower(id.UserId.Email) == address {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// fetchWKD queries the advanced and then the direct Web Key Directory URL
+// for address. A missing key is not an error.
+func (k *pgpKeyring) fetchWKD(address string) (*openpgp.Entity, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	local, domain := address[:at], address[at+1:]
+	digest := sha1.Sum([]byte(local))
+	hash := zbase32(digest[:])
+	query := "?l=" + url.QueryEscape(local)
+
+	urls := []string{
+		fmt.Sprintf("https://openpgpkey.%s/.well-known/openpgpkey/%s/hu/%s%s", domain, domain, hash, query),
+		fmt.Sprintf("https://%s/.well-known/openpgpkey/hu/%s%s", domain, hash, query),
+	}
+	for _, u := range urls {
+		res, err := k.client.Get(u)
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+		entities, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing WKD key for %s: %w", address, err)
+		}
+		if e := findEntity(entities, address); e != nil {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// zbase32 encodes data with the z-base-32 alphabet used by WKD.
+func zbase32(data []byte) string {
+	const alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+	var b strings.Builder
+	var buffer, bits uint
+	for _, c := range data {
+		buffer = buffer<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			b.WriteByte(alphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		b.WriteByte(alphabet[(buffer<<(5-bits))&31])
+	}
+	return b.String()
+}
+
+// partition splits recipients into those with keys and those without,
+// returning an error if the policy forbids sending to the latter in
+// plaintext.
+func (k *pgpKeyring) partition(recipients []string) (openpgp.EntityList, []string, []string, error) {
+	var keys openpgp.EntityList
+	var encrypted, plain []string
+	for _, r := range recipients {
+		e, err := k.lookup(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if e == nil {
+			plain = append(plain, r)
+			continue
+		}
+		keys = append(keys, e)
+		encrypted = append(encrypted, r)
+	}
+	if len(plain) > 0 && k.missingPolicy == pgpPolicyFail {
+		return nil, nil, nil, fmt.Errorf("no PGP key found for %s", strings.Join(plain, ", "))
+	}
+	return keys, encrypted, plain, nil
+}
+
+// pgpEncrypt wraps content in a PGP/MIME multipart/encrypted entity
+// (RFC 3156) readable only by the holders of keys.
+func pgpEncrypt(content *part, keys openpgp.EntityList) (*part, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to encrypt to")
+	}
+	var rendered bytes.Buffer
+	if err := content.writeHeader(&rendered); err != nil {
+		return nil, err
+	}
+	if err := content.writeBody(&rendered); err != nil {
+		return nil, err
+	}
+
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, keys, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+	if _, err := pw.Write(rendered.Bytes()); err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+	if err := pw.Close(); err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	control := rawPart("application/pgp-encrypted", []byte("Version: 1\r\n"))
+	payload := rawPart("application/octet-stream; name=\"encrypted.asc\"", armored.Bytes())
+	encrypted := multipartOf("encrypted", control, payload)
+	encrypted.header.Set("Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"boundary": encrypted.boundary,
+		"protocol": "application/pgp-encrypted",
+	}))
+	return encrypted, nil
+}
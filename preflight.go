@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	preflightCacheTTL = 10 * time.Minute
+	preflightTimeout  = 5 * time.Second
+)
+
+// preflight checks that recipients are plausibly deliverable before any
+// SMTP attempt: the address must be well-formed and its domain must accept
+// mail, having MX records or else an address record, and no null MX
+// (RFC 7505). DNS failures other than the domain not existing are not held
+// against the address.
+type preflight struct {
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]preflightResult
+}
+
+type preflightResult struct {
+	err     error
+	expires time.Time
+}
+
+func newPreflight() *preflight {
+	return &preflight{resolver: net.DefaultResolver, cache: map[string]preflightResult{}}
+}
+
+// check splits recipients into those that pass and those that don't, with
+// the reasons for the latter.
+func (p *preflight) check(recipients []*netmail.Address) (ok []*netmail.Address, rejected []*netmail.Address, reasons []string) {
+	for _, r := range recipients {
+		if err := p.checkAddress(r.Address); err != nil {
+			rejected = append(rejected, r)
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		ok = append(ok, r)
+	}
+	return ok, rejected, reasons
+}
+
+func (p *preflight) checkAddress(address string) error {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return fmt.Errorf("%s: invalid address", address)
+	}
+	local, domain := address[:at], strings.ToLower(address[at+1:])
+	if len(local) > 64 {
+		return fmt.Errorf("%s: local part is longer than 64 characters", address)
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil || !strings.Contains(ascii, ".") || len(ascii) > 253 {
+		return fmt.Errorf("%s: invalid domain", address)
+	}
+	if err := p.checkDomain(ascii); err != nil {
+		return fmt.Errorf("%s: %w", address, err)
+	}
+	return nil
+}
+
+func (p *preflight) checkDomain(domain string) error {
+	p.mu.Lock()
+	cached, ok := p.cache[domain]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.err
+	}
+
+	c, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+	err := p.lookup(c, domain)
+	p.mu.Lock()
+	p.cache[domain] = preflightResult{err: err, expires: time.Now().Add(preflightCacheTTL)}
+	p.mu.Unlock()
+	return err
+}
+
+func (p *preflight) lookup(c context.Context, domain string) error {
+	mxs, err := p.resolver.LookupMX(c, domain)
+	if err == nil && len(mxs) > 0 {
+		if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+			return fmt.Errorf("domain %s does not accept mail (null MX)", domain)
+		}
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return nil
+	}
+	// Without MX records mail goes to the domain's own address (RFC 5321
+	// section 5.1).
+	if _, err := p.resolver.LookupHost(c, domain); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("domain %s has no MX or address records", domain)
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
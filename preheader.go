@@ -0,0 +1,28 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var bodyTagPattern = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// preheaderPadding follows the preheader with invisible characters, so that
+// clients showing more of the preview than it fills don't go on to the
+// text of the message.
+var preheaderPadding = strings.Repeat("&#847;&zwnj;&nbsp;", 80)
+
+// injectPreheader puts text at the start of the body as hidden preview
+// text, which clients show next to the subject in the inbox.
+func injectPreheader(body, text string) string {
+	if text == "" {
+		return body
+	}
+	preheader := `<div style="display:none;font-size:1px;line-height:1px;max-height:0;max-width:0;opacity:0;overflow:hidden;mso-hide:all">` +
+		html.EscapeString(text) + preheaderPadding + `</div>`
+	if loc := bodyTagPattern.FindStringIndex(body); loc != nil {
+		return body[:loc[1]] + preheader + body[loc[1]:]
+	}
+	return preheader + body
+}
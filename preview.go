@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var previewIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>post-room templates</title></head>
+<body><h1>Templates</h1><ul>
+{{range .}}<li><a href="/preview/{{.}}">{{.}}</a></li>
+{{else}}<li>No templates found</li>{{end}}
+</ul></body></html>`))
+
+// runPreview serves every template rendered with its sample data so template
+// authors can iterate in a browser. Templates and fixtures are reloaded on
+// each request, so edits show up on refresh.
+func runPreview(args []string) error {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8025", "address to listen on")
+	dir := fs.String("templates", os.Getenv(templateDirKey), "template directory")
+	fixtures := fs.String("fixtures", "", "directory of <template>.json sample data files (default: <templates>/fixtures)")
+	mjml := fs.String("mjml", os.Getenv(mjmlBinaryKey), "MJML compiler binary")
+	inline := fs.Bool("inline-css", false, "inline CSS for templates without an inlineCss setting")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("no template directory given; use -templates or %s", templateDirKey)
+	}
+	if *fixtures == "" {
+		*fixtures = filepath.Join(*dir, "fixtures")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		store, err := loadTemplates(*dir, *mjml, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := previewIndex.Execute(w, store.keys()); err != nil {
+			log.Print("error rendering preview index: ", err)
+		}
+	})
+	mux.HandleFunc("/preview/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/preview/")
+		store, err := loadTemplates(*dir, *mjml, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := loadFixture(*fixtures, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		name, locale := key, ""
+		if i := strings.Index(key, "."); i >= 0 {
+			name, locale = key[:i], key[i+1:]
+		}
+		html, err := store.execute(key, locale, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inlineStyles := *inline
+		if setting := store.config(name).InlineCSS; setting != nil {
+			inlineStyles = *setting
+		}
+		if inlineStyles {
+			if html, err = inlineCSS(html); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, html)
+	})
+
+	log.Printf("previewing templates from %s at http://%s/", *dir, *addr)
+	return http.ListenAndServe(*addr, mux)
+}
+
+// loadFixture reads the sample data for a template key, trying the locale
+// variant's own fixture before the base template's. Templates without a
+// fixture render with empty data.
+func loadFixture(dir, key string) (map[string]interface{}, error) {
+	candidates := []string{key}
+	if i := strings.Index(key, "."); i >= 0 {
+		candidates = append(candidates, key[:i])
+	}
+	for _, c := range candidates {
+		raw, err := os.ReadFile(filepath.Join(dir, c+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading fixture for %s: %w", key, err)
+		}
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return nil, fmt.Errorf("error parsing fixture for %s: %w", key, err)
+		}
+		return data, nil
+	}
+	return map[string]interface{}{}, nil
+}
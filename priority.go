@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// priorityHeaders maps a task's priority to the X-Priority and Importance
+// values clients use to flag the message.
+var priorityHeaders = map[string][2]string{
+	priorityHigh:   {"1 (Highest)", "high"},
+	priorityNormal: {"3 (Normal)", "normal"},
+	priorityLow:    {"5 (Lowest)", "low"},
+}
+
+// priorityQueue returns the list consumed ahead of queue, to which
+// producers push tasks that should skip the line.
+func priorityQueue(queue string) string {
+	return queue + ":priority"
+}
+
+// priorityFields returns the X-Priority and Importance headers for the
+// priority, or none for an unset one.
+func priorityFields(priority string) (xPriority, importance string, err error) {
+	if priority == "" {
+		return "", "", nil
+	}
+	h, ok := priorityHeaders[priority]
+	if !ok {
+		return "", "", fmt.Errorf("unknown priority %q", priority)
+	}
+	return h[0], h[1], nil
+}
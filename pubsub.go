@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const pubsubTasksMetric = "post_room_pubsub_tasks_total"
+
+func init() {
+	metrics.describe(pubsubTasksMetric, "counter", "Tasks received on PUBSUB_CHANNEL, by result: relayed, ignored by a replica not leading, or error.")
+}
+
+// pubsubIngest takes tasks published on a Redis pub/sub channel, for
+// low-value broadcast notifications whose producers would rather publish
+// than queue. Pub/sub is fire and forget: a task published while no worker
+// is subscribed, as during a deploy, or while leadership changes hands is
+// lost, as are those Redis drops for a subscriber that falls behind. Tasks
+// that must arrive belong on the queue.
+//
+// Every replica receives every message, so only the leader takes them,
+// pushing each onto the queue to be shared out and sent like any other.
+type pubsubIngest struct {
+	rdb     *redis.Client
+	channel string
+	queue   string
+	leader  *leaderElection
+}
+
+func (p *pubsubIngest) run() {
+	pubsub := p.rdb.Subscribe(ctx, p.channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Printf("error subscribing to %s: %v", p.channel, err)
+	}
+	for msg := range pubsub.Channel() {
+		if !p.leader.leader() {
+			metrics.add(pubsubTasksMetric, 1, "result", "ignored")
+			continue
+		}
+		if err := p.rdb.LPush(ctx, p.queue, msg.Payload).Err(); err != nil {
+			log.Printf("error queueing task published on %s: %v", p.channel, err)
+			metrics.add(pubsubTasksMetric, 1, "result", "error")
+			continue
+		}
+		metrics.add(pubsubTasksMetric, 1, "result", "relayed")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// enqueue pushes task onto queue for a worker to send, assigning it an ID
+// first so the caller can report it. Tasks are pushed to the producing end
+// of the list, like any other producer's, or of the priority list for high
+// priority tasks, stamped with the time they were enqueued.
+func enqueue(rdb *redis.Client, queue string, task *Mail) error {
+	if task.ID == "" {
+		task.ID = newTaskID()
+	}
+	now := time.Now().UTC()
+	task.EnqueuedAt = &now
+	body, err := marshalTask(*task)
+	if err != nil {
+		return fmt.Errorf("error marshalling task: %w", err)
+	}
+	if task.Priority == priorityHigh {
+		queue = priorityQueue(queue)
+	}
+	if err := rdb.LPush(ctx, queue, body).Err(); err != nil {
+		return fmt.Errorf("error enqueuing task: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// queueSampleInterval is how often queue lengths and the age of the
+	// oldest queued task are read.
+	queueSampleInterval = 15 * time.Second
+
+	queueWaitMetric      = "post_room_queue_wait_seconds"
+	queueLengthMetric    = "post_room_queue_length"
+	queueOldestAgeMetric = "post_room_queue_oldest_task_age_seconds"
+)
+
+var queueWaitBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+func init() {
+	metrics.describeHistogram(queueWaitMetric, "Time tasks spent in the queue before being taken, for tasks stamped with enqueuedAt.", queueWaitBuckets)
+	metrics.describe(queueLengthMetric, "gauge", "Tasks waiting in the queue.")
+	metrics.describe(queueOldestAgeMetric, "gauge", "Age of the next task to be taken from the queue, or 0 if the queue is empty or the task isn't stamped with enqueuedAt.")
+}
+
+// observeQueueWait records how long task waited in queue, if it was stamped
+// when enqueued.
+func observeQueueWait(queue string, task Mail, now time.Time) {
+	if task.EnqueuedAt == nil {
+		return
+	}
+	wait := now.Sub(*task.EnqueuedAt)
+	if wait < 0 {
+		// The producer's clock is ahead of ours.
+		wait = 0
+	}
+	metrics.observe(queueWaitMetric, wait.Seconds(), "queue", queue)
+}
+
+// sampleQueues exports the length of the tenants' queues and the age of the
+// task at the head of each until the process exits. Every replica samples,
+// so the gauges survive any one of them stopping.
+func sampleQueues(rdb *redis.Client, tenants []*tenant) {
+	for {
+		for _, t := range tenants {
+			for _, queue := range []string{priorityQueue(t.queue), t.queue} {
+				if err := sampleQueue(rdb, t, queue); err != nil {
+					log.Printf("error sampling list %s: %v", queue, err)
+				}
+			}
+		}
+		time.Sleep(queueSampleInterval)
+	}
+}
+
+func sampleQueue(rdb *redis.Client, t *tenant, queue string) error {
+	pipe := rdb.Pipeline()
+	length := pipe.LLen(ctx, queue)
+	head := pipe.LIndex(ctx, queue, -1)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	metrics.set(queueLengthMetric, float64(length.Val()), "queue", queue)
+	var age float64
+	if raw, err := head.Bytes(); err == nil {
+		if at := enqueuedAt(t, raw); at != nil {
+			if age = time.Since(*at).Seconds(); age < 0 {
+				age = 0
+			}
+		}
+	}
+	metrics.set(queueOldestAgeMetric, age, "queue", queue)
+	return nil
+}
+
+// enqueuedAt returns when the queued payload raw was stamped as enqueued,
+// if it can be read.
+func enqueuedAt(t *tenant, raw []byte) *time.Time {
+	body, err := openPayload(raw)
+	if err == nil {
+		body, err = t.payloads.decode(body)
+	}
+	if err != nil {
+		return nil
+	}
+	var stamp struct {
+		EnqueuedAt *time.Time `json:"enqueuedAt"`
+	}
+	if json.Unmarshal(body, &stamp) != nil {
+		return nil
+	}
+	return stamp.EnqueuedAt
+}
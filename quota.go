@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	quotaDeferredMetric = "post_room_quota_deferred_total"
+	quotaUsageMetric    = "post_room_quota_usage"
+)
+
+func init() {
+	metrics.describe(quotaDeferredMetric, "counter", "Tasks deferred to the scheduled set for exceeding a sending quota.")
+	metrics.describe(quotaUsageMetric, "gauge", "Messages counted against a sending quota in the current window.")
+}
+
+// sendQuota limits how many messages may be sent per window. Zero means no
+// limit.
+type sendQuota struct {
+	Hourly int64 `json:"hourly,omitempty"`
+	Daily  int64 `json:"daily,omitempty"`
+}
+
+// quotaScope is a sending quota and the name its counters are kept under.
+type quotaScope struct {
+	name  string
+	quota sendQuota
+}
+
+// quotaCounter counts messages against quotas with Redis counters at
+// <queue>:quota:<scope>:<window start>, shared by every worker.
+type quotaCounter struct {
+	rdb   *redis.Client
+	queue string
+}
+
+type quotaWindow struct {
+	label  string
+	length time.Duration
+	limit  func(sendQuota) int64
+}
+
+var quotaWindows = []quotaWindow{
+	{"hourly", time.Hour, func(q sendQuota) int64 { return q.Hourly }},
+	{"daily", 24 * time.Hour, func(q sendQuota) int64 { return q.Daily }},
+}
+
+// reserve counts n messages against every scope. If that would exceed any
+// quota nothing is counted and retryAt is when the exhausted window resets.
+func (c *quotaCounter) reserve(scopes []quotaScope, n int64, now time.Time) (retryAt time.Time, ok bool, err error) {
+	var reserved []string
+	release := func() {
+		for _, key := range reserved {
+			c.rdb.DecrBy(ctx, key, n)
+		}
+	}
+
+	for _, s := range scopes {
+		for _, w := range quotaWindows {
+			limit := w.limit(s.quota)
+			if limit <= 0 {
+				continue
+			}
+			start := now.Truncate(w.length)
+			key := fmt.Sprintf("%s:quota:%s:%s:%d", c.queue, s.name, w.label, start.Unix())
+			count, err := c.rdb.IncrBy(ctx, key, n).Result()
+			if err != nil {
+				release()
+				return time.Time{}, false, fmt.Errorf("error counting quota %s: %w", key, err)
+			}
+			c.rdb.Expire(ctx, key, w.length+time.Hour)
+			reserved = append(reserved, key)
+			if count > limit {
+				release()
+				metrics.add(quotaDeferredMetric, 1, "queue", c.queue, "scope", s.name, "window", w.label)
+				return start.Add(w.length), false, nil
+			}
+			metrics.set(quotaUsageMetric, float64(count), "queue", c.queue, "scope", s.name, "window", w.label)
+		}
+	}
+	return time.Time{}, true, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	receiptsPath = "/ingest/receipts"
+
+	readReceiptsMetric = "post_room_read_receipts_total"
+)
+
+func init() {
+	metrics.describe(readReceiptsMetric, "counter", "Read receipts recorded against tasks, by disposition.")
+}
+
+// receiptProcessor records message disposition notifications (RFC 8098),
+// the read receipts mail clients send to the Disposition-Notification-To
+// address of tasks with ReadReceipt set, in the status of the task they
+// answer. The mailbox receiving them is piped to it by POSTing each
+// message, as it arrived, to receiptsPath, which is only served with
+// INGEST_TOKEN set.
+type receiptProcessor struct {
+	stores []*statusStore
+	token  string
+}
+
+func (p *receiptProcessor) register(mux *http.ServeMux) {
+	handleWithToken(mux, receiptsPath, p.token, ingestTokenKey, http.HandlerFunc(p.handle))
+}
+
+func (p *receiptProcessor) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	receipt, err := parseReceipt(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, s := range p.stores {
+		found, err := s.recordReceipt(receipt.messageID, receipt.recipient, receipt.disposition)
+		if err != nil {
+			log.Print(err)
+			http.Error(w, "error recording receipt", http.StatusInternalServerError)
+			return
+		}
+		if found {
+			metrics.add(readReceiptsMetric, 1, "disposition", receipt.disposition)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	http.Error(w, "no task sent message "+receipt.messageID, http.StatusNotFound)
+}
+
+// readReceipt is what a disposition notification says: that the message
+// with messageID was, for example, displayed to recipient.
+type readReceipt struct {
+	messageID, recipient, disposition string
+}
+
+// parseReceipt reads the disposition notification out of a
+// multipart/report message.
+func parseReceipt(message []byte) (readReceipt, error) {
+	msg, err := netmail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return readReceipt{}, fmt.Errorf("invalid message: %w", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], "disposition-notification") {
+		return readReceipt{}, errors.New("message is not a disposition notification")
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return readReceipt{}, errors.New("disposition notification has no message/disposition-notification part")
+		}
+		if err != nil {
+			return readReceipt{}, fmt.Errorf("invalid disposition notification: %w", err)
+		}
+		if t, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); t == "message/disposition-notification" {
+			return parseDispositionFields(part)
+		}
+	}
+}
+
+func parseDispositionFields(r io.Reader) (readReceipt, error) {
+	fields, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && !(err == io.EOF && len(fields) > 0) {
+		return readReceipt{}, fmt.Errorf("invalid disposition notification fields: %w", err)
+	}
+	receipt := readReceipt{messageID: normalizeMessageID(fields.Get("Original-Message-ID"))}
+	if receipt.messageID == "" {
+		return readReceipt{}, errors.New("disposition notification has no Original-Message-ID")
+	}
+	// Final-Recipient is "rfc822; <address>", and Disposition is
+	// "<action mode>; <type>[/<modifier>]".
+	recipient := fields.Get("Final-Recipient")
+	if recipient == "" {
+		recipient = fields.Get("Original-Recipient")
+	}
+	if i := strings.IndexByte(recipient, ';'); i >= 0 {
+		receipt.recipient = strings.TrimSpace(recipient[i+1:])
+	}
+	if receipt.recipient == "" {
+		return readReceipt{}, errors.New("disposition notification has no Final-Recipient")
+	}
+	disposition := fields.Get("Disposition")
+	if i := strings.IndexByte(disposition, ';'); i >= 0 {
+		disposition = disposition[i+1:]
+	}
+	if i := strings.IndexByte(disposition, '/'); i >= 0 {
+		disposition = disposition[:i]
+	}
+	if receipt.disposition = strings.ToLower(strings.TrimSpace(disposition)); receipt.disposition == "" {
+		return readReceipt{}, errors.New("disposition notification has no Disposition")
+	}
+	return receipt, nil
+}
+
+// normalizeMessageID strips the angle brackets around a Message-ID.
+func normalizeMessageID(id string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+}
+
+// sentMessageID returns the Message-ID of a message built for sending.
+func sentMessageID(message []byte) string {
+	msg, err := netmail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return ""
+	}
+	return normalizeMessageID(msg.Header.Get("Message-ID"))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const recipientsBlockedMetric = "post_room_recipients_blocked_total"
+
+func init() {
+	metrics.describe(recipientsBlockedMetric, "counter", "Recipients dead-lettered for their domain by RECIPIENT_DOMAIN_ALLOWLIST or RECIPIENT_DOMAIN_DENYLIST, by list.")
+}
+
+// recipientPolicy restricts the domains mail may be sent to, such as to
+// keep a staging worker from reaching real customers: with an allowlist,
+// only its domains are sent to, and the denylist's domains never are. A
+// domain covers its subdomains. A nil policy allows every domain.
+type recipientPolicy struct {
+	allow, deny []string
+}
+
+func newRecipientPolicy(allow, deny []string) *recipientPolicy {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+	return &recipientPolicy{allow: policyDomains(allow), deny: policyDomains(deny)}
+}
+
+// policyDomains normalizes list entries, which may be written as
+// example.com, @example.com or *.example.com, to ASCII domains.
+func policyDomains(entries []string) []string {
+	domains := make([]string, 0, len(entries))
+	for _, e := range entries {
+		domains = append(domains, policyDomain(strings.TrimPrefix(strings.TrimPrefix(e, "*."), "@")))
+	}
+	return domains
+}
+
+func policyDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+
+func matchesDomain(domain string, domains []string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// check splits recipients into those the policy allows and those it
+// doesn't, with the reasons for the latter.
+func (p *recipientPolicy) check(recipients []*netmail.Address) (ok []*netmail.Address, blocked []*netmail.Address, reasons []string) {
+	for _, r := range recipients {
+		domain := policyDomain(addressDomain(r))
+		list := ""
+		switch {
+		case matchesDomain(domain, p.deny):
+			list = "deny"
+			reasons = append(reasons, fmt.Sprintf("%s: domain %s is denied by %s", r.Address, domain, recipientDomainDenylistKey))
+		case len(p.allow) > 0 && !matchesDomain(domain, p.allow):
+			list = "allow"
+			reasons = append(reasons, fmt.Sprintf("%s: domain %s is not in %s", r.Address, domain, recipientDomainAllowlistKey))
+		default:
+			ok = append(ok, r)
+			continue
+		}
+		metrics.add(recipientsBlockedMetric, 1, "list", list)
+		blocked = append(blocked, r)
+	}
+	return ok, blocked, reasons
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisTemplateStore loads templates from Redis so they can be updated
+// centrally for every worker without a redeploy. Each version lives at
+// template:<name>:<version> and template:<name>:latest holds the version
+// used when a task doesn't pin one. Versions are treated as immutable, so
+// compiled templates are cached indefinitely. Partials and layouts come from
+// the file template store, if one is configured.
+type redisTemplateStore struct {
+	rdb   *redis.Client
+	files *templateStore
+
+	mu    sync.Mutex
+	cache map[string]*template.Template
+}
+
+func newRedisTemplateStore(rdb *redis.Client, files *templateStore) *redisTemplateStore {
+	return &redisTemplateStore{rdb: rdb, files: files, cache: map[string]*template.Template{}}
+}
+
+// render executes the given version of the named template, or the latest
+// version if version is empty. found is false when Redis has no such
+// template.
+func (s *redisTemplateStore) render(name, version, locale string, data interface{}) (html string, found bool, err error) {
+	if version == "" {
+		version, err = s.rdb.Get(ctx, fmt.Sprintf("template:%s:latest", name)).Result()
+		if err == redis.Nil {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error reading latest version of template %q: %w", name, err)
+		}
+	}
+	key := fmt.Sprintf("template:%s:%s", name, version)
+
+	s.mu.Lock()
+	t, ok := s.cache[key]
+	s.mu.Unlock()
+	if !ok {
+		source, err := s.rdb.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("error reading template %s: %w", key, err)
+		}
+		if t, err = s.parse(name, key, source); err != nil {
+			return "", false, err
+		}
+		s.mu.Lock()
+		s.cache[key] = t
+		s.mu.Unlock()
+	}
+
+	html, err = executeTemplate(t, key, normalizeLocale(locale), data)
+	return html, true, err
+}
+
+func (s *redisTemplateStore) parse(name, key, source string) (*template.Template, error) {
+	if s.files == nil {
+		t, err := template.New(key).Funcs(templateFuncs("")).Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template %s: %w", key, err)
+		}
+		return t, nil
+	}
+	layout := defaultLayout
+	if l := s.files.config(name).Layout; l != nil {
+		layout = *l
+	}
+	return s.files.parsePage(key, source, layout)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloader rereads the settings kept in files, on SIGHUP or, with
+// CONFIG_WATCH_INTERVAL, when the files change: templates, sender
+// identities, the tenants file's limits, senders and templates, webhook
+// routes and SMTP credentials read from secret files. Sends in progress
+// finish with the settings they started with. Changes that need a restart,
+// such as a tenant's queue or SMTP server, are logged as such.
+type reloader struct {
+	options  AppOptions
+	tenants  []*tenant
+	webhooks *webhookGateway
+	// credentials is false when Vault keeps the SMTP credentials instead.
+	credentials bool
+
+	mu sync.Mutex
+}
+
+// run reloads on every SIGHUP, and every interval that the files have
+// changed if interval is set.
+func (r *reloader) run(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.Tick(interval)
+	}
+	seen := configFingerprint(r.options)
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			current := configFingerprint(r.options)
+			if current == seen {
+				continue
+			}
+			seen = current
+			log.Print("configuration files changed")
+		}
+		r.reload()
+	}
+}
+
+func (r *reloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	options, err := validateEnvironment()
+	if err != nil {
+		log.Print("error reloading configuration: ", err)
+		return
+	}
+	if err := r.reloadTenants(options); err != nil {
+		log.Print("error reloading configuration: ", err)
+		return
+	}
+	if r.webhooks != nil && options.WebhooksFile != "" {
+		routes, err := loadWebhookRoutes(options.WebhooksFile, options)
+		if err != nil {
+			log.Print("error reloading webhook routes: ", err)
+		} else {
+			r.webhooks.setRoutes(routes)
+			log.Printf("reloaded %d webhook routes from %s", len(routes), options.WebhooksFile)
+		}
+	}
+	if r.credentials {
+		base, _ := r.tenants[0].current()
+		reloadCredentials(base.auth, options)
+	}
+	if changed := restartOnlyChanges(r.options, options); len(changed) > 0 {
+		log.Printf("[WARNING] changes to %s need a restart to take effect", strings.Join(changed, ", "))
+	}
+	r.options = options
+	log.Print("configuration reloaded")
+}
+
+// reloadTenants rebuilds the worker's templates and identities, and each
+// tenant's from the tenants file, only swapping them in once all have
+// loaded.
+func (r *reloader) reloadTenants(options AppOptions) error {
+	base, limiter := r.tenants[0].current()
+	if options.TemplateDir != "" {
+		templates, err := loadTemplates(options.TemplateDir, options.MJMLBinary, options.DefaultLocale)
+		if err != nil {
+			return err
+		}
+		base.templates = templates
+		if base.redisTpl != nil {
+			base.redisTpl = newRedisTemplateStore(base.redisTpl.rdb, templates)
+		}
+		log.Printf("reloaded %d templates from %s", len(templates.templates), options.TemplateDir)
+	}
+	if options.IdentitiesFile != "" {
+		identities, err := loadIdentities(options.IdentitiesFile)
+		if err != nil {
+			return err
+		}
+		base.identities = identities
+		log.Printf("reloaded %d sender identities from %s", len(identities), options.IdentitiesFile)
+	}
+
+	var loaded []*tenant
+	if options.TenantsFile != "" {
+		var err error
+		if loaded, err = loadTenants(options.TenantsFile, base, options); err != nil {
+			return err
+		}
+	}
+	r.tenants[0].reconfigure(base, limiter, r.tenants[0].quota, taskDefaults{})
+	fresh := map[string]*tenant{}
+	for _, t := range loaded {
+		fresh[t.id] = t
+	}
+	for _, t := range r.tenants[1:] {
+		next, ok := fresh[t.id]
+		if !ok {
+			log.Printf("[WARNING] tenant %q was removed from %s; restart to stop consuming %s", t.id, options.TenantsFile, t.queue)
+			continue
+		}
+		delete(fresh, t.id)
+		if next.queue != t.queue || next.config.SMTP != t.config.SMTP || (next.slots == nil) != (t.slots == nil) {
+			log.Printf("[WARNING] changes to the queue, SMTP server or, for a tenant without one, concurrency limit of tenant %q need a restart to take effect", t.id)
+		} else if t.slots != nil && next.config.Concurrency != t.config.Concurrency {
+			t.slots.setLimit(next.config.Concurrency)
+		}
+		_, limiter := t.current()
+		if next.config.RateLimit != t.config.RateLimit {
+			limiter = next.limiter
+		}
+		t.reconfigure(next.mailer, limiter, next.quota, next.defaults)
+		t.config = next.config
+	}
+	ids := make([]string, 0, len(fresh))
+	for id := range fresh {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		log.Printf("[WARNING] tenant %q was added to %s; restart to start consuming %s", id, options.TenantsFile, fresh[id].queue)
+	}
+	return nil
+}
+
+// restartOnlyChanges lists the settings that differ between old and
+// current but can't be changed without a restart. Outside secret files,
+// settings come from the environment, which can't change under a running
+// process. The SMTP credentials are reloaded or kept in Vault, and the run
+// mode may have been set by --drain, so they are ignored.
+func restartOnlyChanges(old, current AppOptions) []string {
+	old.SMTPUsername, old.SMTPPassword = current.SMTPUsername, current.SMTPPassword
+	old.RunMode = current.RunMode
+	var changed []string
+	o, n := reflect.ValueOf(old), reflect.ValueOf(current)
+	for i := 0; i < o.NumField(); i++ {
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			changed = append(changed, o.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// configFingerprint summarises the names, sizes and modification times of
+// the template directory and the files named by *_FILE settings.
+func configFingerprint(options AppOptions) string {
+	paths := []string{options.TemplateDir}
+	for _, env := range os.Environ() {
+		if eq := strings.IndexByte(env, '='); eq > 0 && strings.HasSuffix(env[:eq], fileSuffix) {
+			paths = append(paths, env[eq+1:])
+		}
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err == nil {
+				fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	defaultRenderCacheTTL = 3 * 24 * time.Hour
+
+	renderCacheHitsMetric = "post_room_render_cache_hits_total"
+)
+
+func init() {
+	metrics.describe(renderCacheHitsMetric, "counter", "Messages resent as first rendered, from the rendering cache.")
+}
+
+// renderCache keeps the messages rendered for each task in a Redis hash at
+// <queue>:rendered:<task id> for ttl, so that retries resend them byte for
+// byte, with the same Message-ID and Date, rather than rendering them again
+// and looking like a new message to receivers that deduplicate. A message
+// is kept per variant: encrypted or not, and with ASCII or UTF-8 headers,
+// and for a delivery to a single recipient, as split and personalized sends
+// are, per recipient. Messages are encrypted like tasks with PAYLOAD_KEYS.
+// A recipient's messages are dropped once they have been sent to, and the
+// whole cache when the task is amended. A nil cache renders every time.
+type renderCache struct {
+	rdb   *redis.Client
+	queue string
+	ttl   time.Duration
+}
+
+func (r *renderCache) key(id string) string {
+	return r.queue + ":rendered:" + id
+}
+
+// renderVariants are the variants of a message a delivery can be sent.
+var renderVariants = []string{"ascii", "utf8", "ascii+pgp", "utf8+pgp"}
+
+// renderVariant names the variant of a message a delivery is sent.
+func renderVariant(utf8 bool, keys openpgp.EntityList) string {
+	variant := "ascii"
+	if utf8 {
+		variant = "utf8"
+	}
+	if len(keys) > 0 {
+		variant += "+pgp"
+	}
+	return variant
+}
+
+// renderField is the field of the cache holding a variant of the message
+// rendered for mail.
+func renderField(mail Mail, variant string) string {
+	if len(mail.Recipients) != 1 {
+		return variant
+	}
+	recipient := mail.Recipients[0]
+	if address, err := netmail.ParseAddress(recipient); err == nil {
+		recipient = address.Address
+	}
+	return variant + ":" + strings.ToLower(recipient)
+}
+
+// render returns the variant of mail's message rendered by build, from the
+// cache if it has been rendered before. Errors reading or writing the
+// cache are logged, and the message rendered afresh.
+func (r *renderCache) render(mail Mail, variant string, build func() ([]byte, error)) ([]byte, error) {
+	if r == nil || mail.ID == "" {
+		return build()
+	}
+	key, field := r.key(mail.ID), renderField(mail, variant)
+	message, err := r.rdb.HGet(ctx, key, field).Bytes()
+	if err == nil {
+		if message, err = taskSealer.open(message); err == nil {
+			metrics.add(renderCacheHitsMetric, 1)
+			return message, nil
+		}
+	}
+	if err != redis.Nil {
+		log.Printf("error reading rendered message of task %s: %v", mail.ID, err)
+	}
+	if message, err = build(); err != nil {
+		return nil, err
+	}
+	cached := message
+	if taskSealer != nil {
+		if cached, err = taskSealer.seal(message); err != nil {
+			log.Printf("error encrypting rendered message of task %s: %v", mail.ID, err)
+			return message, nil
+		}
+	}
+	pipe := r.rdb.TxPipeline()
+	pipe.HSet(ctx, key, field, cached)
+	pipe.Expire(ctx, key, r.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("error caching rendered message of task %s: %v", mail.ID, err)
+	}
+	return message, nil
+}
+
+// drop forgets the messages rendered for mail, leaving those rendered for
+// the task's other recipients.
+func (r *renderCache) drop(mail Mail) {
+	if r == nil || mail.ID == "" {
+		return
+	}
+	fields := make([]string, len(renderVariants))
+	for i, variant := range renderVariants {
+		fields[i] = renderField(mail, variant)
+	}
+	if err := r.rdb.HDel(ctx, r.key(mail.ID), fields...).Err(); err != nil {
+		log.Printf("error dropping rendered message of task %s: %v", mail.ID, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRenderCache(t *testing.T) {
+	r := &renderCache{rdb: newTestRedis(t), queue: "tasks", ttl: time.Hour}
+	task := Mail{ID: "t1", Recipients: []string{"a@example.com", "b@example.com"}}
+	alice, bob := personalize(task, "a@example.com"), personalize(task, "B <B@example.com>")
+	renders := 0
+	build := func(body string) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			renders++
+			return []byte(body), nil
+		}
+	}
+
+	steps := []struct {
+		name    string
+		mail    Mail
+		variant string
+		body    string
+		want    string
+		renders int
+	}{
+		{"first render", alice, "utf8", "for alice", "for alice", 1},
+		{"resent as rendered", alice, "utf8", "again", "for alice", 1},
+		{"other recipient", bob, "utf8", "for bob", "for bob", 2},
+		{"other variant", alice, "utf8+pgp", "encrypted", "encrypted", 3},
+		{"whole task", task, "utf8", "for both", "for both", 4},
+		{"whole task resent", task, "utf8", "again", "for both", 4},
+	}
+	for _, s := range steps {
+		got, err := r.render(s.mail, s.variant, build(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != s.want || renders != s.renders {
+			t.Errorf("%s: rendered %q with %d renders, want %q with %d", s.name, got, renders, s.want, s.renders)
+		}
+	}
+
+	r.drop(alice)
+	if got, _ := r.render(bob, "utf8", build("fresh")); string(got) != "for bob" {
+		t.Errorf("dropping one recipient's message dropped another's: got %q", got)
+	}
+	if got, _ := r.render(alice, "utf8", build("fresh")); string(got) != "fresh" {
+		t.Errorf("dropped message resent: got %q", got)
+	}
+}
+
+func TestRenderCacheSealed(t *testing.T) {
+	sealer, err := newPayloadSealer([]string{"k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskSealer = sealer
+	defer func() { taskSealer = nil }()
+
+	r := &renderCache{rdb: newTestRedis(t), queue: "tasks", ttl: time.Hour}
+	mail := Mail{ID: "t1", Recipients: []string{"a@example.com"}}
+	message := []byte("Subject: secret\r\n\r\nbody")
+	if _, err := r.render(mail, "utf8", func() ([]byte, error) { return message, nil }); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := r.rdb.HGet(ctx, r.key(mail.ID), renderField(mail, "utf8")).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret")) || !bytes.HasPrefix(stored, []byte(sealedPrefix)) {
+		t.Errorf("cached message is not encrypted: %q", stored)
+	}
+	got, err := r.render(mail, "utf8", func() ([]byte, error) { return []byte("rendered again"), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, message) {
+		t.Errorf("render() = %q, want the cached %q", got, message)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultReportDomains = 10
+
+// reportPeriod is the delivery stats for a day or week. Latency is from
+// when a task was queued, or became due, to when the server accepted the
+// message, for tasks stamped with enqueuedAt; a retry starts the clock
+// again when it becomes due.
+type reportPeriod struct {
+	Start       time.Time `json:"start"`
+	Sent        int64     `json:"sent"`
+	Failed      int64     `json:"failed"`
+	Retried     int64     `json:"retried"`
+	SuccessRate float64   `json:"successRate"`
+	P50         string    `json:"p50,omitempty"`
+	P95         string    `json:"p95,omitempty"`
+	latencies   []time.Duration
+}
+
+// reportDomain counts the outcomes for a recipient domain.
+type reportDomain struct {
+	Domain  string `json:"domain"`
+	Failed  int64  `json:"failed"`
+	Retried int64  `json:"retried"`
+	Sent    int64  `json:"sent"`
+}
+
+type deliveryReport struct {
+	Periods []*reportPeriod `json:"periods"`
+	Domains []reportDomain  `json:"topFailingDomains"`
+}
+
+// report summarises the history rows from since until until by day, or by
+// week starting on Monday, in UTC. Success rate is the share of recipients'
+// final outcomes that were sent; retries are counted but aren't outcomes.
+func (h *historyDB) report(queue string, since, until time.Time, weekly bool, top int) (*deliveryReport, error) {
+	args := []interface{}{since.UTC().Format(historyTimeFormat), until.UTC().Format(historyTimeFormat)}
+	q := fmt.Sprintf("SELECT recipient, state, at, enqueued_at FROM history WHERE at >= %s AND at < %s", h.placeholder(1), h.placeholder(2))
+	if queue != "" {
+		args = append(args, queue)
+		q += " AND queue = " + h.placeholder(3)
+	}
+	rows, err := h.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying history: %w", err)
+	}
+	defer rows.Close()
+
+	periods := map[time.Time]*reportPeriod{}
+	domains := map[string]*reportDomain{}
+	for rows.Next() {
+		var recipient, state, at, enqueued string
+		if err := rows.Scan(&recipient, &state, &at, &enqueued); err != nil {
+			return nil, fmt.Errorf("error reading history: %w", err)
+		}
+		t, err := time.Parse(historyTimeFormat, at)
+		if err != nil {
+			continue
+		}
+		start := reportPeriodStart(t, weekly)
+		p := periods[start]
+		if p == nil {
+			p = &reportPeriod{Start: start}
+			periods[start] = p
+		}
+		domain := recipient[strings.LastIndex(recipient, "@")+1:]
+		d := domains[domain]
+		if d == nil {
+			d = &reportDomain{Domain: domain}
+			domains[domain] = d
+		}
+		switch state {
+		case taskSent:
+			p.Sent++
+			d.Sent++
+			if e, err := time.Parse(historyTimeFormat, enqueued); err == nil && !t.Before(e) {
+				p.latencies = append(p.latencies, t.Sub(e))
+			}
+		case taskFailed:
+			p.Failed++
+			d.Failed++
+		case taskRetrying:
+			p.Retried++
+			d.Retried++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history: %w", err)
+	}
+
+	report := &deliveryReport{Periods: []*reportPeriod{}, Domains: []reportDomain{}}
+	for _, p := range periods {
+		if p.Sent+p.Failed > 0 {
+			p.SuccessRate = float64(p.Sent) / float64(p.Sent+p.Failed)
+		}
+		if len(p.latencies) > 0 {
+			sort.Slice(p.latencies, func(i, j int) bool { return p.latencies[i] < p.latencies[j] })
+			p.P50 = latencyPercentile(p.latencies, 0.5).String()
+			p.P95 = latencyPercentile(p.latencies, 0.95).String()
+		}
+		report.Periods = append(report.Periods, p)
+	}
+	sort.Slice(report.Periods, func(i, j int) bool { return report.Periods[i].Start.Before(report.Periods[j].Start) })
+	for _, d := range domains {
+		if d.Failed+d.Retried > 0 {
+			report.Domains = append(report.Domains, *d)
+		}
+	}
+	sort.Slice(report.Domains, func(i, j int) bool {
+		a, b := report.Domains[i], report.Domains[j]
+		if a.Failed != b.Failed {
+			return a.Failed > b.Failed
+		}
+		if a.Retried != b.Retried {
+			return a.Retried > b.Retried
+		}
+		return a.Domain < b.Domain
+	})
+	if len(report.Domains) > top {
+		report.Domains = report.Domains[:top]
+	}
+	return report, nil
+}
+
+func reportPeriodStart(t time.Time, weekly bool) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if !weekly {
+		return day
+	}
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// latencyPercentile returns the nearest-rank percentile q of sorted.
+func latencyPercentile(sorted []time.Duration, q float64) time.Duration {
+	i := int(q*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i].Round(time.Millisecond)
+}
+
+// runReport prints daily or weekly delivery stats from the history
+// database, for capacity and deliverability reviews.
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	dsn := fs.String("dsn", getenv(historyDSNKey), "history database")
+	queue := fs.String("queue", "", "only report on this queue")
+	period := fs.String("period", "daily", "daily or weekly")
+	since := fs.String("since", "", "earliest time, as a date or RFC 3339 time (default 7 days, or 4 weeks, ago)")
+	until := fs.String("until", "", "latest time (exclusive), as a date or RFC 3339 time (default now)")
+	top := fs.Int("domains", defaultReportDomains, "number of failing domains to list")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dsn == "" {
+		return fmt.Errorf("no history database given; use -dsn or %s", historyDSNKey)
+	}
+	if *period != "daily" && *period != "weekly" {
+		return fmt.Errorf("invalid period %q: use daily or weekly", *period)
+	}
+	weekly := *period == "weekly"
+	to, err := parseHistoryTime(*until)
+	if err != nil {
+		return fmt.Errorf("invalid until: %w", err)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from, err := parseHistoryTime(*since)
+	if err != nil {
+		return fmt.Errorf("invalid since: %w", err)
+	}
+	if from.IsZero() {
+		// The current period and the six days, or three weeks, before.
+		days := -6
+		if weekly {
+			days = -21
+		}
+		from = reportPeriodStart(to, weekly).AddDate(0, 0, days)
+	}
+	db, err := openHistory(*dsn)
+	if err != nil {
+		return err
+	}
+	defer db.db.Close()
+	report, err := db.report(*queue, from, to, weekly, *top)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "PERIOD\tSENT\tFAILED\tRETRIED\tSUCCESS\tP50\tP95\t")
+	for _, p := range report.Periods {
+		label := p.Start.Format("2006-01-02")
+		if weekly {
+			year, week := p.Start.ISOWeek()
+			label = fmt.Sprintf("%d-W%02d", year, week)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t\n", label, p.Sent, p.Failed, p.Retried,
+			reportPercent(p.SuccessRate, p.Sent+p.Failed), orDash(p.P50), orDash(p.P95))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(report.Domains) == 0 {
+		fmt.Println("\nno failing domains")
+		return nil
+	}
+	fmt.Println("\ntop failing domains:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DOMAIN\tFAILED\tRETRIED\tSENT")
+	for _, d := range report.Domains {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", d.Domain, d.Failed, d.Retried, d.Sent)
+	}
+	return tw.Flush()
+}
+
+func reportPercent(ratio float64, outcomes int64) string {
+	if outcomes == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", ratio*100)
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
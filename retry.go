@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"net/textproto"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 5
+	defaultRetryBackoff  = time.Minute
+	maxRetryBackoff      = 6 * time.Hour
+)
+
+// deliveryFailure is a failed attempt to deliver to some of a task's
+// recipients.
+type deliveryFailure struct {
+	recipients []*netmail.Address
+	err        error
+}
+
+// partialDelivery is the error of a send the server accepted for some of
+// its recipients and refused for the others, whose failures it carries.
+type partialDelivery struct {
+	failures []deliveryFailure
+}
+
+func (p *partialDelivery) Error() string {
+	refused := 0
+	for _, f := range p.failures {
+		refused += len(f.recipients)
+	}
+	return fmt.Sprintf("%d recipients refused: %v", refused, p.failures[0].err)
+}
+
+// failuresOf returns the failures of a send to recipients that ended with
+// err: those of a partial delivery, or otherwise all of them.
+func failuresOf(recipients []*netmail.Address, err error) []deliveryFailure {
+	if err == nil {
+		return nil
+	}
+	var partial *partialDelivery
+	if errors.As(err, &partial) {
+		return partial.failures
+	}
+	return []deliveryFailure{{recipients: recipients, err: err}}
+}
+
+// refusals groups the recipients the server refused by its reply, so that
+// those refused alike are retried or dead-lettered together.
+type refusals struct {
+	failures []deliveryFailure
+	byReply  map[string]int
+}
+
+func (r *refusals) add(recipient *netmail.Address, err error) {
+	reply := smtpReply(err)
+	if i, ok := r.byReply[reply]; ok {
+		r.failures[i].recipients = append(r.failures[i].recipients, recipient)
+		return
+	}
+	if r.byReply == nil {
+		r.byReply = map[string]int{}
+	}
+	r.byReply[reply] = len(r.failures)
+	r.failures = append(r.failures, deliveryFailure{recipients: []*netmail.Address{recipient}, err: err})
+}
+
+// err returns the refusals as a partialDelivery, or nil if there were none.
+func (r *refusals) err() error {
+	if len(r.failures) == 0 {
+		return nil
+	}
+	return &partialDelivery{failures: r.failures}
+}
+
+// permanentError marks a failure that retrying won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// isPermanent classifies a delivery error. 5xx replies from the server and
+// errors marked permanent are permanent and dead-lettered at once; anything
+// else, such as a 4xx reply or a network error, is retried with backoff.
+func isPermanent(err error) bool {
+	var p permanentError
+	if errors.As(err, &p) {
+		return true
+	}
+	var reply *textproto.Error
+	return errors.As(err, &reply) && reply.Code >= 500
+}
+
+// smtpReply returns the server reply behind err, as the server sent it, or
+// err itself if the failure wasn't a reply.
+func smtpReply(err error) string {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return fmt.Sprintf("%03d %s", reply.Code, reply.Msg)
+	}
+	return err.Error()
+}
+
+// fail handles a delivery failure for recipients of mail: transient
+// failures are rescheduled with exponential backoff, or after greylisting
+// once greylisting should be over, until the attempts run out, after which,
+// like permanent failures, the recipients are dead-lettered.
+func (m Mailer) fail(mail Mail, f deliveryFailure) {
+	log.Print("error sending email to server: ", f.err)
+	if isTransportBug(f.err) {
+		errorTracker.captureError("error sending task", f.err, "task_id", mail.ID)
+	}
+	mail.Recipients = formatRecipients(f.recipients)
+	reply := smtpReply(f.err)
+	if isPermanent(f.err) {
+		m.recordResult(mail, taskFailed, reply)
+		m.dead.add(mail, f.err.Error())
+		return
+	}
+	if m.retries == nil || mail.Attempt+1 >= m.retryAttempts {
+		m.recordResult(mail, taskFailed, reply)
+		m.dead.add(mail, fmt.Sprintf("giving up after %d attempts: %v", mail.Attempt+1, f.err))
+		return
+	}
+	m.recordResult(mail, taskRetrying, reply)
+	mail.Attempt++
+	at := time.Now().Add(m.retryDelay(f.err, mail.Attempt))
+	if err := m.retries.schedule(mail, at); err != nil {
+		log.Print(err)
+		return
+	}
+	log.Printf("retrying task %s at %s", mail.ID, at.Format(time.RFC3339))
+}
+
+// recordResult records the outcome of this attempt at mail in the status
+// store, if there is one, and for failures in the history. Successful sends
+// are recorded in the history per session, along with their headers, and
+// counted against their template.
+func (m Mailer) recordResult(mail Mail, state, response string) {
+	m.run.record(state)
+	m.alerts.record(state)
+	if state != taskSent {
+		m.history.record(mail, mail.Recipients, state, response, "")
+	}
+	if m.status == nil {
+		return
+	}
+	if err := m.status.recordResult(mail.ID, state, response, mail.Attempt); err != nil {
+		log.Print(err)
+	}
+	if state == taskSent {
+		if err := m.status.countSend(mail.Template); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// retryBackoff doubles base for every attempt after the first.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{time.Minute, 0, time.Minute},
+		{time.Minute, 1, time.Minute},
+		{time.Minute, 2, 2 * time.Minute},
+		{time.Minute, 4, 8 * time.Minute},
+		{time.Minute, 9, 256 * time.Minute},
+		{time.Minute, 10, maxRetryBackoff},
+		{time.Minute, 1000, maxRetryBackoff},
+		{10 * time.Hour, 1, maxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := retryBackoff(tt.base, tt.attempt); got != tt.want {
+			t.Errorf("retryBackoff(%s, %d) = %s, want %s", tt.base, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transient", errors.New("connection reset"), false},
+		{"permanent", permanent(errors.New("bad template")), true},
+		{"wrapped permanent", fmt.Errorf("rendering: %w", permanent(errors.New("bad template"))), true},
+		{"5xx reply", &textproto.Error{Code: 550, Msg: "no such user"}, true},
+		{"4xx reply", &textproto.Error{Code: 451, Msg: "try later"}, false},
+	}
+	for _, tt := range tests {
+		if got := isPermanent(tt.err); got != tt.want {
+			t.Errorf("%s: isPermanent(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSMTPReply(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, "550 5.1.1 no such user"},
+		{fmt.Errorf("sending: %w", &textproto.Error{Code: 451, Msg: "try later"}), "451 try later"},
+		{errors.New("connection reset"), "connection reset"},
+	}
+	for _, tt := range tests {
+		if got := smtpReply(tt.err); got != tt.want {
+			t.Errorf("smtpReply(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	runModeDaemon = "daemon"
+	runModeOnce   = "once"
+
+	// drainFlag runs the worker once, like RUN_MODE=once.
+	drainFlag = "--drain"
+)
+
+// Exit codes of a run in once mode.
+const (
+	runExitOK = 0
+	// runExitFailures means some tasks were dead-lettered or left
+	// scheduled for a retry.
+	runExitFailures = 2
+	// runExitLimited means RUN_MAX_TASKS or RUN_MAX_DURATION stopped the
+	// run with tasks still queued.
+	runExitLimited = 3
+)
+
+// runOnce tracks a run in once mode, in which each consumer stops when its
+// queue is empty or a limit is reached, and the worker exits when the sends
+// in progress are done. Zero limits are unlimited.
+type runOnce struct {
+	maxTasks int64
+	deadline time.Time
+
+	mu             sync.Mutex
+	taken          int64
+	sent, failures int64
+}
+
+func newRunOnce(maxTasks int64, maxDuration time.Duration) *runOnce {
+	r := &runOnce{maxTasks: maxTasks}
+	if maxDuration > 0 {
+		r.deadline = time.Now().Add(maxDuration)
+	}
+	return r
+}
+
+// take reports whether the run may take another task from a queue,
+// counting it if so. It always may outside once mode.
+func (r *runOnce) take() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxTasks > 0 && r.taken >= r.maxTasks {
+		return false
+	}
+	if !r.deadline.IsZero() && time.Now().After(r.deadline) {
+		return false
+	}
+	r.taken++
+	return true
+}
+
+// record counts the outcome of a delivery attempt.
+func (r *runOnce) record(state string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state == taskSent {
+		r.sent++
+	} else {
+		r.failures++
+	}
+}
+
+// exitCode summarises the run given how many tasks are still queued.
+func (r *runOnce) exitCode(remaining int64) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Printf("run finished: %d sent, %d failed, %d still queued", r.sent, r.failures, remaining)
+	switch {
+	case r.failures > 0:
+		return runExitFailures
+	case remaining > 0:
+		return runExitLimited
+	default:
+		return runExitOK
+	}
+}
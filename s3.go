@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	awsAccessKeyIDKey     = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyKey = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenKey    = "AWS_SESSION_TOKEN"
+	awsRegionKey          = "AWS_REGION"
+	awsS3EndpointKey      = "AWS_ENDPOINT_URL_S3"
+)
+
+// s3Client issues SigV4-signed requests against S3 or an S3-compatible
+// endpoint using the standard AWS environment variables.
+type s3Client struct {
+	accessKey, secretKey, sessionToken, region, endpoint string
+}
+
+func s3ClientFromEnv() (*s3Client, error) {
+	p := &envParser{}
+	c := &s3Client{
+		accessKey:    p.string(awsAccessKeyIDKey),
+		secretKey:    p.string(awsSecretAccessKeyKey),
+		sessionToken: p.string(awsSessionTokenKey),
+		region:       p.string(awsRegionKey),
+		endpoint:     strings.TrimSuffix(p.string(awsS3EndpointKey), "/"),
+	}
+	if err := p.err(); err != nil {
+		return nil, err
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("%s and %s are required for S3 access", awsAccessKeyIDKey, awsSecretAccessKeyKey)
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	return c, nil
+}
+
+// parseS3URL splits an s3://bucket/key reference.
+func parseS3URL(ref string) (bucket, key string, err error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "s3" || u.Host == "" || len(u.Path) < 2 {
+		return "", "", fmt.Errorf("invalid S3 reference %q", ref)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// newRequest builds a signed request for the object at bucket/key. A custom
+// endpoint uses path-style addressing, AWS itself virtual-hosted style.
+func (c *s3Client) newRequest(method, bucket, key string, body []byte) (*http.Request, error) {
+	if bucket == "" || key == "" {
+		return nil, errors.New("S3 bucket and key are required")
+	}
+	var target string
+	if c.endpoint != "" {
+		target = fmt.Sprintf("%s/%s/%s", c.endpoint, bucket, s3EscapePath(key))
+	} else {
+		target = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.region, s3EscapePath(key))
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// newBucketRequest builds a signed request against bucket itself, such as a
+// listing.
+func (c *s3Client) newBucketRequest(method, bucket string, query url.Values) (*http.Request, error) {
+	if bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	var target string
+	if c.endpoint != "" {
+		target = fmt.Sprintf("%s/%s/", c.endpoint, bucket)
+	} else {
+		target = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", bucket, c.region)
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	c.sign(req, nil, time.Now().UTC())
+	return req, nil
+}
+
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath URI-encodes each segment of an object key as SigV4 expects.
+func s3EscapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// defaultSanitizeTags and defaultSanitizeAttributes are the elements and
+// attributes user-supplied HTML keeps unless SANITIZE_TAGS and
+// SANITIZE_ATTRIBUTES say otherwise. Images are left out, as most tracking
+// pixels are images.
+var (
+	defaultSanitizeTags = []string{
+		"a", "abbr", "b", "blockquote", "br", "code", "del", "div", "em", "h1", "h2", "h3", "h4", "h5", "h6",
+		"hr", "i", "ins", "li", "ol", "p", "pre", "q", "s", "small", "span", "strong", "sub", "sup",
+		"table", "tbody", "td", "tfoot", "th", "thead", "tr", "u", "ul",
+	}
+	defaultSanitizeAttributes = []string{"a.href", "a.title", "abbr.title", "td.colspan", "td.rowspan", "th.colspan", "th.rowspan", "dir", "lang"}
+)
+
+// droppedElements are removed along with everything in them, rather than
+// only their tags, whatever the allowlist says.
+var droppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "noscript": true, "template": true, "svg": true, "math": true,
+	"head": true, "title": true, "textarea": true, "select": true,
+}
+
+var voidElements = map[string]bool{
+	"area": true, "br": true, "col": true, "hr": true, "img": true, "wbr": true,
+}
+
+// urlAttributes are only kept with a URL in one of safeURLSchemes.
+var (
+	urlAttributes  = map[string]bool{"href": true, "src": true, "cite": true, "background": true}
+	safeURLSchemes = map[string]bool{"http": true, "https": true, "mailto": true, "cid": true}
+)
+
+// htmlSanitizer reduces user-supplied HTML to an allowlist of elements and
+// attributes, so that content from users can go out from our domain
+// without scripts, forms or tracking. Elements not allowed lose their tags
+// but keep their text, except for droppedElements; comments go entirely.
+// The result is balanced, so a fragment can't close or leave open the
+// elements of the message around it. Attributes are allowed by name, for
+// every element, or as element.attribute.
+type htmlSanitizer struct {
+	tags       map[string]bool
+	attributes map[string]bool
+}
+
+// contentSanitizer is shared like taskSealer, as templates use it through
+// their functions. It is configured from SANITIZE_TAGS and
+// SANITIZE_ATTRIBUTES at startup.
+var contentSanitizer = newHTMLSanitizer(defaultSanitizeTags, defaultSanitizeAttributes)
+
+func newHTMLSanitizer(tags, attributes []string) *htmlSanitizer {
+	s := &htmlSanitizer{tags: map[string]bool{}, attributes: map[string]bool{}}
+	for _, t := range tags {
+		s.tags[strings.ToLower(t)] = true
+	}
+	for _, a := range attributes {
+		s.attributes[strings.ToLower(a)] = true
+	}
+	return s
+}
+
+// sanitize returns fragment with everything not allowed removed.
+func (s *htmlSanitizer) sanitize(fragment string) string {
+	var b strings.Builder
+	var open []string
+	// dropping counts the nested dropped elements named skip we are in.
+	skip, dropping := "", 0
+	z := html.NewTokenizer(strings.NewReader(fragment))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				b.WriteString("</" + open[i] + ">")
+			}
+			return b.String()
+		case html.TextToken:
+			if dropping == 0 {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch {
+			case dropping > 0:
+				if tok.Data == skip && tt == html.StartTagToken {
+					dropping++
+				}
+			case droppedElements[tok.Data]:
+				if tt == html.StartTagToken && !voidElements[tok.Data] {
+					skip, dropping = tok.Data, 1
+				}
+			case s.tags[tok.Data]:
+				tok.Attr = s.allowedAttributes(tok.Data, tok.Attr)
+				if voidElements[tok.Data] {
+					tok.Type = html.SelfClosingTagToken
+				} else {
+					tok.Type = html.StartTagToken
+					open = append(open, tok.Data)
+				}
+				b.WriteString(tok.String())
+			}
+		case html.EndTagToken:
+			tok := z.Token()
+			if dropping > 0 {
+				if tok.Data == skip {
+					dropping--
+				}
+				continue
+			}
+			// Close what is open down to the element ending, and ignore
+			// end tags for elements the fragment didn't open.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != tok.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+}
+
+func (s *htmlSanitizer) allowedAttributes(tag string, attrs []html.Attribute) []html.Attribute {
+	var allowed []html.Attribute
+	for _, a := range attrs {
+		if a.Namespace != "" || !(s.attributes[a.Key] || s.attributes[tag+"."+a.Key]) {
+			continue
+		}
+		if urlAttributes[a.Key] && !safeURL(a.Val) {
+			continue
+		}
+		allowed = append(allowed, html.Attribute{Key: a.Key, Val: a.Val})
+	}
+	return allowed
+}
+
+// safeURL reports whether u is an absolute URL in one of safeURLSchemes.
+func safeURL(u string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(u))
+	return err == nil && safeURLSchemes[strings.ToLower(parsed.Scheme)]
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	s := newHTMLSanitizer(defaultSanitizeTags, defaultSanitizeAttributes)
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+	}{
+		{"allowed markup", `<p>Hi <b>there</b></p>`, `<p>Hi <b>there</b></p>`},
+		{"script dropped", `<p>a<script>alert(1)</script>b</p>`, `<p>ab</p>`},
+		{"nested dropped elements", `<svg><svg></svg>x</svg>y`, `y`},
+		{"unknown tag keeps its text", `<blink>hi</blink>`, `hi`},
+		{"image dropped", `<img src="https://t.example/p.gif">`, ``},
+		{"comment dropped", `a<!-- secret -->b`, `ab`},
+		{"event handler dropped", `<p onclick="x()">a</p>`, `<p>a</p>`},
+		{"safe link", `<a href="https://example.com" title="t">a</a>`, `<a href="https://example.com" title="t">a</a>`},
+		{"javascript link", `<a href="javascript:alert(1)">a</a>`, `<a>a</a>`},
+		{"attribute for another element", `<p title="t">a</p>`, `<p>a</p>`},
+		{"global attribute", `<p lang="en">a</p>`, `<p lang="en">a</p>`},
+		{"left open", `<div><p>a`, `<div><p>a</p></div>`},
+		{"closing what it didn't open", `a</div></p>b`, `ab`},
+		{"closes nested elements", `<div><b>a</div>b`, `<div><b>a</b></div>b`},
+		{"void element", `a<br>b`, `a<br/>b`},
+		{"text escaped", `a &lt; b`, `a &lt; b`},
+	}
+	for _, tt := range tests {
+		if got := s.sanitize(tt.fragment); got != tt.want {
+			t.Errorf("%s: sanitize(%q) = %q, want %q", tt.name, tt.fragment, got, tt.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/a", true},
+		{" HTTP://example.com", true},
+		{"mailto:a@example.com", true},
+		{"cid:logo", true},
+		{"javascript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"/relative", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.url); got != tt.want {
+			t.Errorf("safeURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	schedulerInterval = time.Second
+	// scheduledFallbackInterval is how often the scheduler still looks for
+	// due tasks when woken by notifications, for tasks scheduled without a
+	// marker and notifications lost while disconnected.
+	scheduledFallbackInterval = 30 * time.Second
+	// dueResubscribeDelay is how long the notifier waits to subscribe again
+	// after failing to, waking the schedulers every schedulerInterval
+	// meanwhile.
+	dueResubscribeDelay = 10 * time.Second
+)
+
+// promoteScript moves up to ARGV[2] tasks due by ARGV[1] from the scheduled
+// set onto the queue, atomically so concurrent workers can't both move one.
+var promoteScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, task in ipairs(due) do
+	redis.call("ZREM", KEYS[1], task)
+	redis.call("RPUSH", KEYS[2], task)
+end
+return #due
+`)
+
+// scheduler parks tasks that must not be sent yet in a sorted set at
+// <queue>:scheduled, scored by the Unix time they become due, and moves them
+// back onto the queue once they are. With notifications, it also sets a
+// marker key at <queue>:due:<task id> expiring when the task is due, and is
+// woken by its expiry rather than looking every second.
+type scheduler struct {
+	rdb    *redis.Client
+	queue  string
+	notify *dueNotifier
+}
+
+func newScheduler(rdb *redis.Client, queue string) *scheduler {
+	return &scheduler{rdb: rdb, queue: queue}
+}
+
+func (s *scheduler) key() string {
+	return s.queue + ":scheduled"
+}
+
+// schedule parks task until at. Its time in the queue is measured from
+// then, once it is moved back.
+func (s *scheduler) schedule(task Mail, at time.Time) error {
+	due := at.UTC()
+	task.EnqueuedAt = &due
+	body, err := marshalTask(task)
+	if err != nil {
+		return fmt.Errorf("error marshalling task %s: %w", task.ID, err)
+	}
+	pipe := s.rdb.TxPipeline()
+	pipe.ZAdd(ctx, s.key(), &redis.Z{Score: float64(at.Unix()), Member: body})
+	if wait := time.Until(at); s.notify != nil && wait > 0 {
+		pipe.Set(ctx, s.queue+dueMarker+task.ID, "", wait)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error scheduling task %s: %w", task.ID, err)
+	}
+	return nil
+}
+
+// run promotes due tasks until the process exits or stop is closed, while
+// leader leads. Tasks due together are pushed to the consuming end of the
+// queue so they are sent next.
+func (s *scheduler) run(leader *leaderElection, stop <-chan struct{}) {
+	keys := []string{s.key(), s.queue}
+	interval, wake := schedulerInterval, (<-chan struct{})(nil)
+	if s.notify != nil {
+		interval, wake = scheduledFallbackInterval, s.notify.register(s.queue)
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-wake:
+		case <-stop:
+			return
+		}
+		if !leader.leader() {
+			continue
+		}
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		n, err := promoteScript.Run(ctx, s.rdb, keys, now, 100).Int()
+		if err != nil {
+			log.Print("error promoting scheduled tasks: ", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("moved %d scheduled tasks onto list %s", n, s.queue)
+		}
+	}
+}
+
+// dueMarker separates a queue's name from a task ID in the keys marking
+// when scheduled tasks are due.
+const dueMarker = ":due:"
+
+// dueNotifier wakes the schedulers of every queue when their due markers
+// expire, through a single subscription to Redis's keyevent notifications
+// for expired keys, which need notify-keyspace-events to include Ex.
+type dueNotifier struct {
+	rdb *redis.Client
+
+	mu   sync.Mutex
+	wake map[string]chan struct{}
+}
+
+// newDueNotifier returns a notifier, or nil unless the server is known to
+// send the notifications, in which case the schedulers look every second.
+// Managed services often refuse CONFIG GET, leaving the setting unknown.
+func newDueNotifier(rdb *redis.Client) *dueNotifier {
+	config, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		log.Printf("[WARNING] can't check that notify-keyspace-events includes Ex for %s, polling for scheduled tasks instead: %v", schedulerNotificationsKey, err)
+		return nil
+	}
+	if len(config) != 2 {
+		log.Printf("[WARNING] can't check that notify-keyspace-events includes Ex for %s, polling for scheduled tasks instead: the server doesn't report it", schedulerNotificationsKey)
+		return nil
+	}
+	flags, _ := config[1].(string)
+	if !strings.Contains(flags, "E") || !(strings.Contains(flags, "x") || strings.Contains(flags, "A")) {
+		log.Printf("[WARNING] %s needs notify-keyspace-events to include Ex, not %q; polling for scheduled tasks instead", schedulerNotificationsKey, flags)
+		return nil
+	}
+	return &dueNotifier{rdb: rdb, wake: map[string]chan struct{}{}}
+}
+
+// register returns the channel waking the scheduler of queue.
+func (n *dueNotifier) register(queue string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	wake := make(chan struct{}, 1)
+	n.wake[queue] = wake
+	return wake
+}
+
+// run wakes the schedulers as their markers expire. Until it has
+// subscribed, it wakes them all every schedulerInterval, as though they
+// polled; once it has, the subscription reconnects by itself.
+func (n *dueNotifier) run() {
+	channel := fmt.Sprintf("__keyevent@%d__:expired", n.rdb.Options().DB)
+	for {
+		pubsub := n.rdb.Subscribe(ctx, channel)
+		if _, err := pubsub.Receive(ctx); err != nil {
+			log.Printf("error subscribing to %s, polling for scheduled tasks meanwhile: %v", channel, err)
+			pubsub.Close()
+			n.poll(dueResubscribeDelay)
+			continue
+		}
+		for msg := range pubsub.Channel() {
+			i := strings.LastIndex(msg.Payload, dueMarker)
+			if i < 0 {
+				continue
+			}
+			n.mu.Lock()
+			wake, ok := n.wake[msg.Payload[:i]]
+			n.mu.Unlock()
+			if ok {
+				notifyWake(wake)
+			}
+		}
+	}
+}
+
+// poll wakes every scheduler each schedulerInterval for d.
+func (n *dueNotifier) poll(d time.Duration) {
+	tick := time.NewTicker(schedulerInterval)
+	defer tick.Stop()
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		<-tick.C
+		n.mu.Lock()
+		for _, wake := range n.wake {
+			notifyWake(wake)
+		}
+		n.mu.Unlock()
+	}
+}
+
+func notifyWake(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+		// A wake-up is already pending.
+	}
+}
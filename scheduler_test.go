@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewDueNotifierUnverified(t *testing.T) {
+	// miniredis doesn't serve CONFIG GET, as many managed services don't.
+	if n := newDueNotifier(newTestRedis(t)); n != nil {
+		t.Error("newDueNotifier() returned a notifier without knowing the server sends notifications")
+	}
+}
+
+func TestDueNotifierPoll(t *testing.T) {
+	n := &dueNotifier{wake: map[string]chan struct{}{}}
+	a, b := n.register("a"), n.register("b")
+	n.poll(schedulerInterval)
+	for name, wake := range map[string]<-chan struct{}{"a": a, "b": b} {
+		select {
+		case <-wake:
+		case <-time.After(time.Second):
+			t.Errorf("scheduler %s not woken while polling", name)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// taskSchema is the published JSON Schema for task payloads, printed by
+// "post-room schema". It must be kept in step with Mail.
+const taskSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "$id": "https://github.com/djaustin/post-room/task.schema.json",
+  "title": "post-room task",
+  "type": "object",
+  "additionalProperties": false,
+  "properties": {
+    "id": {"type": "string"},
+    "from": {"type": "string"},
+    "identity": {"type": "string"},
+    "priority": {"enum": ["high", "normal", "low"]},
+    "subject": {"type": "string"},
+    "message": {"type": "string"},
+    "recipients": {"type": ["array", "null"], "items": {"type": "string"}},
+    "messageFormat": {"enum": ["", "html", "markdown"]},
+    "template": {"type": "string"},
+    "data": {"type": ["object", "null"]},
+    "templateVersion": {"type": "string"},
+    "locale": {"type": "string"},
+    "split": {"type": "boolean"},
+    "recipientData": {"type": ["object", "null"], "additionalProperties": {"type": "object"}},
+    "trackOpens": {"type": ["boolean", "null"]},
+    "trackClicks": {"type": ["boolean", "null"]},
+    "utm": {"type": ["object", "null"], "additionalProperties": {"type": "string"}},
+    "inline": {"type": ["array", "null"], "items": {"$ref": "#/definitions/attachment"}},
+    "attachments": {"type": ["array", "null"], "items": {"$ref": "#/definitions/attachment"}},
+    "event": {
+      "type": ["object", "null"],
+      "additionalProperties": false,
+      "required": ["start", "end"],
+      "properties": {
+        "uid": {"type": "string"},
+        "summary": {"type": "string"},
+        "description": {"type": "string"},
+        "location": {"type": "string"},
+        "start": {"type": "string", "format": "date-time"},
+        "end": {"type": "string", "format": "date-time"},
+        "organizer": {"type": "string"},
+        "attendees": {"type": ["array", "null"], "items": {"type": "string"}}
+      }
+    },
+    "digest": {"type": "boolean"},
+    "campaign": {
+      "type": ["object", "null"],
+      "additionalProperties": false,
+      "required": ["recipientsKey"],
+      "properties": {
+        "recipientsKey": {"type": "string"},
+        "rate": {"type": "number", "minimum": 0},
+        "subjects": {
+          "type": ["array", "null"],
+          "items": {
+            "type": "object",
+            "additionalProperties": false,
+            "required": ["subject"],
+            "properties": {
+              "name": {"type": "string"},
+              "subject": {"type": "string", "minLength": 1},
+              "weight": {"type": "number", "minimum": 0}
+            }
+          }
+        }
+      }
+    },
+    "deliveryWindow": {
+      "type": ["object", "null"],
+      "additionalProperties": false,
+      "required": ["start", "end"],
+      "properties": {
+        "start": {"type": "string", "pattern": "^\\d{2}:\\d{2}$"},
+        "end": {"type": "string", "pattern": "^\\d{2}:\\d{2}$"}
+      }
+    },
+    "timezone": {"type": "string"},
+    "urgent": {"type": "boolean"},
+    "dsn": {"type": ["array", "null"], "items": {"enum": ["success", "failure", "delay", "never", "SUCCESS", "FAILURE", "DELAY", "NEVER"]}},
+    "attempt": {"type": "integer", "minimum": 0},
+    "collapseKey": {"type": "string"},
+    "headers": {"type": ["object", "null"], "additionalProperties": {"type": "string"}},
+    "skipSigning": {"type": "boolean"},
+    "sanitize": {"type": "boolean"},
+    "readReceipt": {"type": "boolean"},
+    "preheader": {"type": "string"},
+    "enqueuedAt": {"type": "string", "format": "date-time"},
+    "idempotencyKey": {"type": "string", "maxLength": 256}
+  },
+  "definitions": {
+    "attachment": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "filename": {"type": "string"},
+        "contentType": {"type": "string"},
+        "contentId": {"type": "string"},
+        "content": {"type": ["string", "null"], "contentEncoding": "base64"},
+        "url": {"type": "string"},
+        "sha256": {"type": "string", "pattern": "^[0-9a-fA-F]{64}$"},
+        "template": {"type": "string"},
+        "render": {"type": "string", "enum": ["", "pdf", "csv", "xlsx"]},
+        "data": {"type": "string"},
+        "columns": {"type": ["array", "null"], "items": {"type": "string"}},
+        "rows": {"type": ["array", "null"], "items": {"type": "array"}}
+      }
+    }
+  }
+}
+`
+
+// taskValidator checks task payloads against taskSchema.
+type taskValidator struct {
+	schema *jsonschema.Schema
+}
+
+func newTaskValidator() (*taskValidator, error) {
+	c := jsonschema.NewCompiler()
+	c.AssertFormat = true
+	if err := c.AddResource("task.schema.json", strings.NewReader(taskSchema)); err != nil {
+		return nil, fmt.Errorf("error loading task schema: %w", err)
+	}
+	schema, err := c.Compile("task.schema.json")
+	if err != nil {
+		return nil, fmt.Errorf("error compiling task schema: %w", err)
+	}
+	return &taskValidator{schema: schema}, nil
+}
+
+// validate returns an error listing every way body fails the schema.
+func (v *taskValidator) validate(body []byte) error {
+	if v == nil {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	err := v.schema.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+	var problems []string
+	for _, e := range ve.BasicOutput().Errors {
+		// Intermediate entries only say that a child failed.
+		if e.Error == "" || strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+		location := e.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, location+": "+e.Error)
+	}
+	return fmt.Errorf("invalid task: %s", strings.Join(problems, "; "))
+}
+
+// runSchema prints the task schema.
+func runSchema(args []string) error {
+	_, err := io.WriteString(os.Stdout, taskSchema)
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix starts an encrypted task payload, which is written as
+// enc:<key id>:<base64 nonce and ciphertext>. The key ID, empty for a shared
+// key, names the key to decrypt with and is authenticated along with the
+// payload.
+const sealedPrefix = "enc:"
+
+// taskSealer is set when PAYLOAD_KEYS is configured, in which case every task
+// the worker writes to Redis is encrypted. It is shared like metrics since
+// tasks are written from throughout the worker.
+var taskSealer *payloadSealer
+
+// payloadSealer encrypts task payloads with AES-GCM under the first of its
+// keys and decrypts them with whichever key they name.
+type payloadSealer struct {
+	current  string
+	keys     map[string]cipher.AEAD
+	required bool
+}
+
+// newPayloadSealer parses keys written as [<id>:]<base64 key>, using the first
+// to encrypt. When required is set, plaintext payloads are refused.
+func newPayloadSealer(keys []string, required bool) (*payloadSealer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	s := &payloadSealer{keys: map[string]cipher.AEAD{}, required: required}
+	for i, entry := range keys {
+		id, encoded := "", entry
+		if colon := strings.Index(entry, ":"); colon >= 0 {
+			id, encoded = entry[:colon], entry[colon+1:]
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		if _, ok := s.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", id)
+		}
+		s.keys[id] = aead
+		if i == 0 {
+			s.current = id
+		}
+	}
+	return s, nil
+}
+
+func (s *payloadSealer) seal(payload []byte) ([]byte, error) {
+	aead := s.keys[s.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, payload, []byte(s.current))
+	return []byte(sealedPrefix + s.current + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// open decrypts an encrypted payload, passing plaintext ones through unless
+// encryption is required.
+func (s *payloadSealer) open(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte(sealedPrefix)) {
+		if s != nil && s.required {
+			return nil, errors.New("task payload is not encrypted")
+		}
+		return payload, nil
+	}
+	if s == nil {
+		return nil, fmt.Errorf("task payload is encrypted but no %s are configured", payloadKeysKey)
+	}
+	rest := string(payload[len(sealedPrefix):])
+	colon := strings.Index(rest, ":")
+	if colon < 0 {
+		return nil, errors.New("malformed encrypted task payload")
+	}
+	id := rest[:colon]
+	aead, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("task payload is encrypted with unknown key %q", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(rest[colon+1:])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted task payload")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting task payload with key %q: %w", id, err)
+	}
+	return plain, nil
+}
+
+// marshalTask encodes task for writing to Redis, compressed, encrypted and
+// signed if configured.
+func marshalTask(task Mail) ([]byte, error) {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = taskCompressor.compress(body); err != nil {
+		return nil, err
+	}
+	if taskSealer != nil {
+		if body, err = taskSealer.seal(body); err != nil {
+			return nil, err
+		}
+	}
+	return signPayload(body), nil
+}
+
+// openPayload verifies, decrypts and decompresses a payload read from Redis.
+func openPayload(body []byte) ([]byte, error) {
+	verified, err := verifyPayload(body)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := taskSealer.open(verified)
+	if err != nil {
+		return nil, err
+	}
+	return decompressPayload(plain)
+}
+
+// unmarshalTask decodes a task written by marshalTask.
+func unmarshalTask(body []byte, task *Mail) error {
+	plain, err := openPayload(body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, task)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyOne = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testKeyTwo = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func TestPayloadSealer(t *testing.T) {
+	old, err := newPayloadSealer([]string{"k1:" + testKeyOne}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := newPayloadSealer([]string{"k2:" + testKeyTwo, "k1:" + testKeyOne}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	required, err := newPayloadSealer([]string{"k2:" + testKeyTwo}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"subject":"secret"}`)
+	sealedOld, _ := old.seal(payload)
+	sealedNew, _ := rotated.seal(payload)
+	tampered := append([]byte(nil), sealedNew...)
+	tampered[len(tampered)-2] ^= 1
+
+	tests := []struct {
+		name    string
+		sealer  *payloadSealer
+		payload []byte
+		wantErr bool
+	}{
+		{"current key", rotated, sealedNew, false},
+		{"earlier key after rotation", rotated, sealedOld, false},
+		{"plaintext", rotated, payload, false},
+		{"plaintext when required", required, payload, true},
+		{"unknown key", required, sealedOld, true},
+		{"tampered", rotated, tampered, true},
+		{"no keys", nil, sealedNew, true},
+		{"no keys, plaintext", nil, payload, false},
+	}
+	for _, tt := range tests {
+		got, err := tt.sealer.open(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: open() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, payload) {
+			t.Errorf("%s: open() = %q, want %q", tt.name, got, payload)
+		}
+	}
+	if !strings.HasPrefix(string(sealedNew), sealedPrefix+"k2:") || bytes.Contains(sealedNew, []byte("secret")) {
+		t.Errorf("seal() = %q, want it encrypted under k2", sealedNew)
+	}
+	if again, _ := rotated.seal(payload); bytes.Equal(again, sealedNew) {
+		t.Error("seal() reused a nonce")
+	}
+}
+
+func TestNewPayloadSealer(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+	}{
+		{"no keys", nil},
+		{"not base64", []string{"k1:not base64!"}},
+		{"short key", []string{"k1:c2hvcnQ="}},
+		{"duplicate ID", []string{"k1:" + testKeyOne, "k1:" + testKeyTwo}},
+	}
+	for _, tt := range tests {
+		if _, err := newPayloadSealer(tt.keys, false); err == nil {
+			t.Errorf("%s: newPayloadSealer() accepted %q", tt.name, tt.keys)
+		}
+	}
+}
+
+func TestMarshalTask(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		sealed bool
+		signed bool
+	}{
+		{"plain", false, false},
+		{"sealed", true, false},
+		{"signed", false, true},
+		{"sealed and signed", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sealed {
+				taskSealer, _ = newPayloadSealer([]string{testKeyOne}, true)
+				defer func() { taskSealer = nil }()
+			}
+			if tt.signed {
+				taskSigningSecret = []byte("signing secret")
+				defer func() { taskSigningSecret = nil }()
+			}
+			body, err := marshalTask(Mail{ID: "t1", Subject: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.HasPrefix(body, []byte(signedPrefix)) != tt.signed || bytes.Contains(body, []byte(`"secret"`)) == tt.sealed {
+				t.Errorf("marshalTask() = %q", body)
+			}
+			var task Mail
+			if err := unmarshalTask(body, &task); err != nil || task.ID != "t1" || task.Subject != "secret" {
+				t.Errorf("unmarshalTask() = %+v, %v", task, err)
+			}
+		})
+	}
+}
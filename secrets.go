@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/smtp"
+	"sync"
+)
+
+// reloadableAuth authenticates with the SMTP credentials last loaded, so
+// that rotated credentials take effect on SIGHUP without a restart.
+type reloadableAuth struct {
+	mu   sync.RWMutex
+	auth smtp.Auth
+}
+
+func newReloadableAuth(auth smtp.Auth) *reloadableAuth {
+	return &reloadableAuth{auth: auth}
+}
+
+func (a *reloadableAuth) set(auth smtp.Auth) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.auth = auth
+}
+
+func (a *reloadableAuth) current() smtp.Auth {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.auth
+}
+
+func (a *reloadableAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return a.current().Start(server)
+}
+
+func (a *reloadableAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.current().Next(fromServer, more)
+}
+
+// reloadCredentials swaps in the SMTP credentials in options, as reread
+// with any secret files, for those auth was made with.
+func reloadCredentials(auth smtp.Auth, options AppOptions) {
+	reloadable, ok := auth.(*reloadableAuth)
+	if !ok {
+		return
+	}
+	if options.SMTPUsername == "" || options.SMTPPassword == "" {
+		log.Print("error reloading SMTP credentials: none configured")
+		return
+	}
+	reloadable.set(smtp.PlainAuth("", options.SMTPUsername, options.SMTPPassword, options.SMTPHost))
+	log.Print("reloaded SMTP credentials")
+}
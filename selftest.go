@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// selftest runs the steps of a send one at a time, printing each one's
+// outcome and how long it took.
+type selftest struct {
+	failed bool
+}
+
+// step runs fn unless an earlier step failed. fn may return a note to print
+// alongside its outcome.
+func (s *selftest) step(name string, fn func() (string, error)) {
+	if s.failed {
+		fmt.Printf("%-8s %s\n", "skipped", name)
+		return
+	}
+	start := time.Now()
+	note, err := fn()
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case err != nil:
+		s.failed = true
+		fmt.Printf("%-8s %s (%s): %v\n", "FAILED", name, took, err)
+	case note != "":
+		fmt.Printf("%-8s %s (%s): %s\n", "ok", name, took, note)
+	default:
+		fmt.Printf("%-8s %s (%s)\n", "ok", name, took)
+	}
+}
+
+// runSelftest sends a canary email with the worker's configuration,
+// reporting on rendering, connecting, TLS, authentication and sending in
+// turn.
+func runSelftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	to := fs.String("to", "", "comma-separated recipients of the canary email")
+	templateName := fs.String("template", "", "template to render instead of the built-in canary message")
+	data := fs.String("data", "", "JSON data for -template")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return errors.New("no recipients given; use -to")
+	}
+
+	s := &selftest{}
+	var (
+		options    AppOptions
+		mailer     Mailer
+		sender     *identity
+		recipients []*netmail.Address
+	)
+	mail := Mail{
+		ID:         newTaskID(),
+		Subject:    "Post Room self-test " + time.Now().UTC().Format(time.RFC3339),
+		Recipients: splitList(*to),
+		Template:   *templateName,
+	}
+	s.step("configuration", func() (string, error) {
+		var err error
+		if options, err = validateEnvironment(); err != nil {
+			return "", err
+		}
+		if err := protectPayloads(options); err != nil {
+			return "", err
+		}
+		rdb, _, err := connectRedis(&options)
+		if err != nil {
+			return "", err
+		}
+		if mailer, err = newMailer(options, rdb); err != nil {
+			return "", err
+		}
+		// The canary shouldn't leave dead letters behind.
+		mailer.dead = nil
+		if recipients, err = parseRecipients(mail.Recipients); err != nil {
+			return "", err
+		}
+		sender, err = mailer.senderFor(mail)
+		return "", err
+	})
+	s.step("render", func() (string, error) {
+		if mail.Template == "" {
+			mail.Message = "<p>This is a test message sent by <code>post-room selftest</code>.</p>"
+		} else {
+			if *data != "" {
+				if err := json.Unmarshal([]byte(*data), &mail.Data); err != nil {
+					return "", fmt.Errorf("invalid -data: %w", err)
+				}
+			}
+			var err error
+			if mail.Message, err = mailer.renderTemplate(mail); err != nil {
+				return "", err
+			}
+			mail.MessageFormat = messageFormatHTML
+		}
+		message, err := mailer.buildMessage(sender, recipients, mail, nil)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d byte message", len(message)), nil
+	})
+
+	sendCtx, cancel := context.WithTimeout(ctx, mailer.timeouts.send)
+	defer cancel()
+	var dialogue *transcript
+	if mailer.debug {
+		dialogue = &transcript{}
+		sendCtx = withTranscript(sendCtx, dialogue)
+	}
+	if mailer.mx != nil {
+		// Direct delivery connects to each domain's servers in turn, so the
+		// steps can't be told apart.
+		s.step("deliver to MX", func() (string, error) {
+			failures := mailer.deliver(sendCtx, recipients, func(c *smtp.Client, to []*netmail.Address) error {
+				return mailer.sendSession(c, sender, recipients, to, mail, nil)
+			})
+			if len(failures) > 0 {
+				return "", failures[0].err
+			}
+			return "", nil
+		})
+	} else {
+		var (
+			c    *smtp.Client
+			conn *timeoutConn
+		)
+		defer func() {
+			if c != nil {
+				c.Close()
+			}
+		}()
+		s.step("connect", func() (string, error) {
+			var err error
+			addr := net.JoinHostPort(mailer.host, mailer.port)
+			if c, conn, err = mailer.timeouts.connect(sendCtx, addr, mailer.host, mailer.helo, mailer.implicitTLS(mailer.port)); err != nil {
+				return "", err
+			}
+			return "connected to " + addr + ", " + extensionSummary(c), nil
+		})
+		s.step("starttls", func() (string, error) {
+			if state, ok := c.TLSConnectionState(); ok {
+				return "implicit TLS, " + tls.CipherSuiteName(state.CipherSuite), nil
+			}
+			if mailer.auth == nil {
+				return "skipped without credentials", nil
+			}
+			if ok, _ := c.Extension("STARTTLS"); !ok {
+				return "not offered by the server", nil
+			}
+			if err := startTLS(c, conn, &tls.Config{ServerName: mailer.host}); err != nil {
+				return "", err
+			}
+			state, _ := c.TLSConnectionState()
+			return tls.CipherSuiteName(state.CipherSuite), nil
+		})
+		s.step("auth", func() (string, error) {
+			if mailer.auth == nil {
+				return "skipped without credentials", nil
+			}
+			if ok, _ := c.Extension("AUTH"); !ok {
+				return "", errors.New("server doesn't support AUTH")
+			}
+			return "", c.Auth(mailer.auth)
+		})
+		s.step("send", func() (string, error) {
+			replies := newServerReplies()
+			if err := mailer.sendSession(c, sender, recipients, recipients, mail, replies); err != nil {
+				return "", err
+			}
+			reply, _ := replies.get(recipients[0])
+			return "task " + mail.ID + ": " + reply, c.Quit()
+		})
+	}
+	if s.failed {
+		if dialogue != nil {
+			fmt.Printf("\nSMTP dialogue:\n%s\n", dialogue)
+		}
+		return errors.New("self-test failed")
+	}
+	fmt.Println("self-test passed")
+	return nil
+}
+
+// extensionSummary lists the extensions that matter to the worker and
+// whether the server offers them.
+func extensionSummary(c *smtp.Client) string {
+	var offered []string
+	for _, ext := range []string{"STARTTLS", "AUTH", "SIZE", "SMTPUTF8", "DSN", "PIPELINING"} {
+		if ok, _ := c.Extension(ext); ok {
+			offered = append(offered, ext)
+		}
+	}
+	if len(offered) == 0 {
+		return "no extensions offered"
+	}
+	return "offers " + strings.Join(offered, ", ")
+}
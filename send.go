@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// runSend sends one task from the command line. The task is read from stdin
+// as JSON, or when given with -subject, -to and -template, stdin is the
+// message body or the template's JSON data. It is sent
+// through the configured transport at once, or with -enqueue pushed onto the
+// queue for a worker.
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	subject := fs.String("subject", "", "subject; with -to, read the message body from stdin")
+	to := fs.String("to", "", "comma-separated recipients")
+	format := fs.String("format", "", "message format of the body: html (the default) or markdown")
+	templateName := fs.String("template", "", "template to render, with stdin as its JSON data")
+	queue := fs.Bool("enqueue", false, "enqueue the task for a worker instead of sending it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("error reading stdin: %w", err)
+	}
+
+	var task Mail
+	if *subject != "" || *to != "" || *templateName != "" {
+		task = Mail{Subject: *subject, Recipients: splitList(*to), MessageFormat: *format, Template: *templateName}
+		if *templateName == "" {
+			task.Message = string(input)
+		} else if len(input) > 0 {
+			if err := json.Unmarshal(input, &task.Data); err != nil {
+				return fmt.Errorf("invalid template data: %w", err)
+			}
+		}
+		if input, err = json.Marshal(task); err != nil {
+			return err
+		}
+	}
+	validator, err := newTaskValidator()
+	if err != nil {
+		return err
+	}
+	if err := validator.validate(input); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(input, &task); err != nil {
+		return fmt.Errorf("invalid task: %w", err)
+	}
+	if len(task.Recipients) == 0 {
+		return errors.New("no recipients given; use -to or the task's recipients")
+	}
+
+	if *queue {
+		return enqueueFromEnvironment(&task)
+	}
+	return sendNow(task)
+}
+
+// enqueueFromEnvironment pushes task onto REDIS_KEY at REDIS_ADDRESS, which
+// is all the configuration enqueueing needs besides payload protection.
+func enqueueFromEnvironment(task *Mail) error {
+	addr := os.Getenv(redisAddressKey)
+	if addr == "" {
+		return fmt.Errorf("no ENV value provided for %s", redisAddressKey)
+	}
+	queue := os.Getenv(redisKeyKey)
+	if queue == "" {
+		queue = "tasks"
+	}
+	if err := protectPayloadsFromEnvironment(); err != nil {
+		return err
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	defer rdb.Close()
+	if err := enqueue(rdb, queue, task); err != nil {
+		return err
+	}
+	fmt.Println(task.ID)
+	return nil
+}
+
+// sendNow sends task with the worker's configuration. Failures are
+// reported rather than retried or dead-lettered.
+func sendNow(task Mail) error {
+	options, err := validateEnvironment()
+	if err != nil {
+		return err
+	}
+	rdb, _, err := connectRedis(&options)
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+	mailer, err := newMailer(options, rdb)
+	if err != nil {
+		return err
+	}
+	mailer.dead = nil
+	mailer.run = newRunOnce(0, 0)
+	if task.ID == "" {
+		task.ID = newTaskID()
+	}
+	mailer.sendMailSafely(task)
+	if mailer.run.failures > 0 || mailer.run.sent == 0 {
+		return fmt.Errorf("task %s was not sent", task.ID)
+	}
+	fmt.Println(task.ID)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifyPayload(t *testing.T) {
+	taskSigningSecret = []byte("signing secret")
+	defer func() { taskSigningSecret = nil }()
+	signed := signPayload([]byte(`{"id":"t1"}`))
+	forged := bytes.Replace(signed, []byte(`"t1"`), []byte(`"t2"`), 1)
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"signed", signed, false},
+		{"unsigned", []byte(`{"id":"t1"}`), true},
+		{"forged", forged, true},
+		{"malformed", []byte(signedPrefix + "zz:{}"), true},
+		{"no separator", []byte(signedPrefix + "abcd"), true},
+	}
+	for _, tt := range tests {
+		got, err := verifyPayload(tt.payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifyPayload() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && string(got) != `{"id":"t1"}` {
+			t.Errorf("%s: verifyPayload() = %q", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"strconv"
+)
+
+const messagesTooLargeMetric = "post_room_messages_too_large_total"
+
+func init() {
+	metrics.describe(messagesTooLargeMetric, "counter", "Messages rejected before DATA for exceeding the size limit.")
+}
+
+// sizeLimit returns the largest message the session may send: the smaller
+// of the server's advertised SIZE and max, where zero means no limit.
+func sizeLimit(c *smtp.Client, max int64) int64 {
+	ok, param := c.Extension("SIZE")
+	if !ok {
+		return max
+	}
+	advertised, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || advertised <= 0 {
+		return max
+	}
+	if max > 0 && max < advertised {
+		return max
+	}
+	return advertised
+}
+
+// checkSize fails permanently for a message larger than the session allows,
+// so it is dead-lettered instead of being sent only to be refused after
+// DATA.
+func (m Mailer) checkSize(c *smtp.Client, message []byte) error {
+	limit := sizeLimit(c, m.maxMessageBytes)
+	if limit <= 0 || int64(len(message)) <= limit {
+		return nil
+	}
+	metrics.add(messagesTooLargeMetric, 1)
+	return permanent(fmt.Errorf("message too large: %d bytes exceeds the limit of %d bytes", len(message), limit))
+}
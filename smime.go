@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"mime"
+	"os"
+
+	"go.mozilla.org/pkcs7"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// smimeSigner signs outgoing messages with an S/MIME certificate.
+type smimeSigner struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.PrivateKey
+}
+
+// loadSMIMESigner reads a PKCS#12 bundle containing the signing certificate,
+// its private key and, optionally, intermediate certificates.
+func loadSMIMESigner(path, password string) (*smimeSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading S/MIME certificate: %w", err)
+	}
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding S/MIME certificate: %w", err)
+	}
+	return &smimeSigner{cert: cert, chain: chain, key: key}, nil
+}
+
+// sign wraps content in a multipart/signed entity with a detached
+// application/pkcs7-signature over its canonical (CRLF) rendering.
+func (s *smimeSigner) sign(content *part) (*part, error) {
+	var rendered bytes.Buffer
+	if err := content.writeHeader(&rendered); err != nil {
+		return nil, err
+	}
+	if err := content.writeBody(&rendered); err != nil {
+		return nil, err
+	}
+
+	sd, err := pkcs7.NewSignedData(rendered.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error creating S/MIME signature: %w", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(s.cert, s.key, s.chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("error adding S/MIME signer: %w", err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("error finishing S/MIME signature: %w", err)
+	}
+
+	sigPart := binaryPart("application/pkcs7-signature; name=\"smime.p7s\"", signature)
+	sigPart.header.Set("Content-Disposition", dispositionHeader("attachment", "smime.p7s"))
+
+	signed := multipartOf("signed", content, sigPart)
+	signed.header.Set("Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{
+		"boundary": signed.boundary,
+		"protocol": "application/pkcs7-signature",
+		"micalg":   "sha-256",
+	}))
+	return signed, nil
+}
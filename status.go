@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const statusTTL = 30 * 24 * time.Hour
+
+// statusStore records what happened to each task in a Redis hash at
+// <queue>:status:<task id>, expiring after statusTTL, and counts the
+// messages sent with each template in <queue>:sends.
+type statusStore struct {
+	rdb       *redis.Client
+	queue     string
+	prefix    string
+	volumes   string
+	receipts  string
+	campaigns string
+}
+
+// noTemplate is the sends field counting messages sent without a template.
+const noTemplate = "(none)"
+
+func newStatusStore(rdb *redis.Client, queue string) *statusStore {
+	return &statusStore{rdb: rdb, queue: queue, prefix: queue + ":status:", volumes: queue + ":sends", receipts: queue + ":receipts:", campaigns: queue + ":campaign:"}
+}
+
+func (s *statusStore) key(id string) string {
+	return s.prefix + id
+}
+
+// engagementScript counts an open or click in the status hash at KEYS[1],
+// if the task has one: it increments ARGV[1] and, unless empty, ARGV[5], sets
+// first<ARGV[2]> to ARGV[3] unless set and last<ARGV[2]> to it, and expires
+// the hash ARGV[4] seconds on. It returns the new count with the hash's
+// campaign and subjectVariant fields, or nil for a task without a status,
+// so that requests for made-up IDs add nothing to Redis.
+var engagementScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+local n = redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+if ARGV[5] ~= "" then
+	redis.call("HINCRBY", KEYS[1], ARGV[5], 1)
+end
+redis.call("HSETNX", KEYS[1], "first" .. ARGV[2], ARGV[3])
+redis.call("HSET", KEYS[1], "last" .. ARGV[2], ARGV[3])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+local variant = redis.call("HMGET", KEYS[1], "campaign", "subjectVariant")
+return {n, variant[1], variant[2]}
+`)
+
+// recordOpen counts an open of the task's message, keeping the time of the
+// first and the most recent one.
+func (s *statusStore) recordOpen(id string) error {
+	return s.recordEngagement(id, "opens", "OpenedAt", "")
+}
+
+// recordClick counts a click on a link in the task's message, both overall
+// and per URL.
+func (s *statusStore) recordClick(id, target string) error {
+	return s.recordEngagement(id, "clicks", "ClickedAt", "click:"+target)
+}
+
+func (s *statusStore) recordEngagement(id, counter, times, field string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	res, err := engagementScript.Run(ctx, s.rdb, []string{s.key(id)}, counter, times, now, int(statusTTL.Seconds()), field).Slice()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error recording %s of task %s: %w", counter, id, err)
+	}
+	if n, _ := res[0].(int64); n == 1 {
+		return s.countVariant(id, res[1:], counter)
+	}
+	return nil
+}
+
+// countVariant counts the first open or click of a campaign send testing
+// subjects against its variant, given the send's campaign and
+// subjectVariant status fields.
+func (s *statusStore) countVariant(id string, fields []interface{}, counter string) error {
+	campaign, _ := fields[0].(string)
+	variant, _ := fields[1].(string)
+	if campaign == "" || variant == "" {
+		return nil
+	}
+	if err := s.rdb.HIncrBy(ctx, s.campaigns+campaign, "variant:"+variant+":"+counter, 1).Err(); err != nil {
+		return fmt.Errorf("error counting %s of task %s: %w", counter, id, err)
+	}
+	return nil
+}
+
+const (
+	taskSent     = "sent"
+	taskRetrying = "retrying"
+	taskFailed   = "failed"
+)
+
+// recordResult records the outcome of a delivery attempt and, for failures,
+// the server's reply or the error.
+func (s *statusStore) recordResult(id, state, response string, attempt int) error {
+	key := s.key(id)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, key, "state", state, "attempts", attempt+1, "updatedAt", time.Now().UTC().Format(time.RFC3339))
+	if response != "" {
+		pipe.HSet(ctx, key, "response", response)
+	} else {
+		pipe.HDel(ctx, key, "response")
+	}
+	pipe.Expire(ctx, key, statusTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error recording result of task %s: %w", id, err)
+	}
+	return nil
+}
+
+// serverReplies collects the server's final reply to each recipient of a
+// send: the reply accepting the message, which often carries the relay's ID
+// for it, or the one refusing it. A nil collector collects nothing.
+type serverReplies struct {
+	mu      sync.Mutex
+	replies map[string]string
+}
+
+func newServerReplies() *serverReplies {
+	return &serverReplies{replies: map[string]string{}}
+}
+
+func (r *serverReplies) set(to []string, reply string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, address := range to {
+		r.replies[strings.ToLower(address)] = reply
+	}
+}
+
+// get returns the reply to recipient, who may have been sent to under the
+// ASCII form of their address.
+func (r *serverReplies) get(recipient *netmail.Address) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply, ok := r.replies[strings.ToLower(recipient.Address)]
+	if !ok {
+		if ascii, err := asciiAddress(recipient); err == nil {
+			reply, ok = r.replies[strings.ToLower(ascii.Address)]
+		}
+	}
+	return reply, ok
+}
+
+// recordReplies records the server's reply to each of recipients in the
+// response:<recipient> fields of the task's status.
+func (s *statusStore) recordReplies(id string, recipients []*netmail.Address, replies *serverReplies) error {
+	var values []interface{}
+	for _, r := range recipients {
+		if reply, ok := replies.get(r); ok {
+			values = append(values, "response:"+strings.ToLower(r.Address), reply)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	key := s.key(id)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, key, values...)
+	pipe.Expire(ctx, key, statusTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("error recording replies to task %s: %w", id, err)
+	}
+	return nil
+}
+
+// expectReceipt maps the Message-ID of the message sent for a task that
+// asked for a read receipt back to the task, at
+// <queue>:receipts:<message id>, so that the receipt can be recorded
+// against it.
+func (s *statusStore) expectReceipt(id, messageID string) error {
+	if err := s.rdb.Set(ctx, s.receipts+messageID, id, statusTTL).Err(); err != nil {
+		return fmt.Errorf("error recording message ID of task %s: %w", id, err)
+	}
+	return nil
+}
+
+// recordReceipt records a read receipt for the message with messageID in
+// the receipt:<recipient> and receiptAt:<recipient> fields of its task's
+// status, returning false if no task sent by this queue has that ID.
+func (s *statusStore) recordReceipt(messageID, recipient, disposition string) (bool, error) {
+	id, err := s.rdb.Get(ctx, s.receipts+messageID).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up message %s: %w", messageID, err)
+	}
+	recipient = strings.ToLower(recipient)
+	key := s.key(id)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, key, "receipt:"+recipient, disposition, "receiptAt:"+recipient, time.Now().UTC().Format(time.RFC3339))
+	pipe.Expire(ctx, key, statusTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("error recording receipt for task %s: %w", id, err)
+	}
+	return true, nil
+}
+
+// countSend counts a message sent with template.
+func (s *statusStore) countSend(template string) error {
+	if template == "" {
+		template = noTemplate
+	}
+	if err := s.rdb.HIncrBy(ctx, s.volumes, template, 1).Err(); err != nil {
+		return fmt.Errorf("error counting send of template %s: %w", template, err)
+	}
+	return nil
+}
+
+// sendVolumes returns the number of messages sent with each template.
+func (s *statusStore) sendVolumes() (map[string]int64, error) {
+	counts, err := s.rdb.HGetAll(ctx, s.volumes).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error reading send volumes: %w", err)
+	}
+	volumes := make(map[string]int64, len(counts))
+	for template, count := range counts {
+		volumes[template], _ = strconv.ParseInt(count, 10, 64)
+	}
+	return volumes, nil
+}
+
+// newTaskID generates an ID for tasks enqueued without one.
+func newTaskID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("error generating task ID: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
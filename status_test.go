@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestCountVariant(t *testing.T) {
+	rdb := newTestRedis(t)
+	s := newStatusStore(rdb, "tasks")
+	rdb.HSet(ctx, s.key("c1-0"), "campaign", "c1", "subjectVariant", "B")
+	rdb.HSet(ctx, s.key("plain"), "state", taskSent)
+
+	for _, id := range []string{"c1-0", "c1-0", "plain"} {
+		if err := s.recordOpen(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.recordClick("c1-0", "https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := rdb.HGetAll(ctx, "tasks:campaign:c1").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first open of a send counts against its variant.
+	want := map[string]string{"variant:B:opens": "1", "variant:B:clicks": "1"}
+	if len(counts) != len(want) {
+		t.Errorf("campaign counts = %v, want %v", counts, want)
+	}
+	for field, n := range want {
+		if counts[field] != n {
+			t.Errorf("campaign %s = %q, want %s", field, counts[field], n)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		fields []interface{}
+	}{
+		{"not a campaign send", []interface{}{nil, nil}},
+		{"no variant", []interface{}{"c1", nil}},
+	}
+	for _, tt := range tests {
+		if err := s.countVariant("x", tt.fields, "opens"); err != nil {
+			t.Errorf("%s: countVariant() error: %v", tt.name, err)
+		}
+	}
+	if n, _ := rdb.HLen(ctx, "tasks:campaign:c1").Result(); n != 2 {
+		t.Errorf("countVariant() counted a send without a variant")
+	}
+}
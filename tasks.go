@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const tasksPath = "/v1/tasks/"
+
+// tasksAPI serves a task at /v1/tasks/<id>, on the queue given by the queue
+// parameter: GET returns its status, PUT replaces it with the task in the
+// body while it is scheduled and DELETE cancels it. PUT takes the revision
+// it expects the task to be at in If-Match, and returns the new one in
+// ETag. It is only served with API_TOKEN set.
+type tasksAPI struct {
+	rdb          *redis.Client
+	queues       map[string]bool
+	defaultQueue string
+	validator    *taskValidator
+}
+
+type cancelResult struct {
+	ID    string `json:"id"`
+	Queue string `json:"queue"`
+	State string `json:"state"`
+}
+
+type amendResult struct {
+	ID       string `json:"id"`
+	Queue    string `json:"queue"`
+	Revision int64  `json:"revision"`
+}
+
+func (a *tasksAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, tasksPath)
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	queue := r.URL.Query().Get("queue")
+	if queue == "" {
+		queue = a.defaultQueue
+	}
+	if !a.queues[queue] {
+		http.Error(w, fmt.Sprintf("unknown queue %q", queue), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		a.status(w, r, queue, id)
+	case http.MethodPut:
+		a.amend(w, r, queue, id)
+	case http.MethodDelete:
+		a.cancel(w, queue, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *tasksAPI) status(w http.ResponseWriter, r *http.Request, queue, id string) {
+	fields, err := a.rdb.HGetAll(ctx, newStatusStore(a.rdb, queue).key(id)).Result()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error reading task status", http.StatusServiceUnavailable)
+		return
+	}
+	if len(fields) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	revision := fields["revision"]
+	if revision == "" {
+		revision = "0"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", strconv.Quote(revision))
+	json.NewEncoder(w).Encode(fields)
+}
+
+func (a *tasksAPI) amend(w http.ResponseWriter, r *http.Request, queue, id string) {
+	revision := int64(-1)
+	if match := r.Header.Get("If-Match"); match != "" {
+		var err error
+		if revision, err = strconv.ParseInt(strings.Trim(match, `"`), 10, 64); err != nil || revision < 0 {
+			http.Error(w, "invalid If-Match: must be a task revision", http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.validator.validate(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var task Mail
+	if err := json.Unmarshal(body, &task); err != nil {
+		http.Error(w, "invalid task: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	revision, err = newScheduler(a.rdb, queue).amend(id, task, revision)
+	switch {
+	case errors.Is(err, errTaskNotScheduled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errRevisionConflict):
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	case err != nil:
+		log.Print(err)
+		http.Error(w, "error amending task", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("amended task %s in %s, now at revision %d", id, queue, revision)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(revision, 10)))
+	json.NewEncoder(w).Encode(amendResult{ID: id, Queue: queue, Revision: revision})
+}
+
+func (a *tasksAPI) cancel(w http.ResponseWriter, queue, id string) {
+	if err := newCancellations(a.rdb, queue).cancel(id); errors.Is(err, errTaskFinished) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Print(err)
+		http.Error(w, "error cancelling task", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("cancelled task %s in %s", id, queue)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(cancelResult{ID: id, Queue: queue, State: taskCancelled})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+const defaultMJMLBinary = "mjml"
+
+const (
+	layoutsDir    = "layouts"
+	partialsDir   = "partials"
+	contentName   = "content"
+	defaultLayout = "default"
+)
+
+// templateStore holds the named message templates loaded from a directory.
+// Each file is a template named after the file without its extension; .html
+// files are Go html/templates and .mjml files are compiled to HTML with the
+// MJML CLI at load time before being parsed the same way. Locale variants
+// are named <name>.<locale>.<ext>, e.g. welcome.de.html. An optional
+// <name>.json file alongside a template holds its templateConfig.
+//
+// Files in the partials subdirectory can be included from any template with
+// {{template "<name>" .}}. Files in the layouts subdirectory wrap templates,
+// which are rendered into the layout as {{template "content" .}}; the
+// "default" layout is used unless a template's config names another one or
+// sets it to "" for none.
+type templateStore struct {
+	dir           string
+	mjmlBinary    string
+	defaultLocale string
+	templates     map[string]*template.Template
+	configs       map[string]templateConfig
+	base          *template.Template
+	layouts       map[string]*template.Template
+}
+
+// templateConfig holds per-template rendering options. Unset options fall
+// back to the worker-wide defaults.
+type templateConfig struct {
+	InlineCSS *bool             `json:"inlineCss,omitempty"`
+	Layout    *string           `json:"layout,omitempty"`
+	UTM       map[string]string `json:"utm,omitempty"`
+}
+
+func loadTemplates(dir, mjmlBinary, defaultLocale string) (*templateStore, error) {
+	if mjmlBinary == "" {
+		mjmlBinary = defaultMJMLBinary
+	}
+	s := &templateStore{
+		dir:           dir,
+		mjmlBinary:    mjmlBinary,
+		defaultLocale: defaultLocale,
+		templates:     map[string]*template.Template{},
+		configs:       map[string]templateConfig{},
+	}
+
+	pages, err := s.readSources(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	if s.configs, err = readTemplateConfigs(dir, pages); err != nil {
+		return nil, err
+	}
+	partials, err := s.readSources(filepath.Join(dir, partialsDir), false)
+	if err != nil {
+		return nil, err
+	}
+	layoutSources, err := s.readSources(filepath.Join(dir, layoutsDir), false)
+	if err != nil {
+		return nil, err
+	}
+
+	s.base = template.New("").Funcs(templateFuncs(""))
+	for name, source := range partials {
+		if _, err := s.base.New(name).Parse(source); err != nil {
+			return nil, fmt.Errorf("error parsing partial %s: %w", name, err)
+		}
+	}
+	s.layouts = map[string]*template.Template{}
+	for name, source := range layoutSources {
+		l, err := s.base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := l.New(name).Parse(source); err != nil {
+			return nil, fmt.Errorf("error parsing layout %s: %w", name, err)
+		}
+		s.layouts[name] = l
+	}
+
+	for key, source := range pages {
+		name := strings.SplitN(key, ".", 2)[0]
+		layout := defaultLayout
+		if l := s.configs[name].Layout; l != nil {
+			layout = *l
+		}
+		t, err := s.parsePage(key, source, layout)
+		if err != nil {
+			return nil, err
+		}
+		s.templates[key] = t
+	}
+	return s, nil
+}
+
+// parsePage parses a page template with the store's partials, wrapped in
+// layout if the store has it. The returned template is the one to execute.
+func (s *templateStore) parsePage(key, source, layout string) (*template.Template, error) {
+	set, root := s.base, key
+	if l, ok := s.layouts[layout]; ok {
+		set, root = l, layout
+	} else if layout != defaultLayout && layout != "" {
+		return nil, fmt.Errorf("template %s uses unknown layout %q", key, layout)
+	}
+	t, err := set.Clone()
+	if err != nil {
+		return nil, err
+	}
+	pageName := key
+	if root != key {
+		pageName = contentName
+	}
+	if _, err := t.New(pageName).Parse(source); err != nil {
+		return nil, fmt.Errorf("error parsing template %s: %w", key, err)
+	}
+	return t.Lookup(root), nil
+}
+
+// readSources reads the template files directly inside dir keyed by
+// template name. A missing directory is only an error if required.
+func (s *templateStore) readSources(dir string, required bool) (map[string]string, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading template directory: %w", err)
+	}
+	sources := map[string]string{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(f.Name())
+		name := variantKey(strings.TrimSuffix(f.Name(), ext))
+		path := filepath.Join(dir, f.Name())
+
+		var source []byte
+		switch ext {
+		case ".html":
+			source, err = os.ReadFile(path)
+		case ".mjml":
+			source, err = s.compileMJML(path)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := sources[name]; exists {
+			return nil, fmt.Errorf("duplicate template %q", name)
+		}
+		sources[name] = string(source)
+	}
+	return sources, nil
+}
+
+// readTemplateConfigs reads the <name>.json config of each page. Locale
+// variants share their base template's config.
+func readTemplateConfigs(dir string, pages map[string]string) (map[string]templateConfig, error) {
+	configs := map[string]templateConfig{}
+	for key := range pages {
+		if strings.Contains(key, ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, key+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading template config for %s: %w", key, err)
+		}
+		var config templateConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("error parsing template config for %s: %w", key, err)
+		}
+		configs[key] = config
+	}
+	return configs, nil
+}
+
+// config returns the options for the named template.
+func (s *templateStore) config(name string) templateConfig {
+	if s == nil {
+		return templateConfig{}
+	}
+	return s.configs[name]
+}
+
+// compileMJML runs the MJML compiler on path and returns the resulting HTML.
+func (s *templateStore) compileMJML(path string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.mjmlBinary, path, "--stdout")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error compiling MJML template %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// renderInline renders a message body supplied in the task itself as a
+// template, for personalized messages that don't use a stored template.
+func renderInline(source, locale string, data interface{}) (string, error) {
+	t, err := template.New("message").Funcs(templateFuncs(normalizeLocale(locale))).Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("error parsing message template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering message template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// templateFuncs returns the functions available to templates: the Sprig
+// library, the locale formatting helpers bound to locale and sanitize,
+// which embeds user-supplied HTML once it has been through the sanitizer.
+// Sprig's functions reading the environment are left out, as tasks can
+// supply templates and the environment holds the worker's secrets.
+func templateFuncs(locale string) template.FuncMap {
+	funcs := sprig.HtmlFuncMap()
+	delete(funcs, "env")
+	delete(funcs, "expandenv")
+	for name, fn := range localeFuncs(locale) {
+		funcs[name] = fn
+	}
+	funcs["sanitize"] = func(fragment string) template.HTML {
+		return template.HTML(contentSanitizer.sanitize(fragment))
+	}
+	return funcs
+}
+
+// variantKey normalizes the locale part of a template file name so lookups
+// are case-insensitive: "welcome.de_AT" becomes "welcome.de-at".
+func variantKey(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return name
+	}
+	return name[:i] + "." + normalizeLocale(name[i+1:])
+}
+
+// render executes the best match for locale of the named template with
+// data, falling back through localeChain.
+func (s *templateStore) render(name, locale string, data interface{}) (string, error) {
+	for _, l := range localeChain(locale, s.defaultLocale) {
+		key := name
+		if l != "" {
+			key = name + "." + l
+		}
+		if _, ok := s.templates[key]; !ok {
+			continue
+		}
+		if l == "" {
+			l = normalizeLocale(locale)
+		}
+		return s.execute(key, l, data)
+	}
+	return "", fmt.Errorf("unknown template %q", name)
+}
+
+// execute renders the template stored under key.
+func (s *templateStore) execute(key, locale string, data interface{}) (string, error) {
+	t, ok := s.templates[key]
+	if !ok {
+		return "", fmt.Errorf("unknown template %q", key)
+	}
+	return executeTemplate(t, key, locale, data)
+}
+
+// executeTemplate renders t with data. Templates are cloned before execution
+// so each render can bind the locale's formatting helpers.
+func executeTemplate(t *template.Template, key, locale string, data interface{}) (string, error) {
+	clone, err := t.Clone()
+	if err != nil {
+		return "", fmt.Errorf("error preparing template %q: %w", key, err)
+	}
+	var buf bytes.Buffer
+	if err := clone.Funcs(templateFuncs(locale)).Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering template %q: %w", key, err)
+	}
+	return buf.String(), nil
+}
+
+// keys returns the keys of all loaded templates and locale variants, sorted.
+func (s *templateStore) keys() []string {
+	keys := make([]string, 0, len(s.templates))
+	for k := range s.templates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
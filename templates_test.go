@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRenderInlineHasNoEnvironment(t *testing.T) {
+	os.Setenv("POST_ROOM_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("POST_ROOM_TEST_SECRET")
+	tests := []struct {
+		name   string
+		source string
+		want   string
+		err    bool
+	}{
+		{"sprig", `{{ "hi" | upper }}`, "HI", false},
+		{"data", `Hello {{ .name }}`, "Hello Ada", false},
+		{"env", `{{ env "POST_ROOM_TEST_SECRET" }}`, "", true},
+		{"expandenv", `{{ expandenv "$POST_ROOM_TEST_SECRET" }}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderInline(tt.source, "en", map[string]interface{}{"name": "Ada"})
+			if (err != nil) != tt.err {
+				t.Fatalf("renderInline() error = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want || strings.Contains(got, "hunter2") {
+				t.Errorf("renderInline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
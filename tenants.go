@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tenantConfig is an entry in the tenants file, which declares the queues
+// a worker consumes besides its own. Unset fields fall back to the
+// worker's own configuration, except the queue, which defaults to
+// <tenant>:<REDIS_KEY>.
+type tenantConfig struct {
+	Queue string `json:"queue,omitempty"`
+	SMTP  struct {
+		Host     string `json:"host,omitempty"`
+		Port     string `json:"port,omitempty"`
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+	} `json:"smtp"`
+	Sender *identityConfig `json:"sender,omitempty"`
+	// Identity names one of the worker's identities to send as by default,
+	// instead of a Sender of the tenant's own.
+	Identity string `json:"identity,omitempty"`
+	// RateLimit caps the tenant's sends per second, and Concurrency the
+	// sends in progress at once, within the worker's own CONCURRENCY.
+	RateLimit   float64      `json:"rateLimit,omitempty"`
+	Concurrency int          `json:"concurrency,omitempty"`
+	Quota       sendQuota    `json:"quota"`
+	TemplateDir string       `json:"templateDir,omitempty"`
+	Defaults    taskDefaults `json:"defaults"`
+}
+
+// taskDefaults fill in what the tasks of a queue leave unset: the
+// template and locale, and data fields, which the task's own data
+// overrides.
+type taskDefaults struct {
+	Template string                 `json:"template,omitempty"`
+	Locale   string                 `json:"locale,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// apply fills in the defaults task leaves unset. A task with a message of
+// its own isn't given the default template.
+func (d taskDefaults) apply(task *Mail) {
+	if task.Template == "" && task.Message == "" {
+		task.Template = d.Template
+	}
+	if task.Locale == "" {
+		task.Locale = d.Locale
+	}
+	if len(d.Data) == 0 {
+		return
+	}
+	data := make(map[string]interface{}, len(d.Data)+len(task.Data))
+	for k, v := range d.Data {
+		data[k] = v
+	}
+	for k, v := range task.Data {
+		data[k] = v
+	}
+	task.Data = data
+}
+
+// tenant is a queue consumed with its own mailer and limits. A reload may
+// replace the mailer's templates and senders and the tenant's limits while
+// tasks are consumed, so those are read under mu.
+type tenant struct {
+	id     string
+	queue  string
+	config tenantConfig
+
+	mu       sync.RWMutex
+	mailer   Mailer
+	limiter  *rateLimiter
+	quota    sendQuota
+	defaults taskDefaults
+	// window is the default delivery window, in timezone.
+	window   *deliveryWindow
+	timezone *time.Location
+
+	payloads  *payloadDecoder
+	validator *taskValidator
+	quotas    *quotaCounter
+	scheduler *scheduler
+	digests   *digester
+	dedup     *deduplicator
+	campaigns *campaignManager
+	cancelled *cancellations
+	inflight  *inflightTasks
+	control   *controller
+	tuning    *tuning
+	memory    *memoryGuard
+	// slots caps the tenant's own sends in progress.
+	slots *sendSlots
+	// batch takes the tasks consume sends from the queue.
+	batch *taskBatch
+}
+
+// room returns how many more of the tenant's sends may start, or -1
+// without a limit.
+func (t *tenant) room() int {
+	room := t.slots.free()
+	if n := t.tuning.free(); n >= 0 && (room < 0 || n < room) {
+		room = n
+	}
+	return room
+}
+
+// sendSlots caps the sends in progress for a queue. A nil sendSlots
+// doesn't.
+type sendSlots struct {
+	mu       sync.Mutex
+	released *sync.Cond
+	limit    int
+	running  int
+}
+
+func newSendSlots(limit int) *sendSlots {
+	if limit <= 0 {
+		return nil
+	}
+	s := &sendSlots{limit: limit}
+	s.released = sync.NewCond(&s.mu)
+	return s
+}
+
+// wait blocks until fewer sends are in progress than allowed.
+func (s *sendSlots) wait() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.running >= s.limit {
+		s.released.Wait()
+	}
+}
+
+// acquire blocks until another send may start, which must call release
+// when done.
+func (s *sendSlots) acquire() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.running >= s.limit {
+		s.released.Wait()
+	}
+	s.running++
+}
+
+// free returns how many more sends may start, or -1 for a nil sendSlots.
+func (s *sendSlots) free() int {
+	if s == nil {
+		return -1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit - s.running
+}
+
+func (s *sendSlots) release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.released.Broadcast()
+}
+
+// setLimit changes the limit, for a reload.
+func (s *sendSlots) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.released.Broadcast()
+}
+
+// loadTenants reads the tenants file, a JSON object mapping tenant IDs to
+// their tenantConfig, and derives each tenant's mailer from base.
+func loadTenants(path string, base Mailer, options AppOptions) ([]*tenant, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants file: %w", err)
+	}
+	var configs map[string]tenantConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing tenants file: %w", err)
+	}
+
+	ids := make([]string, 0, len(configs))
+	for id := range configs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	queues := map[string]string{options.RedisKey: ""}
+	var tenants []*tenant
+	for _, id := range ids {
+		t, err := newTenant(id, configs[id], base, options)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tenant %q: %w", id, err)
+		}
+		if other, ok := queues[t.queue]; ok {
+			return nil, fmt.Errorf("tenant %q uses queue %q, already used by %q", id, t.queue, other)
+		}
+		queues[t.queue] = id
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+func newTenant(id string, c tenantConfig, base Mailer, options AppOptions) (*tenant, error) {
+	if c.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+	t := &tenant{id: id, queue: c.Queue, config: c, mailer: base, limiter: newRateLimiter(c.RateLimit), quota: c.Quota, defaults: c.Defaults}
+	t.slots = newSendSlots(c.Concurrency)
+	if t.queue == "" {
+		t.queue = id + ":" + options.RedisKey
+	}
+
+	m := &t.mailer
+	m.dead = &deadLetters{rdb: base.dead.rdb, queue: t.queue}
+	if m.history != nil {
+		m.history = &historyStore{db: m.history.db, queue: t.queue}
+	}
+	if m.loops != nil {
+		m.loops = &loopGuard{rdb: m.loops.rdb, queue: t.queue, limit: m.loops.limit, window: m.loops.window}
+	}
+	if c.SMTP.Host != "" {
+		m.host, m.auth, m.mx = c.SMTP.Host, nil, nil
+	}
+	if c.SMTP.Port != "" {
+		if err := checkPort(c.SMTP.Port); err != nil {
+			return nil, fmt.Errorf("invalid SMTP port: %w", err)
+		}
+		m.port = c.SMTP.Port
+	}
+	if m.mx == nil && m.port == "" {
+		return nil, fmt.Errorf("no SMTP port configured")
+	}
+	if m.fallback != nil && (c.SMTP.Host != "" || c.SMTP.Port != "") {
+		// A relay of its own has its own port to keep to.
+		m.fallback = newPortFallback(m.port, m.fallback.ports[1:])
+	}
+	if c.SMTP.Username != "" && c.SMTP.Password != "" {
+		m.auth = smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, m.host)
+	}
+	if c.Sender != nil {
+		sender, err := newIdentity(*c.Sender)
+		if err != nil {
+			return nil, err
+		}
+		// A tenant with its own sender can't send as the worker's
+		// identities or domains.
+		m.sender, m.identities = sender, nil
+		m.senderDomains = []string{addressDomain(sender.from)}
+	}
+	if c.Identity != "" {
+		if c.Sender != nil {
+			return nil, fmt.Errorf("identity and sender can't both be set")
+		}
+		sender, ok := m.identities[c.Identity]
+		if !ok {
+			return nil, fmt.Errorf("unknown sender identity %q", c.Identity)
+		}
+		m.sender = sender
+	}
+	if c.TemplateDir != "" {
+		templates, err := loadTemplates(c.TemplateDir, options.MJMLBinary, options.DefaultLocale)
+		if err != nil {
+			return nil, err
+		}
+		m.templates = templates
+		if m.redisTpl != nil {
+			m.redisTpl = newRedisTemplateStore(m.redisTpl.rdb, templates)
+		}
+	}
+	return t, nil
+}
+
+// admit counts task against the tenant's quota and that of the identity it
+// is sent as. If either is exhausted, retryAt is when to try again.
+func (t *tenant) admit(task Mail) (retryAt time.Time, ok bool, err error) {
+	t.mu.RLock()
+	quota, mailer := t.quota, t.mailer
+	t.mu.RUnlock()
+	var scopes []quotaScope
+	if quota != (sendQuota{}) {
+		scopes = append(scopes, quotaScope{name: "tenant", quota: quota})
+	}
+	name, sender := "default", mailer.sender
+	if task.Identity != "" {
+		name, sender = task.Identity, mailer.identities[task.Identity]
+	}
+	if sender != nil && sender.quota != (sendQuota{}) {
+		scopes = append(scopes, quotaScope{name: "identity:" + name, quota: sender.quota})
+	}
+	if len(scopes) == 0 {
+		return time.Time{}, true, nil
+	}
+	return t.quotas.reserve(scopes, int64(len(task.Recipients)), time.Now())
+}
+
+// current returns the tenant's mailer and rate limiter as they are now.
+// Sends keep the mailer they started with across a reload.
+func (t *tenant) current() (Mailer, *rateLimiter) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.mailer, t.limiter
+}
+
+// applyDefaults fills in the tenant's defaults for what task leaves unset.
+func (t *tenant) applyDefaults(task *Mail) {
+	t.mu.RLock()
+	defaults := t.defaults
+	t.mu.RUnlock()
+	defaults.apply(task)
+}
+
+// reconfigure swaps in the templates and senders of m, and the tenant's new
+// limits and defaults.
+func (t *tenant) reconfigure(m Mailer, limiter *rateLimiter, quota sendQuota, defaults taskDefaults) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mailer.templates, t.mailer.redisTpl = m.templates, m.redisTpl
+	t.mailer.sender, t.mailer.identities, t.mailer.senderDomains = m.sender, m.identities, m.senderDomains
+	t.limiter, t.quota, t.defaults = limiter, quota, defaults
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDialTimeout    = 30 * time.Second
+	defaultCommandTimeout = 2 * time.Minute
+	defaultSendTimeout    = 10 * time.Minute
+)
+
+// smtpTimeouts bounds how long connecting, each SMTP command and a whole
+// send may take.
+type smtpTimeouts struct {
+	dial, command, send time.Duration
+}
+
+// connect dials addr and starts an SMTP session with host, within the
+// deadline of c, over TLS from the start if implicitTLS is set. The session
+// greets the server as helo when set, rather than net/smtp's default of
+// localhost.
+func (t smtpTimeouts) connect(c context.Context, addr, host, helo string, implicitTLS *tls.Config) (*smtp.Client, *timeoutConn, error) {
+	dialer := net.Dialer{Timeout: t.dial}
+	conn, err := dialer.DialContext(c, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &timeoutConn{Conn: conn, timeout: t.command}
+	tc.bind(c)
+	// net/smtp only counts the session as encrypted, as PLAIN auth
+	// requires, if it is given the TLS connection itself.
+	var session net.Conn = tc
+	if implicitTLS != nil {
+		session = tls.Client(tc, implicitTLS)
+	}
+	client, err := smtp.NewClient(session, host)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("error starting SMTP session: %w", err)
+	}
+	tc.tap(client)
+	if helo != "" {
+		if err := client.Hello(helo); err != nil {
+			client.Close()
+			return nil, nil, fmt.Errorf("error greeting SMTP server: %w", err)
+		}
+	}
+	return client, tc, nil
+}
+
+// timeoutConn fails any read or write that takes longer than timeout, or
+// that runs past the deadline of the send using the connection. net/smtp
+// has no notion of deadlines itself, so this is what stops a hung server
+// from blocking a send forever.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+
+	mu         sync.Mutex
+	deadline   time.Time
+	transcript *transcript
+}
+
+// bind applies the deadline of c, if any, to the connection's operations,
+// and records its dialogue in the transcript of c, if any.
+func (t *timeoutConn) bind(c context.Context) {
+	deadline, _ := c.Deadline()
+	transcript := transcriptFrom(c)
+	t.mu.Lock()
+	t.deadline = deadline
+	t.transcript = transcript
+	t.mu.Unlock()
+	if transcript != nil {
+		transcript.note("session with %s", t.Conn.RemoteAddr())
+	}
+}
+
+func (t *timeoutConn) next() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := time.Now().Add(t.timeout)
+	if !t.deadline.IsZero() && t.deadline.Before(next) {
+		next = t.deadline
+	}
+	return next
+}
+
+func (t *timeoutConn) Read(b []byte) (int, error) {
+	t.Conn.SetReadDeadline(t.next())
+	return t.Conn.Read(b)
+}
+
+func (t *timeoutConn) Write(b []byte) (int, error) {
+	t.Conn.SetWriteDeadline(t.next())
+	return t.Conn.Write(b)
+}
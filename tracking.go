@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	openTrackingPath  = "/track/open/"
+	clickTrackingPath = "/track/click/"
+)
+
+// linkPattern matches the href attribute of anchor tags, capturing the
+// prefix up to the value and the quoted value itself.
+var linkPattern = regexp.MustCompile(`(?is)(<a\b[^>]*?\bhref\s*=\s*)("[^"]*"|'[^']*')`)
+
+// transparentGIF is a 1x1 transparent GIF served as the tracking pixel.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// tracker injects tracking into outgoing HTML and records the resulting
+// requests. baseURL is the public URL at which the tracking endpoints are
+// reachable, either post-room's own HTTP server or an external service
+// implementing the same paths.
+//
+// Tracking URLs carry the queue that sent the message, so that opens and
+// clicks are recorded in that queue's status store, and are signed with
+// secret, so that requests can't make up opens or fill Redis with the
+// status of tasks that don't exist. Click tracking rewrites links through a
+// redirect endpoint, which the signature also keeps from being used as an
+// open redirect, and only links to domains in clickDomains are rewritten
+// when it is set, so unsubscribe and other third-party links are left alone.
+type tracker struct {
+	baseURL      string
+	opens        bool
+	clicks       bool
+	clickDomains []string
+	secret       []byte
+	rdb          *redis.Client
+}
+
+// tracksOpens reports whether an open pixel should go into mail, letting
+// the task override the worker default.
+func (t *tracker) tracksOpens(mail Mail) bool {
+	if t == nil || mail.ID == "" || len(t.secret) == 0 {
+		return false
+	}
+	if mail.TrackOpens != nil {
+		return *mail.TrackOpens
+	}
+	return t.opens
+}
+
+// injectOpenPixel adds the tracking pixel for id, sent from queue, just
+// before </body>, or at the end of the document if it has no body element.
+func (t *tracker) injectOpenPixel(body, queue, id string) string {
+	src := t.baseURL + openTrackingPath + url.PathEscape(id) + ".gif?q=" + url.QueryEscape(queue) + "&s=" + t.sign(openTrackingPath, queue, id)
+	pixel := `<img src="` + html.EscapeString(src) + `" width="1" height="1" alt="" style="display:none;border:0">`
+	if i := strings.LastIndex(strings.ToLower(body), "</body>"); i >= 0 {
+		return body[:i] + pixel + body[i:]
+	}
+	return body + pixel
+}
+
+// tracksClicks reports whether links in mail should be rewritten, letting the
+// task override the worker default.
+func (t *tracker) tracksClicks(mail Mail) bool {
+	if t == nil || mail.ID == "" || len(t.secret) == 0 {
+		return false
+	}
+	if mail.TrackClicks != nil {
+		return *mail.TrackClicks
+	}
+	return t.clicks
+}
+
+// mapLinks replaces the href of every anchor in body with the result of fn,
+// which receives and returns unescaped URLs.
+func mapLinks(body string, fn func(target string) string) string {
+	return linkPattern.ReplaceAllStringFunc(body, func(match string) string {
+		groups := linkPattern.FindStringSubmatch(match)
+		quoted := groups[2]
+		target := html.UnescapeString(quoted[1 : len(quoted)-1])
+		replaced := fn(target)
+		if replaced == target {
+			return match
+		}
+		return groups[1] + `"` + html.EscapeString(replaced) + `"`
+	})
+}
+
+// rewriteLinks points every trackable link in html, sent from queue, at
+// the click endpoint.
+func (t *tracker) rewriteLinks(body, queue, id string) string {
+	return mapLinks(body, func(target string) string {
+		if !t.shouldTrack(target) {
+			return target
+		}
+		return t.baseURL + clickTrackingPath + url.PathEscape(id) + "?q=" + url.QueryEscape(queue) +
+			"&u=" + url.QueryEscape(target) + "&s=" + t.sign(clickTrackingPath, queue, id, target)
+	})
+}
+
+func (t *tracker) shouldTrack(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	if len(t.clickDomains) == 0 {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range t.clickDomains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature of a tracking URL: the endpoint's path, which
+// keeps an open's signature from passing for a click's, then the queue, the
+// task ID and, for clicks, the link.
+func (t *tracker) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func (t *tracker) verify(signature string, parts ...string) bool {
+	return hmac.Equal([]byte(t.sign(parts...)), []byte(signature))
+}
+
+func (t *tracker) handleClick(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, clickTrackingPath)
+	query := r.URL.Query()
+	queue, target := query.Get("q"), query.Get("u")
+	if id == "" || queue == "" || target == "" || !t.verify(query.Get("s"), clickTrackingPath, queue, id, target) {
+		http.Error(w, "invalid tracking link", http.StatusBadRequest)
+		return
+	}
+	if err := newStatusStore(t.rdb, queue).recordClick(id, target); err != nil {
+		log.Print(err)
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleOpen records an open for a signed pixel URL. The pixel is served
+// whatever the URL, so that a message never shows a broken image.
+func (t *tracker) handleOpen(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, openTrackingPath), ".gif")
+	query := r.URL.Query()
+	queue := query.Get("q")
+	if id != "" && queue != "" && t.verify(query.Get("s"), openTrackingPath, queue, id) {
+		if err := newStatusStore(t.rdb, queue).recordOpen(id); err != nil {
+			log.Print(err)
+		}
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	w.Write(transparentGIF)
+}
+
+func (t *tracker) register(mux *http.ServeMux) {
+	mux.HandleFunc(openTrackingPath, t.handleOpen)
+	mux.HandleFunc(clickTrackingPath, t.handleClick)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTrackerOpens(t *testing.T) {
+	rdb := newTestRedis(t)
+	tr := &tracker{baseURL: "https://track.example.com", opens: true, secret: []byte("secret"), rdb: rdb}
+	mux := http.NewServeMux()
+	tr.register(mux)
+	acme := newStatusStore(rdb, "tasks:acme")
+	acme.recordResult("t1", taskSent, "", 0)
+
+	pixel := trackingPath(t, tr, tr.injectOpenPixel("<p>Hi</p></body>", "tasks:acme", "t1"), "src")
+	tests := []struct {
+		name  string
+		path  string
+		opens string
+	}{
+		{"signed", pixel, "1"},
+		{"no signature", strings.Split(pixel, "&s=")[0], "1"},
+		{"other queue", strings.Replace(pixel, "q=tasks%3Aacme", "q=tasks", 1), "1"},
+		{"other task", strings.Replace(pixel, "/t1.gif", "/t2.gif", 1), "1"},
+		{"signed again", pixel, "2"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+			t.Errorf("%s: GET %s = %d %s, want the pixel", tt.name, tt.path, w.Code, w.Header().Get("Content-Type"))
+		}
+		if opens, _ := rdb.HGet(ctx, acme.key("t1"), "opens").Result(); opens != tt.opens {
+			t.Errorf("%s: t1 has %q opens, want %s", tt.name, opens, tt.opens)
+		}
+	}
+	// A signed pixel for a task that has no status records nothing, so
+	// requests can't add keys to Redis.
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", trackingPath(t, tr, tr.injectOpenPixel("", "tasks", "unsent"), "src"), nil))
+	if keys, _ := rdb.Keys(ctx, "*").Result(); len(keys) != 1 {
+		t.Errorf("keys %v, want only the status of t1", keys)
+	}
+}
+
+// trackingPath returns the path of the tracking URL in attribute of body.
+func trackingPath(t *testing.T, tr *tracker, body, attribute string) string {
+	t.Helper()
+	match := regexp.MustCompile(attribute + `="([^"]*)"`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("no %s in %s", attribute, body)
+	}
+	return strings.TrimPrefix(html.UnescapeString(match[1]), tr.baseURL)
+}
+
+func TestTrackerClicks(t *testing.T) {
+	rdb := newTestRedis(t)
+	tr := &tracker{baseURL: "https://track.example.com", clicks: true, secret: []byte("secret"), rdb: rdb}
+	mux := http.NewServeMux()
+	tr.register(mux)
+	acme := newStatusStore(rdb, "tasks:acme")
+	acme.recordResult("t1", taskSent, "", 0)
+
+	link := trackingPath(t, tr, tr.rewriteLinks(`<a href="https://example.com/a?b=1&amp;c=2">a</a>`, "tasks:acme", "t1"), "href")
+	tests := []struct {
+		name     string
+		path     string
+		code     int
+		location string
+	}{
+		{"signed", link, http.StatusFound, "https://example.com/a?b=1&c=2"},
+		{"other target", strings.Replace(link, "example.com%2Fa", "evil.example%2Fa", 1), http.StatusBadRequest, ""},
+		{"other queue", strings.Replace(link, "q=tasks%3Aacme", "q=tasks", 1), http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s: GET %s = %d to %q, want %d to %q", tt.name, tt.path, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+	if clicks, _ := rdb.HGet(ctx, acme.key("t1"), "clicks").Result(); clicks != "1" {
+		t.Errorf("t1 has %q clicks, want 1", clicks)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// maxTranscriptBytes caps a transcript, which a send over many connections
+// could otherwise grow without bound.
+const maxTranscriptBytes = 64 << 10
+
+type transcriptKey struct{}
+
+// withTranscript records the SMTP dialogues of the connections bound to the
+// returned context in t.
+func withTranscript(c context.Context, t *transcript) context.Context {
+	return context.WithValue(c, transcriptKey{}, t)
+}
+
+func transcriptFrom(c context.Context) *transcript {
+	t, _ := c.Value(transcriptKey{}).(*transcript)
+	return t
+}
+
+// transcript records an SMTP dialogue line by line. Credentials are masked:
+// the arguments of AUTH and every line sent in answer to a 334 challenge.
+// Message content is summarised by its size.
+type transcript struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	pending   [2][]byte
+	// challenged is set when the next line sent answers a 334 challenge,
+	// and data while the message content is being sent.
+	challenged, data bool
+	dataBytes        int
+}
+
+const (
+	transcriptClient = iota
+	transcriptServer
+)
+
+func (t *transcript) note(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.append("* " + fmt.Sprintf(format, args...))
+}
+
+// write records b, sent by the client or the server, a line at a time.
+func (t *transcript) write(from int, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[from] = append(t.pending[from], b...)
+	for {
+		i := bytes.IndexByte(t.pending[from], '\n')
+		if i < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(t.pending[from][:i]), "\r")
+		t.pending[from] = t.pending[from][i+1:]
+		if from == transcriptServer {
+			t.server(line)
+		} else {
+			t.client(line)
+		}
+	}
+}
+
+func (t *transcript) server(line string) {
+	t.challenged = strings.HasPrefix(line, "334")
+	if strings.HasPrefix(line, "354") {
+		t.data, t.dataBytes = true, 0
+	}
+	t.append("S: " + line)
+}
+
+func (t *transcript) client(line string) {
+	switch {
+	case t.data:
+		if line != "." {
+			t.dataBytes += len(line) + 2
+			return
+		}
+		t.data = false
+		t.append(fmt.Sprintf("C: [%d byte message]", t.dataBytes))
+	case t.challenged:
+		t.challenged = false
+		line = "****"
+	default:
+		if fields := strings.Fields(line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+			line = fields[0] + " " + fields[1] + " ****"
+		}
+	}
+	t.append("C: " + line)
+}
+
+func (t *transcript) append(line string) {
+	if t.truncated {
+		return
+	}
+	if t.buf.Len()+len(line) > maxTranscriptBytes {
+		t.truncated = true
+		line = "[transcript truncated]"
+	}
+	t.buf.WriteString(line)
+	t.buf.WriteByte('\n')
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.TrimSuffix(t.buf.String(), "\n")
+}
+
+// tap records the dialogue of c, which tc carries, in the transcript tc is
+// bound to. STARTTLS replaces the client's text connection, so c must be
+// tapped again after it.
+func (tc *timeoutConn) tap(c *smtp.Client) {
+	c.Text.Reader.R = bufio.NewReader(transcriptReader{r: c.Text.Reader.R, tc: tc})
+	c.Text.Writer.W = bufio.NewWriter(transcriptWriter{w: c.Text.Writer.W, tc: tc})
+}
+
+// record adds b to the transcript the connection is bound to, if any.
+func (tc *timeoutConn) record(from int, b []byte) {
+	tc.mu.Lock()
+	t := tc.transcript
+	tc.mu.Unlock()
+	if t != nil {
+		t.write(from, b)
+	}
+}
+
+// startTLS upgrades c to TLS, keeping its dialogue recorded.
+func startTLS(c *smtp.Client, tc *timeoutConn, config *tls.Config) error {
+	if err := c.StartTLS(config); err != nil {
+		return err
+	}
+	tc.tap(c)
+	return nil
+}
+
+type transcriptReader struct {
+	r  *bufio.Reader
+	tc *timeoutConn
+}
+
+func (r transcriptReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.tc.record(transcriptServer, b[:n])
+	return n, err
+}
+
+// transcriptWriter flushes what it writes straight through, since the
+// client only flushes the writer wrapping it.
+type transcriptWriter struct {
+	w  *bufio.Writer
+	tc *timeoutConn
+}
+
+func (w transcriptWriter) Write(b []byte) (int, error) {
+	w.tc.record(transcriptClient, b)
+	n, err := w.w.Write(b)
+	if err == nil {
+		err = w.w.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// The settings that can be overridden at runtime, as fields of the
+// <queue>:settings hash.
+const (
+	tuningConcurrency = "concurrency"
+	tuningRateLimit   = "rate-limit"
+	tuningDryRun      = "dry-run"
+
+	// tuningPollInterval is how often the settings are read again, for
+	// changes made to the hash directly rather than with the tune command.
+	tuningPollInterval = 5 * time.Second
+
+	// taskSkipped is the state of a task taken in dry-run mode.
+	taskSkipped = "skipped"
+
+	concurrencyLimitMetric = "post_room_concurrency_limit"
+	dryRunMetric           = "post_room_dry_run"
+	dryRunTasksMetric      = "post_room_dry_run_tasks_total"
+)
+
+func init() {
+	metrics.describe(concurrencyLimitMetric, "gauge", "Sends allowed in progress at once, or 0 if unlimited.")
+	metrics.describe(dryRunMetric, "gauge", "Whether tasks are being taken without sending them.")
+	metrics.describe(dryRunTasksMetric, "counter", "Tasks taken but not sent in dry-run mode.")
+}
+
+// tuningSettings are the settings operators can change on every replica
+// at once. A rate limit of 0 is unlimited, as is a concurrency of 0.
+type tuningSettings struct {
+	concurrency int
+	rateLimit   float64
+	// limited is set when the rate limit replaces each queue's own.
+	limited bool
+	dryRun  bool
+}
+
+func (s tuningSettings) String() string {
+	rate := "per queue"
+	if s.limited {
+		rate = strconv.FormatFloat(s.rateLimit, 'g', -1, 64) + "/s"
+	}
+	return fmt.Sprintf("%s=%d %s=%s %s=%t", tuningConcurrency, s.concurrency, tuningRateLimit, rate, tuningDryRun, s.dryRun)
+}
+
+// tuning applies the overrides kept in the <queue>:settings hash over the
+// worker's own CONCURRENCY, RATE_LIMIT and DRY_RUN, so that a runaway
+// queue can be throttled on every replica without a redeploy. Changes made
+// with the tune command are published on the <queue>:settings channel and
+// take effect straight away, others within tuningPollInterval. Limits
+// apply to each replica, like the settings they override.
+type tuning struct {
+	rdb      *redis.Client
+	key      string
+	defaults tuningSettings
+
+	mu       sync.Mutex
+	released *sync.Cond
+	current  tuningSettings
+	limiter  *rateLimiter
+	running  int
+}
+
+func newTuning(rdb *redis.Client, queue string, options AppOptions) *tuning {
+	defaults := tuningSettings{concurrency: options.Concurrency, dryRun: options.DryRun}
+	t := &tuning{rdb: rdb, key: queue + ":settings", defaults: defaults, current: defaults}
+	t.released = sync.NewCond(&t.mu)
+	return t
+}
+
+// start takes up the overrides in force and follows changes to them. It
+// subscribes before reading the hash so that no change is missed.
+func (t *tuning) start() {
+	t.publishMetrics(t.current)
+	pubsub := t.rdb.Subscribe(ctx, t.key)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		log.Printf("error subscribing to settings channel: %v", err)
+	}
+	t.refresh()
+	go func() {
+		poll := time.NewTicker(tuningPollInterval)
+		defer poll.Stop()
+		changes := pubsub.Channel()
+		for {
+			select {
+			case <-changes:
+			case <-poll.C:
+			}
+			t.refresh()
+		}
+	}()
+}
+
+// refresh reads the overrides and applies them over the defaults. Values
+// that don't parse are logged and ignored.
+func (t *tuning) refresh() {
+	fields, err := t.rdb.HGetAll(ctx, t.key).Result()
+	if err != nil {
+		log.Printf("error reading runtime settings: %v", err)
+		return
+	}
+	settings := t.defaults
+	for name, value := range fields {
+		if err := settings.set(name, value); err != nil {
+			log.Printf("ignoring runtime setting %s: %v", name, err)
+		}
+	}
+	t.apply(settings)
+}
+
+// set overrides the setting name with value.
+func (s *tuningSettings) set(name, value string) error {
+	switch name {
+	case tuningConcurrency:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a number of sends", value)
+		}
+		s.concurrency = n
+	case tuningRateLimit:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a number of sends per second", value)
+		}
+		s.rateLimit, s.limited = n, true
+	case tuningDryRun:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		s.dryRun = b
+	default:
+		return fmt.Errorf("unknown setting")
+	}
+	return nil
+}
+
+func (t *tuning) apply(settings tuningSettings) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if settings == t.current {
+		return
+	}
+	if settings.rateLimit != t.current.rateLimit || settings.limited != t.current.limited {
+		t.limiter = newRateLimiter(settings.rateLimit)
+	}
+	t.current = settings
+	log.Printf("runtime settings changed: %s", settings)
+	t.publishMetrics(settings)
+	t.released.Broadcast()
+}
+
+func (t *tuning) publishMetrics(settings tuningSettings) {
+	metrics.set(concurrencyLimitMetric, float64(settings.concurrency))
+	metrics.set(dryRunMetric, boolGauge(settings.dryRun))
+}
+
+// rateLimiter returns the limiter to send with: own, the queue's, unless
+// the rate limit is overridden.
+func (t *tuning) rateLimiter(own *rateLimiter) *rateLimiter {
+	if t == nil {
+		return own
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current.limited {
+		return t.limiter
+	}
+	return own
+}
+
+// dryRun reports whether tasks should be taken without being sent.
+func (t *tuning) dryRun() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current.dryRun
+}
+
+// skip records that task was taken and not sent, in dry-run mode.
+func (t *tuning) skip(task Mail, status *statusStore, history *historyStore) {
+	log.Printf("dry run: not sending task %s to %d recipients", task.ID, len(task.Recipients))
+	metrics.add(dryRunTasksMetric, 1)
+	history.record(task, task.Recipients, taskSkipped, "dry run", "")
+	if status == nil {
+		return
+	}
+	if err := status.recordResult(task.ID, taskSkipped, "dry run", task.Attempt); err != nil {
+		log.Print(err)
+	}
+}
+
+// wait blocks until fewer sends are in progress than allowed.
+func (t *tuning) wait() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.full() {
+		t.released.Wait()
+	}
+}
+
+func (t *tuning) full() bool {
+	return t.current.concurrency > 0 && t.running >= t.current.concurrency
+}
+
+// acquire blocks until another send may start, which must call release
+// when done.
+func (t *tuning) acquire() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.full() {
+		t.released.Wait()
+	}
+	t.running++
+}
+
+// free returns how many more sends may start, or -1 without a limit.
+func (t *tuning) free() int {
+	if t == nil {
+		return -1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current.concurrency <= 0 {
+		return -1
+	}
+	return t.current.concurrency - t.running
+}
+
+func (t *tuning) release() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.running--
+	t.released.Broadcast()
+}
+
+// runTune shows or changes the runtime settings of every replica.
+func runTune(args []string) error {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue the workers are configured with (default tasks)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: tune [flags] [%s=N] [%s=N] [%s=true|false]\n\nA setting given without a value, as in %s=, is reset to the workers' own.\n\n", tuningConcurrency, tuningRateLimit, tuningDryRun, tuningConcurrency)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := map[string]interface{}{}
+	var reset []string
+	for _, arg := range fs.Args() {
+		eq := strings.IndexByte(arg, '=')
+		if eq < 0 {
+			fs.Usage()
+			return fmt.Errorf("invalid setting %q", arg)
+		}
+		name, value := arg[:eq], arg[eq+1:]
+		check := value
+		if check == "" {
+			check = "0"
+		}
+		var s tuningSettings
+		if err := s.set(name, check); err != nil {
+			return fmt.Errorf("invalid setting %s: %w", name, err)
+		}
+		if value == "" {
+			reset = append(reset, name)
+		} else {
+			set[name] = value
+		}
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	key := *queue + ":settings"
+
+	if len(set) > 0 {
+		if err := rdb.HSet(ctx, key, set).Err(); err != nil {
+			return fmt.Errorf("error recording runtime settings: %w", err)
+		}
+	}
+	if len(reset) > 0 {
+		if err := rdb.HDel(ctx, key, reset...).Err(); err != nil {
+			return fmt.Errorf("error resetting runtime settings: %w", err)
+		}
+	}
+	if len(set)+len(reset) > 0 {
+		receivers, err := rdb.Publish(ctx, key, "changed").Result()
+		if err != nil {
+			return fmt.Errorf("error publishing runtime settings: %w", err)
+		}
+		log.Printf("sent runtime settings to %d workers", receivers)
+	}
+
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("error reading runtime settings: %w", err)
+	}
+	if len(fields) == 0 {
+		fmt.Println("no runtime settings; the workers use their own")
+		return nil
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%s\n", name, fields[name])
+	}
+	return nil
+}
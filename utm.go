@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// utmParams merges the template's UTM parameters with the task's, the task
+// taking precedence. Keys may be given with or without the utm_ prefix.
+func utmParams(template, task map[string]string) url.Values {
+	params := url.Values{}
+	for _, source := range []map[string]string{template, task} {
+		for k, v := range source {
+			k = strings.ToLower(k)
+			if !strings.HasPrefix(k, "utm_") {
+				k = "utm_" + k
+			}
+			params.Set(k, v)
+		}
+	}
+	return params
+}
+
+// appendUTM adds params to every http(s) link in body. Parameters a link
+// already carries are left as they are.
+func appendUTM(body string, params url.Values) string {
+	if len(params) == 0 {
+		return body
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return mapLinks(body, func(target string) string {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return target
+		}
+		query := u.Query()
+		var added []string
+		for _, k := range keys {
+			if _, exists := query[k]; !exists {
+				added = append(added, url.QueryEscape(k)+"="+url.QueryEscape(params.Get(k)))
+			}
+		}
+		if len(added) == 0 {
+			return target
+		}
+		// Append rather than re-encode so the link's existing query string
+		// is preserved byte for byte.
+		if u.RawQuery == "" {
+			u.RawQuery = strings.Join(added, "&")
+		} else {
+			u.RawQuery += "&" + strings.Join(added, "&")
+		}
+		return u.String()
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	vaultTimeout = 10 * time.Second
+	// vaultRefreshInterval is how often secrets without a lease, such as KV
+	// secrets, are read again to pick up rotated credentials.
+	vaultRefreshInterval = 5 * time.Minute
+	vaultRetryInterval   = 30 * time.Second
+	// vaultMinLease is the shortest lease worth renewing; a lease renewed
+	// for less is near its maximum TTL, so fresh credentials are read.
+	vaultMinLease = time.Minute
+)
+
+// vaultClient reads credentials from HashiCorp Vault over its HTTP API,
+// authenticating with a token or by AppRole login, and keeps its token
+// alive for as long as the worker runs.
+type vaultClient struct {
+	addr             string
+	roleID, secretID string
+	client           *http.Client
+
+	mu    sync.Mutex
+	token string
+
+	// smtp holds the SMTP credentials read at startup, which the mailer's
+	// auth is rotated from once it exists.
+	smtp *vaultLease
+}
+
+// vaultSecret is a response from Vault. Secrets read from a path carry
+// their fields in Data, and logins and token renewals the token in Auth.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+type vaultCredentials struct {
+	username, password string
+}
+
+// vaultLease tracks credentials read from a path and the lease, if any,
+// they were issued under.
+type vaultLease struct {
+	path   string
+	secret vaultSecret
+	creds  vaultCredentials
+}
+
+// newVault connects to Vault if it is configured, reading the SMTP
+// credentials into options and having new Redis connections made with
+// redisOptions authenticate with the Redis credentials. It returns nil
+// without Vault.
+func newVault(options *AppOptions, redisOptions *redis.Options) (*vaultClient, error) {
+	if options.VaultAddress == "" {
+		return nil, nil
+	}
+	v := &vaultClient{
+		addr:     strings.TrimSuffix(options.VaultAddress, "/"),
+		roleID:   options.VaultRoleID,
+		secretID: options.VaultSecretID,
+		client:   &http.Client{Timeout: vaultTimeout},
+		token:    options.VaultToken,
+	}
+	var (
+		ttl       time.Duration
+		renewable bool
+		err       error
+	)
+	if v.token != "" {
+		ttl, renewable, err = v.lookupSelf()
+	} else {
+		ttl, renewable, err = v.login()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go v.keepToken(ttl, renewable)
+
+	if options.VaultSMTPPath != "" {
+		if v.smtp, err = v.read(options.VaultSMTPPath); err != nil {
+			return nil, err
+		}
+		if v.smtp.creds.username == "" || v.smtp.creds.password == "" {
+			return nil, fmt.Errorf("Vault secret %s has no username and password", options.VaultSMTPPath)
+		}
+		options.SMTPUsername, options.SMTPPassword = v.smtp.creds.username, v.smtp.creds.password
+	}
+	if options.VaultRedisPath != "" {
+		lease, err := v.read(options.VaultRedisPath)
+		if err != nil {
+			return nil, err
+		}
+		if lease.creds.password == "" {
+			return nil, fmt.Errorf("Vault secret %s has no password", options.VaultRedisPath)
+		}
+		auth := &redisCredentials{creds: lease.creds}
+		redisOptions.OnConnect = auth.onConnect
+		go v.watch(lease, auth.set)
+	}
+	return v, nil
+}
+
+// watchSMTP rotates the credentials mailer authenticates with as the SMTP
+// secret changes. It does nothing unless the credentials came from Vault.
+func (v *vaultClient) watchSMTP(mailer Mailer) {
+	if v == nil || v.smtp == nil {
+		return
+	}
+	auth, ok := mailer.auth.(*reloadableAuth)
+	if !ok {
+		return
+	}
+	host := mailer.host
+	go v.watch(v.smtp, func(creds vaultCredentials) {
+		auth.set(smtp.PlainAuth("", creds.username, creds.password, host))
+	})
+}
+
+// watch keeps the lease on credentials renewed, calling set with new
+// credentials whenever they have to be read again or have changed.
+func (v *vaultClient) watch(lease *vaultLease, set func(vaultCredentials)) {
+	for {
+		wait := vaultRefreshInterval
+		if lease.secret.LeaseID != "" && lease.secret.LeaseDuration > 0 {
+			wait = time.Duration(lease.secret.LeaseDuration) * time.Second / 2
+		}
+		time.Sleep(wait)
+		if lease.secret.Renewable && lease.secret.LeaseID != "" {
+			renewed, err := v.renewLease(lease.secret.LeaseID)
+			if err == nil && time.Duration(renewed.LeaseDuration)*time.Second >= vaultMinLease {
+				lease.secret.LeaseDuration = renewed.LeaseDuration
+				continue
+			}
+			if err != nil {
+				log.Print(err)
+			}
+		}
+		fresh, err := v.read(lease.path)
+		if err != nil {
+			log.Print(err)
+			lease.secret = vaultSecret{LeaseDuration: int(2 * vaultRetryInterval / time.Second)}
+			continue
+		}
+		if fresh.creds != lease.creds {
+			set(fresh.creds)
+			log.Printf("rotated credentials from Vault secret %s", lease.path)
+		}
+		*lease = *fresh
+	}
+}
+
+// keepToken renews the client's token before its TTL runs out, logging in
+// again with the AppRole when it can't be renewed. Tokens without a TTL
+// need no renewal.
+func (v *vaultClient) keepToken(ttl time.Duration, renewable bool) {
+	for ttl > 0 {
+		time.Sleep(ttl / 2)
+		var err error
+		if renewable {
+			if ttl, renewable, err = v.renewSelf(); err == nil {
+				continue
+			}
+			log.Print(err)
+		}
+		if v.roleID == "" {
+			log.Printf("Vault token can't be renewed and will expire; set %s and %s to log in again", vaultRoleIDKey, vaultSecretIDKey)
+			return
+		}
+		if ttl, renewable, err = v.login(); err != nil {
+			log.Print(err)
+			ttl, renewable = 2*vaultRetryInterval, false
+		}
+	}
+}
+
+func (v *vaultClient) login() (time.Duration, bool, error) {
+	secret, err := v.do(http.MethodPost, "auth/approle/login", map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+	if err != nil {
+		return 0, false, fmt.Errorf("error logging in to Vault: %w", err)
+	}
+	if secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return 0, false, fmt.Errorf("error logging in to Vault: no token issued")
+	}
+	v.mu.Lock()
+	v.token = secret.Auth.ClientToken
+	v.mu.Unlock()
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second, secret.Auth.Renewable, nil
+}
+
+func (v *vaultClient) lookupSelf() (time.Duration, bool, error) {
+	secret, err := v.do(http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error looking up Vault token: %w", err)
+	}
+	ttl, _ := secret.Data["ttl"].(float64)
+	renewable, _ := secret.Data["renewable"].(bool)
+	return time.Duration(ttl) * time.Second, renewable, nil
+}
+
+func (v *vaultClient) renewSelf() (time.Duration, bool, error) {
+	secret, err := v.do(http.MethodPost, "auth/token/renew-self", nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error renewing Vault token: %w", err)
+	}
+	if secret.Auth == nil {
+		return 0, false, fmt.Errorf("error renewing Vault token: no token returned")
+	}
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second, secret.Auth.Renewable, nil
+}
+
+func (v *vaultClient) renewLease(id string) (vaultSecret, error) {
+	secret, err := v.do(http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": id})
+	if err != nil {
+		return secret, fmt.Errorf("error renewing Vault lease %s: %w", id, err)
+	}
+	return secret, nil
+}
+
+// read reads the credentials at path, from a KV secret of either version
+// or a secrets engine issuing them, such as the database engine.
+func (v *vaultClient) read(path string) (*vaultLease, error) {
+	secret, err := v.do(http.MethodGet, strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Vault secret %s: %w", path, err)
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		// KV version 2 nests the secret's fields.
+		data = inner
+	}
+	username, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	return &vaultLease{path: path, secret: secret, creds: vaultCredentials{username: username, password: password}}, nil
+}
+
+func (v *vaultClient) do(method, path string, body interface{}) (vaultSecret, error) {
+	var secret vaultSecret
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return secret, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+path, payload)
+	if err != nil {
+		return secret, err
+	}
+	v.mu.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mu.Unlock()
+	res, err := v.client.Do(req)
+	if err != nil {
+		return secret, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return secret, err
+	}
+	if res.StatusCode/100 != 2 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return secret, fmt.Errorf("unexpected status %s: %s", res.Status, strings.Join(failure.Errors, "; "))
+		}
+		return secret, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if len(data) == 0 {
+		return secret, nil
+	}
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return secret, fmt.Errorf("error parsing response: %w", err)
+	}
+	return secret, nil
+}
+
+// redisCredentials authenticates new Redis connections with the
+// credentials last read from Vault. Connections already open stay
+// authenticated when the credentials rotate.
+type redisCredentials struct {
+	mu    sync.RWMutex
+	creds vaultCredentials
+}
+
+func (r *redisCredentials) set(creds vaultCredentials) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.creds = creds
+}
+
+func (r *redisCredentials) onConnect(c context.Context, cn *redis.Conn) error {
+	r.mu.RLock()
+	creds := r.creds
+	r.mu.RUnlock()
+	if creds.username == "" {
+		return cn.Auth(c, creds.password).Err()
+	}
+	return cn.AuthACL(c, creds.username, creds.password).Err()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// webhookRoute maps requests to an ingest path onto emails rendered from a
+// template. Fields maps names in the template's Data to JSONPath
+// expressions over the request body, which is also available in full as
+// .payload. Subject and each of Recipients may be literals or JSONPath
+// expressions starting with "$"; recipient expressions may yield a list.
+type webhookRoute struct {
+	Path       string            `json:"path"`
+	Template   string            `json:"template"`
+	Subject    string            `json:"subject"`
+	Recipients []string          `json:"recipients"`
+	Fields     map[string]string `json:"fields,omitempty"`
+}
+
+// webhookGateway serves the configured webhook routes behind INGEST_TOKEN,
+// as they send to whoever the request names. The routes may be replaced by
+// a reload; the paths of removed routes answer 404.
+type webhookGateway struct {
+	rdb   *redis.Client
+	queue string
+	token string
+
+	mu         sync.RWMutex
+	mux        *http.ServeMux
+	routes     map[string]webhookRoute
+	registered map[string]bool
+}
+
+// servedPaths lists the patterns main serves besides the webhook routes.
+// A route may not take one of them, as registering it again would panic,
+// nor sit beneath one ending in "/" and shadow part of what it serves.
+func servedPaths(options AppOptions) []string {
+	paths := []string{
+		metricsPath, openTrackingPath, clickTrackingPath, alertmanagerPath,
+		receiptsPath, campaignsPath, historyPath, dlqReplayPath, tasksPath,
+		dashboardPath, debugPprofPath, debugVarsPath,
+	}
+	if redirect, err := url.Parse(options.OIDCRedirectURL); err == nil && redirect.Path != "" {
+		paths = append(paths, redirect.Path)
+	}
+	return paths
+}
+
+// loadWebhookRoutes reads a JSON array of webhookRoutes from path.
+func loadWebhookRoutes(path string, options AppOptions) ([]webhookRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhooks file: %w", err)
+	}
+	var routes []webhookRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("error parsing webhooks file: %w", err)
+	}
+	served := servedPaths(options)
+	seen := map[string]bool{}
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("webhook route path %q must start with /", r.Path)
+		}
+		for _, p := range served {
+			if r.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(r.Path, p) {
+				return nil, fmt.Errorf("webhook route %s conflicts with %s", r.Path, p)
+			}
+		}
+		if seen[r.Path] {
+			return nil, fmt.Errorf("duplicate webhook route %s", r.Path)
+		}
+		seen[r.Path] = true
+		if r.Template == "" || len(r.Recipients) == 0 {
+			return nil, fmt.Errorf("webhook route %s needs a template and recipients", r.Path)
+		}
+		// Reject bad expressions at startup rather than on the first request.
+		expressions := append([]string{r.Subject}, r.Recipients...)
+		for _, e := range r.Fields {
+			expressions = append(expressions, e)
+		}
+		for _, e := range expressions {
+			if strings.HasPrefix(e, "$") {
+				if _, err := parseJSONPath(e); err != nil {
+					return nil, fmt.Errorf("webhook route %s: %w", r.Path, err)
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+// register serves routes on mux.
+func (g *webhookGateway) register(mux *http.ServeMux, routes []webhookRoute) {
+	g.mu.Lock()
+	g.mux, g.registered = mux, map[string]bool{}
+	g.mu.Unlock()
+	g.setRoutes(routes)
+}
+
+// setRoutes replaces the routes served, adding handlers for new paths.
+func (g *webhookGateway) setRoutes(routes []webhookRoute) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.routes = map[string]webhookRoute{}
+	for _, route := range routes {
+		g.routes[route.Path] = route
+		if g.registered[route.Path] {
+			continue
+		}
+		g.registered[route.Path] = true
+		path := route.Path
+		g.mux.Handle(path, requireToken(g.token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g.mu.RLock()
+			route, ok := g.routes[path]
+			g.mu.RUnlock()
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			g.handle(route, w, r)
+		})))
+	}
+}
+
+func (g *webhookGateway) handle(route webhookRoute, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := readIngestBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid JSON payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	task, err := route.task(payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := enqueue(g.rdb, g.queue, &task); err != nil {
+		log.Print(err)
+		http.Error(w, "error enqueuing email", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("enqueued webhook email %s from %s", task.ID, route.Path)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// task builds the email for a webhook payload.
+func (route webhookRoute) task(payload interface{}) (Mail, error) {
+	task := Mail{Template: route.Template, Data: map[string]interface{}{"payload": payload}}
+	for name, expression := range route.Fields {
+		value, err := jsonPath(payload, expression)
+		if err != nil {
+			return task, err
+		}
+		task.Data[name] = value
+	}
+
+	subject, err := route.extract(payload, route.Subject)
+	if err != nil {
+		return task, err
+	}
+	if len(subject) > 0 {
+		task.Subject = subject[0]
+	}
+	for _, r := range route.Recipients {
+		recipients, err := route.extract(payload, r)
+		if err != nil {
+			return task, err
+		}
+		task.Recipients = append(task.Recipients, recipients...)
+	}
+	if len(task.Recipients) == 0 {
+		return task, fmt.Errorf("no recipients found in payload")
+	}
+	return task, nil
+}
+
+// extract returns a literal as is, or the string values an expression
+// selects from payload.
+func (route webhookRoute) extract(payload interface{}, expression string) ([]string, error) {
+	if !strings.HasPrefix(expression, "$") {
+		return []string{expression}, nil
+	}
+	value, err := jsonPath(payload, expression)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	switch v := value.(type) {
+	case nil:
+	case []interface{}:
+		for _, item := range v {
+			if item != nil {
+				values = append(values, fmt.Sprint(item))
+			}
+		}
+	default:
+		values = append(values, fmt.Sprint(v))
+	}
+	return values, nil
+}
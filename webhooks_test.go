@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadWebhookRoutes(t *testing.T) {
+	options := AppOptions{OIDCRedirectURL: "https://mail.example.com/oauth/callback"}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"own path", "/ingest/deploys", false},
+		{"metrics", metricsPath, true},
+		{"alertmanager", alertmanagerPath, true},
+		{"open tracking", openTrackingPath, true},
+		{"beneath campaigns", campaignsPath + "launch", true},
+		{"beneath dashboard", dashboardPath + "dead", true},
+		{"tasks", tasksPath, true},
+		{"oidc callback", "/oauth/callback", true},
+		{"metrics prefix", metricsPath + "/extra", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "webhooks.json")
+			config := `[{"path":"` + tt.path + `","template":"deploy","recipients":["ops@example.com"]}]`
+			if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadWebhookRoutes(file, options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadWebhookRoutes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// The runtime image has no zoneinfo of its own.
+	_ "time/tzdata"
+)
+
+// deliveryWindow is the time of day, in the recipient's timezone, during
+// which a task may be sent. A window whose end is before its start spans
+// midnight, e.g. 22:00-06:00.
+type deliveryWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// parseDeliveryWindow parses a window written as "08:00-20:00".
+func parseDeliveryWindow(value string) (*deliveryWindow, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid delivery window %q: expected HH:MM-HH:MM", value)
+	}
+	w := &deliveryWindow{Start: strings.TrimSpace(parts[0]), End: strings.TrimSpace(parts[1])}
+	if _, _, err := w.bounds(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// bounds returns the window's start and end as offsets from midnight.
+func (w *deliveryWindow) bounds() (start, end time.Duration, err error) {
+	if start, err = parseTimeOfDay(w.Start); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseTimeOfDay(w.End); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// next returns now if now falls within the window in loc, and otherwise
+// when the window next opens.
+func (w *deliveryWindow) next(now time.Time, loc *time.Location) (time.Time, error) {
+	start, end, err := w.bounds()
+	if err != nil {
+		return time.Time{}, err
+	}
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	offset := local.Sub(midnight)
+
+	open := offset >= start && offset < end
+	if end <= start {
+		open = offset >= start || offset < end
+	}
+	if open {
+		return now, nil
+	}
+	opens := time.Date(local.Year(), local.Month(), local.Day(), int(start/time.Hour), int(start%time.Hour/time.Minute), 0, 0, loc)
+	if !opens.After(local) {
+		opens = time.Date(local.Year(), local.Month(), local.Day()+1, int(start/time.Hour), int(start%time.Hour/time.Minute), 0, 0, loc)
+	}
+	return opens, nil
+}
+
+// deliveryTime returns when task may be sent: now, unless it falls outside
+// its own delivery window or, for tasks that aren't urgent, the default
+// window.
+func deliveryTime(task Mail, defaultWindow *deliveryWindow, defaultLoc *time.Location, now time.Time) (time.Time, error) {
+	window := task.DeliveryWindow
+	if window == nil {
+		if task.Urgent {
+			return now, nil
+		}
+		window = defaultWindow
+	}
+	if window == nil {
+		return now, nil
+	}
+	loc := defaultLoc
+	if task.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(task.Timezone); err != nil {
+			return now, fmt.Errorf("invalid timezone for task %s: %w", task.ID, err)
+		}
+	}
+	return window.next(now, loc)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeliveryWindow(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"08:00-20:00", false},
+		{" 22:00 - 06:00 ", false},
+		{"08:00", true},
+		{"8am-8pm", true},
+		{"08:00-25:00", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseDeliveryWindow(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("parseDeliveryWindow(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDeliveryTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := &deliveryWindow{Start: "08:00", End: "20:00"}
+	night := &deliveryWindow{Start: "22:00", End: "06:00"}
+	at := func(value string) time.Time {
+		v, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name          string
+		task          Mail
+		defaultWindow *deliveryWindow
+		now, want     string
+	}{
+		{"no window", Mail{}, nil, "2026-03-02T03:00:00Z", "2026-03-02T03:00:00Z"},
+		{"within the default window", Mail{}, day, "2026-03-02T12:00:00Z", "2026-03-02T12:00:00Z"},
+		{"before the default window", Mail{}, day, "2026-03-02T06:30:00Z", "2026-03-02T08:00:00Z"},
+		{"after the default window", Mail{}, day, "2026-03-02T21:00:00Z", "2026-03-03T08:00:00Z"},
+		{"window end is exclusive", Mail{}, day, "2026-03-02T20:00:00Z", "2026-03-03T08:00:00Z"},
+		{"urgent skips the default window", Mail{Urgent: true}, day, "2026-03-02T21:00:00Z", "2026-03-02T21:00:00Z"},
+		{"task window over the default", Mail{DeliveryWindow: night}, day, "2026-03-02T12:00:00Z", "2026-03-02T22:00:00Z"},
+		{"urgent keeps the task window", Mail{DeliveryWindow: night, Urgent: true}, day, "2026-03-02T12:00:00Z", "2026-03-02T22:00:00Z"},
+		{"window over midnight, late", Mail{DeliveryWindow: night}, nil, "2026-03-02T23:00:00Z", "2026-03-02T23:00:00Z"},
+		{"window over midnight, early", Mail{DeliveryWindow: night}, nil, "2026-03-02T05:59:00Z", "2026-03-02T05:59:00Z"},
+		// 07:30 UTC is 08:30 in Berlin, within the window, and 19:30 is 20:30,
+		// after it.
+		{"recipient's timezone", Mail{Timezone: "Europe/Berlin"}, day, "2026-03-02T07:30:00Z", "2026-03-02T07:30:00Z"},
+		{"recipient's timezone, closed", Mail{Timezone: "Europe/Berlin"}, day, "2026-03-02T19:30:00Z", "2026-03-03T07:00:00Z"},
+		// Berlin moves to summer time on 29 March 2026.
+		{"across a DST change", Mail{Timezone: "Europe/Berlin"}, day, "2026-03-28T20:00:00Z", "2026-03-29T06:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := deliveryTime(tt.task, tt.defaultWindow, time.UTC, at(tt.now))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%s: deliveryTime() = %s, want %s", tt.name, got.UTC().Format(time.RFC3339), tt.want)
+		}
+	}
+	if _, err := deliveryTime(Mail{Timezone: "Mars/Olympus"}, day, berlin, time.Now()); err == nil {
+		t.Error("deliveryTime() accepted an unknown timezone")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	heartbeatInterval = 10 * time.Second
+	// heartbeatTTL is how long a worker is listed after its last
+	// heartbeat, allowing for a couple to be missed.
+	heartbeatTTL = 3 * heartbeatInterval
+)
+
+// version is the worker's release, set at build time with
+// -ldflags "-X main.version=...".
+var version string
+
+// workerVersion returns the version the worker was built as, falling back
+// to the module version recorded by go build.
+func workerVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// workerInfo is what a worker's heartbeat says about it.
+type workerInfo struct {
+	ID        string    `json:"id"`
+	Version   string    `json:"version"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	Queues    []string  `json:"queues"`
+	InFlight  int       `json:"inFlight"`
+	Started   time.Time `json:"started"`
+	Heartbeat time.Time `json:"heartbeat"`
+	// Instance tells apart processes started with the same ID.
+	Instance string `json:"instance"`
+	// Leader is set in listings on the worker elected leader.
+	Leader bool `json:"leader,omitempty"`
+}
+
+// heartbeat registers the worker in Redis while it runs: in the
+// <queue>:workers set, and under <queue>:workers:<id>, which expires unless
+// refreshed so that workers that die without stopping drop out of the list.
+type heartbeat struct {
+	rdb     *redis.Client
+	queue   string
+	tenants []*tenant
+	info    workerInfo
+	done    chan struct{}
+}
+
+func newHeartbeat(rdb *redis.Client, options AppOptions, tenants []*tenant) *heartbeat {
+	hostname, _ := os.Hostname()
+	h := &heartbeat{
+		rdb:     rdb,
+		queue:   options.RedisKey,
+		tenants: tenants,
+		done:    make(chan struct{}),
+		info: workerInfo{
+			ID:       options.WorkerID,
+			Version:  workerVersion(),
+			Hostname: hostname,
+			PID:      os.Getpid(),
+			Started:  time.Now().UTC(),
+			Instance: newTaskID(),
+		},
+	}
+	for _, t := range tenants {
+		h.info.Queues = append(h.info.Queues, t.queue)
+	}
+	return h
+}
+
+// start warns if another live worker has the same ID, then beats every
+// heartbeatInterval until stopped.
+func (h *heartbeat) start() {
+	if data, err := h.rdb.Get(ctx, workerKey(h.queue, h.info.ID)).Bytes(); err == nil {
+		var other workerInfo
+		if json.Unmarshal(data, &other) == nil && other.Instance != h.info.Instance {
+			log.Printf("[WARNING] another worker with ID %s is running on %s; set %s to tell them apart", other.ID, other.Hostname, workerIDKey)
+		}
+	}
+	h.beat()
+	go func() {
+		tick := time.NewTicker(heartbeatInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				h.beat()
+			case <-h.done:
+				return
+			}
+		}
+	}()
+}
+
+func (h *heartbeat) beat() {
+	info := h.info
+	for _, t := range h.tenants {
+		info.InFlight += t.inflight.count()
+	}
+	info.Heartbeat = time.Now().UTC()
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Print("error encoding heartbeat: ", err)
+		return
+	}
+	_, err = h.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, workerKey(h.queue, info.ID), data, heartbeatTTL)
+		pipe.SAdd(ctx, workersKey(h.queue), info.ID)
+		return nil
+	})
+	if err != nil {
+		log.Print("error recording heartbeat: ", err)
+	}
+}
+
+// stop deregisters the worker, unless another process has since taken its
+// ID.
+func (h *heartbeat) stop() {
+	close(h.done)
+	key := workerKey(h.queue, h.info.ID)
+	if data, err := h.rdb.Get(ctx, key).Bytes(); err == nil {
+		var current workerInfo
+		if json.Unmarshal(data, &current) == nil && current.Instance != h.info.Instance {
+			return
+		}
+	}
+	_, err := h.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, workersKey(h.queue), h.info.ID)
+		return nil
+	})
+	if err != nil {
+		log.Print("error deregistering worker: ", err)
+	}
+}
+
+func workersKey(queue string) string {
+	return queue + ":workers"
+}
+
+func workerKey(queue, id string) string {
+	return workersKey(queue) + ":" + id
+}
+
+// listWorkers returns the live workers consuming queue, by ID, dropping
+// those whose heartbeats have expired from the set.
+func listWorkers(rdb *redis.Client, queue string) ([]workerInfo, error) {
+	ids, err := rdb.SMembers(ctx, workersKey(queue)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("error listing workers: %w", err)
+	}
+	sort.Strings(ids)
+	leader, err := rdb.Get(ctx, leaderKey(queue)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("error reading leader: %w", err)
+	}
+	workers := []workerInfo{}
+	for _, id := range ids {
+		data, err := rdb.Get(ctx, workerKey(queue, id)).Bytes()
+		if err == redis.Nil {
+			rdb.SRem(ctx, workersKey(queue), id)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading worker %s: %w", id, err)
+		}
+		var info workerInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("error decoding worker %s: %w", id, err)
+		}
+		info.Leader = info.Instance == leader
+		workers = append(workers, info)
+	}
+	return workers, nil
+}
+
+// runWorkers lists the live workers, as a table or JSON lines.
+func runWorkers(args []string) error {
+	fs := flag.NewFlagSet("workers", flag.ExitOnError)
+	addr := fs.String("redis", os.Getenv(redisAddressKey), "Redis address")
+	queue := fs.String("queue", os.Getenv(redisKeyKey), "queue the workers are configured with (default tasks)")
+	asJSON := fs.Bool("json", false, "print each worker as a line of JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *addr == "" {
+		return fmt.Errorf("no Redis address given; use -redis or %s", redisAddressKey)
+	}
+	if *queue == "" {
+		*queue = "tasks"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: *addr})
+	defer rdb.Close()
+	workers, err := listWorkers(rdb, *queue)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, w := range workers {
+			if err := enc.Encode(w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(workers) == 0 {
+		fmt.Println("no live workers")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tVERSION\tIN-FLIGHT\tQUEUES\tUP\tLAST SEEN")
+	now := time.Now()
+	for _, w := range workers {
+		id := w.ID
+		if w.Leader {
+			id += " (leader)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s ago\n", id, w.Version, w.InFlight, strings.Join(w.Queues, ","),
+			now.Sub(w.Started).Round(time.Second), now.Sub(w.Heartbeat).Round(time.Second))
+	}
+	return tw.Flush()
+}
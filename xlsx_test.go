@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestXLSXColumn(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "A"},
+		{25, "Z"},
+		{26, "AA"},
+		{27, "AB"},
+		{51, "AZ"},
+		{52, "BA"},
+		{701, "ZZ"},
+		{702, "AAA"},
+	}
+	for _, tt := range tests {
+		if got := xlsxColumn(tt.i); got != tt.want {
+			t.Errorf("xlsxColumn(%d) = %q, want %q", tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestTableXLSX(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		rows    [][]interface{}
+		// want are fragments the sheet contains.
+		want []string
+	}{
+		{"header", []string{"name"}, nil, []string{`<row r="1"><c r="A1" s="1" t="inlineStr"><is><t xml:space="preserve">name</t></is></c></row>`}},
+		{"no header", nil, [][]interface{}{{"ada"}}, []string{`<row r="1"><c r="A1" t="inlineStr">`}},
+		{"number", []string{"n"}, [][]interface{}{{3.5}}, []string{`<c r="A2"><v>3.5</v></c>`}},
+		{"boolean", nil, [][]interface{}{{true, false}}, []string{`<c r="A1" t="b"><v>1</v></c>`, `<c r="B1" t="b"><v>0</v></c>`}},
+		{"empty cell", nil, [][]interface{}{{nil, "b"}}, []string{`<row r="1"><c r="B1" t="inlineStr">`}},
+		{"escaped text", nil, [][]interface{}{{"a < b & c"}}, []string{`a &lt; b &amp; c`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workbook, err := tableXLSX(tt.columns, tt.rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			z, err := zip.NewReader(bytes.NewReader(workbook), int64(len(workbook)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := map[string]string{}
+			for _, f := range z.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				parts[f.Name] = string(content)
+			}
+			for _, p := range xlsxParts {
+				if parts[p.name] != p.content {
+					t.Errorf("workbook part %s missing or changed", p.name)
+				}
+			}
+			sheet, ok := parts["xl/worksheets/sheet1.xml"]
+			if !ok {
+				t.Fatal("workbook has no sheet")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(sheet, want) {
+					t.Errorf("sheet %s doesn't contain %s", sheet, want)
+				}
+			}
+		})
+	}
+}